@@ -0,0 +1,25 @@
+package api
+
+// A DeadLetterInputRoomEvent is written to the dead letter topic when the
+// roomserver fails to process a message from the input topic.
+// It wraps the original message so that it can be replayed into the input
+// topic once the problem has been fixed.
+type DeadLetterInputRoomEvent struct {
+	// The error the roomserver encountered when processing the message.
+	Error string
+	// The topic the message was read from.
+	Topic string
+	// The partition of the topic the message was read from.
+	Partition int32
+	// The offset of the message in the partition.
+	Offset int64
+	// When the message failed to be processed in milliseconds since the unix epoch.
+	Timestamp int64
+	// The key of the original message.
+	Key []byte
+	// The value of the original message.
+	// This is usually an InputRoomEvent serialised as JSON, but since the
+	// message may have failed because it wasn't valid JSON we keep the raw
+	// bytes rather than a json.RawMessage.
+	Value []byte
+}
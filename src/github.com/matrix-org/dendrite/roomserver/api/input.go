@@ -9,7 +9,8 @@ const (
 	// KindOutlier event fall outside the contiguous event graph.
 	// We do not have the state for these events.
 	// These events are state events used to authenticate other events.
-	// They can become part of the contiguous event graph via backfill.
+	// They become part of the contiguous event graph if they are later
+	// received as new or backfilled events.
 	KindOutlier = 1
 	// KindJoin event start a new contiguous event graph. The event must be a
 	// m.room.member event joining this server to the room. This must come with
@@ -22,7 +23,7 @@ const (
 	// have a copy of.
 	KindNew = 3
 	// KindBackfill event extend the contiguous graph going backwards.
-	// They always have state.
+	// They always have state. Backfilled events without state fail processing.
 	KindBackfill = 4
 )
 
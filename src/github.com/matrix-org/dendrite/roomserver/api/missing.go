@@ -0,0 +1,16 @@
+package api
+
+// A MissingEventsRequest is written to the missing events topic when the
+// roomserver receives a new event but doesn't have some of its prev_events.
+// The new event is held by the roomserver and is processed automatically
+// once the missing events have been sent to the roomserver, either as new or
+// backfilled events.
+type MissingEventsRequest struct {
+	// The ID of the room the events are in.
+	RoomID string
+	// The ID of the event that is waiting for the missing events.
+	EventID string
+	// The IDs of the prev_events of the event that the roomserver doesn't have,
+	// or that it doesn't know the state at.
+	MissingEventIDs []string
+}
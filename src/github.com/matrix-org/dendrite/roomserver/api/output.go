@@ -4,6 +4,67 @@ import (
 	"encoding/json"
 )
 
+// OutputType is the type of the payload in an OutputEvent.
+type OutputType string
+
+const (
+	// OutputTypeNewRoomEvent indicates that the event is an OutputRoomEvent
+	OutputTypeNewRoomEvent OutputType = "new_room_event"
+	// OutputTypeNewInviteEvent indicates that the event is an OutputNewInviteEvent
+	OutputTypeNewInviteEvent OutputType = "new_invite_event"
+	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
+	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
+	OutputTypeRedactedEvent OutputType = "redacted_event"
+	// OutputTypeRejectedEvent indicates that the event is an OutputRejectedEvent
+	OutputTypeRejectedEvent OutputType = "rejected_event"
+)
+
+// OutputEventVersion is the version of the OutputEvent envelope written by this roomserver.
+// It is incremented whenever a change is made that existing consumers can't safely ignore.
+const OutputEventVersion = 1
+
+// An OutputEvent is an entry in the roomserver output log.
+// Exactly one of the payload fields is set, and it is the one that matches the Type.
+// Consumers should ignore types they don't understand since new types may be added
+// without changing the Version.
+type OutputEvent struct {
+	// The version of the envelope.
+	// Messages written before the envelope was introduced have version 0.
+	Version int
+	// The type of the payload.
+	Type OutputType
+	// The content of an OutputTypeNewRoomEvent.
+	NewRoomEvent *OutputRoomEvent `json:",omitempty"`
+	// The content of an OutputTypeNewInviteEvent.
+	NewInviteEvent *OutputNewInviteEvent `json:",omitempty"`
+	// The content of an OutputTypeRetireInviteEvent.
+	RetireInviteEvent *OutputRetireInviteEvent `json:",omitempty"`
+	// The content of an OutputTypeRedactedEvent.
+	RedactedEvent *OutputRedactedEvent `json:",omitempty"`
+	// The content of an OutputTypeRejectedEvent.
+	RejectedEvent *OutputRejectedEvent `json:",omitempty"`
+}
+
+// DecodeOutputEvent decodes a message from the roomserver output log.
+// Messages written before the envelope was introduced are bare OutputRoomEvents.
+// These are returned as an OutputTypeNewRoomEvent with a Version of 0 so that
+// consumers can read the output log across an upgrade of the roomserver.
+func DecodeOutputEvent(data []byte) (*OutputEvent, error) {
+	var output OutputEvent
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, err
+	}
+	if output.Type != "" {
+		return &output, nil
+	}
+	var ore OutputRoomEvent
+	if err := json.Unmarshal(data, &ore); err != nil {
+		return nil, err
+	}
+	return &OutputEvent{Type: OutputTypeNewRoomEvent, NewRoomEvent: &ore}, nil
+}
+
 // An OutputRoomEvent is written when the roomserver receives a new event.
 type OutputRoomEvent struct {
 	// The JSON bytes of the event.
@@ -29,6 +90,15 @@ type OutputRoomEvent struct {
 	// If the LastSentEventID doesn't match what they were expecting it to be
 	// they can use the LatestEventIDs to request the full current state.
 	LastSentEventID string
+	// If the event is an m.room.redaction that has been applied then this is
+	// the ID of the event it redacted. Consumers should replace their copy of
+	// that event with the redacted form. A redaction of an event the roomserver
+	// doesn't have yet is applied when the event arrives.
+	RedactsEventID string
+	// If the event was redacted before it was written to the output log then
+	// this is the ID of the m.room.redaction event that redacted it.
+	// In that case Event is the redacted form of the event.
+	RedactedBecauseEventID string
 }
 
 // UnmarshalJSON implements json.Unmarshaller
@@ -38,12 +108,14 @@ func (ore *OutputRoomEvent) UnmarshalJSON(data []byte) error {
 	// We use json.RawMessage so that the event JSON is sent as JSON rather than
 	// being base64 encoded which is the default for []byte.
 	var content struct {
-		Event                *json.RawMessage
-		VisibilityEventIDs   []string
-		LatestEventIDs       []string
-		AddsStateEventIDs    []string
-		RemovesStateEventIDs []string
-		LastSentEventID      string
+		Event                  *json.RawMessage
+		VisibilityEventIDs     []string
+		LatestEventIDs         []string
+		AddsStateEventIDs      []string
+		RemovesStateEventIDs   []string
+		LastSentEventID        string
+		RedactsEventID         string
+		RedactedBecauseEventID string
 	}
 	if err := json.Unmarshal(data, &content); err != nil {
 		return err
@@ -56,6 +128,8 @@ func (ore *OutputRoomEvent) UnmarshalJSON(data []byte) error {
 	ore.AddsStateEventIDs = content.AddsStateEventIDs
 	ore.RemovesStateEventIDs = content.RemovesStateEventIDs
 	ore.LastSentEventID = content.LastSentEventID
+	ore.RedactsEventID = content.RedactsEventID
+	ore.RedactedBecauseEventID = content.RedactedBecauseEventID
 	return nil
 }
 
@@ -67,19 +141,165 @@ func (ore OutputRoomEvent) MarshalJSON() ([]byte, error) {
 	// being base64 encoded which is the default for []byte.
 	event := json.RawMessage(ore.Event)
 	content := struct {
-		Event                *json.RawMessage
-		VisibilityEventIDs   []string
-		LatestEventIDs       []string
-		AddsStateEventIDs    []string
-		RemovesStateEventIDs []string
-		LastSentEventID      string
+		Event                  *json.RawMessage
+		VisibilityEventIDs     []string
+		LatestEventIDs         []string
+		AddsStateEventIDs      []string
+		RemovesStateEventIDs   []string
+		LastSentEventID        string
+		RedactsEventID         string
+		RedactedBecauseEventID string
+	}{
+		Event:                  &event,
+		VisibilityEventIDs:     ore.VisibilityEventIDs,
+		LatestEventIDs:         ore.LatestEventIDs,
+		AddsStateEventIDs:      ore.AddsStateEventIDs,
+		RemovesStateEventIDs:   ore.RemovesStateEventIDs,
+		LastSentEventID:        ore.LastSentEventID,
+		RedactsEventID:         ore.RedactsEventID,
+		RedactedBecauseEventID: ore.RedactedBecauseEventID,
+	}
+	return json.Marshal(&content)
+}
+
+// An OutputRejectedEvent is written to the rejected event topic when the roomserver
+// rejects an event because it failed the auth checks or the signature checks. An
+// event that failed the auth checks is still stored by the roomserver but it is
+// never part of the room state and is never one of the latest events in the room.
+// An event that failed the signature checks isn't stored.
+type OutputRejectedEvent struct {
+	// The JSON bytes of the event.
+	Event []byte
+	// Why the event was rejected.
+	RejectionReason string
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (ore *OutputRejectedEvent) UnmarshalJSON(data []byte) error {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	var content struct {
+		Event           *json.RawMessage
+		RejectionReason string
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	if content.Event != nil {
+		ore.Event = []byte(*content.Event)
+	}
+	ore.RejectionReason = content.RejectionReason
+	return nil
+}
+
+// MarshalJSON implements json.Marshaller
+func (ore OutputRejectedEvent) MarshalJSON() ([]byte, error) {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	event := json.RawMessage(ore.Event)
+	content := struct {
+		Event           *json.RawMessage
+		RejectionReason string
+	}{
+		Event:           &event,
+		RejectionReason: ore.RejectionReason,
+	}
+	return json.Marshal(&content)
+}
+
+// An OutputNewInviteEvent is written whenever an invite becomes part of the
+// current state of a room. It is written after the OutputRoomEvent that added
+// the invite to the state.
+type OutputNewInviteEvent struct {
+	// The JSON bytes of the m.room.member invite event.
+	Event []byte
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (oie *OutputNewInviteEvent) UnmarshalJSON(data []byte) error {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	var content struct {
+		Event *json.RawMessage
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	if content.Event != nil {
+		oie.Event = []byte(*content.Event)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaller
+func (oie OutputNewInviteEvent) MarshalJSON() ([]byte, error) {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	event := json.RawMessage(oie.Event)
+	content := struct {
+		Event *json.RawMessage
+	}{
+		Event: &event,
+	}
+	return json.Marshal(&content)
+}
+
+// An OutputRetireInviteEvent is written whenever an invite is removed from the
+// current state of a room, either because the user joined or rejected the invite,
+// the invite was revoked, or the state of the room was reset by a fork.
+type OutputRetireInviteEvent struct {
+	// The ID of the m.room.member invite event that was retired.
+	EventID string
+	// The ID of the user that was invited.
+	TargetUserID string
+	// The ID of the m.room.member event that replaced the invite in the current state.
+	// This is empty if the user has no membership in the current state of the room.
+	RetiredByEventID string
+	// The membership of the user in the current state of the room after the invite
+	// was retired, e.g. "join" or "leave", or empty if RetiredByEventID is empty.
+	Membership string
+}
+
+// An OutputRedactedEvent is written whenever a redaction is applied to an event
+// that has already been written to the output log. It is written after the
+// OutputRoomEvent for the m.room.redaction event. Consumers should replace their
+// copy of the redacted event with the redacted form.
+type OutputRedactedEvent struct {
+	// The ID of the event that was redacted.
+	RedactedEventID string
+	// The JSON bytes of the m.room.redaction event that redacted it.
+	RedactedBecause []byte
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (ore *OutputRedactedEvent) UnmarshalJSON(data []byte) error {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	var content struct {
+		RedactedEventID string
+		RedactedBecause *json.RawMessage
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	ore.RedactedEventID = content.RedactedEventID
+	if content.RedactedBecause != nil {
+		ore.RedactedBecause = []byte(*content.RedactedBecause)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaller
+func (ore OutputRedactedEvent) MarshalJSON() ([]byte, error) {
+	// We use json.RawMessage so that the event JSON is sent as JSON rather than
+	// being base64 encoded which is the default for []byte.
+	redactedBecause := json.RawMessage(ore.RedactedBecause)
+	content := struct {
+		RedactedEventID string
+		RedactedBecause *json.RawMessage
 	}{
-		Event:                &event,
-		VisibilityEventIDs:   ore.VisibilityEventIDs,
-		LatestEventIDs:       ore.LatestEventIDs,
-		AddsStateEventIDs:    ore.AddsStateEventIDs,
-		RemovesStateEventIDs: ore.RemovesStateEventIDs,
-		LastSentEventID:      ore.LastSentEventID,
+		RedactedEventID: ore.RedactedEventID,
+		RedactedBecause: &redactedBecause,
 	}
 	return json.Marshal(&content)
 }
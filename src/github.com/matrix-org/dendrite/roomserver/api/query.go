@@ -0,0 +1,525 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/gomatrixserverlib"
+	"net/http"
+)
+
+// StateKeyTuple is a pair of an event type and state_key.
+// This is used when requesting parts of the state of a room.
+type StateKeyTuple struct {
+	// The "type" key of a matrix event.
+	EventType string
+	// The "state_key" of a matrix event.
+	// The empty string is a legitimate value for the "state_key" in matrix
+	// so take care to initialise this field lest you accidentally request a
+	// "state_key" with the go default of the empty string.
+	EventStateKey string
+}
+
+// QueryLatestEventsAndStateRequest is a request to QueryLatestEventsAndState
+type QueryLatestEventsAndStateRequest struct {
+	// The room ID to query the latest events for.
+	RoomID string
+	// The state key tuples to fetch from the room current state.
+	// If this list is empty or nil then no state events are returned.
+	StateToFetch []StateKeyTuple
+}
+
+// QueryLatestEventsAndStateResponse is a response to QueryLatestEventsAndState
+type QueryLatestEventsAndStateResponse struct {
+	// Copy of the request for debugging.
+	QueryLatestEventsAndStateRequest
+	// Does the room exist?
+	// If the room doesn't exist this will be false and LatestEvents will be empty.
+	RoomExists bool
+	// The latest events in the room.
+	// These are used to set the prev_events when sending an event.
+	LatestEvents []gomatrixserverlib.EventReference
+	// The state events requested.
+	// This list will be in an arbitrary order.
+	// These are used to set the auth_events when sending an event.
+	StateEvents []gomatrixserverlib.Event
+}
+
+// QueryStateAfterEventsRequest is a request to QueryStateAfterEvents
+type QueryStateAfterEventsRequest struct {
+	// The room ID to query the state in.
+	RoomID string
+	// The list of previous events to return the state after.
+	PrevEventIDs []string
+	// The state key tuples to fetch from the state.
+	// If this list is empty or nil then all the state is returned.
+	StateToFetch []StateKeyTuple
+}
+
+// QueryStateAfterEventsResponse is a response to QueryStateAfterEvents
+type QueryStateAfterEventsResponse struct {
+	// Copy of the request for debugging.
+	QueryStateAfterEventsRequest
+	// Does the room exist on this roomserver?
+	// If the room doesn't exist this will be false and StateEvents will be empty.
+	RoomExists bool
+	// Do all the previous events exist in the room on this roomserver, and do we know the state before them?
+	// If some of the previous events do not exist or are in a different room this will be false and
+	// StateEvents will be empty.
+	PrevEventsExist bool
+	// The state events requested.
+	// If there was more than one previous event then conflicts between the
+	// states after each of them are resolved.
+	// This list will be in an arbitrary order.
+	StateEvents []gomatrixserverlib.Event
+}
+
+// QueryStateAtEventRequest is a request to QueryStateAtEvent
+type QueryStateAtEventRequest struct {
+	// The event ID to return the state before.
+	EventID string
+	// The state key tuples to fetch from the state.
+	// If this list is empty or nil then all the state is returned.
+	StateToFetch []StateKeyTuple
+}
+
+// QueryStateAtEventResponse is a response to QueryStateAtEvent
+type QueryStateAtEventResponse struct {
+	// Copy of the request for debugging.
+	QueryStateAtEventRequest
+	// Does the event exist on this roomserver, and do we know the state before it?
+	// If the event doesn't exist this will be false and StateEvents will be empty.
+	EventExists bool
+	// The state events requested from the state of the room just before the event.
+	// This list will be in an arbitrary order.
+	StateEvents []gomatrixserverlib.Event
+}
+
+// QueryEventsByIDRequest is a request to QueryEventsByID
+type QueryEventsByIDRequest struct {
+	// The event IDs to look up.
+	EventIDs []string
+	// Whether to also return the auth chain of the events.
+	AuthChain bool
+}
+
+// QueryEventsByIDResponse is a response to QueryEventsByID
+type QueryEventsByIDResponse struct {
+	// Copy of the request for debugging.
+	QueryEventsByIDRequest
+	// The events requested.
+	// Events that don't exist on this roomserver are left out of the list.
+	// This list will be in an arbitrary order.
+	Events []gomatrixserverlib.Event
+	// The events in the auth chains of the requested events, if AuthChain
+	// was set in the request. This is every event that can be reached by
+	// repeatedly following the auth_events of the requested events.
+	// This list will be in an arbitrary order.
+	AuthChainEvents []gomatrixserverlib.Event
+}
+
+// QueryRejectedEventsRequest is a request to QueryRejectedEvents
+type QueryRejectedEventsRequest struct {
+	// The event IDs to look up.
+	EventIDs []string
+}
+
+// A RejectedEvent is an event that the roomserver rejected because it failed the auth checks.
+type RejectedEvent struct {
+	// The rejected event.
+	Event gomatrixserverlib.Event
+	// Why the event was rejected.
+	RejectionReason string
+}
+
+// QueryRejectedEventsResponse is a response to QueryRejectedEvents
+type QueryRejectedEventsResponse struct {
+	// Copy of the request for debugging.
+	QueryRejectedEventsRequest
+	// The requested events that were rejected.
+	// Events that weren't rejected or don't exist on this roomserver are left out of the list.
+	// This list will be in an arbitrary order.
+	RejectedEvents []RejectedEvent
+}
+
+// QueryMessagesRequest is a request to QueryMessages
+type QueryMessagesRequest struct {
+	// The ID of the room to page through the history of.
+	RoomID string
+	// The event to start paging from. The event itself isn't returned.
+	// If this is empty then paging starts from FromToken.
+	FromEventID string
+	// A NextToken from an earlier response to continue paging from.
+	// If this and FromEventID are both empty then paging starts from the
+	// end of the history of the room if Backwards is set, or from the start
+	// of the history of the room otherwise.
+	FromToken string
+	// Whether to page backwards through the history towards older events.
+	Backwards bool
+	// The maximum number of events to return.
+	// If this is 0 then DefaultMessagesLimit is used.
+	// At most MaxMessagesLimit events are returned.
+	Limit int
+}
+
+// DefaultMessagesLimit is the number of events QueryMessages returns if the request doesn't set a Limit.
+const DefaultMessagesLimit = 10
+
+// MaxMessagesLimit is the maximum number of events QueryMessages returns.
+const MaxMessagesLimit = 100
+
+// QueryMessagesResponse is a response to QueryMessages
+type QueryMessagesResponse struct {
+	// Copy of the request for debugging.
+	QueryMessagesRequest
+	// Does the room exist?
+	// If the room doesn't exist this will be false and Events will be empty.
+	RoomExists bool
+	// Is the FromEventID part of the history of the room?
+	// If FromEventID was given and it isn't then this will be false and Events will be empty.
+	FromEventExists bool
+	// The events in the history of the room, ordered in the direction of paging.
+	// Events are ordered by their depth in the event graph and then by the order
+	// they were added to the room. Outliers and rejected events are never returned.
+	Events []gomatrixserverlib.Event
+	// A token to pass as the FromToken to get the next page of events.
+	// If there aren't any more events yet then this is a token for the same position.
+	NextToken string
+}
+
+// The responses that contain events implement json.Marshaller and json.Unmarshaller
+// so that the events are sent as their event JSON. Each one marshals a struct that
+// embeds the response with the event fields replaced by json.RawMessage fields.
+// The embedded type doesn't have the methods, and the outer fields hide its event
+// fields from encoding/json.
+
+// MarshalJSON implements json.Marshaller
+func (r QueryLatestEventsAndStateResponse) MarshalJSON() ([]byte, error) {
+	type response QueryLatestEventsAndStateResponse
+	return json.Marshal(&struct {
+		response
+		StateEvents []json.RawMessage
+	}{response(r), eventsToJSON(r.StateEvents)})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *QueryLatestEventsAndStateResponse) UnmarshalJSON(data []byte) (err error) {
+	type response QueryLatestEventsAndStateResponse
+	var content struct {
+		response
+		StateEvents []json.RawMessage
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	*r = QueryLatestEventsAndStateResponse(content.response)
+	r.StateEvents, err = eventsFromJSON(content.StateEvents)
+	return
+}
+
+// MarshalJSON implements json.Marshaller
+func (r QueryStateAfterEventsResponse) MarshalJSON() ([]byte, error) {
+	type response QueryStateAfterEventsResponse
+	return json.Marshal(&struct {
+		response
+		StateEvents []json.RawMessage
+	}{response(r), eventsToJSON(r.StateEvents)})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *QueryStateAfterEventsResponse) UnmarshalJSON(data []byte) (err error) {
+	type response QueryStateAfterEventsResponse
+	var content struct {
+		response
+		StateEvents []json.RawMessage
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	*r = QueryStateAfterEventsResponse(content.response)
+	r.StateEvents, err = eventsFromJSON(content.StateEvents)
+	return
+}
+
+// MarshalJSON implements json.Marshaller
+func (r QueryStateAtEventResponse) MarshalJSON() ([]byte, error) {
+	type response QueryStateAtEventResponse
+	return json.Marshal(&struct {
+		response
+		StateEvents []json.RawMessage
+	}{response(r), eventsToJSON(r.StateEvents)})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *QueryStateAtEventResponse) UnmarshalJSON(data []byte) (err error) {
+	type response QueryStateAtEventResponse
+	var content struct {
+		response
+		StateEvents []json.RawMessage
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	*r = QueryStateAtEventResponse(content.response)
+	r.StateEvents, err = eventsFromJSON(content.StateEvents)
+	return
+}
+
+// MarshalJSON implements json.Marshaller
+func (r QueryEventsByIDResponse) MarshalJSON() ([]byte, error) {
+	type response QueryEventsByIDResponse
+	return json.Marshal(&struct {
+		response
+		Events          []json.RawMessage
+		AuthChainEvents []json.RawMessage
+	}{response(r), eventsToJSON(r.Events), eventsToJSON(r.AuthChainEvents)})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *QueryEventsByIDResponse) UnmarshalJSON(data []byte) (err error) {
+	type response QueryEventsByIDResponse
+	var content struct {
+		response
+		Events          []json.RawMessage
+		AuthChainEvents []json.RawMessage
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	*r = QueryEventsByIDResponse(content.response)
+	if r.Events, err = eventsFromJSON(content.Events); err != nil {
+		return
+	}
+	r.AuthChainEvents, err = eventsFromJSON(content.AuthChainEvents)
+	return
+}
+
+// MarshalJSON implements json.Marshaller
+func (r RejectedEvent) MarshalJSON() ([]byte, error) {
+	event := json.RawMessage(r.Event.JSON())
+	content := struct {
+		Event           *json.RawMessage
+		RejectionReason string
+	}{
+		Event:           &event,
+		RejectionReason: r.RejectionReason,
+	}
+	return json.Marshal(&content)
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *RejectedEvent) UnmarshalJSON(data []byte) (err error) {
+	var content struct {
+		Event           json.RawMessage
+		RejectionReason string
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	r.RejectionReason = content.RejectionReason
+	r.Event, err = gomatrixserverlib.NewEventFromUntrustedJSON(content.Event)
+	return
+}
+
+// MarshalJSON implements json.Marshaller
+func (r QueryMessagesResponse) MarshalJSON() ([]byte, error) {
+	type response QueryMessagesResponse
+	return json.Marshal(&struct {
+		response
+		Events []json.RawMessage
+	}{response(r), eventsToJSON(r.Events)})
+}
+
+// UnmarshalJSON implements json.Unmarshaller
+func (r *QueryMessagesResponse) UnmarshalJSON(data []byte) (err error) {
+	type response QueryMessagesResponse
+	var content struct {
+		response
+		Events []json.RawMessage
+	}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return
+	}
+	*r = QueryMessagesResponse(content.response)
+	r.Events, err = eventsFromJSON(content.Events)
+	return
+}
+
+// eventsToJSON returns the event JSON of each of the events.
+func eventsToJSON(events []gomatrixserverlib.Event) []json.RawMessage {
+	if events == nil {
+		return nil
+	}
+	result := make([]json.RawMessage, len(events))
+	for i := range events {
+		result[i] = json.RawMessage(events[i].JSON())
+	}
+	return result
+}
+
+// eventsFromJSON loads the events from their event JSON.
+// The JSON is treated as untrusted since it came over the network. This performs
+// more checks than are strictly necessary for a response from the roomserver, but is safer.
+func eventsFromJSON(eventJSONs []json.RawMessage) ([]gomatrixserverlib.Event, error) {
+	if eventJSONs == nil {
+		return nil, nil
+	}
+	result := make([]gomatrixserverlib.Event, len(eventJSONs))
+	for i := range eventJSONs {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSONs[i])
+		if err != nil {
+			return nil, err
+		}
+		result[i] = event
+	}
+	return result, nil
+}
+
+// RoomserverQueryAPI is used to query information from the room server.
+type RoomserverQueryAPI interface {
+	// Query the latest events and state for a room from the room server.
+	QueryLatestEventsAndState(
+		request *QueryLatestEventsAndStateRequest,
+		response *QueryLatestEventsAndStateResponse,
+	) error
+
+	// Query the state after a list of events in a room from the room server.
+	QueryStateAfterEvents(
+		request *QueryStateAfterEventsRequest,
+		response *QueryStateAfterEventsResponse,
+	) error
+
+	// Query the state of a room just before an event from the room server.
+	QueryStateAtEvent(
+		request *QueryStateAtEventRequest,
+		response *QueryStateAtEventResponse,
+	) error
+
+	// Query a list of events by event ID, optionally with their auth chains.
+	QueryEventsByID(
+		request *QueryEventsByIDRequest,
+		response *QueryEventsByIDResponse,
+	) error
+
+	// Query which of a list of events were rejected and why.
+	QueryRejectedEvents(
+		request *QueryRejectedEventsRequest,
+		response *QueryRejectedEventsResponse,
+	) error
+
+	// Query a page of the history of a room.
+	QueryMessages(
+		request *QueryMessagesRequest,
+		response *QueryMessagesResponse,
+	) error
+}
+
+// RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
+const RoomserverQueryLatestEventsAndStatePath = "/api/roomserver/QueryLatestEventsAndState"
+
+// RoomserverQueryStateAfterEventsPath is the HTTP path for the QueryStateAfterEvents API.
+const RoomserverQueryStateAfterEventsPath = "/api/roomserver/QueryStateAfterEvents"
+
+// RoomserverQueryStateAtEventPath is the HTTP path for the QueryStateAtEvent API.
+const RoomserverQueryStateAtEventPath = "/api/roomserver/QueryStateAtEvent"
+
+// RoomserverQueryEventsByIDPath is the HTTP path for the QueryEventsByID API.
+const RoomserverQueryEventsByIDPath = "/api/roomserver/QueryEventsByID"
+
+// RoomserverQueryRejectedEventsPath is the HTTP path for the QueryRejectedEvents API.
+const RoomserverQueryRejectedEventsPath = "/api/roomserver/QueryRejectedEvents"
+
+// RoomserverQueryMessagesPath is the HTTP path for the QueryMessages API.
+const RoomserverQueryMessagesPath = "/api/roomserver/QueryMessages"
+
+// NewRoomserverQueryAPIHTTP creates a RoomserverQueryAPI implemented by talking to a HTTP POST API.
+// If httpClient is nil then it uses the http.DefaultClient
+func NewRoomserverQueryAPIHTTP(roomserverURL string, httpClient *http.Client) RoomserverQueryAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpRoomserverQueryAPI{roomserverURL, httpClient}
+}
+
+type httpRoomserverQueryAPI struct {
+	roomserverURL string
+	httpClient    *http.Client
+}
+
+// QueryLatestEventsAndState implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryLatestEventsAndState(
+	request *QueryLatestEventsAndStateRequest,
+	response *QueryLatestEventsAndStateResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryLatestEventsAndStatePath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
+
+// QueryStateAfterEvents implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryStateAfterEvents(
+	request *QueryStateAfterEventsRequest,
+	response *QueryStateAfterEventsResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryStateAfterEventsPath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
+
+// QueryStateAtEvent implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryStateAtEvent(
+	request *QueryStateAtEventRequest,
+	response *QueryStateAtEventResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryStateAtEventPath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
+
+// QueryEventsByID implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryEventsByID(
+	request *QueryEventsByIDRequest,
+	response *QueryEventsByIDResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryEventsByIDPath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
+
+// QueryRejectedEvents implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRejectedEvents(
+	request *QueryRejectedEventsRequest,
+	response *QueryRejectedEventsResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryRejectedEventsPath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
+
+// postJSON sends the request to apiURL as JSON and decodes the JSON response into response.
+// Returns an error if the server responded with anything other than a 200 status code.
+func postJSON(httpClient *http.Client, apiURL string, request, response interface{}) error {
+	jsonBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	res, err := httpClient.Post(apiURL, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var errorBody struct {
+			Message string `json:"message"`
+		}
+		if err = json.NewDecoder(res.Body).Decode(&errorBody); err != nil {
+			return fmt.Errorf("api: %d from %s", res.StatusCode, apiURL)
+		}
+		return fmt.Errorf("api: %d from %s: %s", res.StatusCode, apiURL, errorBody.Message)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// QueryMessages implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryMessages(
+	request *QueryMessagesRequest,
+	response *QueryMessagesResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryMessagesPath
+	return postJSON(h.httpClient, apiURL, request, response)
+}
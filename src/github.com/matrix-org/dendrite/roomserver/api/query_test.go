@@ -0,0 +1,136 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func buildTestEvent(t *testing.T, eventID string, privateKey ed25519.PrivateKey) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: "@alice:a",
+		RoomID: "!room:a",
+		Type:   "m.room.message",
+		Depth:  2,
+	}
+	if err := builder.SetContent(map[string]string{"body": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.SetUnsigned(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := builder.Build(eventID, time.Now(), "a", "ed25519:test", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestQueryResponsesRoundTrip(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := buildTestEvent(t, "$first:a", privateKey)
+	second := buildTestEvent(t, "$second:a", privateKey)
+
+	eventLists := []struct {
+		name   string
+		events []gomatrixserverlib.Event
+	}{
+		{"events", []gomatrixserverlib.Event{first, second}},
+		{"empty", []gomatrixserverlib.Event{}},
+		{"nil", nil},
+	}
+	type testCase struct {
+		name string
+		// A pointer to the response to encode.
+		response interface{}
+		// A pointer to a zero response to decode into.
+		decoded interface{}
+	}
+	var testCases []testCase
+	for _, list := range eventLists {
+		events := list.events
+		testCases = append(testCases,
+			testCase{
+				"QueryLatestEventsAndStateResponse with " + list.name,
+				&QueryLatestEventsAndStateResponse{
+					QueryLatestEventsAndStateRequest: QueryLatestEventsAndStateRequest{
+						RoomID:       "!room:a",
+						StateToFetch: []StateKeyTuple{{"m.room.member", "@alice:a"}},
+					},
+					RoomExists:   true,
+					LatestEvents: []gomatrixserverlib.EventReference{second.EventReference()},
+					StateEvents:  events,
+				},
+				&QueryLatestEventsAndStateResponse{},
+			},
+			testCase{
+				"QueryStateAfterEventsResponse with " + list.name,
+				&QueryStateAfterEventsResponse{
+					QueryStateAfterEventsRequest: QueryStateAfterEventsRequest{
+						RoomID: "!room:a", PrevEventIDs: []string{"$second:a"},
+					},
+					RoomExists:      true,
+					PrevEventsExist: true,
+					StateEvents:     events,
+				},
+				&QueryStateAfterEventsResponse{},
+			},
+			testCase{
+				"QueryStateAtEventResponse with " + list.name,
+				&QueryStateAtEventResponse{
+					QueryStateAtEventRequest: QueryStateAtEventRequest{EventID: "$second:a"},
+					EventExists:              true,
+					StateEvents:              events,
+				},
+				&QueryStateAtEventResponse{},
+			},
+			testCase{
+				"QueryEventsByIDResponse with " + list.name,
+				&QueryEventsByIDResponse{
+					QueryEventsByIDRequest: QueryEventsByIDRequest{
+						EventIDs: []string{"$first:a", "$second:a"}, AuthChain: true,
+					},
+					Events:          events,
+					AuthChainEvents: events,
+				},
+				&QueryEventsByIDResponse{},
+			},
+			testCase{
+				"QueryMessagesResponse with " + list.name,
+				&QueryMessagesResponse{
+					QueryMessagesRequest: QueryMessagesRequest{RoomID: "!room:a", Backwards: true, Limit: 2},
+					RoomExists:           true,
+					FromEventExists:      true,
+					Events:               events,
+					NextToken:            "token",
+				},
+				&QueryMessagesResponse{},
+			},
+		)
+	}
+	testCases = append(testCases, testCase{
+		"RejectedEvent",
+		&RejectedEvent{Event: first, RejectionReason: "not allowed"},
+		&RejectedEvent{},
+	})
+
+	for _, tc := range testCases {
+		data, err := json.Marshal(tc.response)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err = json.Unmarshal(data, tc.decoded); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(tc.decoded, tc.response) {
+			t.Fatalf("%s: wanted %#v, got %#v from %s", tc.name, tc.response, tc.decoded, string(data))
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// Package fsck checks the roomserver database for inconsistencies and repairs the ones it safely can.
+package fsck
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"sort"
+)
+
+// A Database has the storage APIs needed to check the roomserver database.
+type Database interface {
+	input.AuthEventsDatabase
+	// Lookup the events that don't have any JSON.
+	EventsMissingJSON(limit int) ([]types.EventNID, error)
+	// Lookup the event JSON stored for events that don't exist.
+	OrphanedEventJSON(limit int) ([]types.EventNID, error)
+	// Lookup the events that refer to a state snapshot that doesn't exist.
+	EventsMissingState(limit int) ([]types.BrokenReference, error)
+	// Lookup the events that refer to auth events that don't exist.
+	EventsMissingAuthEvents(limit int) ([]types.BrokenReference, error)
+	// Lookup the state snapshots that refer to state blocks that don't exist.
+	StateMissingBlocks(limit int) ([]types.BrokenReference, error)
+	// Lookup the state blocks that refer to events that don't exist.
+	StateBlocksMissingEvents(limit int) ([]types.BrokenReference, error)
+	// Lookup the events listed in the previous events table that don't exist.
+	PreviousEventsMissingEvents(limit int) ([]types.EventNID, error)
+	// Lookup the rooms whose latest events don't exist or don't have a state snapshot.
+	RoomsMissingLatestEvents(limit int) ([]types.BrokenReference, error)
+	// Lookup the rooms whose last event written to the output log doesn't exist.
+	RoomsMissingLastEventSent(limit int) ([]types.BrokenReference, error)
+	// Lookup the rooms whose current state snapshot doesn't exist.
+	RoomsMissingState(limit int) ([]types.BrokenReference, error)
+	// Lookup the state snapshots that use any of a list of state blocks.
+	StateNIDsUsingBlocks(stateBlockNIDs []types.StateBlockNID) ([]types.StateSnapshotNID, error)
+	// Lookup the events whose state is one of a list of state snapshots.
+	EventNIDsWithState(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error)
+	// Lookup which of a list of events are the latest events of their rooms.
+	LatestEventNIDsIn(eventNIDs []types.EventNID) ([]types.EventNID, error)
+	// Lookup a random sample of events.
+	RandomEventNIDs(limit int) ([]types.EventNID, error)
+	// Look up the reasons that events were rejected.
+	// Returns a map from numeric event ID to reason for the events that were rejected.
+	RejectionReasons(eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// Delete the JSON for a list of events.
+	DeleteEventJSON(eventNIDs []types.EventNID) error
+	// Forget the state at the events and remove them from the history of their rooms.
+	MarkEventsAsOutliers(eventNIDs []types.EventNID) error
+	// Remove events from the lists of events that reference each previous event.
+	RemovePreviousEventReferences(eventNIDs []types.EventNID) error
+	// Mark the event as rejected because it failed the auth checks.
+	MarkEventRejected(eventNID types.EventNID, rejectionReason string) error
+	// Remove events from the latest events of a room.
+	RemoveLatestEvents(roomNID types.RoomNID, eventNIDs []types.EventNID) error
+	// Forget the last event written to the output log for each of the rooms.
+	ResetLastEventSent(roomNIDs []types.RoomNID) error
+	// Forget the current state of each of the rooms so that it is worked out again
+	// when the next event in the room is processed.
+	ResetRoomState(roomNIDs []types.RoomNID) error
+}
+
+// DefaultLimit is the maximum number of problems found by each check if Limit isn't set.
+const DefaultLimit = 1000
+
+// DefaultAuthSampleSize is the number of events whose auth is checked if AuthSampleSize isn't set.
+const DefaultAuthSampleSize = 100
+
+// The names of the checks.
+const (
+	CheckEventJSON       = "event_json"
+	CheckEventState      = "event_state"
+	CheckAuthEvents      = "auth_events"
+	CheckStateBlocks     = "state_blocks"
+	CheckPreviousEvents  = "previous_events"
+	CheckRoomLatest      = "room_latest_events"
+	CheckRoomState       = "room_state"
+	CheckEventAuthSample = "event_auth"
+)
+
+// A Checker looks for references between rows in the roomserver database that refer to rows
+// that don't exist, and re-runs the auth checks on a random sample of the stored events.
+// A database with these problems can make the roomserver fail when it processes new events,
+// e.g. when it loads a state snapshot whose state blocks are missing.
+// If Repair is set then the problems that can be repaired without losing information
+// are repaired. Event JSON for events that don't exist is deleted. Events whose state
+// snapshot is missing, or refers to missing state blocks or events, become outliers so
+// that their state is worked out again if it is needed. The latest events of a room
+// are left alone since the room needs the state before them to accept new events.
+// Events that don't exist are removed from the previous events table. Latest events
+// that don't exist or don't have state are removed from their rooms. Rooms whose last
+// sent event doesn't exist forget it, and rooms whose current state snapshot doesn't
+// exist work it out again when their next event is processed. Events that fail the
+// auth checks are marked as rejected. The other problems are only reported.
+// Repairs should be made while the roomserver is stopped.
+type Checker struct {
+	DB Database
+	// Whether to repair the problems that can be repaired.
+	Repair bool
+	// The maximum number of problems found by each check.
+	// If this is 0 then DefaultLimit is used.
+	Limit int
+	// The number of events whose auth is checked.
+	// If this is 0 then DefaultAuthSampleSize is used. If it is negative then no events are checked.
+	AuthSampleSize int
+}
+
+// A Problem is an inconsistency found in the roomserver database.
+type Problem struct {
+	// The name of the check that found the problem.
+	Check string
+	// What is wrong.
+	Description string
+	// Whether the problem was repaired.
+	Repaired bool
+}
+
+// Check runs the checks and returns the problems found.
+func (c *Checker) Check() ([]Problem, error) {
+	var problems []Problem
+	for _, check := range []func() ([]Problem, error){
+		c.checkEventJSON,
+		c.checkEventState,
+		c.checkAuthEvents,
+		c.checkStateBlocks,
+		c.checkPreviousEvents,
+		c.checkRooms,
+		c.checkEventAuth,
+	} {
+		found, err := check()
+		problems = append(problems, found...)
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+func (c *Checker) limit() int {
+	if c.Limit <= 0 {
+		return DefaultLimit
+	}
+	return c.Limit
+}
+
+func (c *Checker) checkEventJSON() ([]Problem, error) {
+	var problems []Problem
+	missing, err := c.DB.EventsMissingJSON(c.limit())
+	if err != nil {
+		return nil, err
+	}
+	for _, eventNID := range missing {
+		problems = append(problems, Problem{
+			Check:       CheckEventJSON,
+			Description: fmt.Sprintf("event %d has no JSON", eventNID),
+		})
+	}
+
+	orphaned, err := c.DB.OrphanedEventJSON(c.limit())
+	if err != nil || len(orphaned) == 0 {
+		return problems, err
+	}
+	repaired := false
+	if c.Repair {
+		if err = c.DB.DeleteEventJSON(orphaned); err != nil {
+			return problems, err
+		}
+		repaired = true
+	}
+	for _, eventNID := range orphaned {
+		problems = append(problems, Problem{
+			Check:       CheckEventJSON,
+			Description: fmt.Sprintf("JSON is stored for event %d which doesn't exist", eventNID),
+			Repaired:    repaired,
+		})
+	}
+	return problems, nil
+}
+
+func (c *Checker) checkEventState() ([]Problem, error) {
+	broken, err := c.DB.EventsMissingState(c.limit())
+	if err != nil || len(broken) == 0 {
+		return nil, err
+	}
+	repaired := false
+	kept := map[types.EventNID]bool{}
+	if c.Repair {
+		eventNIDs := make([]types.EventNID, len(broken))
+		for i := range broken {
+			eventNIDs[i] = types.EventNID(broken[i].FromNID)
+		}
+		if kept, err = c.markEventsAsOutliers(eventNIDs); err != nil {
+			return nil, err
+		}
+		repaired = true
+	}
+	var problems []Problem
+	for _, ref := range broken {
+		problem := Problem{
+			Check:       CheckEventState,
+			Description: fmt.Sprintf("event %d refers to state snapshot %d which doesn't exist", ref.FromNID, ref.MissingNID),
+			Repaired:    repaired && !kept[types.EventNID(ref.FromNID)],
+		}
+		if kept[types.EventNID(ref.FromNID)] {
+			problem.Description += " but is a latest event of its room so can't become an outlier"
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// markEventsAsOutliers turns events into outliers, apart from the latest events of their rooms.
+// The state before the latest events is needed to work out the state after the next event in
+// the room, so making them outliers would stop the room from accepting new events.
+// Returns the events that were kept because they are latest events.
+func (c *Checker) markEventsAsOutliers(eventNIDs []types.EventNID) (map[types.EventNID]bool, error) {
+	latest, err := c.DB.LatestEventNIDsIn(eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[types.EventNID]bool{}
+	for _, eventNID := range latest {
+		kept[eventNID] = true
+	}
+	var outliers []types.EventNID
+	for _, eventNID := range eventNIDs {
+		if !kept[eventNID] {
+			outliers = append(outliers, eventNID)
+		}
+	}
+	if len(outliers) > 0 {
+		if err = c.DB.MarkEventsAsOutliers(outliers); err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+func (c *Checker) checkAuthEvents() ([]Problem, error) {
+	broken, err := c.DB.EventsMissingAuthEvents(c.limit())
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, ref := range broken {
+		problems = append(problems, Problem{
+			Check:       CheckAuthEvents,
+			Description: fmt.Sprintf("event %d refers to auth event %d which doesn't exist", ref.FromNID, ref.MissingNID),
+		})
+	}
+	return problems, nil
+}
+
+// checkStateBlocks finds the state snapshots that can't be loaded because they refer to
+// state blocks that don't exist or to state blocks that refer to events that don't exist.
+func (c *Checker) checkStateBlocks() ([]Problem, error) {
+	missingBlocks, err := c.DB.StateMissingBlocks(c.limit())
+	if err != nil {
+		return nil, err
+	}
+	missingEvents, err := c.DB.StateBlocksMissingEvents(c.limit())
+	if err != nil {
+		return nil, err
+	}
+	if len(missingBlocks) == 0 && len(missingEvents) == 0 {
+		return nil, nil
+	}
+
+	repaired := false
+	var kept map[types.EventNID]bool
+	if c.Repair {
+		stateNIDs := make([]types.StateSnapshotNID, len(missingBlocks))
+		for i := range missingBlocks {
+			stateNIDs[i] = types.StateSnapshotNID(missingBlocks[i].FromNID)
+		}
+		if len(missingEvents) > 0 {
+			stateBlockNIDs := make([]types.StateBlockNID, len(missingEvents))
+			for i := range missingEvents {
+				stateBlockNIDs[i] = types.StateBlockNID(missingEvents[i].FromNID)
+			}
+			var usingBlocks []types.StateSnapshotNID
+			if usingBlocks, err = c.DB.StateNIDsUsingBlocks(stateBlockNIDs); err != nil {
+				return nil, err
+			}
+			stateNIDs = append(stateNIDs, usingBlocks...)
+		}
+		var eventNIDs []types.EventNID
+		if eventNIDs, err = c.DB.EventNIDsWithState(stateNIDs); err != nil {
+			return nil, err
+		}
+		if len(eventNIDs) > 0 {
+			if kept, err = c.markEventsAsOutliers(eventNIDs); err != nil {
+				return nil, err
+			}
+		}
+		// The snapshots are still used if any of the events using them were kept.
+		repaired = len(kept) == 0
+	}
+
+	var problems []Problem
+	for _, ref := range missingBlocks {
+		problems = append(problems, Problem{
+			Check:       CheckStateBlocks,
+			Description: fmt.Sprintf("state snapshot %d refers to state block %d which doesn't exist", ref.FromNID, ref.MissingNID),
+			Repaired:    repaired,
+		})
+	}
+	for _, ref := range missingEvents {
+		problems = append(problems, Problem{
+			Check:       CheckStateBlocks,
+			Description: fmt.Sprintf("state block %d refers to event %d which doesn't exist", ref.FromNID, ref.MissingNID),
+			Repaired:    repaired,
+		})
+	}
+	var keptNIDs []types.EventNID
+	for eventNID := range kept {
+		keptNIDs = append(keptNIDs, eventNID)
+	}
+	sort.Slice(keptNIDs, func(i, j int) bool { return keptNIDs[i] < keptNIDs[j] })
+	for _, eventNID := range keptNIDs {
+		problems = append(problems, Problem{
+			Check:       CheckStateBlocks,
+			Description: fmt.Sprintf("event %d has state that can't be loaded but is a latest event of its room so can't become an outlier", eventNID),
+		})
+	}
+	return problems, nil
+}
+
+func (c *Checker) checkPreviousEvents() ([]Problem, error) {
+	missing, err := c.DB.PreviousEventsMissingEvents(c.limit())
+	if err != nil || len(missing) == 0 {
+		return nil, err
+	}
+	repaired := false
+	if c.Repair {
+		if err = c.DB.RemovePreviousEventReferences(missing); err != nil {
+			return nil, err
+		}
+		repaired = true
+	}
+	var problems []Problem
+	for _, eventNID := range missing {
+		problems = append(problems, Problem{
+			Check:       CheckPreviousEvents,
+			Description: fmt.Sprintf("event %d is listed as referencing a previous event but doesn't exist", eventNID),
+			Repaired:    repaired,
+		})
+	}
+	return problems, nil
+}
+
+// checkRooms finds the rooms that can't accept new events because their latest events, their
+// last sent event or their current state can't be loaded.
+func (c *Checker) checkRooms() ([]Problem, error) {
+	var problems []Problem
+	latest, err := c.DB.RoomsMissingLatestEvents(c.limit())
+	if err != nil {
+		return nil, err
+	}
+	if c.Repair {
+		// The latest events can't be used to work out the state of the room so they are
+		// removed from it. New events that refer to them are held until they are received
+		// again, like any other event whose prev_events are missing.
+		var roomNIDs []types.RoomNID
+		removed := map[types.RoomNID][]types.EventNID{}
+		for _, ref := range latest {
+			roomNID := types.RoomNID(ref.FromNID)
+			if removed[roomNID] == nil {
+				roomNIDs = append(roomNIDs, roomNID)
+			}
+			removed[roomNID] = append(removed[roomNID], types.EventNID(ref.MissingNID))
+		}
+		for _, roomNID := range roomNIDs {
+			if err = c.DB.RemoveLatestEvents(roomNID, removed[roomNID]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, ref := range latest {
+		problems = append(problems, Problem{
+			Check:       CheckRoomLatest,
+			Description: fmt.Sprintf("room %d has latest event %d which doesn't exist or has no state", ref.FromNID, ref.MissingNID),
+			Repaired:    c.Repair,
+		})
+	}
+
+	lastSent, err := c.DB.RoomsMissingLastEventSent(c.limit())
+	if err != nil {
+		return problems, err
+	}
+	if c.Repair && len(lastSent) > 0 {
+		if err = c.DB.ResetLastEventSent(brokenRoomNIDs(lastSent)); err != nil {
+			return problems, err
+		}
+	}
+	for _, ref := range lastSent {
+		problems = append(problems, Problem{
+			Check:       CheckRoomLatest,
+			Description: fmt.Sprintf("room %d has last sent event %d which doesn't exist", ref.FromNID, ref.MissingNID),
+			Repaired:    c.Repair,
+		})
+	}
+
+	current, err := c.DB.RoomsMissingState(c.limit())
+	if err != nil {
+		return problems, err
+	}
+	if c.Repair && len(current) > 0 {
+		if err = c.DB.ResetRoomState(brokenRoomNIDs(current)); err != nil {
+			return problems, err
+		}
+	}
+	for _, ref := range current {
+		problems = append(problems, Problem{
+			Check:       CheckRoomState,
+			Description: fmt.Sprintf("room %d has current state snapshot %d which doesn't exist", ref.FromNID, ref.MissingNID),
+			Repaired:    c.Repair,
+		})
+	}
+	return problems, nil
+}
+
+// brokenRoomNIDs returns the numeric IDs of the rooms with broken references.
+func brokenRoomNIDs(broken []types.BrokenReference) []types.RoomNID {
+	roomNIDs := make([]types.RoomNID, len(broken))
+	for i := range broken {
+		roomNIDs[i] = types.RoomNID(broken[i].FromNID)
+	}
+	return roomNIDs
+}
+
+// checkEventAuth re-runs the auth checks on a random sample of events and checks that the
+// events that fail them are the events that were rejected.
+func (c *Checker) checkEventAuth() ([]Problem, error) {
+	sampleSize := c.AuthSampleSize
+	if sampleSize == 0 {
+		sampleSize = DefaultAuthSampleSize
+	}
+	if sampleSize < 0 {
+		return nil, nil
+	}
+	eventNIDs, err := c.DB.RandomEventNIDs(sampleSize)
+	if err != nil || len(eventNIDs) == 0 {
+		return nil, err
+	}
+	events, err := c.DB.Events(eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	rejected, err := c.DB.RejectionReasons(eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, event := range events {
+		err = input.CheckAuth(c.DB, event.Event)
+		notAllowed, failed := err.(*gomatrixserverlib.NotAllowed)
+		_, wasRejected := rejected[event.EventNID]
+		switch {
+		case err != nil && !failed:
+			problems = append(problems, Problem{
+				Check:       CheckEventAuthSample,
+				Description: fmt.Sprintf("couldn't check auth for event %s: %v", event.EventID(), err),
+			})
+		case failed && !wasRejected:
+			problem := Problem{
+				Check:       CheckEventAuthSample,
+				Description: fmt.Sprintf("event %s fails auth but wasn't rejected: %v", event.EventID(), notAllowed),
+			}
+			if c.Repair {
+				if err = c.DB.MarkEventRejected(event.EventNID, notAllowed.Error()); err != nil {
+					return problems, err
+				}
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		case !failed && wasRejected:
+			problems = append(problems, Problem{
+				Check:       CheckEventAuthSample,
+				Description: fmt.Sprintf("event %s passes auth but was rejected: %s", event.EventID(), rejected[event.EventNID]),
+			})
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,310 @@
+package fsck
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"sort"
+	"testing"
+)
+
+// testDatabase is a Database with some broken references.
+// The methods that aren't implemented panic.
+type testDatabase struct {
+	Database
+	// The state blocks used by each state snapshot.
+	snapshots map[types.StateSnapshotNID][]types.StateBlockNID
+	// The state snapshot used by each event.
+	events map[types.EventNID]types.StateSnapshotNID
+	// The events in the previous events table.
+	previousEvents []types.EventNID
+	// The events that were made outliers.
+	outliers []types.EventNID
+	// The events that were removed from the previous events table.
+	removedPreviousEvents []types.EventNID
+	// The latest events of the rooms.
+	latest []types.EventNID
+	// The broken references from the rooms to their latest events, last sent events and current state.
+	roomsMissingLatest, roomsMissingLastSent, roomsMissingState []types.BrokenReference
+	// The latest events removed from each room.
+	removedLatest map[types.RoomNID][]types.EventNID
+	// The rooms that forgot their last sent event and their current state.
+	resetLastSent, resetState []types.RoomNID
+}
+
+func (db *testDatabase) EventsMissingJSON(limit int) ([]types.EventNID, error) {
+	return nil, nil
+}
+
+func (db *testDatabase) OrphanedEventJSON(limit int) ([]types.EventNID, error) {
+	return nil, nil
+}
+
+func (db *testDatabase) EventsMissingState(limit int) ([]types.BrokenReference, error) {
+	var result []types.BrokenReference
+	for eventNID, stateNID := range db.events {
+		if _, ok := db.snapshots[stateNID]; !ok && stateNID != 0 {
+			result = append(result, types.BrokenReference{FromNID: int64(eventNID), MissingNID: int64(stateNID)})
+		}
+	}
+	return result, nil
+}
+
+func (db *testDatabase) EventsMissingAuthEvents(limit int) ([]types.BrokenReference, error) {
+	return nil, nil
+}
+
+func (db *testDatabase) StateMissingBlocks(limit int) ([]types.BrokenReference, error) {
+	return nil, nil
+}
+
+func (db *testDatabase) StateBlocksMissingEvents(limit int) ([]types.BrokenReference, error) {
+	// Pretend that block 2 refers to event 100 which doesn't exist.
+	return []types.BrokenReference{{FromNID: 2, MissingNID: 100}}, nil
+}
+
+func (db *testDatabase) PreviousEventsMissingEvents(limit int) ([]types.EventNID, error) {
+	var result []types.EventNID
+	for _, eventNID := range db.previousEvents {
+		if _, ok := db.events[eventNID]; !ok {
+			result = append(result, eventNID)
+		}
+	}
+	return result, nil
+}
+
+func (db *testDatabase) RoomsMissingLatestEvents(limit int) ([]types.BrokenReference, error) {
+	return db.roomsMissingLatest, nil
+}
+
+func (db *testDatabase) RoomsMissingLastEventSent(limit int) ([]types.BrokenReference, error) {
+	return db.roomsMissingLastSent, nil
+}
+
+func (db *testDatabase) RoomsMissingState(limit int) ([]types.BrokenReference, error) {
+	return db.roomsMissingState, nil
+}
+
+func (db *testDatabase) LatestEventNIDsIn(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	var result []types.EventNID
+	for _, latestNID := range db.latest {
+		for _, eventNID := range eventNIDs {
+			if latestNID == eventNID {
+				result = append(result, eventNID)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testDatabase) RemoveLatestEvents(roomNID types.RoomNID, eventNIDs []types.EventNID) error {
+	if db.removedLatest == nil {
+		db.removedLatest = map[types.RoomNID][]types.EventNID{}
+	}
+	db.removedLatest[roomNID] = append(db.removedLatest[roomNID], eventNIDs...)
+	return nil
+}
+
+func (db *testDatabase) ResetLastEventSent(roomNIDs []types.RoomNID) error {
+	db.resetLastSent = append(db.resetLastSent, roomNIDs...)
+	return nil
+}
+
+func (db *testDatabase) ResetRoomState(roomNIDs []types.RoomNID) error {
+	db.resetState = append(db.resetState, roomNIDs...)
+	return nil
+}
+
+func (db *testDatabase) StateNIDsUsingBlocks(stateBlockNIDs []types.StateBlockNID) ([]types.StateSnapshotNID, error) {
+	var result []types.StateSnapshotNID
+	for stateNID, blockNIDs := range db.snapshots {
+		for _, blockNID := range blockNIDs {
+			for _, stateBlockNID := range stateBlockNIDs {
+				if blockNID == stateBlockNID {
+					result = append(result, stateNID)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testDatabase) EventNIDsWithState(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	var result []types.EventNID
+	for eventNID, eventStateNID := range db.events {
+		for _, stateNID := range stateNIDs {
+			if eventStateNID == stateNID {
+				result = append(result, eventNID)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testDatabase) MarkEventsAsOutliers(eventNIDs []types.EventNID) error {
+	for _, eventNID := range eventNIDs {
+		db.events[eventNID] = 0
+	}
+	db.outliers = append(db.outliers, eventNIDs...)
+	return nil
+}
+
+func (db *testDatabase) RemovePreviousEventReferences(eventNIDs []types.EventNID) error {
+	db.removedPreviousEvents = append(db.removedPreviousEvents, eventNIDs...)
+	return nil
+}
+
+func TestCheckRepair(t *testing.T) {
+	db := &testDatabase{
+		snapshots: map[types.StateSnapshotNID][]types.StateBlockNID{
+			1: {1},
+			2: {1, 2}, // block 2 refers to an event that doesn't exist
+		},
+		events: map[types.EventNID]types.StateSnapshotNID{
+			1: 1,
+			2: 2,
+			3: 2,
+			4: 5, // state snapshot 5 doesn't exist
+		},
+		previousEvents: []types.EventNID{1, 2, 6},
+	}
+	c := Checker{DB: db, Repair: true, AuthSampleSize: -1}
+	problems, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantChecks := []string{CheckEventState, CheckStateBlocks, CheckPreviousEvents}
+	if len(problems) != len(wantChecks) {
+		t.Fatalf("wanted %d problems, got %#v", len(wantChecks), problems)
+	}
+	for i, problem := range problems {
+		if problem.Check != wantChecks[i] {
+			t.Fatalf("wanted problem %d to be found by %q, got %q", i, wantChecks[i], problem.Check)
+		}
+		if !problem.Repaired {
+			t.Fatalf("wanted problem %q to be repaired", problem.Description)
+		}
+	}
+
+	sort.Slice(db.outliers, func(i, j int) bool { return db.outliers[i] < db.outliers[j] })
+	wantOutliers := []types.EventNID{2, 3, 4}
+	if len(db.outliers) != len(wantOutliers) {
+		t.Fatalf("wanted events %v to become outliers, got %v", wantOutliers, db.outliers)
+	}
+	for i := range wantOutliers {
+		if db.outliers[i] != wantOutliers[i] {
+			t.Fatalf("wanted events %v to become outliers, got %v", wantOutliers, db.outliers)
+		}
+	}
+	if len(db.removedPreviousEvents) != 1 || db.removedPreviousEvents[0] != 6 {
+		t.Fatalf("wanted event 6 to be removed from the previous events, got %v", db.removedPreviousEvents)
+	}
+}
+
+func TestCheckReportOnly(t *testing.T) {
+	db := &testDatabase{
+		snapshots: map[types.StateSnapshotNID][]types.StateBlockNID{1: {1}, 2: {2}},
+		events:    map[types.EventNID]types.StateSnapshotNID{1: 1, 2: 2},
+	}
+	c := Checker{DB: db, AuthSampleSize: -1}
+	problems, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Check != CheckStateBlocks || problems[0].Repaired {
+		t.Fatalf("wanted one unrepaired state block problem, got %#v", problems)
+	}
+	if len(db.outliers) != 0 {
+		t.Fatalf("wanted no events to become outliers, got %v", db.outliers)
+	}
+}
+
+func TestCheckRepairKeepsLatestEvents(t *testing.T) {
+	db := &testDatabase{
+		snapshots: map[types.StateSnapshotNID][]types.StateBlockNID{
+			1: {1},
+			2: {1, 2}, // block 2 refers to an event that doesn't exist
+		},
+		events: map[types.EventNID]types.StateSnapshotNID{
+			1: 1,
+			2: 2,
+			3: 2, // a latest event
+			4: 5, // state snapshot 5 doesn't exist
+			5: 6, // a latest event, and state snapshot 6 doesn't exist
+		},
+		latest: []types.EventNID{3, 5},
+	}
+	c := Checker{DB: db, Repair: true, AuthSampleSize: -1}
+	problems, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(db.outliers, func(i, j int) bool { return db.outliers[i] < db.outliers[j] })
+	if len(db.outliers) != 2 || db.outliers[0] != 2 || db.outliers[1] != 4 {
+		t.Fatalf("wanted events [2 4] to become outliers, got %v", db.outliers)
+	}
+	if db.events[3] != 2 || db.events[5] != 6 {
+		t.Fatalf("wanted the latest events to keep their state, got %v", db.events)
+	}
+	repaired := map[string]int{}
+	unrepaired := map[string]int{}
+	for _, problem := range problems {
+		if problem.Repaired {
+			repaired[problem.Check]++
+		} else {
+			unrepaired[problem.Check]++
+		}
+	}
+	// Event 4 is repaired but latest event 5 isn't. The state block problem isn't repaired
+	// because latest event 3 still uses snapshot 2, which is reported as a separate problem.
+	if repaired[CheckEventState] != 1 || unrepaired[CheckEventState] != 1 {
+		t.Fatalf("wanted one repaired and one unrepaired event state problem, got %#v", problems)
+	}
+	if repaired[CheckStateBlocks] != 0 || unrepaired[CheckStateBlocks] != 2 {
+		t.Fatalf("wanted two unrepaired state block problems, got %#v", problems)
+	}
+}
+
+func TestCheckRepairRooms(t *testing.T) {
+	db := &testDatabase{
+		snapshots: map[types.StateSnapshotNID][]types.StateBlockNID{1: {1}},
+		events:    map[types.EventNID]types.StateSnapshotNID{1: 1},
+		roomsMissingLatest: []types.BrokenReference{
+			{FromNID: 1, MissingNID: 7},
+			{FromNID: 1, MissingNID: 8},
+			{FromNID: 2, MissingNID: 9},
+		},
+		roomsMissingLastSent: []types.BrokenReference{{FromNID: 3, MissingNID: 10}},
+		roomsMissingState:    []types.BrokenReference{{FromNID: 4, MissingNID: 11}},
+	}
+	c := Checker{DB: db, Repair: true, AuthSampleSize: -1}
+	problems, err := c.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms := 0
+	for _, problem := range problems {
+		if problem.Check != CheckRoomLatest && problem.Check != CheckRoomState {
+			continue
+		}
+		rooms++
+		if !problem.Repaired {
+			t.Fatalf("wanted problem %q to be repaired", problem.Description)
+		}
+	}
+	if rooms != 5 {
+		t.Fatalf("wanted 5 room problems, got %#v", problems)
+	}
+	if removed := db.removedLatest[1]; len(removed) != 2 || removed[0] != 7 || removed[1] != 8 {
+		t.Fatalf("wanted events [7 8] to be removed from the latest events of room 1, got %v", removed)
+	}
+	if removed := db.removedLatest[2]; len(removed) != 1 || removed[0] != 9 {
+		t.Fatalf("wanted event 9 to be removed from the latest events of room 2, got %v", removed)
+	}
+	if len(db.resetLastSent) != 1 || db.resetLastSent[0] != 3 {
+		t.Fatalf("wanted room 3 to forget its last sent event, got %v", db.resetLastSent)
+	}
+	if len(db.resetState) != 1 || db.resetState[0] != 4 {
+		t.Fatalf("wanted room 4 to forget its current state, got %v", db.resetState)
+	}
+}
@@ -1,16 +1,50 @@
 package input
 
 import (
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
-	"sort"
 )
 
+// An AuthEventsDatabase has the storage APIs needed to check an event against its auth events.
+type AuthEventsDatabase interface {
+	// Lookup the state entries for a list of string event IDs
+	// Returns an error if the there is an error talking to the database
+	// or if the event IDs aren't in the database.
+	// Returns a types.RejectedEventError if any of the events were rejected.
+	StateEntriesForEventIDs(eventIDs []string) ([]types.StateEntry, error)
+	// Lookup the numeric IDs for a list of string event state keys.
+	// Returns a map from string state key to numeric ID for the state key.
+	EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error)
+	// Lookup the Events for a list of numeric event IDs.
+	// Returns a sorted list of events.
+	Events(eventNIDs []types.EventNID) ([]types.Event, error)
+}
+
+// CheckAuth checks that a stored event passes authentication checks against the auth events it references.
+// If the event fails the checks then this returns a *gomatrixserverlib.NotAllowed error.
+func CheckAuth(db AuthEventsDatabase, event gomatrixserverlib.Event) error {
+	authEventIDs := make([]string, len(event.AuthEvents()))
+	for i, ref := range event.AuthEvents() {
+		authEventIDs[i] = ref.EventID
+	}
+	_, err := checkAuthEvents(db, event, authEventIDs)
+	return err
+}
+
 // checkAuthEvents checks that the event passes authentication checks
 // Returns the numeric IDs for the auth events.
-func checkAuthEvents(db RoomEventDatabase, event gomatrixserverlib.Event, authEventIDs []string) ([]types.EventNID, error) {
+// If the event fails the checks then this returns a *gomatrixserverlib.NotAllowed
+// error along with the numeric IDs for the auth events so that the rejected event
+// can still be stored. If any of the auth events were rejected themselves then the
+// event isn't allowed either, and no numeric IDs are returned.
+func checkAuthEvents(db AuthEventsDatabase, event gomatrixserverlib.Event, authEventIDs []string) ([]types.EventNID, error) {
 	// Grab the numeric IDs for the supplied auth state events from the database.
 	authStateEntries, err := db.StateEntriesForEventIDs(authEventIDs)
+	if _, ok := err.(types.RejectedEventError); ok {
+		// An event that references a rejected event as an auth event can't be allowed.
+		return nil, &gomatrixserverlib.NotAllowed{Message: err.Error()}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -25,23 +59,20 @@ func checkAuthEvents(db RoomEventDatabase, event gomatrixserverlib.Event, authEv
 		return nil, err
 	}
 
-	// Check if the event is allowed.
-	if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
-		return nil, err
-	}
-
-	// Return the numeric IDs for the auth events.
+	// Work out the numeric IDs for the auth events.
 	result := make([]types.EventNID, len(authStateEntries))
 	for i := range authStateEntries {
 		result[i] = authStateEntries[i].EventNID
 	}
-	return result, nil
+
+	// Check if the event is allowed.
+	return result, gomatrixserverlib.Allowed(event, &authEvents)
 }
 
 type authEvents struct {
 	stateKeyNIDMap map[string]types.EventStateKeyNID
-	state          stateEntryMap
-	events         eventMap
+	state          state.StateEntryMap
+	events         state.EventMap
 }
 
 // Create implements gomatrixserverlib.AuthEvents
@@ -70,11 +101,11 @@ func (ae *authEvents) ThirdPartyInvite(stateKey string) (*gomatrixserverlib.Even
 }
 
 func (ae *authEvents) lookupEventWithEmptyStateKey(typeNID types.EventTypeNID) *gomatrixserverlib.Event {
-	eventNID, ok := ae.state.lookup(types.StateKeyTuple{typeNID, types.EmptyStateKeyNID})
+	eventNID, ok := ae.state.Lookup(types.StateKeyTuple{typeNID, types.EmptyStateKeyNID})
 	if !ok {
 		return nil
 	}
-	event, ok := ae.events.lookup(eventNID)
+	event, ok := ae.events.Lookup(eventNID)
 	if !ok {
 		return nil
 	}
@@ -86,11 +117,11 @@ func (ae *authEvents) lookupEvent(typeNID types.EventTypeNID, stateKey string) *
 	if !ok {
 		return nil
 	}
-	eventNID, ok := ae.state.lookup(types.StateKeyTuple{typeNID, stateKeyNID})
+	eventNID, ok := ae.state.Lookup(types.StateKeyTuple{typeNID, stateKeyNID})
 	if !ok {
 		return nil
 	}
-	event, ok := ae.events.lookup(eventNID)
+	event, ok := ae.events.Lookup(eventNID)
 	if !ok {
 		return nil
 	}
@@ -99,9 +130,9 @@ func (ae *authEvents) lookupEvent(typeNID types.EventTypeNID, stateKey string) *
 
 // loadAuthEvents loads the events needed for authentication from the supplied room state.
 func loadAuthEvents(
-	db RoomEventDatabase,
+	db AuthEventsDatabase,
 	needed gomatrixserverlib.StateNeeded,
-	state []types.StateEntry,
+	stateEntries []types.StateEntry,
 ) (result authEvents, err error) {
 	// Lookup the numeric IDs for the state keys needed for auth.
 	var neededStateKeys []string
@@ -112,11 +143,11 @@ func loadAuthEvents(
 	}
 
 	// Load the events we need.
-	result.state = state
+	result.state = stateEntries
 	var eventNIDs []types.EventNID
-	keyTuplesNeeded := stateKeyTuplesNeeded(result.stateKeyNIDMap, needed)
+	keyTuplesNeeded := state.StateKeyTuplesNeeded(result.stateKeyNIDMap, needed)
 	for _, keyTuple := range keyTuplesNeeded {
-		eventNID, ok := result.state.lookup(keyTuple)
+		eventNID, ok := result.state.Lookup(keyTuple)
 		if ok {
 			eventNIDs = append(eventNIDs, eventNID)
 		}
@@ -126,72 +157,3 @@ func loadAuthEvents(
 	}
 	return
 }
-
-// stateKeyTuplesNeeded works out which numeric state key tuples we need to authenticate some events.
-func stateKeyTuplesNeeded(stateKeyNIDMap map[string]types.EventStateKeyNID, stateNeeded gomatrixserverlib.StateNeeded) []types.StateKeyTuple {
-	var keyTuples []types.StateKeyTuple
-	if stateNeeded.Create {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID})
-	}
-	if stateNeeded.PowerLevels {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID})
-	}
-	if stateNeeded.JoinRules {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomJoinRulesNID, types.EmptyStateKeyNID})
-	}
-	for _, member := range stateNeeded.Member {
-		stateKeyNID, ok := stateKeyNIDMap[member]
-		if ok {
-			keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomMemberNID, stateKeyNID})
-		}
-	}
-	for _, token := range stateNeeded.ThirdPartyInvite {
-		stateKeyNID, ok := stateKeyNIDMap[token]
-		if ok {
-			keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomThirdPartyInviteNID, stateKeyNID})
-		}
-	}
-	return keyTuples
-}
-
-// Map from event type, state key tuple to numeric event ID.
-// Implemented using binary search on a sorted array.
-type stateEntryMap []types.StateEntry
-
-// lookup an entry in the event map.
-func (m stateEntryMap) lookup(stateKey types.StateKeyTuple) (eventNID types.EventNID, ok bool) {
-	// Since the list is sorted we can implement this using binary search.
-	// This is faster than using a hash map.
-	// We don't have to worry about pathological cases because the keys are fixed
-	// size and are controlled by us.
-	list := []types.StateEntry(m)
-	i := sort.Search(len(list), func(i int) bool {
-		return !list[i].StateKeyTuple.LessThan(stateKey)
-	})
-	if i < len(list) && list[i].StateKeyTuple == stateKey {
-		ok = true
-		eventNID = list[i].EventNID
-	}
-	return
-}
-
-// Map from numeric event ID to event.
-// Implemented using binary search on a sorted array.
-type eventMap []types.Event
-
-// lookup an entry in the event map.
-func (m eventMap) lookup(eventNID types.EventNID) (event *types.Event, ok bool) {
-	// Since the list is sorted we can implement this using binary search.
-	// This is faster than using a hash map.
-	// We don't have to worry about pathological cases because the keys are fixed
-	// size are controlled by us.
-	list := []types.Event(m)
-	i := sort.Search(len(list), func(i int) bool {
-		return list[i].EventNID >= eventNID
-	})
-	if i < len(list) && list[i].EventNID == eventNID {
-		ok = true
-		event = &list[i]
-	}
-	return
-}
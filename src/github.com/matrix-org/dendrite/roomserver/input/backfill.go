@@ -0,0 +1,71 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// updateBackfilledEvent links a backfilled event into the event graph for the room.
+// Backfilled events extend the event graph backwards:
+//
+//     Time goes down the page.
+//
+//        0                     Storing 1 records that 1 references its own
+//        |                     prev_events, {0}, even if 0 isn't stored yet.
+//        1 <--- backfilled
+//        |                     2 already records that it references 1.
+//        2
+//        |                     The latest events stay as {3}.
+//        3 <--- latest
+//
+// Since a backfilled event comes before the events we already have it can
+// never be one of the latest events in the room. So unlike updateLatestEvents
+// this doesn't touch the latest events or write the event to the output log.
+func updateBackfilledEvent(
+	db RoomEventDatabase, roomNID types.RoomNID, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
+	offset inputOffset,
+) (err error) {
+	// We take the same lock on the room as updateLatestEvents because the
+	// previous events table must only be modified while holding it.
+	_, _, updater, err := db.GetLatestEventsForUpdate(roomNID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			// Commit if there wasn't an error.
+			// Set the returned err value if we encounter an error committing.
+			// This only works because err is a named return.
+			err = updater.Commit()
+		} else {
+			// Ignore any error we get rolling back since we don't want to
+			// clobber the current error
+			// TODO: log the error here.
+			updater.Rollback()
+		}
+	}()
+
+	if err = doUpdateBackfilledEvent(updater, stateAtEvent, event); err != nil {
+		return
+	}
+	err = updater.SetPartitionOffset(offset.topic, offset.partition, offset.offset)
+	return
+}
+
+func doUpdateBackfilledEvent(
+	updater types.RoomRecentEventsUpdater, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
+) error {
+	if err := updater.StorePreviousEvents(stateAtEvent.EventNID, event.PrevEvents()); err != nil {
+		return err
+	}
+
+	if err := updater.SetStreamPosition(stateAtEvent.EventNID, true); err != nil {
+		return err
+	}
+
+	// Mark the event as sent so that it isn't written to the output log if
+	// the same event is later received as a new event.
+	// Readers find out about backfilled events by asking for them rather than
+	// by reading them from the output log.
+	return updater.MarkEventAsSent(stateAtEvent.EventNID)
+}
@@ -0,0 +1,86 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"testing"
+)
+
+// testBackfillUpdater is a RoomRecentEventsUpdater that records how a backfilled event is linked.
+type testBackfillUpdater struct {
+	types.RoomRecentEventsUpdater
+	// The event NID and prev_events passed to StorePreviousEvents.
+	linkedEventNID types.EventNID
+	linkedPrevIDs  []string
+	// Whether the stream position was set for a backfilled event.
+	backfilled bool
+	// The event NIDs marked as sent.
+	sent []types.EventNID
+}
+
+func (u *testBackfillUpdater) StorePreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
+	u.linkedEventNID = eventNID
+	for _, ref := range previousEventReferences {
+		u.linkedPrevIDs = append(u.linkedPrevIDs, ref.EventID)
+	}
+	return nil
+}
+
+func (u *testBackfillUpdater) SetStreamPosition(eventNID types.EventNID, backfilled bool) error {
+	u.backfilled = backfilled
+	return nil
+}
+
+func (u *testBackfillUpdater) MarkEventAsSent(eventNID types.EventNID) error {
+	u.sent = append(u.sent, eventNID)
+	return nil
+}
+
+func TestDoUpdateBackfilledEvent(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"type":"m.room.message",`+
+		`"event_id":"$one:a","room_id":"!room:a","sender":"@alice:a","depth":2,"content":{},`+
+		`"prev_events":[["$zero:a",{"sha256":"aGFzaA"}]]}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updater testBackfillUpdater
+	stateAtEvent := types.StateAtEvent{BeforeStateSnapshotNID: 1, StateEntry: types.StateEntry{EventNID: 5}}
+	if err = doUpdateBackfilledEvent(&updater, stateAtEvent, event); err != nil {
+		t.Fatal(err)
+	}
+	// The backfilled event is recorded as referencing its own prev_events.
+	if updater.linkedEventNID != 5 || len(updater.linkedPrevIDs) != 1 || updater.linkedPrevIDs[0] != "$zero:a" {
+		t.Fatalf("wanted event 5 to reference [$zero:a], got event %d referencing %v",
+			updater.linkedEventNID, updater.linkedPrevIDs)
+	}
+	if !updater.backfilled {
+		t.Fatalf("wanted the event to get a backfilled stream position")
+	}
+	if len(updater.sent) != 1 || updater.sent[0] != 5 {
+		t.Fatalf("wanted event 5 to be marked as sent, got %v", updater.sent)
+	}
+}
+
+func TestProcessRoomEventBackfillNeedsState(t *testing.T) {
+	db := &testPromotionDatabase{events: map[string]types.StateAtEvent{}}
+	input := api.InputRoomEvent{Kind: api.KindBackfill, Event: []byte(testCreateJSON)}
+	if err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs); err == nil {
+		t.Fatalf("wanted an error processing a backfilled event without state")
+	}
+	if len(db.events) != 0 {
+		t.Fatalf("wanted the backfilled event not to be stored, got %v", db.events)
+	}
+
+	input.HasState = true
+	if err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs); err != nil {
+		t.Fatal(err)
+	}
+	stateAtEvent := db.events["$create:a"]
+	if stateAtEvent.BeforeStateSnapshotNID == 0 {
+		t.Fatalf("wanted the backfilled event to have a state snapshot")
+	}
+	if len(db.linked) != 1 || len(db.sent) != 1 || len(db.output) != 0 {
+		t.Fatalf("wanted the backfilled event to be linked and marked as sent without output, got %#v", db)
+	}
+}
@@ -3,11 +3,19 @@ package input
 
 import (
 	"encoding/json"
+	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	sarama "gopkg.in/Shopify/sarama.v1"
+	"sync"
+	"time"
 )
 
+// DefaultDeadLetterRetryInterval is how long the Consumer waits before retrying a failed
+// write to the dead letter topic if DeadLetterRetryInterval isn't set.
+const DefaultDeadLetterRetryInterval = time.Second
+
 // A ConsumerDatabase has the storage APIs needed by the consumer.
 type ConsumerDatabase interface {
 	RoomEventDatabase
@@ -15,6 +23,14 @@ type ConsumerDatabase interface {
 	PartitionOffsets(topic string) ([]types.PartitionOffset, error)
 	// SetPartitionOffset records where the consumer has reached for a partition.
 	SetPartitionOffset(topic string, partition int32, offset int64) error
+	// ReadyPendingEvents returns the held events in a room that have all the events they were missing.
+	ReadyPendingEvents(roomID string) ([]types.PendingEvent, error)
+	// DeletePendingEvent removes a held event once it has been processed.
+	DeletePendingEvent(eventID string) error
+	// RoomNID looks up the numeric ID for a room. Returns 0 if the room isn't stored.
+	RoomNID(roomID string) (types.RoomNID, error)
+	// LatestEventIDs returns the latest events in a room and the state snapshot after them.
+	LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, error)
 }
 
 // An ErrorLogger handles the errors encountered by the consumer.
@@ -28,41 +44,81 @@ type ErrorLogger interface {
 // The events needed to authenticate the event should already be stored on the roomserver.
 // The events needed to construct the state at the event should already be stored on the roomserver.
 // If the event is not valid then it will be discarded and an error will be logged.
+// If a DeadLetterTopic is configured then the discarded message is also written to that topic.
+// Events are processed by a pool of workers. Events for the same room are processed in the order
+// they appear in the stream. Events for different rooms may be processed concurrently.
 type Consumer struct {
 	// A kafkaesque stream consumer providing the APIs for talking to the event source.
 	// The interface is taken from a client library for Apache Kafka.
 	// But any equivalent event streaming protocol could be made to implement the same interface.
 	Consumer sarama.Consumer
 	// The database used to store the room events.
-	DB       ConsumerDatabase
+	DB ConsumerDatabase
+	// The producer used to write messages that fail processing to the DeadLetterTopic,
+	// notices about rejected events to the RejectedEventTopic and requests for missing
+	// events to the MissingEventsTopic.
+	// New room events are written to the output log by an OutputPublisher.
 	Producer sarama.SyncProducer
 	// The kafkaesque topic to consume room events from.
 	// This is the name used in kafka to identify the stream to consume events from.
 	InputRoomEventTopic string
-	// The kafkaesque topic to output new room events to.
-	// This is the name used in kafka to identify the stream to write events to.
-	OutputRoomEventTopic string
+	// The kafkaesque topic to write input messages that fail processing to.
+	// The messages are written as api.DeadLetterInputRoomEvent structs serialised as JSON.
+	// If left empty then messages that fail processing are discarded.
+	DeadLetterTopic string
+	// How long to wait before retrying a failed write to the DeadLetterTopic.
+	// If left as 0 then DefaultDeadLetterRetryInterval is used.
+	DeadLetterRetryInterval time.Duration
+	// The kafkaesque topic to write a notice to when an event is rejected because it failed the auth checks
+	// or the signature checks.
+	// The notices are written as api.OutputEvent envelopes of type api.OutputTypeRejectedEvent serialised as JSON.
+	// If left empty then no notices are written for rejected events.
+	RejectedEventTopic string
+	// The kafkaesque topic to write a request to when a new event is held because some of its
+	// prev_events are missing. The requests are written as api.MissingEventsRequest structs
+	// serialised as JSON. If left empty then no requests are written, but the held events are
+	// still processed if the missing events arrive.
+	MissingEventsTopic string
+	// The KeyRing used to check the signatures on the room events.
+	// Events that aren't correctly signed are rejected without being stored.
+	// If left as nil then the signatures aren't checked.
+	KeyRing *KeyRing
 	// The ErrorLogger for this consumer.
-	// If left as nil then the consumer will panic when it encounters an error
+	// If left as nil then the consumer will log errors using logrus.
 	ErrorLogger ErrorLogger
-}
-
-// WriteOutputRoomEvent implements OutputRoomEventWriter
-func (c *Consumer) WriteOutputRoomEvent(output api.OutputRoomEvent) error {
-	var m sarama.ProducerMessage
-	value, err := json.Marshal(output)
-	if err != nil {
-		return err
-	}
-	m.Topic = c.OutputRoomEventTopic
-	m.Key = sarama.StringEncoder("")
-	m.Value = sarama.ByteEncoder(value)
-	_, _, err = c.Producer.SendMessage(&m)
-	return err
+	// The maximum number of state data blocks to use to encode a snapshot of room state.
+	// If left as 0 then DefaultMaxStateBlockNIDs is used.
+	MaxStateBlockNIDs int
+	// The number of workers processing room events.
+	// If left as 0 then DefaultWorkers is used.
+	Workers int
+	// The number of forward extremities a room can have before a dummy event is sent to merge them.
+	// If left as 0 then DefaultMaxForwardExtremities is used.
+	MaxForwardExtremities int
+	// The identity used to sign the dummy events. The dummy events are written to the InputRoomEventTopic.
+	// If left as nil then dummy events aren't sent, but the number of forward extremities is still tracked.
+	Signer *EventSigner
+	// How long to wait before sending another dummy event to a room after one was rejected or couldn't be built.
+	// If left as 0 then DefaultDummyEventRetryInterval is used.
+	DummyEventRetryInterval time.Duration
+	// Closed by Stop to tell the partition goroutines to stop consuming.
+	stop chan struct{}
+	// Tracks the running partition goroutines so that Stop can wait for them.
+	running sync.WaitGroup
+	// The channels used to send events to each worker.
+	workers []chan inputTask
+	// Tracks the running workers so that Stop can wait for them.
+	workersRunning sync.WaitGroup
+	// The event IDs of the dummy events that have been sent but not processed yet, indexed by room ID.
+	dummyEvents map[string]string
+	// The time a dummy event for a room was last rejected or couldn't be built, indexed by room ID.
+	dummyEventFailures map[string]time.Time
+	// Protects dummyEvents and dummyEventFailures, which are shared by the workers.
+	dummyEventsMutex sync.Mutex
 }
 
 // Start starts the consumer consuming.
-// Starts up a goroutine for each partition in the kafka stream.
+// Starts up a goroutine for each partition in the kafka stream and the workers that process the events.
 // Returns nil once all the goroutines are started.
 // Returns an error if it can't start consuming for any of the partitions.
 func (c *Consumer) Start() error {
@@ -82,8 +138,9 @@ func (c *Consumer) Start() error {
 		return err
 	}
 	for _, offset := range storedOffsets {
-		// We've already processed events from this partition so advance the offset to where we got to.
-		offsets[offset.Partition] = offset.Offset
+		// We've already processed events from this partition so start from the event after the last
+		// one we processed.
+		offsets[offset.Partition] = offset.Offset + 1
 	}
 
 	var partitionConsumers []sarama.PartitionConsumer
@@ -97,42 +154,206 @@ func (c *Consumer) Start() error {
 		}
 		partitionConsumers = append(partitionConsumers, pc)
 	}
+	c.stop = make(chan struct{})
+	c.startWorkers()
 	for _, pc := range partitionConsumers {
+		c.running.Add(1)
 		go c.consumePartition(pc)
 	}
 
 	return nil
 }
 
+// Stop stops the consumer consuming.
+// The partition goroutines stop reading messages from the stream and the
+// workers finish processing the messages that have already been read.
+// Blocks until all the partition goroutines and workers have stopped.
+// The Consumer, Producer and DB are left open so that the caller can close them.
+// Does nothing if the consumer wasn't started.
+func (c *Consumer) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	c.running.Wait()
+	c.stopWorkers()
+}
+
 // consumePartition consumes the room events for a single partition of the kafkaesque stream.
 func (c *Consumer) consumePartition(pc sarama.PartitionConsumer) {
+	defer c.running.Done()
 	defer pc.Close()
-	for message := range pc.Messages() {
-		var input api.InputRoomEvent
-		if err := json.Unmarshal(message.Value, &input); err != nil {
-			// If the message is invalid then log it and move onto the next message in the stream.
-			c.logError(message, err)
-		} else {
-			if err := processRoomEvent(c.DB, c, input); err != nil {
-				// If there was an error processing the message then log it and
-				// move onto the next message in the stream.
-				// TODO: If the error was due to a problem talking to the database
-				// then we shouldn't move onto the next message and we should either
-				// retry processing the message, or panic and kill ourselves.
-				c.logError(message, err)
+	progress := newPartitionProgress()
+	for {
+		// Check whether we've been asked to stop before waiting for a message
+		// so that we don't pick up a new message if both channels are ready.
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		select {
+		case <-c.stop:
+			return
+		case message, ok := <-pc.Messages():
+			if !ok {
+				return
 			}
+			recordConsumerLag(message.Partition, message.Offset, pc.HighWaterMarkOffset())
+			c.processMessage(progress, message)
+		}
+	}
+}
+
+// processMessage decodes a single message from the input stream and sends it to a worker to be processed.
+func (c *Consumer) processMessage(progress *partitionProgress, message *sarama.ConsumerMessage) {
+	progress.add(message.Offset)
+	var input api.InputRoomEvent
+	if err := json.Unmarshal(message.Value, &input); err != nil {
+		// If the message is invalid then log it and move onto the next message in the stream.
+		if c.failMessage(message, err) {
+			c.finishMessage(progress, message)
+		}
+		return
+	}
+	c.dispatch(inputTask{message: message, input: input, progress: progress})
+}
+
+// finishMessage records that a message has been processed.
+// If every earlier message in the partition has been processed too then it
+// advances our position in the stream so that we will start at the right position
+// after a restart. Events that update a room also commit the position along with
+// the update, this records the position for events that didn't update a room, such
+// as outliers and events that failed processing.
+func (c *Consumer) finishMessage(progress *partitionProgress, message *sarama.ConsumerMessage) {
+	processed, advanced := progress.finish(message.Offset)
+	if !advanced {
+		return
+	}
+	if err := c.DB.SetPartitionOffset(c.InputRoomEventTopic, message.Partition, processed); err != nil {
+		c.logError(message, err)
+	}
+}
+
+// maxStateBlockNIDs returns the configured maximum number of state data blocks in a snapshot.
+func (c *Consumer) maxStateBlockNIDs() int {
+	if c.MaxStateBlockNIDs == 0 {
+		return DefaultMaxStateBlockNIDs
+	}
+	return c.MaxStateBlockNIDs
+}
+
+// failMessage handles a message that couldn't be processed.
+// It logs the error and, if a dead letter topic is configured, writes the message to it.
+// If writing the message fails then it retries every DeadLetterRetryInterval until it
+// succeeds or the consumer is stopped.
+// Returns false if the message wasn't written, in which case our position in the stream
+// must not advance past the message so that it is read again after a restart.
+func (c *Consumer) failMessage(message *sarama.ConsumerMessage, err error) bool {
+	c.logError(message, err)
+	if c.DeadLetterTopic == "" {
+		return true
+	}
+	interval := c.DeadLetterRetryInterval
+	if interval == 0 {
+		interval = DefaultDeadLetterRetryInterval
+	}
+	for {
+		writeErr := c.writeDeadLetter(message, err)
+		if writeErr == nil {
+			return true
 		}
-		// Advance our position in the stream so that we will start at the right position after a restart.
-		if err := c.DB.SetPartitionOffset(c.InputRoomEventTopic, message.Partition, message.Offset); err != nil {
-			c.logError(message, err)
+		c.logError(message, writeErr)
+		select {
+		case <-c.stop:
+			return false
+		case <-time.After(interval):
 		}
 	}
 }
 
+// writeDeadLetter writes a message that couldn't be processed to the dead letter topic.
+func (c *Consumer) writeDeadLetter(message *sarama.ConsumerMessage, failure error) error {
+	value, err := json.Marshal(api.DeadLetterInputRoomEvent{
+		Error:     failure.Error(),
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Key:       message.Key,
+		Value:     message.Value,
+	})
+	if err != nil {
+		return err
+	}
+	var m sarama.ProducerMessage
+	m.Topic = c.DeadLetterTopic
+	m.Key = sarama.ByteEncoder(message.Key)
+	m.Value = sarama.ByteEncoder(value)
+	_, _, err = c.Producer.SendMessage(&m)
+	return err
+}
+
+// rejectMessage handles a message with an event that was stored but rejected because it failed the auth checks.
+// If a rejected event topic is configured then it writes a notice about the rejected event to it.
+func (c *Consumer) rejectMessage(message *sarama.ConsumerMessage, rejected *rejectedEventError) {
+	if c.RejectedEventTopic == "" {
+		return
+	}
+	value, err := json.Marshal(api.OutputEvent{
+		Version: api.OutputEventVersion,
+		Type:    api.OutputTypeRejectedEvent,
+		RejectedEvent: &api.OutputRejectedEvent{
+			Event:           rejected.event.JSON(),
+			RejectionReason: rejected.reason,
+		},
+	})
+	if err != nil {
+		c.logError(message, err)
+		return
+	}
+	var m sarama.ProducerMessage
+	m.Topic = c.RejectedEventTopic
+	m.Key = sarama.ByteEncoder(message.Key)
+	m.Value = sarama.ByteEncoder(value)
+	if _, _, err = c.Producer.SendMessage(&m); err != nil {
+		c.logError(message, err)
+	}
+}
+
+// holdMessage handles a message with a new event that was held because some of its prev_events are missing.
+// If a missing events topic is configured then it writes a request for the missing events to it.
+func (c *Consumer) holdMessage(message *sarama.ConsumerMessage, missing *missingEventsError) {
+	if c.MissingEventsTopic == "" {
+		return
+	}
+	value, err := json.Marshal(api.MissingEventsRequest{
+		RoomID:          missing.event.RoomID(),
+		EventID:         missing.event.EventID(),
+		MissingEventIDs: missing.missingEventIDs,
+	})
+	if err != nil {
+		c.logError(message, err)
+		return
+	}
+	var m sarama.ProducerMessage
+	m.Topic = c.MissingEventsTopic
+	m.Key = sarama.ByteEncoder(message.Key)
+	m.Value = sarama.ByteEncoder(value)
+	if _, _, err = c.Producer.SendMessage(&m); err != nil {
+		c.logError(message, err)
+	}
+}
+
 // logError is a convenience method for logging errors.
 func (c *Consumer) logError(message *sarama.ConsumerMessage, err error) {
 	if c.ErrorLogger == nil {
-		panic(err)
+		log.WithFields(log.Fields{
+			"topic":     message.Topic,
+			"partition": message.Partition,
+			"offset":    message.Offset,
+		}).WithError(err).Error("Error processing room event")
+		return
 	}
 	c.ErrorLogger.OnError(message, err)
 }
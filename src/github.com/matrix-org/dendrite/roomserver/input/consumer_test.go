@@ -0,0 +1,194 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"testing"
+	"time"
+)
+
+// testFlakySyncProducer is a SyncProducer that fails to send the first failures messages.
+type testFlakySyncProducer struct {
+	sarama.SyncProducer
+	failures int
+	sent     []*sarama.ProducerMessage
+}
+
+func (p *testFlakySyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if p.failures > 0 {
+		p.failures--
+		return 0, 0, fmt.Errorf("kafka is down")
+	}
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent)), nil
+}
+
+// testErrorLogger is an ErrorLogger that counts the errors.
+type testErrorLogger struct {
+	errors int
+}
+
+func (l *testErrorLogger) OnError(message *sarama.ConsumerMessage, err error) {
+	l.errors++
+}
+
+func TestFailMessageRetriesDeadLetter(t *testing.T) {
+	producer := &testFlakySyncProducer{failures: 2}
+	logger := &testErrorLogger{}
+	c := Consumer{
+		Producer: producer, DeadLetterTopic: "dead", DeadLetterRetryInterval: time.Millisecond,
+		ErrorLogger: logger, stop: make(chan struct{}),
+	}
+	message := &sarama.ConsumerMessage{
+		Topic: "input", Partition: 2, Offset: 7, Key: []byte("key"), Value: []byte("value"),
+	}
+	if !c.failMessage(message, fmt.Errorf("bad event")) {
+		t.Fatalf("wanted the message to be written to the dead letter topic")
+	}
+	// One error for the failure and one for each failed write.
+	if logger.errors != 3 {
+		t.Fatalf("wanted 3 errors to be logged, got %d", logger.errors)
+	}
+	if len(producer.sent) != 1 || producer.sent[0].Topic != "dead" {
+		t.Fatalf("wanted one message to be written to the dead letter topic, got %#v", producer.sent)
+	}
+	value, err := producer.sent[0].Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deadLetter api.DeadLetterInputRoomEvent
+	if err = json.Unmarshal(value, &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Error != "bad event" || deadLetter.Topic != "input" || deadLetter.Partition != 2 ||
+		deadLetter.Offset != 7 || string(deadLetter.Key) != "key" || string(deadLetter.Value) != "value" {
+		t.Fatalf("wrong dead letter: %#v", deadLetter)
+	}
+}
+
+func TestRejectMessageWritesEnvelope(t *testing.T) {
+	producer := &testFlakySyncProducer{}
+	c := Consumer{Producer: producer, RejectedEventTopic: "rejected"}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(testCreateJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &sarama.ConsumerMessage{Topic: "input", Key: []byte("key")}
+	c.rejectMessage(message, &rejectedEventError{event: event, reason: "not allowed"})
+
+	if len(producer.sent) != 1 || producer.sent[0].Topic != "rejected" {
+		t.Fatalf("wanted one message to be written to the rejected event topic, got %#v", producer.sent)
+	}
+	value, err := producer.sent[0].Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := api.DecodeOutputEvent(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Version != api.OutputEventVersion || output.Type != api.OutputTypeRejectedEvent || output.RejectedEvent == nil {
+		t.Fatalf("wanted a version %d rejected event, got %#v", api.OutputEventVersion, output)
+	}
+	if string(output.RejectedEvent.Event) != string(event.JSON()) || output.RejectedEvent.RejectionReason != "not allowed" {
+		t.Fatalf("wanted the rejected event and the reason, got %#v", output.RejectedEvent)
+	}
+}
+
+func TestFailMessageGivesUpWhenStopped(t *testing.T) {
+	producer := &testFlakySyncProducer{failures: 1000}
+	c := Consumer{
+		Producer: producer, DeadLetterTopic: "dead", DeadLetterRetryInterval: time.Millisecond,
+		ErrorLogger: &testErrorLogger{}, stop: make(chan struct{}),
+	}
+	close(c.stop)
+	if c.failMessage(&sarama.ConsumerMessage{}, fmt.Errorf("bad event")) {
+		t.Fatalf("wanted the message not to be written to the dead letter topic")
+	}
+}
+
+func TestFailMessageWithoutDeadLetterTopic(t *testing.T) {
+	producer := &testFlakySyncProducer{}
+	c := Consumer{Producer: producer, ErrorLogger: &testErrorLogger{}}
+	if !c.failMessage(&sarama.ConsumerMessage{}, fmt.Errorf("bad event")) {
+		t.Fatalf("wanted the message to be discarded")
+	}
+	if len(producer.sent) != 0 {
+		t.Fatalf("wanted nothing to be written, got %#v", producer.sent)
+	}
+}
+
+// testSaramaConsumer is a sarama.Consumer with a single partition that records where it was asked to start.
+type testSaramaConsumer struct {
+	sarama.Consumer
+	partition *testPartitionConsumer
+	offset    int64
+}
+
+func (c *testSaramaConsumer) Partitions(topic string) ([]int32, error) {
+	return []int32{0}, nil
+}
+
+func (c *testSaramaConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	c.offset = offset
+	return c.partition, nil
+}
+
+// testPartitionConsumer is a sarama.PartitionConsumer that never receives any messages.
+type testPartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+	closed   bool
+}
+
+func (pc *testPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return pc.messages
+}
+
+func (pc *testPartitionConsumer) Close() error {
+	pc.closed = true
+	return nil
+}
+
+// testOffsetDatabase is a ConsumerDatabase that has processed up to offset 41 of partition 0.
+type testOffsetDatabase struct {
+	ConsumerDatabase
+}
+
+func (db testOffsetDatabase) PartitionOffsets(topic string) ([]types.PartitionOffset, error) {
+	return []types.PartitionOffset{{Partition: 0, Offset: 41}}, nil
+}
+
+func TestConsumerStop(t *testing.T) {
+	// Stopping a consumer that wasn't started does nothing.
+	var notStarted Consumer
+	notStarted.Stop()
+
+	pc := &testPartitionConsumer{messages: make(chan *sarama.ConsumerMessage)}
+	saramaConsumer := &testSaramaConsumer{partition: pc}
+	c := Consumer{Consumer: saramaConsumer, DB: testOffsetDatabase{}, Workers: 2}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if saramaConsumer.offset != 42 {
+		t.Fatalf("wanted to start consuming after the stored offset at 42, got %d", saramaConsumer.offset)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the consumer to stop")
+	}
+	if !pc.closed {
+		t.Fatalf("wanted the partition consumer to be closed")
+	}
+}
@@ -1,39 +1,43 @@
 package input
 
 import (
+	"fmt"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"time"
 )
 
 // A RoomEventDatabase has the storage APIs needed to store a room event.
 type RoomEventDatabase interface {
+	state.RoomStateDatabase
 	// Stores a matrix room event in the database
+	// If the event is already stored then this returns the numeric IDs and the state snapshot
+	// stored for it. The state snapshot is 0 if the event was stored as an outlier.
 	StoreEvent(event gomatrixserverlib.Event, authEventNIDs []types.EventNID) (types.RoomNID, types.StateAtEvent, error)
 	// Lookup the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// or if the event IDs aren't in the database.
+	// Returns a types.RejectedEventError if any of the events were rejected.
 	StateEntriesForEventIDs(eventIDs []string) ([]types.StateEntry, error)
-	// Lookup the numeric IDs for a list of string event state keys.
-	// Returns a map from string state key to numeric ID for the state key.
-	EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error)
-	// Lookup the Events for a list of numeric event IDs.
-	// Returns a sorted list of events.
-	Events(eventNIDs []types.EventNID) ([]types.Event, error)
+	// Lookup the string event IDs for a list of numeric event IDs.
+	// Returns a map from numeric event ID to string event ID.
+	// Returns an error if there was a problem talking to the database
+	// or if any of the numeric event IDs aren't in the database.
+	EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error)
 	// Lookup the state of a room at each event for a list of string event IDs.
 	// Returns an error if there is an error talking to the database
 	// or if the room state for the event IDs aren't in the database
 	StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error)
-	// Lookup the numeric state data IDs for each numeric state snapshot ID
-	// The returned slice is sorted by numeric state snapshot ID.
-	StateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
-	// Lookup the state data for each numeric state data ID
-	// The returned slice is sorted by numeric state data ID.
-	StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
 	// Store the room state at an event in the database
 	AddState(roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error)
 	// Set the state at an event.
 	SetState(eventNID types.EventNID, stateNID types.StateSnapshotNID) error
+	// Take the lock on the state of a room so that the state read and stored while holding it
+	// isn't deleted by a purge of the room. Many events can hold the lock at once.
+	// Unlock must be called on the RoomStateLock if this doesn't return an error.
+	LockRoomState(roomNID types.RoomNID) (types.RoomStateLock, error)
 	// Lookup the latest events in a room in preparation for an update.
 	// The RoomRecentEventsUpdater must have Commit or Rollback called on it if this doesn't return an error.
 	// Returns the latest events in the room and the last eventID sent to the log along with an updater.
@@ -41,32 +45,130 @@ type RoomEventDatabase interface {
 	GetLatestEventsForUpdate(roomNID types.RoomNID) (
 		latestEvents []types.StateAtEventAndReference, lastEventIDSent string, updater types.RoomRecentEventsUpdater, err error,
 	)
+	// Lookup the numeric IDs for a list of string event IDs.
+	// Event IDs that aren't in the database are left out of the map.
+	EventNIDs(eventIDs []string) (map[string]types.EventNID, error)
+	// Store a redaction so that it can be applied to the event it redacts.
+	// This is a no-op if the redaction has already been stored.
+	StoreRedaction(redactionEventID, redactsEventID string, roomNID types.RoomNID) error
+	// Lookup the redactions of an event, including redactions that haven't been applied yet.
+	RedactionsForEvent(redactsEventID string) ([]types.Redaction, error)
+	// Replace the JSON stored for an event with the redacted JSON and mark the redaction as applied.
+	RedactEvent(redactionEventID string, eventNID types.EventNID, redactedJSON []byte) error
+	// Mark a stored event as rejected because it failed the auth checks.
+	// This is a no-op if the event has already been marked as rejected.
+	MarkEventRejected(eventNID types.EventNID, rejectionReason string) error
+	// Lookup which of a list of event IDs either aren't in the database or don't have state stored for them.
+	MissingEventIDs(eventIDs []string) ([]string, error)
+	// Store an input event that is waiting for the given missing events.
+	// If the event is already waiting then the list of missing events is replaced.
+	StorePendingEvent(eventID, roomID string, missingEventIDs []string, inputJSON []byte) error
 }
 
-// OutputRoomEventWriter has the APIs needed to write an event to the output logs.
-type OutputRoomEventWriter interface {
-	// Write an event.
-	WriteOutputRoomEvent(output api.OutputRoomEvent) error
+// An inputOffset is a position in a partition of the kafkaesque input stream
+// that every input event up to and including has been processed.
+// The offset is committed in the same database transaction that updates the
+// room so that the stored position and the rooms never get out of step.
+// The offset doesn't include the event being processed. If that event is read
+// again after a restart it is recognised as having already been sent.
+type inputOffset struct {
+	topic     string
+	partition int32
+	offset    int64
 }
 
-func processRoomEvent(db RoomEventDatabase, ow OutputRoomEventWriter, input api.InputRoomEvent) error {
+// processRoomEvent stores a room event and, unless it is an outlier, works out the state before it and
+// updates the latest events in the room. State snapshots are stored using at most maxStateBlockNIDs blocks.
+// If keyRing is not nil then the signatures on the event are checked before it is stored.
+func processRoomEvent(
+	db RoomEventDatabase, keyRing *KeyRing, input api.InputRoomEvent, offset inputOffset, maxStateBlockNIDs int,
+) error {
 	// Parse and validate the event JSON
 	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(input.Event)
 	if err != nil {
 		return err
 	}
 
+	if input.Kind == api.KindBackfill && !input.HasState {
+		// The prev_events of a backfilled event are usually missing so
+		// the state before it can't be worked out from them.
+		return fmt.Errorf("input: backfilled event %q must have state", event.EventID())
+	}
+
+	if keyRing != nil {
+		// Events that aren't signed by the servers that sent them are dropped
+		// without being stored.
+		if err = keyRing.VerifyEvent(event); err != nil {
+			if signatureErr, ok := err.(SignatureError); ok {
+				return &rejectedEventError{event: event, reason: signatureErr.Error()}
+			}
+			return err
+		}
+	}
+
+	if input.Kind == api.KindNew && !input.HasState {
+		// We need the state at the prev events to work out the state at a new
+		// event. If we don't have some of them then hold the event until they arrive.
+		var missingEventIDs []string
+		if missingEventIDs, err = missingPrevEvents(db, event); err != nil {
+			return err
+		}
+		if len(missingEventIDs) > 0 {
+			return holdRoomEvent(db, event, input, missingEventIDs)
+		}
+	}
+
 	// Check that the event passes authentication checks and work out the numeric IDs for the auth events.
+	start := time.Now()
 	authEventNIDs, err := checkAuthEvents(db, event, input.AuthEventIDs)
-	if err != nil {
+	observeStage(stageAuth, start)
+	notAllowed, rejected := err.(*gomatrixserverlib.NotAllowed)
+	if err != nil && !rejected {
 		return err
 	}
 
-	// Store the event
+	// Store the event.
+	// If the event was already stored as an outlier then this returns a state
+	// snapshot of 0, and the event is promoted into the contiguous event graph
+	// below by working out the state before it, linking it to its prev_events
+	// and, for new events, writing it to the output log.
+	start = time.Now()
 	roomNID, stateAtEvent, err := db.StoreEvent(event, authEventNIDs)
+	observeStage(stageStore, start)
+	if err != nil {
+		return err
+	}
+
+	if input.Kind != api.KindOutlier {
+		// Hold the lock on the state of the room until the event and the room refer
+		// to the state we work out for them, so that a purge running at the same
+		// time can't delete the state we use.
+		var stateLock types.RoomStateLock
+		if stateLock, err = db.LockRoomState(roomNID); err != nil {
+			return err
+		}
+		// Ignore any error we get unlocking since the lock is released when
+		// its transaction ends anyway.
+		defer stateLock.Unlock()
+	}
+
+	if rejected {
+		// Events that fail the auth checks are stored so that the events
+		// that come after them can still be placed in the event graph, but
+		// they are kept out of the room state and the latest events.
+		return rejectRoomEvent(db, roomNID, stateAtEvent, event, input, notAllowed, maxStateBlockNIDs)
+	}
+
+	// Apply any redactions that can be applied now the event is stored.
+	redactions, err := processRedactions(db, roomNID, stateAtEvent.EventNID, event)
 	if err != nil {
 		return err
 	}
+	if redactions.redactedBecauseEventID != "" {
+		// The event was redacted before it arrived so only the redacted
+		// form of the event should be written to the output log.
+		event = event.Redact()
+	}
 
 	if input.Kind == api.KindOutlier {
 		// For outliers we can stop after we've stored the event itself as it
@@ -75,46 +177,56 @@ func processRoomEvent(db RoomEventDatabase, ow OutputRoomEventWriter, input api.
 		return nil
 	}
 
-	if stateAtEvent.BeforeStateSnapshotNID == 0 {
-		// We haven't calculated a state for this event yet.
-		// Lets calculate one.
-		if input.HasState {
-			// We've been told what the state at the event is so we don't need to calculate it.
-			// Check that those state events are in the database and store the state.
-			entries, err := db.StateEntriesForEventIDs(input.StateEventIDs)
-			if err != nil {
-				return err
-			}
-
-			if stateAtEvent.BeforeStateSnapshotNID, err = db.AddState(roomNID, nil, entries); err != nil {
-				return nil
-			}
-		} else {
-			// We haven't been told what the state at the event is so we need to calculate it from the prev_events
-			if stateAtEvent.BeforeStateSnapshotNID, err = calculateAndStoreState(db, event, roomNID); err != nil {
-				return err
-			}
-		}
-		db.SetState(stateAtEvent.EventNID, stateAtEvent.BeforeStateSnapshotNID)
+	start = time.Now()
+	err = storeStateBeforeEvent(db, roomNID, &stateAtEvent, event, input, maxStateBlockNIDs)
+	observeStage(stageState, start)
+	if err != nil {
+		return err
 	}
 
 	if input.Kind == api.KindBackfill {
-		// Backfill is not implemented.
-		panic("Not implemented")
+		// Backfilled events are older than the events we already have so
+		// they don't change the latest events and aren't written to the
+		// output log. We only need to link them into the event graph.
+		return updateBackfilledEvent(db, roomNID, stateAtEvent, event, offset)
 	}
 
 	// Update the extremities of the event graph for the room
-	if err := updateLatestEvents(db, ow, roomNID, stateAtEvent, event); err != nil {
-		return err
+	start = time.Now()
+	err = updateLatestEvents(db, roomNID, stateAtEvent, event, redactions, offset, maxStateBlockNIDs)
+	observeStage(stageLatestEvents, start)
+	return err
+}
+
+// storeStateBeforeEvent works out the state before an event and stores it, unless we have done so already.
+// Events stored as outliers don't have state so it is worked out when they are received again as new
+// or backfilled events.
+// Updates the BeforeStateSnapshotNID of the stateAtEvent.
+func storeStateBeforeEvent(
+	db RoomEventDatabase, roomNID types.RoomNID, stateAtEvent *types.StateAtEvent, event gomatrixserverlib.Event,
+	input api.InputRoomEvent, maxStateBlockNIDs int,
+) error {
+	if stateAtEvent.BeforeStateSnapshotNID != 0 {
+		// We've already calculated a state for this event.
+		return nil
 	}
 
-	// TODO:
-	//  * Caculate the new current state for the room if the forward extremities have changed.
-	//  * Work out the delta between the new current state and the previous current state.
-	//  * Work out the visibility of the event.
-	//  * Write a message to the output logs containing:
-	//      - The event itself
-	//      - The visiblity of the event, i.e. who is allowed to see the event.
-	//      - The changes to the current state of the room.
-	return nil
+	var err error
+	if input.HasState {
+		// We've been told what the state at the event is so we don't need to calculate it.
+		// Check that those state events are in the database and weren't rejected, and store the state.
+		var entries []types.StateEntry
+		if entries, err = db.StateEntriesForEventIDs(input.StateEventIDs); err != nil {
+			return err
+		}
+		if stateAtEvent.BeforeStateSnapshotNID, err = db.AddState(roomNID, nil, entries); err != nil {
+			return err
+		}
+	} else {
+		// We haven't been told what the state at the event is so we need to calculate it from the prev_events
+		if stateAtEvent.BeforeStateSnapshotNID, err = calculateAndStoreState(db, event, roomNID, maxStateBlockNIDs); err != nil {
+			return err
+		}
+	}
+	return db.SetState(stateAtEvent.EventNID, stateAtEvent.BeforeStateSnapshotNID)
 }
@@ -0,0 +1,232 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"testing"
+)
+
+// testPromotionDatabase is a RoomEventDatabase that stores a single room in memory.
+// Only the methods needed to process an event with no prev_events or auth events are implemented.
+type testPromotionDatabase struct {
+	testRoomEventDatabase
+	// The stored events indexed by event ID.
+	events map[string]types.StateAtEvent
+	// The event NIDs that have been linked to their prev_events.
+	linked []types.EventNID
+	// The event NIDs that have been sent to the output log.
+	sent []types.EventNID
+	// The messages written to the output log.
+	output [][]byte
+}
+
+func (db *testPromotionDatabase) StateEntriesForEventIDs(eventIDs []string) ([]types.StateEntry, error) {
+	return nil, nil
+}
+
+func (db *testPromotionDatabase) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return map[string]types.EventStateKeyNID{}, nil
+}
+
+func (db *testPromotionDatabase) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
+	return nil, nil
+}
+
+func (db *testPromotionDatabase) StoreEvent(
+	event gomatrixserverlib.Event, authEventNIDs []types.EventNID,
+) (types.RoomNID, types.StateAtEvent, error) {
+	if stateAtEvent, ok := db.events[event.EventID()]; ok {
+		return 1, stateAtEvent, nil
+	}
+	stateAtEvent := types.StateAtEvent{StateEntry: types.StateEntry{
+		StateKeyTuple: types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID},
+		EventNID:      types.EventNID(len(db.events) + 1),
+	}}
+	db.events[event.EventID()] = stateAtEvent
+	return 1, stateAtEvent, nil
+}
+
+func (db *testPromotionDatabase) SetState(eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	for eventID, stateAtEvent := range db.events {
+		if stateAtEvent.EventNID == eventNID {
+			stateAtEvent.BeforeStateSnapshotNID = stateNID
+			db.events[eventID] = stateAtEvent
+		}
+	}
+	return nil
+}
+
+func (db *testPromotionDatabase) StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error) {
+	return nil, nil
+}
+
+func (db *testPromotionDatabase) EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	result := map[types.EventNID]string{}
+	for eventID, stateAtEvent := range db.events {
+		result[stateAtEvent.EventNID] = eventID
+	}
+	return result, nil
+}
+
+func (db *testPromotionDatabase) RedactionsForEvent(redactsEventID string) ([]types.Redaction, error) {
+	return nil, nil
+}
+
+func (db *testPromotionDatabase) GetLatestEventsForUpdate(roomNID types.RoomNID) (
+	[]types.StateAtEventAndReference, string, types.RoomRecentEventsUpdater, error,
+) {
+	return nil, "", &testPromotionUpdater{db: db}, nil
+}
+
+// testPromotionUpdater is a RoomRecentEventsUpdater for a testPromotionDatabase.
+type testPromotionUpdater struct {
+	types.RoomRecentEventsUpdater
+	db *testPromotionDatabase
+}
+
+func (u *testPromotionUpdater) StorePreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
+	u.db.linked = append(u.db.linked, eventNID)
+	return nil
+}
+
+func (u *testPromotionUpdater) IsReferenced(eventReference gomatrixserverlib.EventReference) (bool, error) {
+	return false, nil
+}
+
+func (u *testPromotionUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID { return 0 }
+
+func (u *testPromotionUpdater) SetLatestEvents(
+	roomNID types.RoomNID, latest []types.StateAtEventAndReference, lastEventNIDSent types.EventNID,
+	currentStateSnapshotNID types.StateSnapshotNID,
+) error {
+	return nil
+}
+
+func (u *testPromotionUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
+	for _, sent := range u.db.sent {
+		if sent == eventNID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (u *testPromotionUpdater) MarkEventAsSent(eventNID types.EventNID) error {
+	u.db.sent = append(u.db.sent, eventNID)
+	return nil
+}
+
+func (u *testPromotionUpdater) StorePendingOutput(value []byte) error {
+	u.db.output = append(u.db.output, value)
+	return nil
+}
+
+func (u *testPromotionUpdater) SetStreamPosition(eventNID types.EventNID, backfilled bool) error {
+	return nil
+}
+
+func (u *testPromotionUpdater) SetPartitionOffset(topic string, partition int32, offset int64) error {
+	return nil
+}
+
+func (u *testPromotionUpdater) Commit() error { return nil }
+
+func (u *testPromotionUpdater) Rollback() error { return nil }
+
+const testCreateJSON = `{"type":"m.room.create","event_id":"$create:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","state_key":"","depth":1,"prev_events":[],"auth_events":[],` +
+	`"content":{"creator":"@alice:a"}}`
+
+func TestProcessRoomEventPromotesOutliers(t *testing.T) {
+	db := &testPromotionDatabase{events: map[string]types.StateAtEvent{}}
+
+	outlier := api.InputRoomEvent{Kind: api.KindOutlier, Event: []byte(testCreateJSON)}
+	if err := processRoomEvent(db, nil, outlier, inputOffset{}, DefaultMaxStateBlockNIDs); err != nil {
+		t.Fatal(err)
+	}
+	if db.events["$create:a"].BeforeStateSnapshotNID != 0 || len(db.linked) != 0 || len(db.output) != 0 {
+		t.Fatalf("Wanted the outlier to be stored without state, got %#v", db)
+	}
+
+	// The same event is received again as a new event.
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testCreateJSON)}
+	if err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs); err != nil {
+		t.Fatal(err)
+	}
+	stateAtEvent := db.events["$create:a"]
+	if stateAtEvent.BeforeStateSnapshotNID == 0 {
+		t.Fatalf("Wanted the promoted event to have a state snapshot")
+	}
+	if len(db.linked) != 1 || db.linked[0] != stateAtEvent.EventNID {
+		t.Fatalf("Wanted the promoted event to be linked into the event graph, got %v", db.linked)
+	}
+	if len(db.output) != 1 {
+		t.Fatalf("Wanted the promoted event to be written to the output log, got %d messages", len(db.output))
+	}
+	envelope, err := api.DecodeOutputEvent(db.output[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != api.OutputTypeNewRoomEvent || envelope.Version != api.OutputEventVersion {
+		t.Fatalf("Wanted a version %d new room event, got %#v", api.OutputEventVersion, envelope)
+	}
+	output := envelope.NewRoomEvent
+	if len(output.LatestEventIDs) != 1 || output.LatestEventIDs[0] != "$create:a" {
+		t.Fatalf("Wanted the latest events to be [$create:a], got %v", output.LatestEventIDs)
+	}
+	if len(output.AddsStateEventIDs) != 1 || output.AddsStateEventIDs[0] != "$create:a" {
+		t.Fatalf("Wanted the promoted event to be added to the room state, got %v", output.AddsStateEventIDs)
+	}
+}
+
+// testStateLockDatabase is a testPromotionDatabase that checks that state is only stored
+// while the lock on the state of the room is held.
+type testStateLockDatabase struct {
+	testPromotionDatabase
+	// The number of locks currently held.
+	locks int
+	// Whether state was stored without holding the lock.
+	unlockedAddState bool
+}
+
+func (db *testStateLockDatabase) LockRoomState(roomNID types.RoomNID) (types.RoomStateLock, error) {
+	db.locks++
+	return &testCountedStateLock{db}, nil
+}
+
+func (db *testStateLockDatabase) AddState(
+	roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	if db.locks == 0 {
+		db.unlockedAddState = true
+	}
+	return db.testPromotionDatabase.AddState(roomNID, stateBlockNIDs, state)
+}
+
+type testCountedStateLock struct {
+	db *testStateLockDatabase
+}
+
+func (l *testCountedStateLock) Unlock() error {
+	l.db.locks--
+	return nil
+}
+
+func TestProcessRoomEventHoldsStateLock(t *testing.T) {
+	db := &testStateLockDatabase{testPromotionDatabase: testPromotionDatabase{events: map[string]types.StateAtEvent{}}}
+
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testCreateJSON)}
+	if err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs); err != nil {
+		t.Fatal(err)
+	}
+	if db.events["$create:a"].BeforeStateSnapshotNID == 0 {
+		t.Fatalf("Wanted the event to have a state snapshot")
+	}
+	if db.unlockedAddState {
+		t.Fatalf("Wanted the state to be stored while holding the lock on the room state")
+	}
+	if db.locks != 0 {
+		t.Fatalf("Wanted the lock on the room state to be released, %d locks are still held", db.locks)
+	}
+}
@@ -0,0 +1,346 @@
+package input
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ed25519"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"time"
+)
+
+// DefaultMaxForwardExtremities is the number of forward extremities a room can have before
+// the Consumer sends a dummy event to merge them if MaxForwardExtremities isn't set.
+const DefaultMaxForwardExtremities = 10
+
+// DefaultDummyEventRetryInterval is how long the Consumer waits before sending another dummy event to a
+// room after one wasn't processed or couldn't be built if DummyEventRetryInterval isn't set.
+const DefaultDummyEventRetryInterval = time.Hour
+
+// mDummyEvent is the event type of the dummy events sent to merge forward extremities.
+const mDummyEvent = "org.matrix.dummy_event"
+
+// This isn't labelled by room since there is no bound on the number of rooms.
+var forwardExtremitiesHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "dendrite",
+	Subsystem: "roomserver",
+	Name:      "forward_extremities",
+	Help: "The number of forward extremities, or latest events, in a room, " +
+		"observed each time an event in the room is processed.",
+	Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+})
+
+func init() {
+	prometheus.MustRegister(forwardExtremitiesHistogram)
+}
+
+// An EventSigner is the identity the roomserver uses to sign the events it creates itself.
+type EventSigner struct {
+	// The name of this matrix server.
+	ServerName string
+	// The ID of the key used to sign the events, e.g. "ed25519:auto".
+	KeyID string
+	// The ed25519 private key used to sign the events.
+	PrivateKey ed25519.PrivateKey
+}
+
+// pruneForwardExtremities records the number of forward extremities in a room and the number of state
+// blocks in its current state snapshot. If the room has too many forward extremities, it writes a dummy
+// event that references all of them to the input log. Once the dummy event is processed the room has
+// a single forward extremity, so later events don't need to resolve the state across all of them.
+// Only one dummy event is sent at a time for each room so that we don't send another while the first
+// is still waiting in the input log. If a dummy event isn't processed, or none of our users can send one,
+// then we wait for DummyEventRetryInterval before trying again so that we don't keep sending dummy
+// events that will be rejected.
+func (c *Consumer) pruneForwardExtremities(task inputTask, roomID string) {
+	if c.hasPendingDummyEvent(roomID) {
+		// We are still waiting for the dummy event we sent to be processed.
+		return
+	}
+
+	roomNID, err := c.DB.RoomNID(roomID)
+	if err != nil {
+		c.logError(task.message, err)
+		return
+	}
+	if roomNID == 0 {
+		// The room isn't stored, which can happen if the event failed processing.
+		return
+	}
+	latest, currentStateNID, err := c.DB.LatestEventIDs(roomNID)
+	if err != nil {
+		c.logError(task.message, err)
+		return
+	}
+	forwardExtremitiesHistogram.Observe(float64(len(latest)))
+	if currentStateNID != 0 {
+		var stateBlockNIDLists []types.StateBlockNIDList
+		if stateBlockNIDLists, err = c.DB.StateBlockNIDs([]types.StateSnapshotNID{currentStateNID}); err != nil {
+			c.logError(task.message, err)
+			return
+		}
+		if len(stateBlockNIDLists) == 1 {
+			stateBlocksHistogram.Observe(float64(len(stateBlockNIDLists[0].StateBlockNIDs)))
+		}
+	}
+
+	if c.Signer == nil || len(latest) <= c.maxForwardExtremities() || c.dummyEventsDelayed(roomID) {
+		return
+	}
+	dummy, err := buildDummyEvent(c.DB, c.Signer, roomID, latest, currentStateNID)
+	if err != nil {
+		c.dummyEventFailed(roomID)
+		c.logError(task.message, err)
+		return
+	}
+	value, err := json.Marshal(dummy)
+	if err != nil {
+		c.logError(task.message, err)
+		return
+	}
+	var m sarama.ProducerMessage
+	m.Topic = c.InputRoomEventTopic
+	m.Key = sarama.ByteEncoder(task.message.Key)
+	m.Value = sarama.ByteEncoder(value)
+	if _, _, err = c.Producer.SendMessage(&m); err != nil {
+		c.logError(task.message, err)
+		return
+	}
+	c.startDummyEvent(roomID, eventIDForInput(dummy))
+}
+
+// maxForwardExtremities returns the configured maximum number of forward extremities in a room.
+func (c *Consumer) maxForwardExtremities() int {
+	if c.MaxForwardExtremities == 0 {
+		return DefaultMaxForwardExtremities
+	}
+	return c.MaxForwardExtremities
+}
+
+// startDummyEvent records that a dummy event has been sent for a room.
+func (c *Consumer) startDummyEvent(roomID, eventID string) {
+	c.dummyEventsMutex.Lock()
+	defer c.dummyEventsMutex.Unlock()
+	if c.dummyEvents == nil {
+		c.dummyEvents = map[string]string{}
+	}
+	c.dummyEvents[roomID] = eventID
+}
+
+// hasPendingDummyEvent returns whether a dummy event sent for a room hasn't been processed yet.
+func (c *Consumer) hasPendingDummyEvent(roomID string) bool {
+	c.dummyEventsMutex.Lock()
+	defer c.dummyEventsMutex.Unlock()
+	_, ok := c.dummyEvents[roomID]
+	return ok
+}
+
+// finishDummyEvent records that an event has finished processing, whether it was processed,
+// rejected, held or failed. If it was the dummy event sent for its room then the room no longer
+// has a pending dummy event, and if the dummy event wasn't processed we wait before sending another.
+func (c *Consumer) finishDummyEvent(roomID, eventID string, processed bool) {
+	c.dummyEventsMutex.Lock()
+	defer c.dummyEventsMutex.Unlock()
+	if pending, ok := c.dummyEvents[roomID]; !ok || pending != eventID {
+		return
+	}
+	delete(c.dummyEvents, roomID)
+	if !processed {
+		c.recordDummyEventFailure(roomID)
+	}
+}
+
+// dummyEventFailed records that we couldn't build a dummy event for a room.
+func (c *Consumer) dummyEventFailed(roomID string) {
+	c.dummyEventsMutex.Lock()
+	defer c.dummyEventsMutex.Unlock()
+	c.recordDummyEventFailure(roomID)
+}
+
+// recordDummyEventFailure records the time a dummy event for a room failed.
+// The dummyEventsMutex must be held.
+func (c *Consumer) recordDummyEventFailure(roomID string) {
+	if c.dummyEventFailures == nil {
+		c.dummyEventFailures = map[string]time.Time{}
+	}
+	c.dummyEventFailures[roomID] = time.Now()
+}
+
+// dummyEventsDelayed returns whether we are waiting before sending another dummy event
+// to a room because the last one failed.
+func (c *Consumer) dummyEventsDelayed(roomID string) bool {
+	c.dummyEventsMutex.Lock()
+	defer c.dummyEventsMutex.Unlock()
+	failed, ok := c.dummyEventFailures[roomID]
+	if !ok {
+		return false
+	}
+	interval := c.DummyEventRetryInterval
+	if interval == 0 {
+		interval = DefaultDummyEventRetryInterval
+	}
+	if time.Since(failed) < interval {
+		return true
+	}
+	delete(c.dummyEventFailures, roomID)
+	return false
+}
+
+// buildDummyEvent builds a dummy event that references each of the latest events in a room.
+// The event is sent by one of the users on this server that is joined to the room and has enough
+// power to send it, and is signed by the EventSigner. Returns an error if none of our users that
+// are joined to the room can send the event.
+func buildDummyEvent(
+	db RoomEventDatabase, signer *EventSigner, roomID string,
+	latest []gomatrixserverlib.EventReference, currentStateNID types.StateSnapshotNID,
+) (api.InputRoomEvent, error) {
+	entries, err := state.LoadStateAtSnapshot(db, currentStateNID)
+	if err != nil {
+		return api.InputRoomEvent{}, err
+	}
+
+	// Find the auth events, and the member events so that we can pick a user to send the event.
+	var authNIDs, memberNIDs []types.EventNID
+	for _, entry := range entries {
+		switch {
+		case entry.EventTypeNID == types.MRoomMemberNID:
+			memberNIDs = append(memberNIDs, entry.EventNID)
+		case entry.EventStateKeyNID != types.EmptyStateKeyNID:
+			// The other auth events all have an empty state key.
+		case entry.EventTypeNID == types.MRoomCreateNID, entry.EventTypeNID == types.MRoomPowerLevelsNID:
+			authNIDs = append(authNIDs, entry.EventNID)
+		}
+	}
+	members, err := db.Events(memberNIDs)
+	if err != nil {
+		return api.InputRoomEvent{}, err
+	}
+	roomAuthEvents, err := db.Events(authNIDs)
+	if err != nil {
+		return api.InputRoomEvent{}, err
+	}
+
+	// The dummy event must be deeper than any of the events it references.
+	depth, err := maxDepth(db, latest)
+	if err != nil {
+		return api.InputRoomEvent{}, err
+	}
+
+	joined := false
+	for _, member := range members {
+		if !isLocalJoin(member.Event, signer.ServerName) {
+			continue
+		}
+		joined = true
+		var event gomatrixserverlib.Event
+		if event, err = buildDummyEventAs(signer, roomID, latest, depth, member, roomAuthEvents); err != nil {
+			return api.InputRoomEvent{}, err
+		}
+		// Check the event against the auth rules so that we pick a user with enough power to send it.
+		var allowedBy authEvents
+		stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event})
+		if allowedBy, err = loadAuthEvents(db, stateNeeded, entries); err != nil {
+			return api.InputRoomEvent{}, err
+		}
+		err = gomatrixserverlib.Allowed(event, &allowedBy)
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+			continue
+		}
+		if err != nil {
+			return api.InputRoomEvent{}, err
+		}
+		authEventIDs := make([]string, 0, len(roomAuthEvents)+1)
+		for _, authEvent := range append(roomAuthEvents, member) {
+			authEventIDs = append(authEventIDs, authEvent.EventID())
+		}
+		return api.InputRoomEvent{Kind: api.KindNew, Event: event.JSON(), AuthEventIDs: authEventIDs}, nil
+	}
+	if !joined {
+		return api.InputRoomEvent{}, fmt.Errorf("input: none of our users are joined to %s", roomID)
+	}
+	return api.InputRoomEvent{}, fmt.Errorf("input: none of our users in %s have enough power to send a dummy event", roomID)
+}
+
+// buildDummyEventAs builds and signs a dummy event sent by the user of an m.room.member event.
+func buildDummyEventAs(
+	signer *EventSigner, roomID string, latest []gomatrixserverlib.EventReference, depth int64,
+	sender types.Event, authEvents []types.Event,
+) (gomatrixserverlib.Event, error) {
+	authRefs := make([]gomatrixserverlib.EventReference, 0, len(authEvents)+1)
+	for _, authEvent := range append(authEvents, sender) {
+		authRefs = append(authRefs, authEvent.EventReference())
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     *sender.StateKey(),
+		RoomID:     roomID,
+		Type:       mDummyEvent,
+		PrevEvents: latest,
+		AuthEvents: authRefs,
+		Depth:      depth + 1,
+	}
+	if err := builder.SetContent(struct{}{}); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if err := builder.SetUnsigned(struct{}{}); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	eventID, err := newEventID(signer.ServerName)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	return builder.Build(eventID, time.Now(), signer.ServerName, signer.KeyID, signer.PrivateKey)
+}
+
+// isLocalJoin returns whether an m.room.member event is a user on the given server joining the room.
+func isLocalJoin(event gomatrixserverlib.Event, serverName string) bool {
+	stateKey := event.StateKey()
+	if stateKey == nil {
+		return false
+	}
+	if userServerName, err := serverNameFromID(*stateKey); err != nil || userServerName != serverName {
+		return false
+	}
+	return membership(event) == "join"
+}
+
+// maxDepth returns the largest depth of the given events.
+func maxDepth(db RoomEventDatabase, refs []gomatrixserverlib.EventReference) (int64, error) {
+	eventIDs := make([]string, len(refs))
+	for i := range refs {
+		eventIDs[i] = refs[i].EventID
+	}
+	eventNIDMap, err := db.EventNIDs(eventIDs)
+	if err != nil {
+		return 0, err
+	}
+	var eventNIDs []types.EventNID
+	for _, eventNID := range eventNIDMap {
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	events, err := db.Events(eventNIDs)
+	if err != nil {
+		return 0, err
+	}
+	var depth int64
+	for _, event := range events {
+		if event.Depth() > depth {
+			depth = event.Depth()
+		}
+	}
+	return depth, nil
+}
+
+// newEventID returns a new random event ID for an event created by the given server.
+func newEventID(serverName string) (string, error) {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return "$" + base64.RawURLEncoding.EncodeToString(random) + ":" + serverName, nil
+}
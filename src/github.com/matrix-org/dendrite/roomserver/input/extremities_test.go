@@ -0,0 +1,172 @@
+package input
+
+import (
+	"crypto/rand"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testExtremitiesDatabase is a RoomEventDatabase that stores events and state in memory.
+// Only the methods needed by buildDummyEvent are implemented.
+type testExtremitiesDatabase struct {
+	testRoomEventDatabase
+	events map[types.EventNID]gomatrixserverlib.Event
+}
+
+func (db *testExtremitiesDatabase) storeEvent(t *testing.T, eventNID types.EventNID, eventJSON string) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events[eventNID] = event
+}
+
+func (db *testExtremitiesDatabase) EventNIDs(eventIDs []string) (map[string]types.EventNID, error) {
+	result := map[string]types.EventNID{}
+	for eventNID, event := range db.events {
+		for _, eventID := range eventIDs {
+			if event.EventID() == eventID {
+				result[eventID] = eventNID
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testExtremitiesDatabase) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	stateKeyNIDs := map[string]types.EventStateKeyNID{"": 1, "@bob:b": 2, "@carol:a": 3, "@alice:a": 4, "@dave:a": 5}
+	result := map[string]types.EventStateKeyNID{}
+	for _, eventStateKey := range eventStateKeys {
+		if eventStateKeyNID, ok := stateKeyNIDs[eventStateKey]; ok {
+			result[eventStateKey] = eventStateKeyNID
+		}
+	}
+	return result, nil
+}
+
+func (db *testExtremitiesDatabase) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventNID := range eventNIDs {
+		if event, ok := db.events[eventNID]; ok {
+			result = append(result, types.Event{EventNID: eventNID, Event: event})
+		}
+	}
+	return result, nil
+}
+
+func TestBuildDummyEvent(t *testing.T) {
+	db := &testExtremitiesDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}}
+	db.storeEvent(t, 1, `{"type":"m.room.create","event_id":"$create:b","room_id":"!room:b","sender":"@bob:b",`+
+		`"state_key":"","depth":1,"prev_events":[],"content":{"creator":"@bob:b"}}`)
+	db.storeEvent(t, 2, `{"type":"m.room.power_levels","event_id":"$power:b","room_id":"!room:b","sender":"@bob:b",`+
+		`"state_key":"","depth":3,"prev_events":[],"content":{"event_default":50,"users":{"@bob:b":100,"@dave:a":50}}}`)
+	db.storeEvent(t, 3, `{"type":"m.room.member","event_id":"$bob:b","room_id":"!room:b","sender":"@bob:b",`+
+		`"state_key":"@bob:b","depth":2,"prev_events":[],"content":{"membership":"join"}}`)
+	db.storeEvent(t, 4, `{"type":"m.room.member","event_id":"$carol:a","room_id":"!room:b","sender":"@carol:a",`+
+		`"state_key":"@carol:a","depth":4,"prev_events":[],"content":{"membership":"leave"}}`)
+	db.storeEvent(t, 5, `{"type":"m.room.member","event_id":"$alice:a","room_id":"!room:b","sender":"@alice:a",`+
+		`"state_key":"@alice:a","depth":5,"prev_events":[],"content":{"membership":"join"}}`)
+	db.storeEvent(t, 8, `{"type":"m.room.member","event_id":"$dave:a","room_id":"!room:b","sender":"@dave:a",`+
+		`"state_key":"@dave:a","depth":6,"prev_events":[],"content":{"membership":"join"}}`)
+	db.storeEvent(t, 6, `{"type":"m.room.message","event_id":"$fork1:b","room_id":"!room:b","sender":"@bob:b",`+
+		`"depth":7,"prev_events":[],"content":{}}`)
+	db.storeEvent(t, 7, `{"type":"m.room.message","event_id":"$fork2:a","room_id":"!room:b","sender":"@alice:a",`+
+		`"depth":9,"prev_events":[],"content":{}}`)
+
+	entries := []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1},
+		{types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID}, 2},
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 3},
+		{types.StateKeyTuple{types.MRoomMemberNID, 3}, 4},
+		{types.StateKeyTuple{types.MRoomMemberNID, 4}, 5},
+		{types.StateKeyTuple{types.MRoomMemberNID, 5}, 8},
+	}
+	stateNID, _ := db.AddState(1, nil, entries)
+	latest := []gomatrixserverlib.EventReference{
+		db.events[6].EventReference(), db.events[7].EventReference(),
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &EventSigner{ServerName: "a", KeyID: "ed25519:test", PrivateKey: privateKey}
+
+	input, err := buildDummyEvent(db, signer, "!room:b", latest, stateNID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(input.Event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = event.Verify("a", "ed25519:test", publicKey); err != nil {
+		t.Fatal(err)
+	}
+	// @alice:a is joined but doesn't have enough power to send the event.
+	if event.Type() != mDummyEvent || event.Sender() != "@dave:a" || event.Depth() != 10 {
+		t.Fatalf("Wanted a dummy event from @dave:a with depth 10, got %s", string(event.JSON()))
+	}
+	if prevEvents := event.PrevEvents(); len(prevEvents) != 2 ||
+		prevEvents[0].EventID != "$fork1:b" || prevEvents[1].EventID != "$fork2:a" {
+		t.Fatalf("Wanted the dummy event to reference the latest events, got %v", prevEvents)
+	}
+	sort.Strings(input.AuthEventIDs)
+	want := []string{"$create:b", "$dave:a", "$power:b"}
+	if len(input.AuthEventIDs) != len(want) {
+		t.Fatalf("Wanted auth events %v, got %v", want, input.AuthEventIDs)
+	}
+	for i := range want {
+		if input.AuthEventIDs[i] != want[i] {
+			t.Fatalf("Wanted auth events %v, got %v", want, input.AuthEventIDs)
+		}
+	}
+
+	// None of our joined users have enough power to send the event.
+	db.storeEvent(t, 8, `{"type":"m.room.member","event_id":"$dave:a","room_id":"!room:b","sender":"@dave:a",`+
+		`"state_key":"@dave:a","depth":6,"prev_events":[],"content":{"membership":"leave"}}`)
+	if _, err = buildDummyEvent(db, signer, "!room:b", latest, stateNID); err == nil {
+		t.Fatalf("Wanted an error when none of our users have enough power to send the event")
+	}
+
+	// None of our users are joined to the room.
+	signer.ServerName = "c"
+	if _, err = buildDummyEvent(db, signer, "!room:b", latest, stateNID); err == nil {
+		t.Fatalf("Wanted an error when none of our users are joined to the room")
+	}
+}
+
+func TestDummyEventsDelayedAfterRejection(t *testing.T) {
+	c := &Consumer{}
+	c.startDummyEvent("!room:a", "$dummy:a")
+
+	// Other events being rejected don't delay the dummy events.
+	c.finishDummyEvent("!room:a", "$other:a", false)
+	if c.dummyEventsDelayed("!room:a") {
+		t.Fatalf("Wanted dummy events not to be delayed when another event was rejected")
+	}
+	if !c.hasPendingDummyEvent("!room:a") {
+		t.Fatalf("Wanted the dummy event to still be pending when another event was rejected")
+	}
+
+	c.finishDummyEvent("!room:a", "$dummy:a", false)
+	if c.hasPendingDummyEvent("!room:a") {
+		t.Fatalf("Wanted the dummy event not to be pending after it was rejected")
+	}
+	if !c.dummyEventsDelayed("!room:a") {
+		t.Fatalf("Wanted dummy events to be delayed after the dummy event was rejected")
+	}
+	if c.dummyEventsDelayed("!other:a") {
+		t.Fatalf("Wanted dummy events for other rooms not to be delayed")
+	}
+
+	c.DummyEventRetryInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if c.dummyEventsDelayed("!room:a") {
+		t.Fatalf("Wanted dummy events not to be delayed after the retry interval")
+	}
+}
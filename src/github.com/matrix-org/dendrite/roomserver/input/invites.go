@@ -0,0 +1,82 @@
+package input
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// inviteOutput works out the invites that were added to and retired from the
+// current state of a room from the state entries removed from and added to it.
+// Returns an api.OutputEvent for each new invite and for each retired invite.
+func inviteOutput(db RoomEventDatabase, removed, added []types.StateEntry) ([]api.OutputEvent, error) {
+	var eventNIDs []types.EventNID
+	for _, entry := range removed {
+		if entry.EventTypeNID == types.MRoomMemberNID {
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
+	}
+	for _, entry := range added {
+		if entry.EventTypeNID == types.MRoomMemberNID {
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
+	}
+	if len(eventNIDs) == 0 {
+		return nil, nil
+	}
+	events, err := db.Events(eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	eventMap := make(map[types.EventNID]gomatrixserverlib.Event, len(events))
+	for _, event := range events {
+		eventMap[event.EventNID] = event.Event
+	}
+
+	// The member events added to the state indexed by state key NID so that we can
+	// tell which event replaced a retired invite.
+	addedMembers := map[types.EventStateKeyNID]gomatrixserverlib.Event{}
+	for _, entry := range added {
+		if event, ok := eventMap[entry.EventNID]; ok && entry.EventTypeNID == types.MRoomMemberNID {
+			addedMembers[entry.EventStateKeyNID] = event
+		}
+	}
+
+	var result []api.OutputEvent
+	for _, entry := range removed {
+		event, ok := eventMap[entry.EventNID]
+		if !ok || entry.EventTypeNID != types.MRoomMemberNID || membership(event) != "invite" {
+			continue
+		}
+		retired := api.OutputRetireInviteEvent{EventID: event.EventID(), TargetUserID: *event.StateKey()}
+		if replacement, ok := addedMembers[entry.EventStateKeyNID]; ok {
+			retired.RetiredByEventID = replacement.EventID()
+			retired.Membership = membership(replacement)
+		}
+		result = append(result, api.OutputEvent{Type: api.OutputTypeRetireInviteEvent, RetireInviteEvent: &retired})
+	}
+	for _, entry := range added {
+		event, ok := eventMap[entry.EventNID]
+		if !ok || entry.EventTypeNID != types.MRoomMemberNID || membership(event) != "invite" {
+			continue
+		}
+		result = append(result, api.OutputEvent{
+			Type:           api.OutputTypeNewInviteEvent,
+			NewInviteEvent: &api.OutputNewInviteEvent{Event: event.JSON()},
+		})
+	}
+	return result, nil
+}
+
+// membership returns the membership in the content of an m.room.member event,
+// or the empty string if the content can't be parsed.
+func membership(event gomatrixserverlib.Event) string {
+	var content struct {
+		Membership string `json:"membership"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return ""
+	}
+	return content.Membership
+}
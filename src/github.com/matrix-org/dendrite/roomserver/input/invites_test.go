@@ -0,0 +1,55 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"testing"
+)
+
+func TestInviteOutput(t *testing.T) {
+	db := &testExtremitiesDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}}
+	db.storeEvent(t, 1, `{"type":"m.room.member","event_id":"$invite-bob:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"state_key":"@bob:b","depth":3,"prev_events":[],"content":{"membership":"invite"}}`)
+	db.storeEvent(t, 2, `{"type":"m.room.member","event_id":"$join-bob:b","room_id":"!room:a","sender":"@bob:b",`+
+		`"state_key":"@bob:b","depth":4,"prev_events":[],"content":{"membership":"join"}}`)
+	db.storeEvent(t, 3, `{"type":"m.room.member","event_id":"$invite-carol:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"state_key":"@carol:c","depth":4,"prev_events":[],"content":{"membership":"invite"}}`)
+	db.storeEvent(t, 4, `{"type":"m.room.member","event_id":"$leave-dan:d","room_id":"!room:a","sender":"@dan:d",`+
+		`"state_key":"@dan:d","depth":4,"prev_events":[],"content":{"membership":"leave"}}`)
+
+	removed := []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 1},
+	}
+	added := []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 2},
+		{types.StateKeyTuple{types.MRoomMemberNID, 3}, 3},
+		{types.StateKeyTuple{types.MRoomMemberNID, 4}, 4},
+	}
+	output, err := inviteOutput(db, removed, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output) != 2 {
+		t.Fatalf("Wanted 2 output events, got %d", len(output))
+	}
+
+	retired := output[0].RetireInviteEvent
+	if output[0].Type != api.OutputTypeRetireInviteEvent || retired == nil {
+		t.Fatalf("Wanted the first output event to retire an invite, got %#v", output[0])
+	}
+	want := api.OutputRetireInviteEvent{
+		EventID: "$invite-bob:a", TargetUserID: "@bob:b", RetiredByEventID: "$join-bob:b", Membership: "join",
+	}
+	if *retired != want {
+		t.Fatalf("Wanted %#v, got %#v", want, *retired)
+	}
+
+	invite := output[1].NewInviteEvent
+	if output[1].Type != api.OutputTypeNewInviteEvent || invite == nil {
+		t.Fatalf("Wanted the second output event to be a new invite, got %#v", output[1])
+	}
+	if string(invite.Event) != string(db.events[3].JSON()) {
+		t.Fatalf("Wanted the invite for @carol:c, got %s", string(invite.Event))
+	}
+}
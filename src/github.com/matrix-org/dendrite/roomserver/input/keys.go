@@ -0,0 +1,300 @@
+package input
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A KeyDatabase has the storage APIs needed to cache the signing keys of other matrix servers.
+type KeyDatabase interface {
+	// Lookup the stored keys for a server.
+	ServerKeys(serverName string) ([]types.ServerKey, error)
+	// Store the keys for a server, replacing any stored keys with the same key IDs.
+	StoreServerKeys(keys []types.ServerKey) error
+}
+
+// A KeyFetcher fetches the signing keys that a matrix server publishes.
+type KeyFetcher interface {
+	// Fetch the keys for a server.
+	// Returns the state of the TLS connection the keys were fetched over so that the
+	// TLS fingerprints listed in the keys can be checked, or nil if there wasn't one.
+	FetchKeys(serverName string) (*gomatrixserverlib.ServerKeys, *tls.ConnectionState, error)
+}
+
+// defaultFederationPort is the port a matrix server listens on for federation
+// requests if the server name doesn't include a port.
+const defaultFederationPort = "8448"
+
+// DefaultKeyFetchTimeout is how long the DirectKeyFetcher waits for a server to
+// send its keys if Timeout isn't set.
+const DefaultKeyFetchTimeout = 30 * time.Second
+
+// A DirectKeyFetcher fetches the keys directly from the server in the same way as
+// gomatrixserverlib.FetchKeysDirect, but gives up if the server doesn't respond in time.
+// TODO: Lookup the SRV records for the server name.
+type DirectKeyFetcher struct {
+	// How long to wait for the whole request, including connecting to the server.
+	// If this is 0 then DefaultKeyFetchTimeout is used.
+	Timeout time.Duration
+}
+
+// FetchKeys implements KeyFetcher
+func (f DirectKeyFetcher) FetchKeys(serverName string) (*gomatrixserverlib.ServerKeys, *tls.ConnectionState, error) {
+	host, port, err := net.SplitHostPort(serverName)
+	if err != nil {
+		// The server name doesn't include a port.
+		host, port = strings.Trim(serverName, "[]"), defaultFederationPort
+	}
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = DefaultKeyFetchTimeout
+	}
+
+	tcpconn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tcpconn.Close()
+	// The deadline covers the TLS handshake and reading the response as well as connecting.
+	if err = tcpconn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	tlsconn := tls.Client(tcpconn, &tls.Config{
+		ServerName: host,
+		// The certificate is checked against the tls_fingerprints in the keys instead.
+		InsecureSkipVerify: true,
+	})
+	if err = tlsconn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	connectionState := tlsconn.ConnectionState()
+
+	request, err := http.NewRequest("GET", "matrix://"+serverName+"/_matrix/key/v2/server", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Connection", "close")
+	if err = request.Write(tlsconn); err != nil {
+		return nil, nil, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(tlsconn), request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("input: %d fetching the keys for %s", response.StatusCode, serverName)
+	}
+	var keys gomatrixserverlib.ServerKeys
+	if keys.Raw, err = ioutil.ReadAll(response.Body); err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(keys.Raw, &keys); err != nil {
+		return nil, nil, err
+	}
+	return &keys, &connectionState, nil
+}
+
+// A SignatureError is returned by KeyRing.VerifyEvent when an event isn't correctly signed.
+type SignatureError string
+
+func (e SignatureError) Error() string { return string(e) }
+
+// A KeyRing checks the signatures on events using the keys of the servers that signed them.
+// The keys are stored in the database once they have been fetched and checked so that they
+// don't need to be fetched for every event. They are fetched again once they expire.
+// If the keys for a server can't be fetched then we don't try to fetch them again
+// until FetchRetryInterval has passed, so that a server that is down doesn't hold up
+// every event from it.
+type KeyRing struct {
+	// The database used to store the keys.
+	DB KeyDatabase
+	// The KeyFetcher used to fetch keys we don't have.
+	Fetcher KeyFetcher
+	// How long to wait after failing to fetch the keys for a server before trying again.
+	// If this is 0 then DefaultKeyFetchRetryInterval is used.
+	FetchRetryInterval time.Duration
+
+	failedFetchesMutex sync.Mutex
+	// The time we last failed to fetch the keys for each server, indexed by server name.
+	failedFetches map[string]time.Time
+}
+
+// DefaultKeyFetchRetryInterval is how long the KeyRing waits after failing to fetch
+// the keys for a server before trying again if FetchRetryInterval isn't set.
+const DefaultKeyFetchRetryInterval = time.Minute
+
+// VerifyEvent checks that an event is signed by the server of its sender and by the server
+// that created its event ID.
+// Returns a SignatureError if the event isn't correctly signed. Returns some other error
+// if we don't have the keys needed to check the signatures and can't fetch them.
+// The content hashes aren't checked here because gomatrixserverlib.NewEventFromUntrustedJSON
+// already redacts events whose content doesn't match their hashes.
+func (k *KeyRing) VerifyEvent(event gomatrixserverlib.Event) error {
+	serverNames, err := signingServerNames(event)
+	if err != nil {
+		return SignatureError(err.Error())
+	}
+	for _, serverName := range serverNames {
+		if err = k.verifyEventSignature(event, serverName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyEventSignature checks that an event has a valid signature from one of the keys of a server.
+func (k *KeyRing) verifyEventSignature(event gomatrixserverlib.Event, serverName string) error {
+	keyIDs := event.KeyIDs(serverName)
+	if len(keyIDs) == 0 {
+		return SignatureError(fmt.Sprintf("input: event %s is not signed by %s", event.EventID(), serverName))
+	}
+	keys, err := k.serverKeys(serverName, keyIDs)
+	if err != nil {
+		return err
+	}
+	for _, keyID := range keyIDs {
+		publicKey, ok := keys[keyID]
+		if !ok {
+			continue
+		}
+		if err = event.Verify(serverName, keyID, ed25519.PublicKey(publicKey)); err == nil {
+			return nil
+		}
+	}
+	return SignatureError(fmt.Sprintf("input: event %s does not have a valid signature from %s", event.EventID(), serverName))
+}
+
+// serverKeys returns the keys of a server as a map from key ID to public key.
+// The stored keys are used if one of the given key IDs is stored and hasn't expired.
+// Otherwise the keys are fetched from the server and stored if they pass the checks.
+// If the keys can't be fetched then any stored keys are used even if they have expired.
+// TODO: Use the old_verify_keys of the server to check historic events.
+func (k *KeyRing) serverKeys(serverName string, keyIDs []string) (map[string][]byte, error) {
+	stored, err := k.DB.ServerKeys(serverName)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+	result := map[string][]byte{}
+	current := false
+	for _, key := range stored {
+		result[key.KeyID] = key.PublicKey
+		for _, keyID := range keyIDs {
+			if key.KeyID == keyID && key.ValidUntilTS > nowMS {
+				current = true
+			}
+		}
+	}
+	if current {
+		return result, nil
+	}
+
+	if retryAt, ok := k.nextFetch(serverName, now); !ok {
+		if len(result) > 0 {
+			return result, nil
+		}
+		return nil, fmt.Errorf("input: not fetching the keys for %s again until %s", serverName, retryAt)
+	}
+	serverKeys, connState, err := k.Fetcher.FetchKeys(serverName)
+	if err != nil {
+		k.fetchFailed(serverName, now)
+		if len(result) > 0 {
+			return result, nil
+		}
+		return nil, err
+	}
+	checks, ed25519Keys, _ := gomatrixserverlib.CheckKeys(serverName, now, *serverKeys, connState)
+	if !checks.AllChecksOK {
+		k.fetchFailed(serverName, now)
+		if len(result) > 0 {
+			return result, nil
+		}
+		return nil, fmt.Errorf("input: the keys fetched for %s failed the checks: %+v", serverName, checks)
+	}
+
+	var keys []types.ServerKey
+	for keyID, publicKey := range ed25519Keys {
+		keys = append(keys, types.ServerKey{
+			ServerName:   serverName,
+			KeyID:        keyID,
+			PublicKey:    []byte(publicKey),
+			ValidUntilTS: serverKeys.ValidUntilTS,
+		})
+		result[keyID] = []byte(publicKey)
+	}
+	if err = k.DB.StoreServerKeys(keys); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// nextFetch returns whether we can try to fetch the keys for a server now.
+// If we can't then it returns when we can try again.
+func (k *KeyRing) nextFetch(serverName string, now time.Time) (time.Time, bool) {
+	k.failedFetchesMutex.Lock()
+	defer k.failedFetchesMutex.Unlock()
+	failed, ok := k.failedFetches[serverName]
+	if !ok {
+		return now, true
+	}
+	interval := k.FetchRetryInterval
+	if interval == 0 {
+		interval = DefaultKeyFetchRetryInterval
+	}
+	retryAt := failed.Add(interval)
+	if now.Before(retryAt) {
+		return retryAt, false
+	}
+	delete(k.failedFetches, serverName)
+	return now, true
+}
+
+// fetchFailed records that we failed to fetch the keys for a server.
+func (k *KeyRing) fetchFailed(serverName string, now time.Time) {
+	k.failedFetchesMutex.Lock()
+	defer k.failedFetchesMutex.Unlock()
+	if k.failedFetches == nil {
+		k.failedFetches = map[string]time.Time{}
+	}
+	k.failedFetches[serverName] = now
+}
+
+// signingServerNames returns the names of the servers that must have signed an event.
+// These are the server of the sender and the server that created the event ID.
+func signingServerNames(event gomatrixserverlib.Event) ([]string, error) {
+	senderServerName, err := serverNameFromID(event.Sender())
+	if err != nil {
+		return nil, err
+	}
+	eventIDServerName, err := serverNameFromID(event.EventID())
+	if err != nil {
+		return nil, err
+	}
+	if senderServerName == eventIDServerName {
+		return []string{senderServerName}, nil
+	}
+	return []string{senderServerName, eventIDServerName}, nil
+}
+
+// serverNameFromID returns the server name part of a matrix ID.
+// This is everything after the first ":" since the server name can contain ":" characters.
+func serverNameFromID(id string) (string, error) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("input: invalid ID %q", id)
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,212 @@
+package input
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+// testKeyServer is a KeyFetcher that serves the keys of a single matrix server from memory.
+type testKeyServer struct {
+	serverName string
+	keyID      string
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+	// The number of times the keys have been fetched.
+	fetches int
+}
+
+func newTestKeyServer(t *testing.T, serverName string) *testKeyServer {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyServer{serverName: serverName, keyID: "ed25519:test", publicKey: publicKey, privateKey: privateKey}
+}
+
+// FetchKeys implements KeyFetcher
+func (s *testKeyServer) FetchKeys(serverName string) (*gomatrixserverlib.ServerKeys, *tls.ConnectionState, error) {
+	s.fetches++
+	if serverName != s.serverName {
+		return nil, nil, fmt.Errorf("unknown server %q", serverName)
+	}
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"server_name":      s.serverName,
+		"valid_until_ts":   time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond),
+		"verify_keys":      map[string]interface{}{s.keyID: map[string]interface{}{"key": gomatrixserverlib.Base64String(s.publicKey)}},
+		"tls_fingerprints": []interface{}{map[string]interface{}{"sha256": gomatrixserverlib.Base64String(make([]byte, 32))}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys gomatrixserverlib.ServerKeys
+	if keys.Raw, err = gomatrixserverlib.SignJSON(s.serverName, s.keyID, s.privateKey, unsigned); err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(keys.Raw, &keys); err != nil {
+		return nil, nil, err
+	}
+	return &keys, nil, nil
+}
+
+// testKeyDatabase is a KeyDatabase that stores keys in memory.
+type testKeyDatabase struct {
+	keys []types.ServerKey
+}
+
+func (db *testKeyDatabase) ServerKeys(serverName string) ([]types.ServerKey, error) {
+	var result []types.ServerKey
+	for _, key := range db.keys {
+		if key.ServerName == serverName {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+func (db *testKeyDatabase) StoreServerKeys(keys []types.ServerKey) error {
+	db.keys = append(db.keys, keys...)
+	return nil
+}
+
+func buildTestEvent(t *testing.T, eventID, keyID string, privateKey ed25519.PrivateKey) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: "@alice:a",
+		RoomID: "!room:a",
+		Type:   "m.room.message",
+		Depth:  2,
+	}
+	if err := builder.SetContent(map[string]string{"body": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.SetUnsigned(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := builder.Build(eventID, time.Now(), "a", keyID, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestVerifyEvent(t *testing.T) {
+	server := newTestKeyServer(t, "a")
+	keyRing := &KeyRing{DB: &testKeyDatabase{}, Fetcher: server}
+
+	event := buildTestEvent(t, "$event:a", server.keyID, server.privateKey)
+	if err := keyRing.VerifyEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyRing.VerifyEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if server.fetches != 1 {
+		t.Fatalf("Wanted the keys to be fetched once, got %d fetches", server.fetches)
+	}
+
+	// An event signed with a different key using the same key ID.
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := buildTestEvent(t, "$forged:a", server.keyID, otherKey)
+	if _, ok := keyRing.VerifyEvent(forged).(SignatureError); !ok {
+		t.Fatalf("Wanted a SignatureError for a forged event, got %v", keyRing.VerifyEvent(forged))
+	}
+
+	// An event whose event ID was created by a server that didn't sign it.
+	unsigned := buildTestEvent(t, "$event:b", server.keyID, server.privateKey)
+	if _, ok := keyRing.VerifyEvent(unsigned).(SignatureError); !ok {
+		t.Fatalf("Wanted a SignatureError for an unsigned event, got %v", keyRing.VerifyEvent(unsigned))
+	}
+}
+
+func TestVerifyEventKeyFetchFailure(t *testing.T) {
+	server := newTestKeyServer(t, "b")
+	keyRing := &KeyRing{DB: &testKeyDatabase{}, Fetcher: server}
+
+	// We can't fetch the keys for "a" so we can't tell whether the event is signed.
+	event := buildTestEvent(t, "$event:a", server.keyID, server.privateKey)
+	err := keyRing.VerifyEvent(event)
+	if err == nil {
+		t.Fatalf("Wanted an error when the keys can't be fetched")
+	}
+	if _, ok := err.(SignatureError); ok {
+		t.Fatalf("Wanted the error not to be a SignatureError, got %v", err)
+	}
+
+	// The keys aren't fetched again until the retry interval has passed.
+	if err = keyRing.VerifyEvent(event); err == nil {
+		t.Fatalf("Wanted an error when the keys can't be fetched")
+	}
+	if server.fetches != 1 {
+		t.Fatalf("Wanted the keys to be fetched once, got %d fetches", server.fetches)
+	}
+	keyRing.FetchRetryInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err = keyRing.VerifyEvent(event); err == nil {
+		t.Fatalf("Wanted an error when the keys can't be fetched")
+	}
+	if server.fetches != 2 {
+		t.Fatalf("Wanted the keys to be fetched again after the retry interval, got %d fetches", server.fetches)
+	}
+}
+
+func TestDirectKeyFetcherTimeout(t *testing.T) {
+	// A server that accepts connections but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	fetcher := DirectKeyFetcher{Timeout: 50 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		_, _, fetchErr := fetcher.FetchKeys(listener.Addr().String())
+		done <- fetchErr
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatalf("Wanted an error when the server doesn't respond")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wanted FetchKeys to give up after the timeout")
+	}
+}
+
+func TestProcessRoomEventRejectsForgedEvents(t *testing.T) {
+	server := newTestKeyServer(t, "a")
+	keyRing := &KeyRing{DB: &testKeyDatabase{}, Fetcher: server}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := buildTestEvent(t, "$forged:a", server.keyID, otherKey)
+
+	// None of the database methods are implemented so this checks that the event isn't stored.
+	db := &testRoomEventDatabase{}
+	input := api.InputRoomEvent{Kind: api.KindOutlier, Event: forged.JSON()}
+	err = processRoomEvent(db, keyRing, input, inputOffset{}, DefaultMaxStateBlockNIDs)
+	if _, ok := err.(*rejectedEventError); !ok {
+		t.Fatalf("Wanted a *rejectedEventError, got %v", err)
+	}
+}
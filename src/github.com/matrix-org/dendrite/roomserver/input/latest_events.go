@@ -2,13 +2,17 @@ package input
 
 import (
 	"bytes"
+	"encoding/json"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
-// updateLatestEvents updates the list of latest events for this room in the database and writes the
-// event to the output log.
+// updateLatestEvents updates the list of latest events for this room in the database and stores the
+// event to be written to the output log.
+// The output and the offset of the input event are committed in the same transaction as the latest
+// events so that each input event updates the room and produces output exactly once.
 // The latest events are the events that aren't referenced by another event in the database:
 //
 //     Time goes down the page. 1 is the m.room.create event (root).
@@ -24,7 +28,8 @@ import (
 //      7 <----- latest
 //
 func updateLatestEvents(
-	db RoomEventDatabase, ow OutputRoomEventWriter, roomNID types.RoomNID, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
+	db RoomEventDatabase, roomNID types.RoomNID, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
+	redactions appliedRedactions, offset inputOffset, maxStateBlockNIDs int,
 ) (err error) {
 	oldLatest, lastEventIDSent, updater, err := db.GetLatestEventsForUpdate(roomNID)
 	if err != nil {
@@ -44,63 +49,156 @@ func updateLatestEvents(
 		}
 	}()
 
-	err = doUpdateLatestEvents(updater, ow, oldLatest, lastEventIDSent, roomNID, stateAtEvent, event)
+	u := latestEventsUpdater{
+		db: db, updater: updater, roomNID: roomNID,
+		stateAtEvent: stateAtEvent, event: event, redactions: redactions,
+		oldLatest: oldLatest, lastEventIDSent: lastEventIDSent,
+		maxStateBlockNIDs: maxStateBlockNIDs,
+	}
+	if err = u.doUpdateLatestEvents(); err != nil {
+		return
+	}
+	err = updater.SetPartitionOffset(offset.topic, offset.partition, offset.offset)
 	return
 }
 
-func doUpdateLatestEvents(
-	updater types.RoomRecentEventsUpdater, ow OutputRoomEventWriter, oldLatest []types.StateAtEventAndReference, lastEventIDSent string, roomNID types.RoomNID, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
-) error {
+// latestEventsUpdater tracks the state used to update the latest events in the
+// room. It mostly just ferries state between the various function calls.
+// The state for this type is accessed in a single goroutine.
+type latestEventsUpdater struct {
+	db           RoomEventDatabase
+	updater      types.RoomRecentEventsUpdater
+	roomNID      types.RoomNID
+	stateAtEvent types.StateAtEvent
+	event        gomatrixserverlib.Event
+	// The redactions applied while processing this event.
+	redactions appliedRedactions
+	// The latest events in the room before processing this event.
+	oldLatest []types.StateAtEventAndReference
+	// The ID of the last event written to the output log before this event.
+	lastEventIDSent string
+	// The latest events in the room after processing this event.
+	latest []types.StateAtEventAndReference
+	// The state entries removed from and added to the current state of the
+	// room as a result of processing this event. They are sorted by state key tuple.
+	removed []types.StateEntry
+	added   []types.StateEntry
+	// The snapshots of current state before and after processing this event.
+	oldStateNID types.StateSnapshotNID
+	newStateNID types.StateSnapshotNID
+	// The state entries needed to work out who can see this event.
+	visibility []types.StateEntry
+	// The maximum number of blocks to use when storing the new current state.
+	maxStateBlockNIDs int
+}
+
+func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	var err error
 	var prevEvents []gomatrixserverlib.EventReference
-	prevEvents = event.PrevEvents()
+	prevEvents = u.event.PrevEvents()
 
-	if hasBeenSent, err := updater.HasEventBeenSent(stateAtEvent.EventNID); err != nil {
+	if hasBeenSent, err := u.updater.HasEventBeenSent(u.stateAtEvent.EventNID); err != nil {
 		return err
 	} else if hasBeenSent {
 		// Already sent this event so we can stop processing
 		return nil
 	}
 
-	if err = updater.StorePreviousEvents(stateAtEvent.EventNID, prevEvents); err != nil {
+	if err = u.updater.StorePreviousEvents(u.stateAtEvent.EventNID, prevEvents); err != nil {
 		return err
 	}
 
-	eventReference := event.EventReference()
+	if err = u.updater.SetStreamPosition(u.stateAtEvent.EventNID, false); err != nil {
+		return err
+	}
+
+	eventReference := u.event.EventReference()
 	// Check if this event is already referenced by another event in the room.
 	var alreadyReferenced bool
-	if alreadyReferenced, err = updater.IsReferenced(eventReference); err != nil {
+	if alreadyReferenced, err = u.updater.IsReferenced(eventReference); err != nil {
 		return err
 	}
 
-	newLatest := calculateLatest(oldLatest, alreadyReferenced, prevEvents, types.StateAtEventAndReference{
+	u.latest = calculateLatest(u.oldLatest, alreadyReferenced, prevEvents, types.StateAtEventAndReference{
 		EventReference: eventReference,
-		StateAtEvent:   stateAtEvent,
+		StateAtEvent:   u.stateAtEvent,
 	})
 
-	// Send the event to the output logs.
-	// We do this inside the database transaction to ensure that we only mark an event as sent if we sent it.
-	// (n.b. this means that it's possible that the same event will be sent twice if the transaction fails but
-	//  the write to the output log succeeds)
-	// TODO: This assumes that writing the event to the output log is synchronous. It should be possible to
-	// send the event asynchronously but we would need to ensure that 1) the events are written to the log in
-	// the correct order, 2) that pending writes are resent across restarts. In order to avoid writing all the
-	// necessary bookkeeping we'll keep the event sending synchronous for now.
-	if err = writeEvent(ow, lastEventIDSent, event, newLatest); err != nil {
+	if err = u.latestState(); err != nil {
 		return err
 	}
 
-	if err = updater.SetLatestEvents(roomNID, newLatest, stateAtEvent.EventNID); err != nil {
+	if u.visibility, err = loadVisibilityState(u.db, u.stateAtEvent); err != nil {
 		return err
 	}
 
-	if err = updater.MarkEventAsSent(stateAtEvent.EventNID); err != nil {
+	// Store the event to be sent to the output logs.
+	// We do this inside the database transaction so that the event is only
+	// sent if the transaction commits. The OutputPublisher sends the stored
+	// events in the order they were stored.
+	if err = u.writeEvent(); err != nil {
+		return err
+	}
+
+	if err = u.updater.SetLatestEvents(u.roomNID, u.latest, u.stateAtEvent.EventNID, u.newStateNID); err != nil {
+		return err
+	}
+
+	if err = u.updater.MarkEventAsSent(u.stateAtEvent.EventNID); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// latestState works out the current state of the room after the new latest
+// events and the delta between that and the current state before the event.
+func (u *latestEventsUpdater) latestState() error {
+	var err error
+	u.oldStateNID = u.updater.CurrentStateSnapshotNID()
+
+	if sameLatestEvents(u.oldLatest, u.latest) && u.oldStateNID != 0 {
+		// The latest events haven't changed so neither has the current state.
+		u.newStateNID = u.oldStateNID
+		return nil
+	}
+
+	latestStateAtEvents := make([]types.StateAtEvent, len(u.latest))
+	for i := range u.latest {
+		latestStateAtEvents[i] = u.latest[i].StateAtEvent
+	}
+	u.newStateNID, err = calculateAndStoreStateAfterEvents(
+		u.db, u.roomNID, latestStateAtEvents, u.maxStateBlockNIDs,
+	)
+	if err != nil {
+		return err
+	}
+
+	u.removed, u.added, err = state.DifferenceBetweenStateSnapshots(u.db, u.oldStateNID, u.newStateNID)
+	return err
+}
+
+// sameLatestEvents returns whether two lists of latest events contain the same events.
+// The lists are small so we don't bother sorting them.
+func sameLatestEvents(a, b []types.StateAtEventAndReference) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		found := false
+		for j := range b {
+			if a[i].EventNID == b[j].EventNID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func calculateLatest(oldLatest []types.StateAtEventAndReference, alreadyReferenced bool, prevEvents []gomatrixserverlib.EventReference, newEvent types.StateAtEventAndReference) []types.StateAtEventAndReference {
 	var alreadyInLatest bool
 	var newLatest []types.StateAtEventAndReference
@@ -134,18 +232,105 @@ func calculateLatest(oldLatest []types.StateAtEventAndReference, alreadyReferenc
 	return newLatest
 }
 
-func writeEvent(ow OutputRoomEventWriter, lastEventIDSent string, event gomatrixserverlib.Event, latest []types.StateAtEventAndReference) error {
+func (u *latestEventsUpdater) writeEvent() error {
+	output := roomEventOutput{
+		event: u.event, lastEventIDSent: u.lastEventIDSent, latest: u.latest,
+		visibility: u.visibility, removed: u.removed, added: u.added, redactions: u.redactions,
+	}
+	outputEvents, err := output.outputEvents(u.db)
+	if err != nil {
+		return err
+	}
+	for _, outputEvent := range outputEvents {
+		if err = u.storeOutput(outputEvent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	latestEventIDs := make([]string, len(latest))
-	for i := range latest {
-		latestEventIDs[i] = latest[i].EventID
+// roomEventOutput is what we know about a new event in a room once the latest events
+// and the current state of the room have been updated for it.
+type roomEventOutput struct {
+	event gomatrixserverlib.Event
+	// The ID of the last event written to the output log before this event.
+	lastEventIDSent string
+	// The latest events in the room after this event.
+	latest []types.StateAtEventAndReference
+	// The state entries needed to work out who can see this event.
+	visibility []types.StateEntry
+	// The state entries removed from and added to the current state of the room by this event.
+	removed []types.StateEntry
+	added   []types.StateEntry
+	// The redactions applied while processing this event.
+	redactions appliedRedactions
+}
+
+// outputEvents returns the messages to write to the output log for the event.
+// The first message is the api.OutputRoomEvent for the event. It is followed by any
+// messages for the redactions applied by the event and the invites it changed.
+func (o roomEventOutput) outputEvents(db RoomEventDatabase) ([]api.OutputEvent, error) {
+	latestEventIDs := make([]string, len(o.latest))
+	for i := range o.latest {
+		latestEventIDs[i] = o.latest[i].EventID
 	}
 
-	// TODO: Fill out AddsStateEventIDs and RemovesStateEventIDs
-	// TODO: Fill out VisibilityStateIDs
-	return ow.WriteOutputRoomEvent(api.OutputRoomEvent{
-		Event:           event.JSON(),
-		LastSentEventID: lastEventIDSent,
-		LatestEventIDs:  latestEventIDs,
-	})
+	ore := api.OutputRoomEvent{
+		Event:                  o.event.JSON(),
+		LastSentEventID:        o.lastEventIDSent,
+		LatestEventIDs:         latestEventIDs,
+		RedactsEventID:         o.redactions.redactsEventID,
+		RedactedBecauseEventID: o.redactions.redactedBecauseEventID,
+	}
+
+	var stateEventNIDs []types.EventNID
+	for _, entry := range o.visibility {
+		stateEventNIDs = append(stateEventNIDs, entry.EventNID)
+	}
+	for _, entry := range o.added {
+		stateEventNIDs = append(stateEventNIDs, entry.EventNID)
+	}
+	for _, entry := range o.removed {
+		stateEventNIDs = append(stateEventNIDs, entry.EventNID)
+	}
+	if len(stateEventNIDs) > 0 {
+		eventIDMap, err := db.EventIDs(state.UniqueEventNIDs(stateEventNIDs))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range o.visibility {
+			ore.VisibilityEventIDs = append(ore.VisibilityEventIDs, eventIDMap[entry.EventNID])
+		}
+		for _, entry := range o.added {
+			ore.AddsStateEventIDs = append(ore.AddsStateEventIDs, eventIDMap[entry.EventNID])
+		}
+		for _, entry := range o.removed {
+			ore.RemovesStateEventIDs = append(ore.RemovesStateEventIDs, eventIDMap[entry.EventNID])
+		}
+	}
+
+	result := []api.OutputEvent{{Type: api.OutputTypeNewRoomEvent, NewRoomEvent: &ore}}
+
+	if o.redactions.redactsEventID != "" {
+		result = append(result, api.OutputEvent{Type: api.OutputTypeRedactedEvent, RedactedEvent: &api.OutputRedactedEvent{
+			RedactedEventID: o.redactions.redactsEventID,
+			RedactedBecause: o.event.JSON(),
+		}})
+	}
+
+	invites, err := inviteOutput(db, o.removed, o.added)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, invites...), nil
+}
+
+// storeOutput stores a message to be written to the output log.
+func (u *latestEventsUpdater) storeOutput(output api.OutputEvent) error {
+	output.Version = api.OutputEventVersion
+	value, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	return u.updater.StorePendingOutput(value)
 }
@@ -0,0 +1,96 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+// The stages of processing an input room event that are timed.
+const (
+	stageAuth         = "auth"
+	stageStore        = "store"
+	stageState        = "state"
+	stageLatestEvents = "latest_events"
+	stageOutput       = "output"
+)
+
+// The outcomes of processing an input room event.
+const (
+	outcomeProcessed = "processed"
+	outcomeRejected  = "rejected"
+	outcomeHeld      = "held"
+	outcomeFailed    = "failed"
+)
+
+var (
+	stageDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_stage_duration_seconds",
+		Help: "The time taken by each stage of processing an input room event. The output stage is " +
+			"the time taken to write each message to the output log.",
+	}, []string{"stage"})
+	processedEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_events_total",
+		Help:      "The number of input room events processed, by kind of event and outcome.",
+	}, []string{"kind", "outcome"})
+	consumerLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_consumer_lag",
+		Help:      "The number of messages in each partition of the input log that haven't been read yet.",
+	}, []string{"partition"})
+	// This isn't labelled by room since there is no bound on the number of rooms.
+	stateBlocksHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "current_state_blocks",
+		Help: "The number of state blocks in the snapshot of the current state of a room, " +
+			"observed each time an event in the room is processed.",
+		Buckets: []float64{1, 2, 4, 8, 16, 32, 64, 128},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(stageDurationHistogram, processedEventsCounter, consumerLagGauge, stateBlocksHistogram)
+}
+
+// observeStage records how long a stage of processing an input room event took.
+// It is called whether or not the stage failed, so that slow failures are counted too.
+func observeStage(stage string, start time.Time) {
+	stageDurationHistogram.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// countEvent records the outcome of processing an input room event.
+func countEvent(input api.InputRoomEvent, outcome string) {
+	processedEventsCounter.WithLabelValues(kindName(input.Kind), outcome).Inc()
+}
+
+// kindName returns the name used in the metrics for a kind of input room event.
+func kindName(kind int) string {
+	switch kind {
+	case api.KindOutlier:
+		return "outlier"
+	case api.KindJoin:
+		return "join"
+	case api.KindNew:
+		return "new"
+	case api.KindBackfill:
+		return "backfill"
+	default:
+		return "unknown"
+	}
+}
+
+// recordConsumerLag records how far behind the end of a partition of the input log the message is.
+func recordConsumerLag(partition int32, offset, highWaterMarkOffset int64) {
+	lag := highWaterMarkOffset - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	consumerLagGauge.WithLabelValues(strconv.Itoa(int(partition))).Set(float64(lag))
+}
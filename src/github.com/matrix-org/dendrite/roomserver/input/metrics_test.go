@@ -0,0 +1,66 @@
+package input
+
+import (
+	"errors"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func consumerLag(t *testing.T, partition string) float64 {
+	var m dto.Metric
+	if err := consumerLagGauge.WithLabelValues(partition).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestRecordConsumerLag(t *testing.T) {
+	// The high water mark is the offset of the next message written to the partition.
+	recordConsumerLag(3, 5, 10)
+	if lag := consumerLag(t, "3"); lag != 4 {
+		t.Fatalf("wanted a lag of 4, got %v", lag)
+	}
+	recordConsumerLag(3, 9, 10)
+	if lag := consumerLag(t, "3"); lag != 0 {
+		t.Fatalf("wanted a lag of 0 after reading the last message, got %v", lag)
+	}
+	// The high water mark can be behind the message if it hasn't been updated yet.
+	recordConsumerLag(3, 12, 10)
+	if lag := consumerLag(t, "3"); lag != 0 {
+		t.Fatalf("wanted a lag of 0, got %v", lag)
+	}
+}
+
+func stageCount(t *testing.T, stage string) uint64 {
+	var m dto.Metric
+	if err := stageDurationHistogram.WithLabelValues(stage).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// testFailingStoreDatabase is a testPromotionDatabase that fails to store events.
+type testFailingStoreDatabase struct {
+	testPromotionDatabase
+}
+
+func (db *testFailingStoreDatabase) StoreEvent(
+	event gomatrixserverlib.Event, authEventNIDs []types.EventNID,
+) (types.RoomNID, types.StateAtEvent, error) {
+	return 0, types.StateAtEvent{}, errors.New("the database is down")
+}
+
+func TestProcessRoomEventObservesFailedStages(t *testing.T) {
+	db := &testFailingStoreDatabase{testPromotionDatabase{events: map[string]types.StateAtEvent{}}}
+	before := stageCount(t, stageStore)
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testCreateJSON)}
+	if err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs); err == nil {
+		t.Fatal("wanted storing the event to fail")
+	}
+	if after := stageCount(t, stageStore); after != before+1 {
+		t.Fatalf("wanted the failed store stage to be observed, got %d observations before and %d after", before, after)
+	}
+}
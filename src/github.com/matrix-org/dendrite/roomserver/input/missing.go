@@ -0,0 +1,49 @@
+package input
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A missingEventsError is returned by processRoomEvent when a new event was
+// held because we don't have some of its prev_events.
+type missingEventsError struct {
+	// The held event.
+	event gomatrixserverlib.Event
+	// The IDs of the prev_events we don't have.
+	missingEventIDs []string
+}
+
+func (e *missingEventsError) Error() string {
+	return "input: event " + e.event.EventID() + " is missing prev_events"
+}
+
+// missingPrevEvents returns the IDs of the prev_events of an event that we either don't have
+// or don't know the state at. We can't work out the state at an event until we have those.
+func missingPrevEvents(db RoomEventDatabase, event gomatrixserverlib.Event) ([]string, error) {
+	prevEventRefs := event.PrevEvents()
+	if len(prevEventRefs) == 0 {
+		return nil, nil
+	}
+	prevEventIDs := make([]string, len(prevEventRefs))
+	for i := range prevEventRefs {
+		prevEventIDs[i] = prevEventRefs[i].EventID
+	}
+	return db.MissingEventIDs(prevEventIDs)
+}
+
+// holdRoomEvent stores an input event in the pending events table until its missing prev_events arrive.
+// Returns a *missingEventsError if the event was held successfully.
+func holdRoomEvent(
+	db RoomEventDatabase, event gomatrixserverlib.Event, input api.InputRoomEvent, missingEventIDs []string,
+) error {
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	if err = db.StorePendingEvent(event.EventID(), event.RoomID(), missingEventIDs, inputJSON); err != nil {
+		return err
+	}
+	return &missingEventsError{event: event, missingEventIDs: missingEventIDs}
+}
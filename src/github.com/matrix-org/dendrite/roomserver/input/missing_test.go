@@ -0,0 +1,56 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"testing"
+)
+
+// testMissingEventsDatabase is a RoomEventDatabase that knows about a fixed set of events.
+// Only the methods needed to hold an event are implemented.
+type testMissingEventsDatabase struct {
+	RoomEventDatabase
+	// The IDs of the events we have with state.
+	known map[string]bool
+	// The events that have been held, indexed by event ID.
+	pending map[string]types.PendingEvent
+}
+
+func (db *testMissingEventsDatabase) MissingEventIDs(eventIDs []string) ([]string, error) {
+	var missing []string
+	for _, eventID := range eventIDs {
+		if !db.known[eventID] {
+			missing = append(missing, eventID)
+		}
+	}
+	return missing, nil
+}
+
+func (db *testMissingEventsDatabase) StorePendingEvent(eventID, roomID string, missingEventIDs []string, inputJSON []byte) error {
+	db.pending[eventID] = types.PendingEvent{EventID: eventID, InputJSON: inputJSON}
+	return nil
+}
+
+const testPrevEventsJSON = `{"type":"m.room.message","event_id":"$child:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":5,"content":{"body":"hello"},` +
+	`"prev_events":[["$known:a",{"sha256":"aGFzaA"}],["$missing:a",{"sha256":"aGFzaA"}]]}`
+
+func TestProcessRoomEventHoldsEventsWithMissingPrevEvents(t *testing.T) {
+	db := &testMissingEventsDatabase{
+		known:   map[string]bool{"$known:a": true},
+		pending: map[string]types.PendingEvent{},
+	}
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testPrevEventsJSON)}
+
+	err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs)
+	missing, ok := err.(*missingEventsError)
+	if !ok {
+		t.Fatalf("Wanted a *missingEventsError, got %v", err)
+	}
+	if len(missing.missingEventIDs) != 1 || missing.missingEventIDs[0] != "$missing:a" {
+		t.Fatalf("Wanted missing events [$missing:a], got %v", missing.missingEventIDs)
+	}
+	if _, ok = db.pending["$child:a"]; !ok {
+		t.Fatalf("Wanted $child:a to be held")
+	}
+}
@@ -0,0 +1,152 @@
+package input
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"time"
+)
+
+// An OutputPublisherDatabase has the storage APIs needed by the output publisher.
+type OutputPublisherDatabase interface {
+	// Lookup the oldest messages waiting to be written to the output log.
+	// Returns at most limit messages sorted by numeric ID.
+	PendingOutput(limit int) ([]types.PendingOutput, error)
+	// Remove the message with the numeric ID once it has been written.
+	// Only that message is removed because messages with lower numeric IDs may
+	// have been committed since it was read.
+	DeletePendingOutput(pendingOutputNID types.PendingOutputNID) error
+}
+
+// DefaultPublishPollInterval is how often the OutputPublisher checks for new
+// messages if PollInterval isn't set.
+const DefaultPublishPollInterval = 100 * time.Millisecond
+
+// publishBatchSize is the number of pending messages read from the database at a time.
+const publishBatchSize = 100
+
+// An OutputPublisher writes the messages stored by the Consumer to the output log.
+// The Consumer stores the messages in the database in the same transaction that
+// updates the room, so a message is written only if the update was committed.
+// The messages are written in the order they were stored. Each message is
+// removed from the database after it has been written. If the roomserver stops
+// between writing a message and removing it then the message will be written
+// again when the roomserver restarts. Readers of the output log can detect this
+// using the LastSentEventID of the api.OutputRoomEvent.
+// Each message is an api.OutputEvent unless LegacyOutput is set.
+type OutputPublisher struct {
+	// The database the Consumer stores messages in.
+	DB OutputPublisherDatabase
+	// The producer used to write messages to the output log.
+	Producer sarama.SyncProducer
+	// The kafkaesque topic to output new room events to.
+	// This is the name used in kafka to identify the stream to write events to.
+	OutputRoomEventTopic string
+	// Write the output log in the format used before the api.OutputEvent envelope was introduced.
+	// Each new room event is written as a bare api.OutputRoomEvent and the other types of output
+	// are dropped. This lets the roomserver be upgraded before the consumers of the output log.
+	LegacyOutput bool
+	// How often to check the database for new messages.
+	// If left as 0 then DefaultPublishPollInterval is used.
+	PollInterval time.Duration
+	// Closed by Stop to tell the publishing goroutine to stop.
+	stop chan struct{}
+	// Closed by the publishing goroutine once it has stopped.
+	stopped chan struct{}
+}
+
+// Start starts a goroutine that writes pending messages to the output log.
+func (p *OutputPublisher) Start() {
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go p.run()
+}
+
+// Stop stops the publisher.
+// Blocks until the publishing goroutine has finished writing the message it is working on.
+// Any messages left in the database are written the next time the publisher is started.
+func (p *OutputPublisher) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
+
+func (p *OutputPublisher) run() {
+	defer close(p.stopped)
+	interval := p.PollInterval
+	if interval == 0 {
+		interval = DefaultPublishPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.publishPending(); err != nil {
+			// Log the error and try again next time round.
+			// The messages stay in the database until they have been written.
+			log.WithError(err).Error("Error writing room events to the output log")
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishPending writes all the pending messages to the output log.
+func (p *OutputPublisher) publishPending() error {
+	for {
+		pending, err := p.DB.PendingOutput(publishBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, output := range pending {
+			select {
+			case <-p.stop:
+				return nil
+			default:
+			}
+			value := output.Value
+			if p.LegacyOutput {
+				if value, err = legacyOutput(value); err != nil {
+					return err
+				}
+			}
+			if value != nil {
+				var m sarama.ProducerMessage
+				m.Topic = p.OutputRoomEventTopic
+				m.Key = sarama.StringEncoder("")
+				m.Value = sarama.ByteEncoder(value)
+				start := time.Now()
+				_, _, err = p.Producer.SendMessage(&m)
+				observeStage(stageOutput, start)
+				if err != nil {
+					return err
+				}
+			}
+			// Remove each message as soon as it is written so that as few
+			// messages as possible are written twice after a restart.
+			if err = p.DB.DeletePendingOutput(output.PendingOutputNID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// legacyOutput converts a message stored for the output log to the format used before the
+// api.OutputEvent envelope was introduced.
+// Returns nil if the message can't be represented in that format and should be dropped.
+func legacyOutput(value []byte) ([]byte, error) {
+	output, err := api.DecodeOutputEvent(value)
+	if err != nil {
+		return nil, err
+	}
+	if output.Type != api.OutputTypeNewRoomEvent || output.NewRoomEvent == nil {
+		return nil, nil
+	}
+	return json.Marshal(output.NewRoomEvent)
+}
@@ -0,0 +1,153 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"sort"
+	"testing"
+)
+
+type testOutputPublisherDatabase struct {
+	pending []types.PendingOutput
+}
+
+func (db *testOutputPublisherDatabase) PendingOutput(limit int) ([]types.PendingOutput, error) {
+	sort.Slice(db.pending, func(i, j int) bool { return db.pending[i].PendingOutputNID < db.pending[j].PendingOutputNID })
+	if len(db.pending) < limit {
+		limit = len(db.pending)
+	}
+	return append([]types.PendingOutput(nil), db.pending[:limit]...), nil
+}
+
+func (db *testOutputPublisherDatabase) DeletePendingOutput(pendingOutputNID types.PendingOutputNID) error {
+	for i := range db.pending {
+		if db.pending[i].PendingOutputNID == pendingOutputNID {
+			db.pending = append(db.pending[:i], db.pending[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+type testSyncProducer struct {
+	sarama.SyncProducer
+	sent      []string
+	failAfter int
+}
+
+func (p *testSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if len(p.sent) == p.failAfter {
+		return 0, 0, fmt.Errorf("kafka is down")
+	}
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	p.sent = append(p.sent, string(value))
+	return 0, int64(len(p.sent)), nil
+}
+
+func TestPublishPending(t *testing.T) {
+	db := &testOutputPublisherDatabase{}
+	for i := 1; i <= publishBatchSize+5; i++ {
+		db.pending = append(db.pending, types.PendingOutput{
+			PendingOutputNID: types.PendingOutputNID(i),
+			Value:            []byte(fmt.Sprintf("%d", i)),
+		})
+	}
+	producer := &testSyncProducer{failAfter: 3}
+	p := OutputPublisher{DB: db, Producer: producer, stop: make(chan struct{})}
+
+	// The messages that couldn't be written must stay in the database.
+	if err := p.publishPending(); err == nil {
+		t.Fatalf("wanted an error from publishPending")
+	}
+	if len(db.pending) != publishBatchSize+2 {
+		t.Fatalf("wanted %d pending messages got %d", publishBatchSize+2, len(db.pending))
+	}
+
+	// Once the producer recovers the rest of the messages are written in order.
+	producer.failAfter = -1
+	if err := p.publishPending(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.pending) != 0 {
+		t.Fatalf("wanted no pending messages got %d", len(db.pending))
+	}
+	for i, value := range producer.sent {
+		if want := fmt.Sprintf("%d", i+1); value != want {
+			t.Fatalf("wanted message %d to be %q got %q", i, want, value)
+		}
+	}
+}
+
+func TestPublishPendingLegacyOutput(t *testing.T) {
+	db := &testOutputPublisherDatabase{pending: []types.PendingOutput{
+		// Stored before the output envelope was introduced.
+		{PendingOutputNID: 1, Value: []byte(`{"Event":{"event_id":"$one:a"},"LastSentEventID":""}`)},
+		{PendingOutputNID: 2, Value: []byte(`{"Version":1,"Type":"new_room_event",` +
+			`"NewRoomEvent":{"Event":{"event_id":"$two:a"},"LastSentEventID":"$one:a"}}`)},
+		{PendingOutputNID: 3, Value: []byte(`{"Version":1,"Type":"new_invite_event",` +
+			`"NewInviteEvent":{"Event":{"event_id":"$two:a"}}}`)},
+	}}
+	producer := &testSyncProducer{failAfter: -1}
+	p := OutputPublisher{DB: db, Producer: producer, LegacyOutput: true, stop: make(chan struct{})}
+
+	if err := p.publishPending(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.pending) != 0 {
+		t.Fatalf("wanted no pending messages got %d", len(db.pending))
+	}
+	if len(producer.sent) != 2 {
+		t.Fatalf("wanted 2 messages to be written got %d", len(producer.sent))
+	}
+	for i, wantEventID := range []string{"$one:a", "$two:a"} {
+		var output api.OutputRoomEvent
+		if err := json.Unmarshal([]byte(producer.sent[i]), &output); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(`{"event_id":%q}`, wantEventID); string(output.Event) != want {
+			t.Fatalf("wanted message %d to be for %s got %q", i, wantEventID, producer.sent[i])
+		}
+	}
+}
+
+// testCommittingSyncProducer is a SyncProducer that calls onSend after each message is written.
+type testCommittingSyncProducer struct {
+	testSyncProducer
+	onSend func()
+}
+
+func (p *testCommittingSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	partition, offset, err := p.testSyncProducer.SendMessage(msg)
+	if err == nil && p.onSend != nil {
+		p.onSend()
+		p.onSend = nil
+	}
+	return partition, offset, err
+}
+
+func TestPublishPendingCommittedOutOfOrder(t *testing.T) {
+	db := &testOutputPublisherDatabase{pending: []types.PendingOutput{{PendingOutputNID: 6, Value: []byte("6")}}}
+	producer := &testCommittingSyncProducer{testSyncProducer: testSyncProducer{failAfter: -1}}
+	// A transaction for another room that was given an earlier numeric ID commits
+	// after message 6 is written but before it is removed.
+	producer.onSend = func() {
+		db.pending = append(db.pending, types.PendingOutput{PendingOutputNID: 5, Value: []byte("5")})
+	}
+	p := OutputPublisher{DB: db, Producer: producer, stop: make(chan struct{})}
+
+	if err := p.publishPending(); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.sent) != 2 || producer.sent[0] != "6" || producer.sent[1] != "5" {
+		t.Fatalf("wanted messages 6 and 5 to be written, got %v", producer.sent)
+	}
+	if len(db.pending) != 0 {
+		t.Fatalf("wanted no pending messages got %d", len(db.pending))
+	}
+}
@@ -0,0 +1,86 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// mRoomRedaction is the event type of redaction events.
+const mRoomRedaction = "m.room.redaction"
+
+// appliedRedactions records the redactions that were applied while processing an event
+// so that consumers of the output log can be told about them.
+type appliedRedactions struct {
+	// If the event is a redaction that was applied then this is the ID of the event it redacted.
+	redactsEventID string
+	// If the event was redacted by a redaction that arrived before it then this is the ID of that redaction.
+	redactedBecauseEventID string
+}
+
+// processRedactions applies any redactions that can be applied now that the event has been stored.
+// If the event is a redaction then it is applied to the event it redacts if we already have that
+// event. Otherwise it is applied when that event arrives. Any redactions of the event that arrived
+// before it are applied to it.
+// The event must have passed the auth checks, which check that the sender of a redaction is allowed
+// to redact the event. A redaction is only applied to an event in the same room as the redaction.
+// This is idempotent so that it is safe to process the same event again.
+func processRedactions(
+	db RoomEventDatabase, roomNID types.RoomNID, eventNID types.EventNID, event gomatrixserverlib.Event,
+) (result appliedRedactions, err error) {
+	if event.Type() == mRoomRedaction && event.Redacts() != "" {
+		if result.redactsEventID, err = redactExistingEvent(db, roomNID, event); err != nil {
+			return
+		}
+	}
+
+	redactions, err := db.RedactionsForEvent(event.EventID())
+	if err != nil {
+		return
+	}
+	for _, redaction := range redactions {
+		if redaction.RoomNID != roomNID {
+			// Redactions can only redact events in the same room.
+			continue
+		}
+		if err = db.RedactEvent(redaction.RedactionEventID, eventNID, event.Redact().JSON()); err != nil {
+			return
+		}
+		result.redactedBecauseEventID = redaction.RedactionEventID
+	}
+	return
+}
+
+// redactExistingEvent stores a redaction and applies it to the event it redacts if we have that event.
+// Returns the ID of the redacted event if the redaction was applied or the empty string if it wasn't.
+func redactExistingEvent(
+	db RoomEventDatabase, roomNID types.RoomNID, redaction gomatrixserverlib.Event,
+) (string, error) {
+	// Store the redaction first so that it is applied if the event it redacts arrives later.
+	if err := db.StoreRedaction(redaction.EventID(), redaction.Redacts(), roomNID); err != nil {
+		return "", err
+	}
+
+	eventNIDs, err := db.EventNIDs([]string{redaction.Redacts()})
+	if err != nil {
+		return "", err
+	}
+	eventNID, ok := eventNIDs[redaction.Redacts()]
+	if !ok {
+		// We don't have the event yet.
+		return "", nil
+	}
+
+	events, err := db.Events([]types.EventNID{eventNID})
+	if err != nil {
+		return "", err
+	}
+	if len(events) != 1 || events[0].RoomID() != redaction.RoomID() {
+		// Redactions can only redact events in the same room.
+		return "", nil
+	}
+
+	if err = db.RedactEvent(redaction.EventID(), eventNID, events[0].Redact().JSON()); err != nil {
+		return "", err
+	}
+	return redaction.Redacts(), nil
+}
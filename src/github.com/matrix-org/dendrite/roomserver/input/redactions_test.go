@@ -0,0 +1,146 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"testing"
+)
+
+// testRedactionDatabase is a RoomEventDatabase that stores events and redactions in memory.
+// Only the methods needed by processRedactions are implemented.
+type testRedactionDatabase struct {
+	RoomEventDatabase
+	events     map[types.EventNID]gomatrixserverlib.Event
+	redactions []types.Redaction
+}
+
+func (db *testRedactionDatabase) storeEvent(t *testing.T, eventNID types.EventNID, eventJSON string) gomatrixserverlib.Event {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.events[eventNID] = event
+	return event
+}
+
+func (db *testRedactionDatabase) EventNIDs(eventIDs []string) (map[string]types.EventNID, error) {
+	result := map[string]types.EventNID{}
+	for eventNID, event := range db.events {
+		for _, eventID := range eventIDs {
+			if event.EventID() == eventID {
+				result[eventID] = eventNID
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testRedactionDatabase) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventNID := range eventNIDs {
+		if event, ok := db.events[eventNID]; ok {
+			result = append(result, types.Event{EventNID: eventNID, Event: event})
+		}
+	}
+	return result, nil
+}
+
+func (db *testRedactionDatabase) StoreRedaction(redactionEventID, redactsEventID string, roomNID types.RoomNID) error {
+	for _, redaction := range db.redactions {
+		if redaction.RedactionEventID == redactionEventID {
+			return nil
+		}
+	}
+	db.redactions = append(db.redactions, types.Redaction{
+		RedactionEventID: redactionEventID,
+		RedactsEventID:   redactsEventID,
+		RoomNID:          roomNID,
+	})
+	return nil
+}
+
+func (db *testRedactionDatabase) RedactionsForEvent(redactsEventID string) ([]types.Redaction, error) {
+	var result []types.Redaction
+	for _, redaction := range db.redactions {
+		if redaction.RedactsEventID == redactsEventID {
+			result = append(result, redaction)
+		}
+	}
+	return result, nil
+}
+
+func (db *testRedactionDatabase) RedactEvent(redactionEventID string, eventNID types.EventNID, redactedJSON []byte) error {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(redactedJSON, true)
+	if err != nil {
+		return err
+	}
+	db.events[eventNID] = event
+	for i := range db.redactions {
+		if db.redactions[i].RedactionEventID == redactionEventID {
+			db.redactions[i].RedactsEventNID = eventNID
+		}
+	}
+	return nil
+}
+
+const testMessageJSON = `{"type":"m.room.message","event_id":"$message:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":3,"prev_events":[],"content":{"body":"secret"}}`
+
+const testRedactionJSON = `{"type":"m.room.redaction","event_id":"$redaction:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":4,"prev_events":[],"redacts":"$message:a","content":{}}`
+
+const testOtherRoomRedactionJSON = `{"type":"m.room.redaction","event_id":"$redaction:a","room_id":"!other:a",` +
+	`"sender":"@alice:a","depth":4,"prev_events":[],"redacts":"$message:a","content":{}}`
+
+func TestProcessRedactions(t *testing.T) {
+	// The redaction arrives after the event it redacts.
+	db := &testRedactionDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}}
+	message := db.storeEvent(t, 1, testMessageJSON)
+	if result, err := processRedactions(db, 1, 1, message); err != nil {
+		t.Fatal(err)
+	} else if result != (appliedRedactions{}) {
+		t.Fatalf("Wanted no redactions to be applied, got %#v", result)
+	}
+	redaction := db.storeEvent(t, 2, testRedactionJSON)
+	result, err := processRedactions(db, 1, 2, redaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.redactsEventID != "$message:a" || result.redactedBecauseEventID != "" {
+		t.Fatalf("Wanted the redaction to redact $message:a, got %#v", result)
+	}
+	if !db.events[1].Redacted() || string(db.events[1].Content()) != "{}" {
+		t.Fatalf("Wanted $message:a to be redacted, got %s", string(db.events[1].JSON()))
+	}
+
+	// The redaction arrives before the event it redacts.
+	db = &testRedactionDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}}
+	redaction = db.storeEvent(t, 1, testRedactionJSON)
+	if result, err = processRedactions(db, 1, 1, redaction); err != nil {
+		t.Fatal(err)
+	}
+	if result.redactsEventID != "" {
+		t.Fatalf("Wanted the redaction not to be applied yet, got %#v", result)
+	}
+	message = db.storeEvent(t, 2, testMessageJSON)
+	if result, err = processRedactions(db, 1, 2, message); err != nil {
+		t.Fatal(err)
+	}
+	if result.redactedBecauseEventID != "$redaction:a" {
+		t.Fatalf("Wanted $message:a to be redacted by $redaction:a, got %#v", result)
+	}
+	if !db.events[2].Redacted() {
+		t.Fatalf("Wanted $message:a to be redacted, got %s", string(db.events[2].JSON()))
+	}
+
+	// Redactions in a different room are never applied.
+	db = &testRedactionDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}}
+	db.storeEvent(t, 1, testMessageJSON)
+	redaction = db.storeEvent(t, 2, testOtherRoomRedactionJSON)
+	if result, err = processRedactions(db, 2, 2, redaction); err != nil {
+		t.Fatal(err)
+	}
+	if result.redactsEventID != "" || db.events[1].Redacted() {
+		t.Fatalf("Wanted the redaction from another room not to be applied, got %#v", result)
+	}
+}
@@ -0,0 +1,272 @@
+package input
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"time"
+)
+
+// A RegenerateOutputDatabase has the storage APIs needed to regenerate the output log.
+type RegenerateOutputDatabase interface {
+	RoomEventDatabase
+	// Lookup the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	RoomNID(roomID string) (types.RoomNID, error)
+	// Lookup the numeric IDs of every room.
+	RoomNIDs() ([]types.RoomNID, error)
+	// Lookup the numeric IDs of the events in a room that were written to the output log,
+	// in the order they were written.
+	SentEventNIDs(roomNID types.RoomNID) ([]types.EventNID, error)
+}
+
+// regenerateBatchSize is the number of events loaded from the database at a time.
+const regenerateBatchSize = 100
+
+// An OutputRegenerator rebuilds the output log from the events stored in the database.
+// The events in each room are replayed in the order they were first written to the
+// output log, and the latest events and the current state of the room are worked out
+// again as each event is replayed. The output for an event is the same as the output
+// written when it was processed, except that the event is written in its current form,
+// which is redacted if the event has since been redacted.
+// Rooms are regenerated one at a time, so the messages for different rooms aren't
+// interleaved in the order they were originally written.
+type OutputRegenerator struct {
+	// The database the events are read from.
+	DB RegenerateOutputDatabase
+	// The producer used to write the messages.
+	Producer sarama.SyncProducer
+	// The kafkaesque topic to write the messages to.
+	OutputRoomEventTopic string
+	// Write the output log in the format used before the api.OutputEvent envelope was introduced.
+	LegacyOutput bool
+	// The IDs of the rooms to regenerate the output for.
+	// If this is empty then the output for every room is regenerated.
+	RoomIDs []string
+	// Only write the messages for events with an origin_server_ts at or after From.
+	// If this is the zero time then there is no lower limit.
+	From time.Time
+	// Only write the messages for events with an origin_server_ts before To.
+	// If this is the zero time then there is no upper limit.
+	To time.Time
+}
+
+// Regenerate writes the output for the rooms to the output log.
+// Returns the number of messages written.
+func (r *OutputRegenerator) Regenerate() (int, error) {
+	var roomNIDs []types.RoomNID
+	if len(r.RoomIDs) == 0 {
+		var err error
+		if roomNIDs, err = r.DB.RoomNIDs(); err != nil {
+			return 0, err
+		}
+	}
+	for _, roomID := range r.RoomIDs {
+		roomNID, err := r.DB.RoomNID(roomID)
+		if err != nil {
+			return 0, err
+		}
+		if roomNID != 0 {
+			roomNIDs = append(roomNIDs, roomNID)
+		}
+	}
+
+	var count int
+	for _, roomNID := range roomNIDs {
+		written, err := r.regenerateRoom(roomNID)
+		count += written
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// roomReplay tracks the state of a room while its events are replayed.
+type roomReplay struct {
+	// The ID of the last event replayed, used as the LastSentEventID of the next event.
+	lastEventIDSent string
+	// The latest events in the room after the last event replayed.
+	latest []types.StateAtEventAndReference
+	// The current state of the room after the last event replayed.
+	current []types.StateEntry
+	// The IDs of the events referenced as prev_events by the events replayed so far.
+	referenced map[string]bool
+	// The IDs of the events replayed so far.
+	replayed map[string]bool
+}
+
+// regenerateRoom replays the events that were written to the output log for a room.
+// Every event is replayed so that the LastSentEventID, the latest events and the state
+// deltas are correct, but only the messages for the events in the time range are written.
+// Returns the number of messages written.
+func (r *OutputRegenerator) regenerateRoom(roomNID types.RoomNID) (int, error) {
+	eventNIDs, err := r.DB.SentEventNIDs(roomNID)
+	if err != nil {
+		return 0, err
+	}
+	replay := roomReplay{referenced: map[string]bool{}, replayed: map[string]bool{}}
+	var count int
+	for len(eventNIDs) > 0 {
+		batch := eventNIDs
+		if len(batch) > regenerateBatchSize {
+			batch = batch[:regenerateBatchSize]
+		}
+		eventNIDs = eventNIDs[len(batch):]
+
+		var events []types.Event
+		if events, err = r.DB.Events(batch); err != nil {
+			return count, err
+		}
+		eventMap := make(map[types.EventNID]gomatrixserverlib.Event, len(events))
+		for _, event := range events {
+			eventMap[event.EventNID] = event.Event
+		}
+		for _, eventNID := range batch {
+			event, ok := eventMap[eventNID]
+			if !ok {
+				continue
+			}
+			var outputEvents []api.OutputEvent
+			if outputEvents, err = replay.replayEvent(r.DB, event); err != nil {
+				return count, err
+			}
+			if !r.inTimeRange(event) {
+				continue
+			}
+			for _, output := range outputEvents {
+				var written bool
+				if written, err = r.writeOutput(output); err != nil {
+					return count, err
+				}
+				if written {
+					count++
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+// replayEvent updates the latest events and the current state of the room for the next event
+// in the room and returns the messages to write to the output log for the event.
+func (r *roomReplay) replayEvent(db RegenerateOutputDatabase, event gomatrixserverlib.Event) ([]api.OutputEvent, error) {
+	stateAtEvents, err := db.StateAtEventIDs([]string{event.EventID()})
+	if err != nil {
+		return nil, err
+	}
+	stateAtEvent := stateAtEvents[0]
+
+	oldLatest := r.latest
+	alreadyReferenced := r.referenced[event.EventID()]
+	prevEvents := event.PrevEvents()
+	for _, prevEvent := range prevEvents {
+		r.referenced[prevEvent.EventID] = true
+	}
+	r.latest = calculateLatest(oldLatest, alreadyReferenced, prevEvents, types.StateAtEventAndReference{
+		EventReference: event.EventReference(),
+		StateAtEvent:   stateAtEvent,
+	})
+
+	output := roomEventOutput{event: event, lastEventIDSent: r.lastEventIDSent, latest: r.latest}
+	if !sameLatestEvents(oldLatest, r.latest) || r.current == nil {
+		latestStateAtEvents := make([]types.StateAtEvent, len(r.latest))
+		for i := range r.latest {
+			latestStateAtEvents[i] = r.latest[i].StateAtEvent
+		}
+		var current []types.StateEntry
+		if current, err = state.LoadStateAfterEvents(db, latestStateAtEvents); err != nil {
+			return nil, err
+		}
+		output.removed, output.added = state.DifferenceBetweenStateEntries(r.current, current)
+		r.current = current
+	}
+
+	if output.visibility, err = loadVisibilityState(db, stateAtEvent); err != nil {
+		return nil, err
+	}
+	if output.redactions, err = r.replayedRedactions(db, event); err != nil {
+		return nil, err
+	}
+
+	r.lastEventIDSent = event.EventID()
+	r.replayed[event.EventID()] = true
+	return output.outputEvents(db)
+}
+
+// replayedRedactions works out which redactions to report in the output for an event.
+// The stored form of an event that has been redacted is the redacted form, so its
+// output says which redaction redacted it. A redaction says which event it redacted
+// if that event has already been replayed.
+func (r *roomReplay) replayedRedactions(db RegenerateOutputDatabase, event gomatrixserverlib.Event) (
+	result appliedRedactions, err error,
+) {
+	var redactions []types.Redaction
+	if event.Type() == mRoomRedaction && event.Redacts() != "" && r.replayed[event.Redacts()] {
+		if redactions, err = db.RedactionsForEvent(event.Redacts()); err != nil {
+			return result, err
+		}
+		for _, redaction := range redactions {
+			if redaction.RedactionEventID == event.EventID() && redaction.RedactsEventNID != 0 {
+				result.redactsEventID = event.Redacts()
+			}
+		}
+	}
+
+	if redactions, err = db.RedactionsForEvent(event.EventID()); err != nil {
+		return result, err
+	}
+	for _, redaction := range redactions {
+		if redaction.RedactsEventNID != 0 {
+			result.redactedBecauseEventID = redaction.RedactionEventID
+		}
+	}
+	return result, nil
+}
+
+// inTimeRange returns whether the origin_server_ts of an event is in the time range of the regenerator.
+func (r *OutputRegenerator) inTimeRange(event gomatrixserverlib.Event) bool {
+	if r.From.IsZero() && r.To.IsZero() {
+		return true
+	}
+	var fields struct {
+		OriginServerTS int64 `json:"origin_server_ts"`
+	}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return false
+	}
+	ts := time.Unix(0, fields.OriginServerTS*int64(time.Millisecond))
+	if !r.From.IsZero() && ts.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && !ts.Before(r.To) {
+		return false
+	}
+	return true
+}
+
+// writeOutput writes a message to the output log in the same way as the OutputPublisher.
+// Returns false if the message was dropped because it can't be written in the legacy format.
+func (r *OutputRegenerator) writeOutput(output api.OutputEvent) (bool, error) {
+	output.Version = api.OutputEventVersion
+	value, err := json.Marshal(output)
+	if err != nil {
+		return false, err
+	}
+	if r.LegacyOutput {
+		if value, err = legacyOutput(value); err != nil || value == nil {
+			return false, err
+		}
+	}
+	var m sarama.ProducerMessage
+	m.Topic = r.OutputRoomEventTopic
+	m.Key = sarama.StringEncoder("")
+	m.Value = sarama.ByteEncoder(value)
+	if _, _, err = r.Producer.SendMessage(&m); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package input
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"testing"
+	"time"
+)
+
+// testRegenerateDatabase is a RegenerateOutputDatabase for a single room stored in memory.
+type testRegenerateDatabase struct {
+	testExtremitiesDatabase
+	// The state at each event indexed by event ID.
+	states map[string]types.StateAtEvent
+	// The events that were written to the output log in the order they were written.
+	sent []types.EventNID
+	// The redactions indexed by the ID of the event they redact.
+	redactions map[string][]types.Redaction
+}
+
+func (db *testRegenerateDatabase) RoomNID(roomID string) (types.RoomNID, error) {
+	if roomID == "!room:a" {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (db *testRegenerateDatabase) RoomNIDs() ([]types.RoomNID, error) {
+	return []types.RoomNID{1}, nil
+}
+
+func (db *testRegenerateDatabase) SentEventNIDs(roomNID types.RoomNID) ([]types.EventNID, error) {
+	return db.sent, nil
+}
+
+func (db *testRegenerateDatabase) StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error) {
+	var result []types.StateAtEvent
+	for _, eventID := range eventIDs {
+		result = append(result, db.states[eventID])
+	}
+	return result, nil
+}
+
+func (db *testRegenerateDatabase) EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	result := map[types.EventNID]string{}
+	for _, eventNID := range eventNIDs {
+		result[eventNID] = db.events[eventNID].EventID()
+	}
+	return result, nil
+}
+
+func (db *testRegenerateDatabase) RedactionsForEvent(redactsEventID string) ([]types.Redaction, error) {
+	return db.redactions[redactsEventID], nil
+}
+
+func newTestRegenerateDatabase(t *testing.T) *testRegenerateDatabase {
+	db := &testRegenerateDatabase{
+		testExtremitiesDatabase: testExtremitiesDatabase{events: map[types.EventNID]gomatrixserverlib.Event{}},
+		states:                  map[string]types.StateAtEvent{},
+	}
+	db.storeEvent(t, 1, `{"type":"m.room.create","event_id":"$create:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"state_key":"","depth":1,"origin_server_ts":1000,"prev_events":[],"content":{"creator":"@alice:a"}}`)
+	db.storeEvent(t, 2, `{"type":"m.room.member","event_id":"$join:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"state_key":"@alice:a","depth":2,"origin_server_ts":2000,"prev_events":`+prevEventsJSON(t, db.events[1])+`,`+
+		`"content":{"membership":"join"}}`)
+	// The message has been redacted so the stored form is the redacted form.
+	db.storeEvent(t, 3, `{"type":"m.room.message","event_id":"$message:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"depth":3,"origin_server_ts":3000,"prev_events":`+prevEventsJSON(t, db.events[2])+`,"content":{}}`)
+	db.storeEvent(t, 4, `{"type":"m.room.redaction","event_id":"$redaction:a","room_id":"!room:a","sender":"@alice:a",`+
+		`"redacts":"$message:a","depth":4,"origin_server_ts":4000,"prev_events":`+prevEventsJSON(t, db.events[3])+`,"content":{}}`)
+	db.sent = []types.EventNID{1, 2, 3, 4}
+	db.redactions = map[string][]types.Redaction{"$message:a": {{
+		RedactionEventID: "$redaction:a", RedactsEventID: "$message:a", RoomNID: 1, RedactsEventNID: 3,
+	}}}
+
+	create := types.StateEntry{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1}
+	join := types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, 2}, 2}
+	beforeCreate, _ := db.AddState(1, nil, nil)
+	beforeJoin, _ := db.AddState(1, nil, []types.StateEntry{create})
+	afterJoin, _ := db.AddState(1, nil, []types.StateEntry{create, join})
+	db.states["$create:a"] = types.StateAtEvent{BeforeStateSnapshotNID: beforeCreate, StateEntry: create}
+	db.states["$join:a"] = types.StateAtEvent{BeforeStateSnapshotNID: beforeJoin, StateEntry: join}
+	db.states["$message:a"] = types.StateAtEvent{BeforeStateSnapshotNID: afterJoin, StateEntry: types.StateEntry{
+		StateKeyTuple: types.StateKeyTuple{65536, 0}, EventNID: 3,
+	}}
+	db.states["$redaction:a"] = types.StateAtEvent{BeforeStateSnapshotNID: afterJoin, StateEntry: types.StateEntry{
+		StateKeyTuple: types.StateKeyTuple{65537, 0}, EventNID: 4,
+	}}
+	return db
+}
+
+// prevEventsJSON returns the JSON for a list of prev_events that references an event.
+func prevEventsJSON(t *testing.T, event gomatrixserverlib.Event) string {
+	prevEvents, err := json.Marshal([]gomatrixserverlib.EventReference{event.EventReference()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(prevEvents)
+}
+
+// decodeOutput decodes the messages written to a testSyncProducer.
+func decodeOutput(t *testing.T, producer *testSyncProducer) []*api.OutputEvent {
+	var result []*api.OutputEvent
+	for _, value := range producer.sent {
+		output, err := api.DecodeOutputEvent([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, output)
+	}
+	return result
+}
+
+func TestRegenerateOutput(t *testing.T) {
+	producer := &testSyncProducer{failAfter: -1}
+	r := OutputRegenerator{DB: newTestRegenerateDatabase(t), Producer: producer}
+	count, err := r.Regenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := decodeOutput(t, producer)
+	if count != 5 || len(output) != 5 {
+		t.Fatalf("Wanted 5 messages, got %d messages and a count of %d", len(output), count)
+	}
+
+	wantTypes := []api.OutputType{
+		api.OutputTypeNewRoomEvent, api.OutputTypeNewRoomEvent, api.OutputTypeNewRoomEvent,
+		api.OutputTypeNewRoomEvent, api.OutputTypeRedactedEvent,
+	}
+	for i := range wantTypes {
+		if output[i].Type != wantTypes[i] {
+			t.Fatalf("Wanted message %d to be a %s, got a %s", i, wantTypes[i], output[i].Type)
+		}
+	}
+
+	join := output[1].NewRoomEvent
+	if join.LastSentEventID != "$create:a" {
+		t.Fatalf("Wanted the LastSentEventID of the join to be $create:a, got %q", join.LastSentEventID)
+	}
+	if len(join.LatestEventIDs) != 1 || join.LatestEventIDs[0] != "$join:a" {
+		t.Fatalf("Wanted the latest events after the join to be [$join:a], got %v", join.LatestEventIDs)
+	}
+	if len(join.AddsStateEventIDs) != 1 || join.AddsStateEventIDs[0] != "$join:a" {
+		t.Fatalf("Wanted the join to add [$join:a] to the state, got %v", join.AddsStateEventIDs)
+	}
+	if len(join.VisibilityEventIDs) != 0 {
+		t.Fatalf("Wanted no visibility events for the join, got %v", join.VisibilityEventIDs)
+	}
+
+	message := output[2].NewRoomEvent
+	if message.RedactedBecauseEventID != "$redaction:a" || len(message.AddsStateEventIDs) != 0 {
+		t.Fatalf("Wanted the message to be redacted without changing the state, got %#v", message)
+	}
+	if len(message.VisibilityEventIDs) != 1 || message.VisibilityEventIDs[0] != "$join:a" {
+		t.Fatalf("Wanted the visibility events for the message to be [$join:a], got %v", message.VisibilityEventIDs)
+	}
+
+	if redaction := output[3].NewRoomEvent; redaction.RedactsEventID != "$message:a" {
+		t.Fatalf("Wanted the redaction to redact $message:a, got %q", redaction.RedactsEventID)
+	}
+	if redacted := output[4].RedactedEvent; redacted.RedactedEventID != "$message:a" {
+		t.Fatalf("Wanted $message:a to be redacted, got %q", redacted.RedactedEventID)
+	}
+}
+
+func TestRegenerateOutputTimeRange(t *testing.T) {
+	producer := &testSyncProducer{failAfter: -1}
+	r := OutputRegenerator{
+		DB:       newTestRegenerateDatabase(t),
+		Producer: producer,
+		RoomIDs:  []string{"!room:a", "!missing:a"},
+		From:     time.Unix(2, 0),
+		To:       time.Unix(3, 0),
+	}
+	if _, err := r.Regenerate(); err != nil {
+		t.Fatal(err)
+	}
+	output := decodeOutput(t, producer)
+	if len(output) != 1 || output[0].NewRoomEvent == nil {
+		t.Fatalf("Wanted the output for the join only, got %d messages", len(output))
+	}
+	join := output[0].NewRoomEvent
+	if join.LastSentEventID != "$create:a" {
+		t.Fatalf("Wanted the LastSentEventID of the join to be $create:a, got %q", join.LastSentEventID)
+	}
+}
@@ -0,0 +1,44 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A rejectedEventError is returned by processRoomEvent when the event was
+// rejected. Events that fail the auth checks are stored before they are
+// rejected. Events that fail the signature checks are not stored.
+type rejectedEventError struct {
+	// The rejected event.
+	event gomatrixserverlib.Event
+	// Why the event was rejected.
+	reason string
+}
+
+func (e *rejectedEventError) Error() string {
+	return "input: event " + e.event.EventID() + " rejected: " + e.reason
+}
+
+// rejectRoomEvent marks a stored event as rejected.
+// The state before a rejected event is still worked out, unless it is an outlier, so
+// that the events that reference it in their prev_events can be placed in the event graph.
+// But a rejected event never changes the state of the room, is never one of the latest
+// events in the room and isn't written to the output log.
+// Returns a *rejectedEventError if the event was rejected successfully.
+func rejectRoomEvent(
+	db RoomEventDatabase, roomNID types.RoomNID, stateAtEvent types.StateAtEvent, event gomatrixserverlib.Event,
+	input api.InputRoomEvent, notAllowed *gomatrixserverlib.NotAllowed, maxStateBlockNIDs int,
+) error {
+	if err := db.MarkEventRejected(stateAtEvent.EventNID, notAllowed.Error()); err != nil {
+		return err
+	}
+
+	if input.Kind != api.KindOutlier {
+		if err := storeStateBeforeEvent(db, roomNID, &stateAtEvent, event, input, maxStateBlockNIDs); err != nil {
+			return err
+		}
+	}
+
+	return &rejectedEventError{event: event, reason: notAllowed.Error()}
+}
@@ -0,0 +1,74 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"testing"
+)
+
+// testRejectedAuthDatabase is a testPromotionDatabase where "$rejected:a" is an event that was rejected.
+type testRejectedAuthDatabase struct {
+	testPromotionDatabase
+	// The rejection reasons of the events marked as rejected, indexed by event NID.
+	rejected map[types.EventNID]string
+}
+
+func (db *testRejectedAuthDatabase) StateEntriesForEventIDs(eventIDs []string) ([]types.StateEntry, error) {
+	for _, eventID := range eventIDs {
+		if eventID == "$rejected:a" {
+			return nil, types.RejectedEventError("$rejected:a was rejected")
+		}
+	}
+	return nil, nil
+}
+
+func (db *testRejectedAuthDatabase) MarkEventRejected(eventNID types.EventNID, reason string) error {
+	db.rejected[eventNID] = reason
+	return nil
+}
+
+func newTestRejectedAuthDatabase() *testRejectedAuthDatabase {
+	return &testRejectedAuthDatabase{
+		testPromotionDatabase: testPromotionDatabase{events: map[string]types.StateAtEvent{}},
+		rejected:              map[types.EventNID]string{},
+	}
+}
+
+func TestProcessRoomEventRejectsEventsAuthedByRejectedEvents(t *testing.T) {
+	db := newTestRejectedAuthDatabase()
+	input := api.InputRoomEvent{
+		Kind:         api.KindNew,
+		Event:        []byte(testCreateJSON),
+		AuthEventIDs: []string{"$rejected:a"},
+	}
+
+	err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs)
+	if _, ok := err.(*rejectedEventError); !ok {
+		t.Fatalf("Wanted a *rejectedEventError, got %v", err)
+	}
+	eventNID := db.events["$create:a"].EventNID
+	if _, ok := db.rejected[eventNID]; !ok {
+		t.Fatalf("Wanted the event to be stored as rejected")
+	}
+	if len(db.linked) != 0 || len(db.output) != 0 {
+		t.Fatalf("Wanted the rejected event to be kept out of the event graph and the output log")
+	}
+}
+
+func TestProcessRoomEventFailsWithRejectedStateEvents(t *testing.T) {
+	db := newTestRejectedAuthDatabase()
+	input := api.InputRoomEvent{
+		Kind:          api.KindNew,
+		Event:         []byte(testCreateJSON),
+		HasState:      true,
+		StateEventIDs: []string{"$rejected:a"},
+	}
+
+	err := processRoomEvent(db, nil, input, inputOffset{}, DefaultMaxStateBlockNIDs)
+	if _, ok := err.(types.RejectedEventError); !ok {
+		t.Fatalf("Wanted a types.RejectedEventError, got %v", err)
+	}
+	if db.events["$create:a"].BeforeStateSnapshotNID != 0 || len(db.output) != 0 {
+		t.Fatalf("Wanted no state to be stored for the event")
+	}
+}
@@ -1,67 +1,163 @@
 package input
 
 import (
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"testing"
 )
 
-type sortBytes []byte
+// testRoomEventDatabase is a RoomEventDatabase that serves events from memory.
+// Only the methods needed by the tests are implemented, calling any other
+// method will panic.
+type testRoomEventDatabase struct {
+	RoomEventDatabase
+	// The state snapshots indexed by numeric state snapshot ID minus one.
+	stateBlockNIDLists []types.StateBlockNIDList
+	// The state data blocks indexed by numeric state data ID minus one.
+	stateEntryLists []types.StateEntryList
+}
 
-func (s sortBytes) Len() int           { return len(s) }
-func (s sortBytes) Less(i, j int) bool { return s[i] < s[j] }
-func (s sortBytes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (db *testRoomEventDatabase) StateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	result := make([]types.StateBlockNIDList, len(stateNIDs))
+	for i, stateNID := range stateNIDs {
+		result[i] = db.stateBlockNIDLists[stateNID-1]
+	}
+	return result, nil
+}
 
-func TestUnique(t *testing.T) {
-	testCases := []struct {
-		Input string
-		Want  string
-	}{
-		{"", ""},
-		{"abc", "abc"},
-		{"aaabbbccc", "abc"},
+func (db *testRoomEventDatabase) StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	result := make([]types.StateEntryList, len(stateBlockNIDs))
+	for i, stateBlockNID := range stateBlockNIDs {
+		result[i] = db.stateEntryLists[stateBlockNID-1]
 	}
+	return result, nil
+}
 
-	for _, test := range testCases {
-		input := []byte(test.Input)
-		want := string(test.Want)
-		got := string(input[:unique(sortBytes(input))])
-		if got != want {
-			t.Fatal("Wanted ", want, " got ", got)
-		}
+func (db *testRoomEventDatabase) LockRoomState(roomNID types.RoomNID) (types.RoomStateLock, error) {
+	return testRoomStateLock{}, nil
+}
+
+// testRoomStateLock is a RoomStateLock that doesn't lock anything.
+type testRoomStateLock struct{}
+
+func (testRoomStateLock) Unlock() error { return nil }
+
+func (db *testRoomEventDatabase) AddState(
+	roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	if len(state) > 0 {
+		stateBlockNID := types.StateBlockNID(len(db.stateEntryLists) + 1)
+		db.stateEntryLists = append(db.stateEntryLists, types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  state,
+		})
+		stateBlockNIDs = append(stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)], stateBlockNID)
 	}
+	stateNID := types.StateSnapshotNID(len(db.stateBlockNIDLists) + 1)
+	db.stateBlockNIDLists = append(db.stateBlockNIDLists, types.StateBlockNIDList{
+		StateSnapshotNID: stateNID,
+		StateBlockNIDs:   stateBlockNIDs,
+	})
+	return stateNID, nil
 }
 
-func TestFindDuplicateStateKeys(t *testing.T) {
-	testCases := []struct {
-		Input []types.StateEntry
-		Want  []types.StateEntry
-	}{{
-		Input: []types.StateEntry{
-			{types.StateKeyTuple{1, 1}, 1},
-			{types.StateKeyTuple{1, 1}, 2},
-			{types.StateKeyTuple{2, 2}, 3},
-		},
-		Want: []types.StateEntry{
-			{types.StateKeyTuple{1, 1}, 1},
-			{types.StateKeyTuple{1, 1}, 2},
+// storedStateEntries returns the number of state entries stored in all the state data blocks.
+func (db *testRoomEventDatabase) storedStateEntries() int {
+	var count int
+	for _, list := range db.stateEntryLists {
+		count += len(list.StateEntries)
+	}
+	return count
+}
+
+// newTestForkedRoom creates a room with the given number of members and two prev events
+// that fork from the same state. The first prev event is a new member joining and
+// the second is a message.
+func newTestForkedRoom(members int) (*testRoomEventDatabase, []types.StateAtEvent) {
+	db := &testRoomEventDatabase{}
+	var state []types.StateEntry
+	state = append(state, types.StateEntry{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1})
+	for i := 0; i < members; i++ {
+		state = append(state, types.StateEntry{
+			types.StateKeyTuple{types.MRoomMemberNID, types.EventStateKeyNID(i + 2)},
+			types.EventNID(i + 2),
+		})
+	}
+	stateNID, _ := db.AddState(1, nil, state)
+	prevStates := []types.StateAtEvent{{
+		BeforeStateSnapshotNID: stateNID,
+		StateEntry: types.StateEntry{
+			types.StateKeyTuple{types.MRoomMemberNID, types.EventStateKeyNID(members + 2)},
+			types.EventNID(members + 2),
 		},
 	}, {
-		Input: []types.StateEntry{
-			{types.StateKeyTuple{1, 1}, 1},
-			{types.StateKeyTuple{1, 2}, 2},
-		},
-		Want: nil,
+		BeforeStateSnapshotNID: stateNID,
+		StateEntry:             types.StateEntry{types.StateKeyTuple{65536, 0}, types.EventNID(members + 3)},
 	}}
+	return db, prevStates
+}
 
-	for _, test := range testCases {
-		got := findDuplicateStateKeys(test.Input)
-		if len(got) != len(test.Want) {
-			t.Fatalf("Wanted %v, got %v", test.Want, got)
-		}
-		for i := range got {
-			if got[i] != test.Want[i] {
-				t.Fatalf("Wanted %v, got %v", test.Want, got)
-			}
+func TestCalculateAndStoreStateManyDelta(t *testing.T) {
+	db, prevStates := newTestForkedRoom(100)
+	before := db.storedStateEntries()
+
+	stateNID, err := calculateAndStoreStateMany(db, 1, prevStates, DefaultMaxStateBlockNIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the new member event should have been stored.
+	if added := db.storedStateEntries() - before; added != 1 {
+		t.Fatalf("Wanted 1 new state entry to be stored, got %d", added)
+	}
+	// The new snapshot should reuse the block from the old snapshot.
+	want := []types.StateBlockNID{1, 2}
+	got := db.stateBlockNIDLists[stateNID-1].StateBlockNIDs
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Wanted state block NIDs %v, got %v", want, got)
+	}
+	// The full state should include the new member event.
+	entries, err := state.LoadStateAtSnapshot(db, stateNID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 102 {
+		t.Fatalf("Wanted 102 state entries, got %d", len(entries))
+	}
+	if _, ok := state.StateEntryMap(entries).Lookup(prevStates[0].StateKeyTuple); !ok {
+		t.Fatalf("Wanted %v to be in the state", prevStates[0].StateKeyTuple)
+	}
+
+	// When the snapshot already has too many blocks the full state is stored.
+	db, prevStates = newTestForkedRoom(100)
+	before = db.storedStateEntries()
+	if _, err = calculateAndStoreStateMany(db, 1, prevStates, 1); err != nil {
+		t.Fatal(err)
+	}
+	if added := db.storedStateEntries() - before; added != 102 {
+		t.Fatalf("Wanted 102 new state entries to be stored, got %d", added)
+	}
+}
+
+func benchmarkCalculateAndStoreStateMany(members, maxStateBlockNIDs int, b *testing.B) {
+	var stored int
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, prevStates := newTestForkedRoom(members)
+		before := db.storedStateEntries()
+		b.StartTimer()
+		if _, err := calculateAndStoreStateMany(db, 1, prevStates, maxStateBlockNIDs); err != nil {
+			b.Fatal(err)
 		}
+		stored += db.storedStateEntries() - before
 	}
+	b.ReportMetric(float64(stored)/float64(b.N), "entries/op")
+}
+
+func BenchmarkCalculateAndStoreStateMany1000FullCopy(b *testing.B) {
+	benchmarkCalculateAndStoreStateMany(1000, 1, b)
+}
+
+func BenchmarkCalculateAndStoreStateMany1000Delta(b *testing.B) {
+	benchmarkCalculateAndStoreStateMany(1000, DefaultMaxStateBlockNIDs, b)
 }
@@ -0,0 +1,40 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// loadVisibilityState loads the state entries needed to work out which users can see an event.
+// These are taken from the state of the room before the event so that, for example,
+// a user joining the room is not considered to have been able to see their own join.
+// Returns a list of state entries sorted by state key tuple.
+func loadVisibilityState(db RoomEventDatabase, stateAtEvent types.StateAtEvent) ([]types.StateEntry, error) {
+	if stateAtEvent.BeforeStateSnapshotNID == 0 {
+		// We don't know the state before the event so we can't say who can see it.
+		return nil, nil
+	}
+	entries, err := state.LoadStateAtSnapshot(db, stateAtEvent.BeforeStateSnapshotNID)
+	if err != nil {
+		return nil, err
+	}
+	return visibilityStateEntries(entries), nil
+}
+
+// visibilityStateEntries picks the entries needed to work out the visibility of an event from
+// a list of state entries. This is all the m.room.member events and the m.room.history_visibility event.
+// The order of the entries is preserved.
+func visibilityStateEntries(state []types.StateEntry) []types.StateEntry {
+	var result []types.StateEntry
+	for _, entry := range state {
+		switch entry.EventTypeNID {
+		case types.MRoomMemberNID:
+			result = append(result, entry)
+		case types.MRoomHistoryVisibilityNID:
+			if entry.EventStateKeyNID == types.EmptyStateKeyNID {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result
+}
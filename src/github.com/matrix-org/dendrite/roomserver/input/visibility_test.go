@@ -0,0 +1,32 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"testing"
+)
+
+func TestVisibilityStateEntries(t *testing.T) {
+	input := []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1},
+		{types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID}, 2},
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 3},
+		{types.StateKeyTuple{types.MRoomMemberNID, 3}, 4},
+		{types.StateKeyTuple{types.MRoomHistoryVisibilityNID, types.EmptyStateKeyNID}, 5},
+		{types.StateKeyTuple{types.MRoomHistoryVisibilityNID, 2}, 6},
+		{types.StateKeyTuple{65536, types.EmptyStateKeyNID}, 7},
+	}
+	want := []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 3},
+		{types.StateKeyTuple{types.MRoomMemberNID, 3}, 4},
+		{types.StateKeyTuple{types.MRoomHistoryVisibilityNID, types.EmptyStateKeyNID}, 5},
+	}
+	got := visibilityStateEntries(input)
+	if len(got) != len(want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package input
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/prometheus/client_golang/prometheus"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultWorkers is the number of workers used by the Consumer if Workers isn't set.
+const DefaultWorkers = 16
+
+// workerQueueSize is the number of events that can be waiting for each worker
+// before the partition goroutines stop reading from the input log.
+const workerQueueSize = 16
+
+var (
+	workersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_workers",
+		Help:      "The number of workers processing input room events.",
+	})
+	busyWorkersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_workers_busy",
+		Help:      "The number of workers currently processing an input room event.",
+	})
+	queuedEventsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "input_queued_events",
+		Help:      "The number of input room events waiting for a worker.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(workersGauge, busyWorkersGauge, queuedEventsGauge)
+}
+
+// An inputTask is an input room event waiting to be processed by a worker.
+type inputTask struct {
+	message  *sarama.ConsumerMessage
+	input    api.InputRoomEvent
+	progress *partitionProgress
+}
+
+// startWorkers starts the goroutines that process the input room events.
+func (c *Consumer) startWorkers() {
+	n := c.Workers
+	if n == 0 {
+		n = DefaultWorkers
+	}
+	c.workers = make([]chan inputTask, n)
+	for i := range c.workers {
+		c.workers[i] = make(chan inputTask, workerQueueSize)
+		c.workersRunning.Add(1)
+		go c.runWorker(c.workers[i])
+	}
+	workersGauge.Set(float64(n))
+}
+
+// stopWorkers waits for the workers to process the events already sent to them and then stops them.
+// It must only be called once nothing else is sending events to the workers.
+func (c *Consumer) stopWorkers() {
+	for _, tasks := range c.workers {
+		close(tasks)
+	}
+	c.workersRunning.Wait()
+	workersGauge.Set(0)
+}
+
+// dispatch sends an input room event to the worker for its room.
+// All the events for a room are processed by the same worker so that they are processed in order.
+// Blocks if the worker already has a full queue of events.
+func (c *Consumer) dispatch(task inputTask) {
+	queuedEventsGauge.Inc()
+	c.workers[workerForRoom(roomIDForInput(task.input), len(c.workers))] <- task
+}
+
+// runWorker processes the input room events sent to a worker until the channel is closed.
+func (c *Consumer) runWorker(tasks <-chan inputTask) {
+	defer c.workersRunning.Done()
+	for task := range tasks {
+		queuedEventsGauge.Dec()
+		busyWorkersGauge.Inc()
+		c.processTask(task)
+		busyWorkersGauge.Dec()
+	}
+}
+
+// processTask processes a single input room event. Then it processes any held events in the
+// room that were waiting for the event and checks whether the room has too many forward
+// extremities. Finally it records our position in the stream.
+// If the event failed and couldn't be written to the dead letter topic then our position
+// isn't recorded, so that the event is read again after a restart.
+func (c *Consumer) processTask(task inputTask) {
+	result := c.processInput(task, task.message, task.input)
+	if roomID := roomIDForInput(task.input); roomID != "" {
+		c.processPendingEvents(task, roomID)
+		c.pruneForwardExtremities(task, roomID)
+	}
+	if result != inputUnfinished {
+		c.finishMessage(task.progress, task.message)
+	}
+}
+
+// An inputResult is what happened to an input room event after it was processed.
+type inputResult int
+
+const (
+	// The event was processed, rejected, or failed processing and was written to the dead letter topic.
+	inputFinished inputResult = iota
+	// The event was held because some of its prev_events are missing.
+	inputHeld
+	// The event failed processing and couldn't be written to the dead letter topic before the
+	// consumer was stopped. It must be processed again after a restart.
+	inputUnfinished
+)
+
+// processInput processes an input room event from a message.
+func (c *Consumer) processInput(task inputTask, message *sarama.ConsumerMessage, input api.InputRoomEvent) inputResult {
+	// Only record the offset that every earlier event in the partition has
+	// been processed up to, since events from other rooms might still be
+	// being processed by other workers.
+	offset := inputOffset{c.InputRoomEventTopic, task.message.Partition, task.progress.processedOffset()}
+	err := processRoomEvent(c.DB, c.KeyRing, input, offset, c.maxStateBlockNIDs())
+	// Whatever happened to the event, if it was a dummy event we sent then it is no longer pending.
+	// Dummy events are only sent to replace the latest events in a room so a dummy event that was held
+	// won't be released until events we already have arrive, if ever, and we treat it like a failure.
+	c.finishDummyEvent(roomIDForInput(input), eventIDForInput(input), err == nil)
+	switch e := err.(type) {
+	case nil:
+		countEvent(input, outcomeProcessed)
+	case *rejectedEventError:
+		// The event failed the auth checks or the signature checks.
+		countEvent(input, outcomeRejected)
+		c.rejectMessage(message, e)
+	case *missingEventsError:
+		// The event was held until its missing prev_events arrive.
+		countEvent(input, outcomeHeld)
+		c.holdMessage(message, e)
+		return inputHeld
+	default:
+		countEvent(input, outcomeFailed)
+		// If there was an error processing the message then log it and
+		// move onto the next message in the stream.
+		// TODO: If the error was due to a problem talking to the database
+		// then we shouldn't move onto the next message and we should either
+		// retry processing the message, or panic and kill ourselves.
+		if !c.failMessage(message, err) {
+			return inputUnfinished
+		}
+	}
+	return inputFinished
+}
+
+// processPendingEvents processes the held events in a room that now have all the prev_events they were
+// missing. Processing a held event can make other held events ready so this repeats until none are ready.
+// Held events are only deleted once they have been processed so that they aren't lost if we crash. Any
+// held events left behind are processed when the next event for the room is processed.
+func (c *Consumer) processPendingEvents(task inputTask, roomID string) {
+	for {
+		pending, err := c.DB.ReadyPendingEvents(roomID)
+		if err != nil {
+			c.logError(task.message, err)
+			return
+		}
+		if len(pending) == 0 {
+			return
+		}
+		for _, event := range pending {
+			// Report any problems with the held event as if they were problems
+			// with the message that released it, but with the held event as the value.
+			message := *task.message
+			message.Value = event.InputJSON
+			var input api.InputRoomEvent
+			result := inputFinished
+			if err = json.Unmarshal(event.InputJSON, &input); err != nil {
+				if !c.failMessage(&message, err) {
+					result = inputUnfinished
+				}
+			} else {
+				result = c.processInput(task, &message, input)
+			}
+			if result == inputHeld {
+				// The event is still missing some prev_events so leave it held.
+				continue
+			}
+			if result == inputUnfinished {
+				// The consumer is stopping. Leave the event held so that it is
+				// processed again after a restart.
+				return
+			}
+			if err = c.DB.DeletePendingEvent(event.EventID); err != nil {
+				c.logError(&message, err)
+				return
+			}
+		}
+	}
+}
+
+// roomIDForInput returns the room ID of the event in an input room event.
+// Returns an empty string if the event doesn't have a room ID. Those events
+// will fail processing anyway so it doesn't matter which worker they go to.
+func roomIDForInput(input api.InputRoomEvent) string {
+	var event struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := json.Unmarshal(input.Event, &event); err != nil {
+		return ""
+	}
+	return event.RoomID
+}
+
+// eventIDForInput returns the event ID of the event in an input room event.
+// Returns an empty string if the event doesn't have an event ID.
+func eventIDForInput(input api.InputRoomEvent) string {
+	var event struct {
+		EventID string `json:"event_id"`
+	}
+	if err := json.Unmarshal(input.Event, &event); err != nil {
+		return ""
+	}
+	return event.EventID
+}
+
+// workerForRoom picks which of n workers processes the events for a room.
+func workerForRoom(roomID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(roomID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// partitionProgress tracks which messages from a partition of the input log
+// have been processed. Messages for different rooms can finish processing
+// in a different order to the order they were read in. The offset we record
+// for the partition is the offset that every message up to and including it
+// has been processed so that no message is skipped after a restart.
+type partitionProgress struct {
+	mutex sync.Mutex
+	// The offsets of the messages that have been read but haven't finished processing, in order.
+	pending []int64
+	// The pending offsets that have finished processing.
+	finished map[int64]bool
+	// Every message up to and including this offset has been processed.
+	processed int64
+	// Whether we have read any messages yet.
+	started bool
+}
+
+func newPartitionProgress() *partitionProgress {
+	return &partitionProgress{finished: map[int64]bool{}}
+}
+
+// add records that we have read the message at offset.
+// Messages must be added in the order they were read from the partition.
+func (p *partitionProgress) add(offset int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.started {
+		// Everything before the first message we read has been processed already.
+		p.processed = offset - 1
+		p.started = true
+	}
+	p.pending = append(p.pending, offset)
+}
+
+// finish records that the message at offset has been processed.
+// Returns the offset every message has been processed up to and whether that
+// offset has advanced as a result of this message.
+func (p *partitionProgress) finish(offset int64) (int64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finished[offset] = true
+	advanced := false
+	for len(p.pending) > 0 && p.finished[p.pending[0]] {
+		p.processed = p.pending[0]
+		delete(p.finished, p.pending[0])
+		p.pending = p.pending[1:]
+		advanced = true
+	}
+	return p.processed, advanced
+}
+
+// processedOffset returns the offset every message has been processed up to.
+func (p *partitionProgress) processedOffset() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.processed
+}
@@ -0,0 +1,157 @@
+package input
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"testing"
+)
+
+func TestPartitionProgress(t *testing.T) {
+	p := newPartitionProgress()
+	for _, offset := range []int64{10, 11, 13, 14} {
+		p.add(offset)
+	}
+	if got := p.processedOffset(); got != 9 {
+		t.Fatalf("wanted processed offset 9 before finishing anything got %d", got)
+	}
+
+	testCases := []struct {
+		finish       int64
+		wantOffset   int64
+		wantAdvanced bool
+	}{
+		// Finishing messages after one that is still pending doesn't advance the offset.
+		{13, 9, false},
+		{11, 9, false},
+		// Finishing the earliest pending message advances past all the finished messages.
+		{10, 13, true},
+		{14, 14, true},
+	}
+	for _, tc := range testCases {
+		gotOffset, gotAdvanced := p.finish(tc.finish)
+		if gotOffset != tc.wantOffset || gotAdvanced != tc.wantAdvanced {
+			t.Fatalf(
+				"finish(%d): wanted (%d, %v) got (%d, %v)",
+				tc.finish, tc.wantOffset, tc.wantAdvanced, gotOffset, gotAdvanced,
+			)
+		}
+	}
+}
+
+// testConsumerDatabase is a ConsumerDatabase that stores a single room and the partition offsets in memory.
+type testConsumerDatabase struct {
+	testPromotionDatabase
+	// The stored offset for each partition.
+	offsets map[int32]int64
+}
+
+func (db *testConsumerDatabase) PartitionOffsets(topic string) ([]types.PartitionOffset, error) {
+	return nil, nil
+}
+
+func (db *testConsumerDatabase) SetPartitionOffset(topic string, partition int32, offset int64) error {
+	db.offsets[partition] = offset
+	return nil
+}
+
+func (db *testConsumerDatabase) ReadyPendingEvents(roomID string) ([]types.PendingEvent, error) {
+	return nil, nil
+}
+
+func (db *testConsumerDatabase) DeletePendingEvent(eventID string) error {
+	return nil
+}
+
+func (db *testConsumerDatabase) RoomNID(roomID string) (types.RoomNID, error) {
+	// Pretend the room isn't stored so that the forward extremities aren't checked.
+	return 0, nil
+}
+
+func (db *testConsumerDatabase) LatestEventIDs(roomNID types.RoomNID) (
+	[]gomatrixserverlib.EventReference, types.StateSnapshotNID, error,
+) {
+	return nil, 0, nil
+}
+
+func TestProcessTaskAdvancesOffset(t *testing.T) {
+	db := &testConsumerDatabase{
+		testPromotionDatabase: testPromotionDatabase{events: map[string]types.StateAtEvent{}},
+		offsets:               map[int32]int64{},
+	}
+	c := Consumer{DB: db, InputRoomEventTopic: "input"}
+	progress := newPartitionProgress()
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testCreateJSON)}
+	var tasks []inputTask
+	for _, offset := range []int64{5, 6} {
+		progress.add(offset)
+		message := &sarama.ConsumerMessage{Topic: "input", Partition: 2, Offset: offset}
+		tasks = append(tasks, inputTask{message: message, input: input, progress: progress})
+	}
+
+	// Finishing the later message doesn't advance the offset while the earlier one is pending.
+	c.processTask(tasks[1])
+	if _, ok := db.offsets[2]; ok {
+		t.Fatalf("wanted no offset to be stored, got %d", db.offsets[2])
+	}
+	c.processTask(tasks[0])
+	if db.offsets[2] != 6 {
+		t.Fatalf("wanted the stored offset to advance to 6, got %d", db.offsets[2])
+	}
+	if got := progress.processedOffset(); got != 6 {
+		t.Fatalf("wanted the processed offset to be 6, got %d", got)
+	}
+}
+
+const testDummyEventJSON = `{"type":"org.matrix.dummy_event","event_id":"$dummy:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":5,"content":{},` +
+	`"prev_events":[["$known:a",{"sha256":"aGFzaA"}],["$missing:a",{"sha256":"aGFzaA"}]]}`
+
+func TestProcessInputFinishesDummyEvents(t *testing.T) {
+	testCases := []struct {
+		name       string
+		input      api.InputRoomEvent
+		wantResult inputResult
+	}{
+		// A backfilled event without state fails processing.
+		{"failed", api.InputRoomEvent{Kind: api.KindBackfill, Event: []byte(testDummyEventJSON)}, inputFinished},
+		{"held", api.InputRoomEvent{Kind: api.KindNew, Event: []byte(testDummyEventJSON)}, inputHeld},
+	}
+	for _, tc := range testCases {
+		db := &testMissingEventsDatabase{
+			known:   map[string]bool{"$known:a": true},
+			pending: map[string]types.PendingEvent{},
+		}
+		c := Consumer{DB: testHoldingConsumerDatabase{held: db}, ErrorLogger: &testErrorLogger{}}
+		c.startDummyEvent("!room:a", "$dummy:a")
+		progress := newPartitionProgress()
+		progress.add(3)
+		message := &sarama.ConsumerMessage{Topic: "input", Offset: 3}
+		task := inputTask{message: message, input: tc.input, progress: progress}
+
+		if result := c.processInput(task, message, tc.input); result != tc.wantResult {
+			t.Fatalf("%s: wanted result %d, got %d", tc.name, tc.wantResult, result)
+		}
+		if c.hasPendingDummyEvent("!room:a") {
+			t.Fatalf("%s: wanted the dummy event not to be pending", tc.name)
+		}
+		if !c.dummyEventsDelayed("!room:a") {
+			t.Fatalf("%s: wanted dummy events to be delayed after the dummy event wasn't processed", tc.name)
+		}
+	}
+}
+
+// testHoldingConsumerDatabase is a ConsumerDatabase that can only hold events.
+type testHoldingConsumerDatabase struct {
+	ConsumerDatabase
+	held *testMissingEventsDatabase
+}
+
+func (db testHoldingConsumerDatabase) MissingEventIDs(eventIDs []string) ([]string, error) {
+	return db.held.MissingEventIDs(eventIDs)
+}
+
+func (db testHoldingConsumerDatabase) StorePendingEvent(eventID, roomID string, missingEventIDs []string, inputJSON []byte) error {
+	return db.held.StorePendingEvent(eventID, roomID, missingEventIDs, inputJSON)
+}
@@ -0,0 +1,183 @@
+package purge
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// DefaultCollectInterval is how often the StateCollector deletes unused state if Interval isn't set.
+const DefaultCollectInterval = time.Hour
+
+var (
+	deletedStateSnapshotsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "deleted_state_snapshots_total",
+		Help:      "The number of unused state snapshots deleted.",
+	})
+	deletedStateBlocksCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "deleted_state_blocks_total",
+		Help:      "The number of unused state blocks deleted.",
+	})
+	deletedStateBytesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "deleted_state_bytes_total",
+		Help:      "The total size of the unused state snapshot and state block rows deleted, in bytes.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(deletedStateSnapshotsCounter, deletedStateBlocksCounter, deletedStateBytesCounter)
+}
+
+// recordDeletedState adds deleted state to the metrics.
+func recordDeletedState(deleted types.DeletedState) {
+	deletedStateSnapshotsCounter.Add(float64(deleted.StateSnapshots))
+	deletedStateBlocksCounter.Add(float64(deleted.StateBlocks))
+	deletedStateBytesCounter.Add(float64(deleted.Bytes))
+}
+
+// A StateCollectorDatabase has the storage APIs needed to delete unused state.
+type StateCollectorDatabase interface {
+	// Lookup the state snapshots with numeric IDs after afterStateNID that aren't the state
+	// before an event or the current state of a room.
+	// Returns at most limit snapshots ordered by numeric ID.
+	UnusedStateSnapshotNIDs(afterStateNID types.StateSnapshotNID, limit int) ([]types.StateSnapshotNID, error)
+	// Lookup the state blocks with numeric IDs after afterStateBlockNID that aren't used by a state snapshot.
+	// Returns at most limit blocks ordered by numeric ID.
+	UnusedStateBlockNIDs(afterStateBlockNID types.StateBlockNID, limit int) ([]types.StateBlockNID, error)
+	// Delete the state snapshots and state blocks in the lists that are still unused, along with
+	// the state blocks that only the deleted snapshots used.
+	// Takes the lock on the state of every room, so waits for the events that are storing
+	// state to finish and checks whether the state is used once they have.
+	DeleteUnusedState(stateNIDs []types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID) (types.DeletedState, error)
+}
+
+// A StateCollector deletes state snapshots and state blocks that nothing uses.
+// These are left behind when storing the state for an event fails part way through,
+// and when the state after the latest events of a room is stored but the latest
+// events aren't updated.
+// The state is stored before the events that use it are updated to refer to it, so
+// new state looks unused for a short while. The roomserver holds the lock on the state
+// of the room from before it reads the state it builds on until the event and the room
+// refer to the new state, and each batch is deleted while holding the lock on the state
+// of every room. So whether the state in a batch is used is checked once the events
+// storing state have finished, and the collector can run while the roomserver is
+// processing events.
+type StateCollector struct {
+	DB StateCollectorDatabase
+	// The number of snapshots or blocks deleted in each transaction.
+	// If this is 0 then DefaultPurgeBatchSize is used.
+	BatchSize int
+	// How often to delete the unused state.
+	// If left as 0 then DefaultCollectInterval is used.
+	Interval time.Duration
+	// Closed by Stop to tell the collecting goroutine to stop.
+	stop chan struct{}
+	// Closed by the collecting goroutine when it has stopped.
+	stopped chan struct{}
+}
+
+// Start starts a goroutine that deletes the unused state every Interval.
+func (c *StateCollector) Start() {
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.run()
+}
+
+// Stop stops the collecting goroutine and waits for it to finish.
+func (c *StateCollector) Stop() {
+	close(c.stop)
+	<-c.stopped
+}
+
+func (c *StateCollector) run() {
+	defer close(c.stopped)
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultCollectInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		deleted, err := c.Collect()
+		if err != nil {
+			// Log the error and try again next time round.
+			log.WithError(err).Error("Error deleting unused state")
+		} else {
+			log.WithFields(log.Fields{
+				"state_snapshots": deleted.StateSnapshots,
+				"state_blocks":    deleted.StateBlocks,
+				"bytes":           deleted.Bytes,
+			}).Info("Deleted unused state")
+		}
+	}
+}
+
+// Collect deletes the unused state snapshots and state blocks.
+func (c *StateCollector) Collect() (types.DeletedState, error) {
+	var result types.DeletedState
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeBatchSize
+	}
+
+	// Delete the snapshots first so that the blocks only they used are deleted too.
+	var afterStateNID types.StateSnapshotNID
+	for {
+		stateNIDs, err := c.DB.UnusedStateSnapshotNIDs(afterStateNID, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(stateNIDs) > 0 {
+			if err = c.deleteUnusedState(stateNIDs, nil, &result); err != nil {
+				return result, err
+			}
+			afterStateNID = stateNIDs[len(stateNIDs)-1]
+		}
+		if len(stateNIDs) < batchSize {
+			break
+		}
+	}
+
+	var afterStateBlockNID types.StateBlockNID
+	for {
+		stateBlockNIDs, err := c.DB.UnusedStateBlockNIDs(afterStateBlockNID, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(stateBlockNIDs) > 0 {
+			if err = c.deleteUnusedState(nil, stateBlockNIDs, &result); err != nil {
+				return result, err
+			}
+			afterStateBlockNID = stateBlockNIDs[len(stateBlockNIDs)-1]
+		}
+		if len(stateBlockNIDs) < batchSize {
+			return result, nil
+		}
+	}
+}
+
+func (c *StateCollector) deleteUnusedState(
+	stateNIDs []types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID, result *types.DeletedState,
+) error {
+	deleted, err := c.DB.DeleteUnusedState(stateNIDs, stateBlockNIDs)
+	if err != nil {
+		return err
+	}
+	recordDeletedState(deleted)
+	result.StateSnapshots += deleted.StateSnapshots
+	result.StateBlocks += deleted.StateBlocks
+	result.Bytes += deleted.Bytes
+	return nil
+}
@@ -0,0 +1,120 @@
+package purge
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"sort"
+	"testing"
+)
+
+// testStateCollectorDatabase is a StateCollectorDatabase that stores state in memory.
+type testStateCollectorDatabase struct {
+	// The state blocks used by each state snapshot.
+	snapshots map[types.StateSnapshotNID][]types.StateBlockNID
+	// The state blocks.
+	blocks map[types.StateBlockNID]bool
+	// The state snapshots used by an event or as the current state of a room.
+	used map[types.StateSnapshotNID]bool
+	// The number of times DeleteUnusedState was called.
+	deletes int
+}
+
+func (db *testStateCollectorDatabase) UnusedStateSnapshotNIDs(
+	afterStateNID types.StateSnapshotNID, limit int,
+) ([]types.StateSnapshotNID, error) {
+	var result []types.StateSnapshotNID
+	for stateNID := range db.snapshots {
+		if stateNID > afterStateNID && !db.used[stateNID] {
+			result = append(result, stateNID)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (db *testStateCollectorDatabase) UnusedStateBlockNIDs(
+	afterStateBlockNID types.StateBlockNID, limit int,
+) ([]types.StateBlockNID, error) {
+	var result []types.StateBlockNID
+	for stateBlockNID := range db.blocks {
+		if stateBlockNID > afterStateBlockNID && !db.blockUsed(stateBlockNID) {
+			result = append(result, stateBlockNID)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (db *testStateCollectorDatabase) DeleteUnusedState(
+	stateNIDs []types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID,
+) (deleted types.DeletedState, err error) {
+	db.deletes++
+	for _, stateNID := range stateNIDs {
+		if _, ok := db.snapshots[stateNID]; ok && !db.used[stateNID] {
+			stateBlockNIDs = append(stateBlockNIDs, db.snapshots[stateNID]...)
+			delete(db.snapshots, stateNID)
+			deleted.StateSnapshots++
+			deleted.Bytes += 100
+		}
+	}
+	for _, stateBlockNID := range stateBlockNIDs {
+		if db.blocks[stateBlockNID] && !db.blockUsed(stateBlockNID) {
+			delete(db.blocks, stateBlockNID)
+			deleted.StateBlocks++
+			deleted.Bytes += 10
+		}
+	}
+	return
+}
+
+func (db *testStateCollectorDatabase) blockUsed(stateBlockNID types.StateBlockNID) bool {
+	for _, stateBlockNIDs := range db.snapshots {
+		for _, blockNID := range stateBlockNIDs {
+			if blockNID == stateBlockNID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestStateCollectorCollect(t *testing.T) {
+	db := &testStateCollectorDatabase{
+		snapshots: map[types.StateSnapshotNID][]types.StateBlockNID{
+			1: {1},
+			2: {1, 2},
+			3: {1, 3}, // unused, and the only snapshot using block 3
+			4: {1, 2}, // unused
+		},
+		blocks: map[types.StateBlockNID]bool{1: true, 2: true, 3: true, 4: true}, // block 4 is unused
+		used:   map[types.StateSnapshotNID]bool{1: true, 2: true},
+	}
+
+	c := StateCollector{DB: db, BatchSize: 1}
+	deleted, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (types.DeletedState{StateSnapshots: 2, StateBlocks: 2, Bytes: 220}); deleted != want {
+		t.Fatalf("wanted %#v to be deleted, got %#v", want, deleted)
+	}
+	for _, stateNID := range []types.StateSnapshotNID{1, 2} {
+		if _, ok := db.snapshots[stateNID]; !ok {
+			t.Fatalf("wanted state snapshot %d to be kept", stateNID)
+		}
+	}
+	for _, stateBlockNID := range []types.StateBlockNID{1, 2} {
+		if !db.blocks[stateBlockNID] {
+			t.Fatalf("wanted state block %d to be kept", stateBlockNID)
+		}
+	}
+	if db.deletes != 3 {
+		t.Fatalf("wanted the state to be deleted in 3 batches, got %d", db.deletes)
+	}
+}
@@ -0,0 +1,374 @@
+// Package purge deletes old room history and unused room state from the roomserver database.
+package purge
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"time"
+)
+
+// A Database has the storage APIs needed to purge the history of a room.
+type Database interface {
+	// Lookup the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	RoomNID(roomID string) (types.RoomNID, error)
+	// Lookup the numeric IDs for a list of string event IDs.
+	// Returns a map from string event ID to numeric ID.
+	// If an event ID is not in the database then it is omitted from the map.
+	EventNIDs(eventIDs []string) (map[string]types.EventNID, error)
+	// Lookup the Events for a list of numeric event IDs.
+	// Returns a sorted list of events.
+	Events(eventNIDs []types.EventNID) ([]types.Event, error)
+	// Lookup the numeric IDs of the events in the auth chains of a list of events.
+	AuthChainEventNIDs(eventNIDs []types.EventNID) ([]types.EventNID, error)
+	// Lookup up to limit events in a room with numeric IDs after afterEventNID, ordered by numeric ID,
+	// along with whether each event is older than the cutoff.
+	RoomEventsForPurge(
+		roomNID types.RoomNID, cutoff types.PurgeCutoff, afterEventNID types.EventNID, limit int,
+	) ([]types.PurgeEvent, error)
+	// Lookup the numeric IDs of every event referenced by the state blocks of a list of state snapshots.
+	StateSnapshotEventNIDs(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error)
+	// Lock a room and its state so that its history can be deleted.
+	// Waits for the events that are storing state for the room to finish.
+	GetRoomForPurge(roomNID types.RoomNID) (types.RoomPurgeUpdater, error)
+}
+
+// DefaultPurgeBatchSize is the number of old events handled in each transaction by default.
+const DefaultPurgeBatchSize = 1000
+
+// A Purger deletes the events in a room that are older than a cutoff.
+// The events that are still needed are kept: the events in the current state of
+// the room, the latest events, the events referenced by the state before the
+// events that aren't being purged, and the auth chains of all of those events.
+// The old events that are kept are turned into outliers so that they are no longer
+// part of the history of the room. Once the events have been purged the state
+// snapshots for the purged events and the state blocks that only they used are
+// deleted.
+// The events are purged in batches, each in its own transaction that holds the lock
+// on the room and the lock on the state of the room. The roomserver holds the lock on
+// the state while it stores the state for an event, so the purge can run while the
+// roomserver is processing events without deleting state that an event is about to use.
+type Purger struct {
+	DB Database
+	// The number of old events handled in each transaction.
+	// If this is 0 then DefaultPurgeBatchSize is used.
+	BatchSize int
+}
+
+// A Result says what was deleted by a purge.
+type Result struct {
+	// The number of events deleted.
+	PurgedEvents int
+	// The number of old events kept as outliers because they were still needed.
+	RetainedEvents int
+	// The state snapshots and state blocks deleted.
+	DeletedState types.DeletedState
+}
+
+// PurgeBeforeEvent purges the events that come before an event in its room.
+// The events with a depth less than the depth of the event are purged.
+func (p *Purger) PurgeBeforeEvent(eventID string) (Result, error) {
+	eventNIDMap, err := p.DB.EventNIDs([]string{eventID})
+	if err != nil {
+		return Result{}, err
+	}
+	eventNID, ok := eventNIDMap[eventID]
+	if !ok {
+		return Result{}, types.MissingEventError(fmt.Sprintf("purge: unknown event %q", eventID))
+	}
+	events, err := p.DB.Events([]types.EventNID{eventNID})
+	if err != nil {
+		return Result{}, err
+	}
+	if len(events) != 1 {
+		return Result{}, types.MissingEventError(fmt.Sprintf("purge: missing JSON for event %q", eventID))
+	}
+	event := events[0].Event
+	roomNID, err := p.DB.RoomNID(event.RoomID())
+	if err != nil {
+		return Result{}, err
+	}
+	if event.Depth() <= 0 {
+		// A depth of 0 means "no limit" so there is nothing before the event to purge.
+		return Result{}, nil
+	}
+	return p.purgeRoom(roomNID, types.PurgeCutoff{Depth: event.Depth()})
+}
+
+// PurgeBeforeTimestamp purges the events in a room with an origin_server_ts before a time.
+func (p *Purger) PurgeBeforeTimestamp(roomID string, before time.Time) (Result, error) {
+	roomNID, err := p.DB.RoomNID(roomID)
+	if err != nil {
+		return Result{}, err
+	}
+	if roomNID == 0 {
+		return Result{}, fmt.Errorf("purge: unknown room %q", roomID)
+	}
+	timestampMS := before.UnixNano() / int64(time.Millisecond)
+	if timestampMS <= 0 {
+		return Result{}, nil
+	}
+	return p.purgeRoom(roomNID, types.PurgeCutoff{TimestampMS: timestampMS})
+}
+
+// purgeRoom purges the events in a room that are older than the cutoff.
+// The events are read a page at a time so that the events in the room aren't all held in
+// memory. The events that aren't old enough to purge are read first to work out which of
+// the old events they need, then the old events are purged a batch at a time.
+func (p *Purger) purgeRoom(roomNID types.RoomNID, cutoff types.PurgeCutoff) (Result, error) {
+	var result Result
+	batchSize := p.batchSize()
+
+	// Every event that isn't old enough to purge is kept along with everything it needs.
+	needed := neededEvents{db: p.DB, events: map[types.EventNID]bool{}, states: map[types.StateSnapshotNID]bool{}}
+	// The events added to the room after lastEventNID are handled by purgeBatch.
+	var lastEventNID types.EventNID
+	var hasOldEvents bool
+	for {
+		events, err := p.DB.RoomEventsForPurge(roomNID, cutoff, lastEventNID, batchSize)
+		if err != nil {
+			return result, err
+		}
+		var keep []types.PurgeEvent
+		for _, event := range events {
+			if event.BeforeCutoff {
+				hasOldEvents = true
+			} else {
+				keep = append(keep, event)
+			}
+			lastEventNID = event.EventNID
+		}
+		if err = needed.addKept(keep); err != nil {
+			return result, err
+		}
+		if len(events) < batchSize {
+			break
+		}
+	}
+	if !hasOldEvents {
+		return result, nil
+	}
+
+	maxEventNID := lastEventNID
+	var batch []types.PurgeEvent
+	var afterEventNID types.EventNID
+	for afterEventNID < lastEventNID {
+		events, err := p.DB.RoomEventsForPurge(roomNID, cutoff, afterEventNID, batchSize)
+		if err != nil {
+			return result, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			afterEventNID = event.EventNID
+			if event.EventNID > lastEventNID || !event.BeforeCutoff {
+				continue
+			}
+			if batch = append(batch, event); len(batch) < batchSize {
+				continue
+			}
+			if err = p.purgeBatch(roomNID, cutoff, batch, &maxEventNID, &needed, &result); err != nil {
+				return result, err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		if err := p.purgeBatch(roomNID, cutoff, batch, &maxEventNID, &needed, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// batchSize returns the configured number of old events handled in each transaction.
+func (p *Purger) batchSize() int {
+	if p.BatchSize <= 0 {
+		return DefaultPurgeBatchSize
+	}
+	return p.BatchSize
+}
+
+// purgeBatch deletes or turns into outliers a batch of old events while holding the lock on the room.
+// The events added to the room since the purge started are kept along with the latest events and
+// the current state of the room as they are when the lock is taken.
+func (p *Purger) purgeBatch(
+	roomNID types.RoomNID, cutoff types.PurgeCutoff, batch []types.PurgeEvent,
+	maxEventNID *types.EventNID, needed *neededEvents, result *Result,
+) (err error) {
+	updater, err := p.DB.GetRoomForPurge(roomNID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			// Commit if there wasn't an error.
+			// Set the returned err value if we encounter an error committing.
+			// This only works because err is a named return.
+			err = updater.Commit()
+		} else {
+			// Ignore any error we get rolling back since we don't want to
+			// clobber the current error
+			updater.Rollback()
+		}
+	}()
+
+	keepNIDs := append([]types.EventNID{updater.LastEventNIDSent()}, updater.LatestEventNIDs()...)
+	keepStateNIDs := []types.StateSnapshotNID{updater.CurrentStateSnapshotNID()}
+	for {
+		var newEvents []types.PurgeEvent
+		if newEvents, err = p.DB.RoomEventsForPurge(roomNID, cutoff, *maxEventNID, p.batchSize()); err != nil {
+			return
+		}
+		for _, event := range newEvents {
+			keepNIDs = append(keepNIDs, event.EventNID)
+			keepStateNIDs = append(keepStateNIDs, event.BeforeStateSnapshotNID)
+			*maxEventNID = event.EventNID
+		}
+		if len(newEvents) < p.batchSize() {
+			break
+		}
+	}
+
+	// The state before the latest events is needed to work out the state of the room
+	// after the next event, so the latest events in the batch keep their state.
+	latest := map[types.EventNID]bool{}
+	for _, eventNID := range updater.LatestEventNIDs() {
+		latest[eventNID] = true
+	}
+	for _, event := range batch {
+		if latest[event.EventNID] {
+			keepStateNIDs = append(keepStateNIDs, event.BeforeStateSnapshotNID)
+		}
+	}
+	if err = needed.add(keepNIDs, keepStateNIDs); err != nil {
+		return
+	}
+
+	var deleteNIDs, outlierNIDs []types.EventNID
+	var stateNIDs []types.StateSnapshotNID
+	for _, event := range batch {
+		if latest[event.EventNID] {
+			continue
+		}
+		if event.BeforeStateSnapshotNID != 0 {
+			stateNIDs = append(stateNIDs, event.BeforeStateSnapshotNID)
+		}
+		if !needed.events[event.EventNID] {
+			deleteNIDs = append(deleteNIDs, event.EventNID)
+		} else if event.BeforeStateSnapshotNID != 0 {
+			outlierNIDs = append(outlierNIDs, event.EventNID)
+		}
+	}
+
+	if len(deleteNIDs) > 0 {
+		if err = updater.DeleteEvents(deleteNIDs); err != nil {
+			return
+		}
+	}
+	if len(outlierNIDs) > 0 {
+		if err = updater.MarkEventsAsOutliers(outlierNIDs); err != nil {
+			return
+		}
+	}
+	if len(stateNIDs) > 0 {
+		var deleted types.DeletedState
+		if deleted, err = updater.DeleteUnusedStateSnapshots(state.UniqueStateSnapshotNIDs(stateNIDs)); err != nil {
+			return
+		}
+		// The metrics may count state that is rolled back if the transaction fails to commit,
+		// which is fine since they are only a rough guide.
+		recordDeletedState(deleted)
+		result.DeletedState.StateSnapshots += deleted.StateSnapshots
+		result.DeletedState.StateBlocks += deleted.StateBlocks
+		result.DeletedState.Bytes += deleted.Bytes
+	}
+	result.PurgedEvents += len(deleteNIDs)
+	result.RetainedEvents += len(outlierNIDs)
+	return
+}
+
+// neededEvents tracks the events that must be kept by a purge.
+type neededEvents struct {
+	db Database
+	// The numeric IDs of the events that must be kept.
+	events map[types.EventNID]bool
+	// The state snapshots whose events have been added to the events that must be kept.
+	states map[types.StateSnapshotNID]bool
+}
+
+// addKept adds the events needed by a page of the events that aren't old enough to purge: the events
+// referenced by the state before them and the auth chains of the events. The kept events themselves
+// aren't recorded since they won't be purged, so that they don't all have to be held in memory.
+func (n *neededEvents) addKept(events []types.PurgeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var eventNIDs []types.EventNID
+	var stateNIDs []types.StateSnapshotNID
+	for _, event := range events {
+		eventNIDs = append(eventNIDs, event.EventNID)
+		if event.BeforeStateSnapshotNID != 0 {
+			stateNIDs = append(stateNIDs, event.BeforeStateSnapshotNID)
+		}
+	}
+	if len(stateNIDs) > 0 {
+		stateEventNIDs, err := n.db.StateSnapshotEventNIDs(state.UniqueStateSnapshotNIDs(stateNIDs))
+		if err != nil {
+			return err
+		}
+		if err = n.add(stateEventNIDs, nil); err != nil {
+			return err
+		}
+	}
+	authEventNIDs, err := n.db.AuthChainEventNIDs(eventNIDs)
+	if err != nil {
+		return err
+	}
+	for _, eventNID := range authEventNIDs {
+		n.events[eventNID] = true
+	}
+	return nil
+}
+
+// add adds events, the events referenced by state snapshots, and the auth chains of those events
+// to the events that must be kept.
+func (n *neededEvents) add(eventNIDs []types.EventNID, stateNIDs []types.StateSnapshotNID) error {
+	var newStateNIDs []types.StateSnapshotNID
+	for _, stateNID := range stateNIDs {
+		if stateNID != 0 && !n.states[stateNID] {
+			n.states[stateNID] = true
+			newStateNIDs = append(newStateNIDs, stateNID)
+		}
+	}
+	if len(newStateNIDs) > 0 {
+		stateEventNIDs, err := n.db.StateSnapshotEventNIDs(newStateNIDs)
+		if err != nil {
+			return err
+		}
+		eventNIDs = append(eventNIDs, stateEventNIDs...)
+	}
+
+	// The auth chain of an event that is already kept is already kept, so we only
+	// need to look up the auth chains of the events that weren't kept before.
+	var newEventNIDs []types.EventNID
+	for _, eventNID := range eventNIDs {
+		if eventNID != 0 && !n.events[eventNID] {
+			n.events[eventNID] = true
+			newEventNIDs = append(newEventNIDs, eventNID)
+		}
+	}
+	if len(newEventNIDs) == 0 {
+		return nil
+	}
+	authEventNIDs, err := n.db.AuthChainEventNIDs(newEventNIDs)
+	if err != nil {
+		return err
+	}
+	for _, eventNID := range authEventNIDs {
+		n.events[eventNID] = true
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package purge
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testPurgeDatabase is a Database that stores a single room in memory.
+type testPurgeDatabase struct {
+	Database
+	// The events in the room ordered by numeric ID.
+	events []types.PurgeEvent
+	// The auth events of each event.
+	authEvents map[types.EventNID][]types.EventNID
+	// The events referenced by each state snapshot.
+	states map[types.StateSnapshotNID][]types.EventNID
+	// The latest events and the current state of the room.
+	latest  []types.EventNID
+	current types.StateSnapshotNID
+	// Called each time the room is locked, with the number of times it has been locked.
+	onLock func(locks int)
+	locks  int
+}
+
+func (db *testPurgeDatabase) RoomNID(roomID string) (types.RoomNID, error) {
+	return 1, nil
+}
+
+func (db *testPurgeDatabase) AuthChainEventNIDs(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	seen := map[types.EventNID]bool{}
+	var result []types.EventNID
+	for len(eventNIDs) > 0 {
+		eventNID := eventNIDs[0]
+		eventNIDs = eventNIDs[1:]
+		for _, authEventNID := range db.authEvents[eventNID] {
+			if !seen[authEventNID] {
+				seen[authEventNID] = true
+				result = append(result, authEventNID)
+				eventNIDs = append(eventNIDs, authEventNID)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testPurgeDatabase) RoomEventsForPurge(
+	roomNID types.RoomNID, cutoff types.PurgeCutoff, afterEventNID types.EventNID, limit int,
+) ([]types.PurgeEvent, error) {
+	var result []types.PurgeEvent
+	for _, event := range db.events {
+		if event.EventNID > afterEventNID && len(result) < limit {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (db *testPurgeDatabase) StateSnapshotEventNIDs(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	var result []types.EventNID
+	for _, stateNID := range stateNIDs {
+		result = append(result, db.states[stateNID]...)
+	}
+	return result, nil
+}
+
+func (db *testPurgeDatabase) GetRoomForPurge(roomNID types.RoomNID) (types.RoomPurgeUpdater, error) {
+	db.locks++
+	if db.onLock != nil {
+		db.onLock(db.locks)
+	}
+	return &testPurgeUpdater{db: db}, nil
+}
+
+// addEvent adds an event to the end of the room.
+func (db *testPurgeDatabase) addEvent(
+	eventNID types.EventNID, stateNID types.StateSnapshotNID, old bool, authEventNIDs ...types.EventNID,
+) {
+	db.events = append(db.events, types.PurgeEvent{
+		EventNID: eventNID, BeforeStateSnapshotNID: stateNID, BeforeCutoff: old,
+	})
+	db.authEvents[eventNID] = authEventNIDs
+}
+
+// testPurgeUpdater is a RoomPurgeUpdater for a testPurgeDatabase.
+type testPurgeUpdater struct {
+	types.RoomPurgeUpdater
+	db *testPurgeDatabase
+}
+
+func (u *testPurgeUpdater) LatestEventNIDs() []types.EventNID { return u.db.latest }
+
+func (u *testPurgeUpdater) LastEventNIDSent() types.EventNID { return u.db.latest[0] }
+
+func (u *testPurgeUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID { return u.db.current }
+
+func (u *testPurgeUpdater) DeleteEvents(eventNIDs []types.EventNID) error {
+	deleted := map[types.EventNID]bool{}
+	for _, eventNID := range eventNIDs {
+		deleted[eventNID] = true
+	}
+	var events []types.PurgeEvent
+	for _, event := range u.db.events {
+		if !deleted[event.EventNID] {
+			events = append(events, event)
+		}
+	}
+	u.db.events = events
+	return nil
+}
+
+func (u *testPurgeUpdater) MarkEventsAsOutliers(eventNIDs []types.EventNID) error {
+	for _, eventNID := range eventNIDs {
+		for i := range u.db.events {
+			if u.db.events[i].EventNID == eventNID {
+				u.db.events[i].BeforeStateSnapshotNID = 0
+			}
+		}
+	}
+	return nil
+}
+
+func (u *testPurgeUpdater) DeleteUnusedStateSnapshots(stateNIDs []types.StateSnapshotNID) (deleted types.DeletedState, err error) {
+	for _, stateNID := range stateNIDs {
+		used := stateNID == u.db.current
+		for _, event := range u.db.events {
+			if event.BeforeStateSnapshotNID == stateNID {
+				used = true
+			}
+		}
+		if _, ok := u.db.states[stateNID]; ok && !used {
+			delete(u.db.states, stateNID)
+			deleted.StateSnapshots++
+			deleted.StateBlocks++
+		}
+	}
+	return
+}
+
+func (u *testPurgeUpdater) Commit() error { return nil }
+
+func (u *testPurgeUpdater) Rollback() error { return nil }
+
+// newTestPurgeDatabase creates a room where events 1 to 4 are old:
+//
+//	1 m.room.create     old, in the current state
+//	2 m.room.member     old, in the current state
+//	3 m.room.message    old
+//	4 m.room.topic      old, in the state before event 5
+//	5 m.room.message    new
+//	6 m.room.message    new, the latest event
+func newTestPurgeDatabase() *testPurgeDatabase {
+	db := &testPurgeDatabase{
+		authEvents: map[types.EventNID][]types.EventNID{},
+		states: map[types.StateSnapshotNID][]types.EventNID{
+			1: nil,
+			2: {1},
+			3: {1, 2},
+			4: {1, 2, 4},
+			5: {1, 2},
+		},
+		latest:  []types.EventNID{6},
+		current: 5,
+	}
+	db.addEvent(1, 1, true)
+	db.addEvent(2, 2, true, 1)
+	db.addEvent(3, 3, true, 1, 2)
+	db.addEvent(4, 3, true, 1, 2)
+	db.addEvent(5, 4, false, 1, 2)
+	db.addEvent(6, 4, false, 1, 2)
+	return db
+}
+
+func eventNIDsInRoom(db *testPurgeDatabase) (kept, outliers []types.EventNID) {
+	for _, event := range db.events {
+		kept = append(kept, event.EventNID)
+		if event.BeforeStateSnapshotNID == 0 {
+			outliers = append(outliers, event.EventNID)
+		}
+	}
+	return
+}
+
+func sameEventNIDs(a, b []types.EventNID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPurgeBeforeTimestamp(t *testing.T) {
+	db := newTestPurgeDatabase()
+	p := Purger{DB: db, BatchSize: 3}
+
+	result, err := p.PurgeBeforeTimestamp("!room:a", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, outliers := eventNIDsInRoom(db)
+	if want := []types.EventNID{1, 2, 4, 5, 6}; !sameEventNIDs(kept, want) {
+		t.Fatalf("wanted events %v to be kept, got %v", want, kept)
+	}
+	if want := []types.EventNID{1, 2, 4}; !sameEventNIDs(outliers, want) {
+		t.Fatalf("wanted events %v to be outliers, got %v", want, outliers)
+	}
+	for _, stateNID := range []types.StateSnapshotNID{1, 2, 3} {
+		if _, ok := db.states[stateNID]; ok {
+			t.Fatalf("wanted state snapshot %d to be deleted", stateNID)
+		}
+	}
+	want := Result{PurgedEvents: 1, RetainedEvents: 3, DeletedState: types.DeletedState{StateSnapshots: 3, StateBlocks: 3}}
+	if result != want {
+		t.Fatalf("wanted result %#v, got %#v", want, result)
+	}
+	if db.locks != 2 {
+		t.Fatalf("wanted the old events to be purged in 2 batches, got %d", db.locks)
+	}
+}
+
+func TestPurgeKeepsEventsAddedDuringPurge(t *testing.T) {
+	db := newTestPurgeDatabase()
+	db.onLock = func(locks int) {
+		if locks == 2 {
+			// Event 7 arrives between the batches and the state before it refers to event 3.
+			db.states[6] = []types.EventNID{1, 2, 3}
+			db.addEvent(7, 6, false, 1, 2)
+			db.latest = []types.EventNID{7}
+		}
+	}
+	p := Purger{DB: db, BatchSize: 2}
+
+	if _, err := p.PurgeBeforeTimestamp("!room:a", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, outliers := eventNIDsInRoom(db)
+	if want := []types.EventNID{1, 2, 3, 4, 5, 6, 7}; !sameEventNIDs(kept, want) {
+		t.Fatalf("wanted events %v to be kept, got %v", want, kept)
+	}
+	if want := []types.EventNID{1, 2, 3, 4}; !sameEventNIDs(outliers, want) {
+		t.Fatalf("wanted events %v to be outliers, got %v", want, outliers)
+	}
+}
@@ -0,0 +1,485 @@
+// Package query implements the roomserver query API over HTTP.
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net/http"
+)
+
+// RoomserverQueryAPIDatabase has the storage APIs needed to implement the query API.
+type RoomserverQueryAPIDatabase interface {
+	state.RoomStateDatabase
+	// Lookup the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	// Returns an error if there was a problem talking to the database.
+	RoomNID(roomID string) (types.RoomNID, error)
+	// Lookup event references for the latest events in the room and the current state snapshot.
+	// Returns the latest events, the current state and an error if there was a problem talking to the database.
+	LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, error)
+	// Lookup the numeric IDs for the events and the state snapshots before them.
+	// Returns a types.MissingEventError if any of the events are missing or we don't know the state before them.
+	// Returns an error if there was a problem talking to the database.
+	StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error)
+	// Lookup the numeric IDs for a list of string event IDs.
+	// Event IDs that aren't in the database are left out of the map.
+	// Returns an error if there was a problem talking to the database.
+	EventNIDs(eventIDs []string) (map[string]types.EventNID, error)
+	// Lookup the room that each of a list of events is in.
+	// Events that aren't in the database are left out of the map.
+	// Returns an error if there was a problem talking to the database.
+	EventRoomNIDs(eventNIDs []types.EventNID) (map[types.EventNID]types.RoomNID, error)
+	// Lookup the numeric IDs of every event in the auth chains of the given events.
+	// Returns an error if there was a problem talking to the database.
+	AuthChainEventNIDs(eventNIDs []types.EventNID) ([]types.EventNID, error)
+	// Lookup why each of a list of events was rejected.
+	// Returns a map from numeric event ID to the rejection reason. Events that weren't rejected are left out.
+	// Returns an error if there was a problem talking to the database.
+	RejectionReasons(eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// Lookup the room and the position in the history of the room for an event.
+	// Returns a room NID of 0 if the event isn't stored.
+	// Returns a zero StreamPosition if the event isn't part of the history of the room.
+	// Returns an error if there was a problem talking to the database.
+	EventHistoryPosition(eventID string) (types.RoomNID, types.HistoryPosition, error)
+	// Lookup up to limit events in the history of a room before or after a position.
+	// The events are ordered in the direction of paging and the event at the position isn't included.
+	// Returns an error if there was a problem talking to the database.
+	RoomHistory(roomNID types.RoomNID, from types.HistoryPosition, backwards bool, limit int) ([]types.HistoryEvent, error)
+}
+
+// RoomserverQueryAPI is an implementation of api.RoomserverQueryAPI
+type RoomserverQueryAPI struct {
+	DB RoomserverQueryAPIDatabase
+}
+
+// QueryLatestEventsAndState implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryLatestEventsAndState(
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.QueryLatestEventsAndStateRequest = *request
+	roomNID, err := r.DB.RoomNID(request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+	var currentStateSnapshotNID types.StateSnapshotNID
+	response.LatestEvents, currentStateSnapshotNID, err = r.DB.LatestEventIDs(roomNID)
+	if err != nil {
+		return err
+	}
+	if currentStateSnapshotNID == 0 || len(request.StateToFetch) == 0 {
+		// We either don't know the current state of the room yet or we
+		// haven't been asked for any of it.
+		return nil
+	}
+
+	// Lookup the current state for the requested tuples.
+	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(r.DB, currentStateSnapshotNID, request.StateToFetch)
+	if err != nil {
+		return err
+	}
+
+	response.StateEvents, err = r.loadStateEvents(stateEntries)
+	return err
+}
+
+// QueryStateAfterEvents implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryStateAfterEvents(
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) error {
+	response.QueryStateAfterEventsRequest = *request
+	roomNID, err := r.DB.RoomNID(request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+
+	// The same event can be listed more than once. Remove the duplicates
+	// since the database returns one entry for each distinct event.
+	prevStates, err := r.DB.StateAtEventIDs(uniqueEventIDs(request.PrevEventIDs))
+	if err != nil {
+		if _, ok := err.(types.MissingEventError); ok {
+			return nil
+		}
+		return err
+	}
+
+	// The previous events must be in the requested room, otherwise we would
+	// return the state of a different room.
+	prevEventNIDs := make([]types.EventNID, len(prevStates))
+	for i := range prevStates {
+		prevEventNIDs[i] = prevStates[i].EventNID
+	}
+	prevRoomNIDs, err := r.DB.EventRoomNIDs(prevEventNIDs)
+	if err != nil {
+		return err
+	}
+	for _, eventNID := range prevEventNIDs {
+		if prevRoomNIDs[eventNID] != roomNID {
+			return nil
+		}
+	}
+	response.PrevEventsExist = true
+
+	// Look up the state after the events, resolving any conflicts between them.
+	var stateEntries []types.StateEntry
+	if len(request.StateToFetch) == 0 {
+		stateEntries, err = state.LoadStateAfterEvents(r.DB, prevStates)
+	} else {
+		stateEntries, err = state.LoadStateAfterEventsForStringTuples(r.DB, prevStates, request.StateToFetch)
+	}
+	if err != nil {
+		return err
+	}
+
+	response.StateEvents, err = r.loadStateEvents(stateEntries)
+	return err
+}
+
+// uniqueEventIDs returns the event IDs without any duplicates, in the order they were first listed.
+func uniqueEventIDs(eventIDs []string) []string {
+	seen := make(map[string]bool, len(eventIDs))
+	var result []string
+	for _, eventID := range eventIDs {
+		if !seen[eventID] {
+			seen[eventID] = true
+			result = append(result, eventID)
+		}
+	}
+	return result
+}
+
+// QueryStateAtEvent implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryStateAtEvent(
+	request *api.QueryStateAtEventRequest,
+	response *api.QueryStateAtEventResponse,
+) error {
+	response.QueryStateAtEventRequest = *request
+	stateAtEvents, err := r.DB.StateAtEventIDs([]string{request.EventID})
+	if err != nil {
+		if _, ok := err.(types.MissingEventError); ok {
+			return nil
+		}
+		return err
+	}
+	response.EventExists = true
+
+	// The state snapshot stored for an event is the state just before it.
+	stateNID := stateAtEvents[0].BeforeStateSnapshotNID
+	var stateEntries []types.StateEntry
+	if len(request.StateToFetch) == 0 {
+		stateEntries, err = state.LoadStateAtSnapshot(r.DB, stateNID)
+	} else {
+		stateEntries, err = state.LoadStateAtSnapshotForStringTuples(r.DB, stateNID, request.StateToFetch)
+	}
+	if err != nil {
+		return err
+	}
+
+	response.StateEvents, err = r.loadStateEvents(stateEntries)
+	return err
+}
+
+// QueryEventsByID implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryEventsByID(
+	request *api.QueryEventsByIDRequest,
+	response *api.QueryEventsByIDResponse,
+) error {
+	response.QueryEventsByIDRequest = *request
+	eventNIDMap, err := r.DB.EventNIDs(request.EventIDs)
+	if err != nil {
+		return err
+	}
+	eventNIDs := make([]types.EventNID, 0, len(eventNIDMap))
+	for _, eventNID := range eventNIDMap {
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+
+	response.Events, err = r.loadEvents(eventNIDs)
+	if err != nil {
+		return err
+	}
+
+	if !request.AuthChain || len(eventNIDs) == 0 {
+		return nil
+	}
+
+	authChainNIDs, err := r.DB.AuthChainEventNIDs(eventNIDs)
+	if err != nil {
+		return err
+	}
+
+	response.AuthChainEvents, err = r.loadEvents(authChainNIDs)
+	return err
+}
+
+// QueryRejectedEvents implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRejectedEvents(
+	request *api.QueryRejectedEventsRequest,
+	response *api.QueryRejectedEventsResponse,
+) error {
+	response.QueryRejectedEventsRequest = *request
+	eventNIDMap, err := r.DB.EventNIDs(request.EventIDs)
+	if err != nil {
+		return err
+	}
+	eventNIDs := make([]types.EventNID, 0, len(eventNIDMap))
+	for _, eventNID := range eventNIDMap {
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+
+	reasons, err := r.DB.RejectionReasons(eventNIDs)
+	if err != nil {
+		return err
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	rejectedNIDs := make([]types.EventNID, 0, len(reasons))
+	for eventNID := range reasons {
+		rejectedNIDs = append(rejectedNIDs, eventNID)
+	}
+
+	events, err := r.DB.Events(rejectedNIDs)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		response.RejectedEvents = append(response.RejectedEvents, api.RejectedEvent{
+			Event:           event.Event,
+			RejectionReason: reasons[event.EventNID],
+		})
+	}
+	return nil
+}
+
+// QueryMessages implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryMessages(
+	request *api.QueryMessagesRequest,
+	response *api.QueryMessagesResponse,
+) error {
+	response.QueryMessagesRequest = *request
+	roomNID, err := r.DB.RoomNID(request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+
+	// Work out where to start paging from.
+	var from types.HistoryPosition
+	switch {
+	case request.FromEventID != "":
+		var eventRoomNID types.RoomNID
+		eventRoomNID, from, err = r.DB.EventHistoryPosition(request.FromEventID)
+		if err != nil {
+			return err
+		}
+		if eventRoomNID != roomNID || from.StreamPosition == 0 {
+			// The event isn't part of the history of this room.
+			return nil
+		}
+	case request.FromToken != "":
+		if from, err = parseHistoryToken(request.FromToken); err != nil {
+			return err
+		}
+	case request.Backwards:
+		from = types.HistoryPosition{Depth: math.MaxInt64, StreamPosition: math.MaxInt64}
+	default:
+		from = types.HistoryPosition{Depth: math.MinInt64, StreamPosition: math.MinInt64}
+	}
+	response.FromEventExists = true
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = api.DefaultMessagesLimit
+	}
+	if limit > api.MaxMessagesLimit {
+		limit = api.MaxMessagesLimit
+	}
+
+	history, err := r.DB.RoomHistory(roomNID, from, request.Backwards, limit)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		response.NextToken = historyToken(from)
+		return nil
+	}
+	response.NextToken = historyToken(history[len(history)-1].HistoryPosition)
+
+	// The events are loaded in an arbitrary order so put them back in the order of the history.
+	eventNIDs := make([]types.EventNID, len(history))
+	for i := range history {
+		eventNIDs[i] = history[i].EventNID
+	}
+	events, err := r.DB.Events(eventNIDs)
+	if err != nil {
+		return err
+	}
+	eventMap := make(map[types.EventNID]gomatrixserverlib.Event, len(events))
+	for _, event := range events {
+		eventMap[event.EventNID] = event.Event
+	}
+	for _, eventNID := range eventNIDs {
+		if event, ok := eventMap[eventNID]; ok {
+			response.Events = append(response.Events, event)
+		}
+	}
+	return nil
+}
+
+// historyToken encodes a position in the history of a room as a token for the NextToken of a QueryMessagesResponse.
+func historyToken(position types.HistoryPosition) string {
+	return fmt.Sprintf("t%d_%d", position.Depth, position.StreamPosition)
+}
+
+// parseHistoryToken decodes a token created by historyToken.
+func parseHistoryToken(token string) (types.HistoryPosition, error) {
+	var position types.HistoryPosition
+	if _, err := fmt.Sscanf(token, "t%d_%d", &position.Depth, &position.StreamPosition); err != nil {
+		return types.HistoryPosition{}, fmt.Errorf("query: invalid history token %q: %s", token, err)
+	}
+	return position, nil
+}
+
+// loadStateEvents loads the matrix events for a list of state entries.
+func (r *RoomserverQueryAPI) loadStateEvents(stateEntries []types.StateEntry) ([]gomatrixserverlib.Event, error) {
+	eventNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		eventNIDs[i] = stateEntries[i].EventNID
+	}
+	return r.loadEvents(eventNIDs)
+}
+
+// loadEvents loads the matrix events for a list of numeric event IDs.
+func (r *RoomserverQueryAPI) loadEvents(eventNIDs []types.EventNID) ([]gomatrixserverlib.Event, error) {
+	events, err := r.DB.Events(eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]gomatrixserverlib.Event, len(events))
+	for i := range events {
+		result[i] = events[i].Event
+	}
+	return result, nil
+}
+
+// SetupHTTP adds the RoomserverQueryAPI handlers to the http.ServeMux.
+func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(
+		api.RoomserverQueryLatestEventsAndStatePath,
+		makeHTTPAPI("query_latest_events_and_state", func(req *http.Request) util.JSONResponse {
+			var request api.QueryLatestEventsAndStateRequest
+			var response api.QueryLatestEventsAndStateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryLatestEventsAndState(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryStateAfterEventsPath,
+		makeHTTPAPI("query_state_after_events", func(req *http.Request) util.JSONResponse {
+			var request api.QueryStateAfterEventsRequest
+			var response api.QueryStateAfterEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryStateAfterEvents(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryStateAtEventPath,
+		makeHTTPAPI("query_state_at_event", func(req *http.Request) util.JSONResponse {
+			var request api.QueryStateAtEventRequest
+			var response api.QueryStateAtEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryStateAtEvent(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryEventsByIDPath,
+		makeHTTPAPI("query_events_by_id", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventsByIDRequest
+			var response api.QueryEventsByIDResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryEventsByID(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRejectedEventsPath,
+		makeHTTPAPI("query_rejected_events", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRejectedEventsRequest
+			var response api.QueryRejectedEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryRejectedEvents(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryMessagesPath,
+		makeHTTPAPI("query_messages", func(req *http.Request) util.JSONResponse {
+			var request api.QueryMessagesRequest
+			var response api.QueryMessagesResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(400, err.Error())
+			}
+			if err := r.QueryMessages(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+}
+
+// makeHTTPAPI wraps a function handling a JSON request as an http.Handler that records metrics.
+func makeHTTPAPI(metricsName string, f func(req *http.Request) util.JSONResponse) http.Handler {
+	return prometheus.InstrumentHandler(metricsName, util.MakeJSONAPI(jsonRequestHandlerFunc(f)))
+}
+
+// jsonRequestHandlerFunc allows in-line functions to conform to util.JSONRequestHandler
+type jsonRequestHandlerFunc func(req *http.Request) util.JSONResponse
+
+// OnIncomingRequest implements util.JSONRequestHandler
+func (f jsonRequestHandlerFunc) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	return f(req)
+}
@@ -0,0 +1,482 @@
+package query
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testQueryDatabase is a RoomserverQueryAPIDatabase for a single room with
+// a create event and a join event in its current state.
+type testQueryDatabase struct {
+	state.RoomStateDatabase
+	events   []types.Event
+	rejected map[types.EventNID]string
+}
+
+const testCreateJSON = `{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":1,"prev_events":[],"content":{"creator":"@alice:a"}}`
+
+const testJoinJSON = `{"type":"m.room.member","state_key":"@alice:a","event_id":"$join:a","room_id":"!room:a",` +
+	`"sender":"@alice:a","depth":2,"prev_events":[],"content":{"membership":"join"}}`
+
+func newTestQueryDatabase(t *testing.T) *testQueryDatabase {
+	db := &testQueryDatabase{}
+	for i, eventJSON := range []string{testCreateJSON, testJoinJSON} {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.events = append(db.events, types.Event{EventNID: types.EventNID(i + 1), Event: event})
+	}
+	return db
+}
+
+func (db *testQueryDatabase) RoomNID(roomID string) (types.RoomNID, error) {
+	if roomID == "!room:a" {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (db *testQueryDatabase) LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, error) {
+	return []gomatrixserverlib.EventReference{{EventID: "$join:a", EventSHA256: []byte("hash")}}, 1, nil
+}
+
+// StateAtEventIDs returns one entry for each distinct event, like the real database,
+// so a list with duplicates is reported as having missing events.
+func (db *testQueryDatabase) StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error) {
+	var result []types.StateAtEvent
+	seen := map[string]bool{}
+	for _, eventID := range eventIDs {
+		if seen[eventID] {
+			continue
+		}
+		seen[eventID] = true
+		switch eventID {
+		case "$create:a":
+			result = append(result, types.StateAtEvent{
+				StateEntry: types.StateEntry{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1},
+			})
+		case "$join:a":
+			result = append(result, types.StateAtEvent{
+				BeforeStateSnapshotNID: 1,
+				StateEntry:             types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, 2}, 2},
+			})
+		case "$other:b":
+			// An event in a different room.
+			result = append(result, types.StateAtEvent{
+				BeforeStateSnapshotNID: 1,
+				StateEntry:             types.StateEntry{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 3},
+			})
+		default:
+			return nil, types.MissingEventError("missing " + eventID)
+		}
+	}
+	if len(result) != len(eventIDs) {
+		return nil, types.MissingEventError("duplicate event IDs")
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) EventRoomNIDs(eventNIDs []types.EventNID) (map[types.EventNID]types.RoomNID, error) {
+	result := map[types.EventNID]types.RoomNID{}
+	for _, eventNID := range eventNIDs {
+		if eventNID == 3 {
+			result[eventNID] = 2
+		} else {
+			result[eventNID] = 1
+		}
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) EventNIDs(eventIDs []string) (map[string]types.EventNID, error) {
+	result := map[string]types.EventNID{}
+	for _, eventID := range eventIDs {
+		for _, event := range db.events {
+			if event.EventID() == eventID {
+				result[eventID] = event.EventNID
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) AuthChainEventNIDs(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	// The join event is authed by the create event which has no auth events.
+	for _, eventNID := range eventNIDs {
+		if eventNID == 2 {
+			return []types.EventNID{1}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (db *testQueryDatabase) RejectionReasons(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	result := map[types.EventNID]string{}
+	for _, eventNID := range eventNIDs {
+		if reason, ok := db.rejected[eventNID]; ok {
+			result[eventNID] = reason
+		}
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) EventTypeNIDs(eventTypes []string) (map[string]types.EventTypeNID, error) {
+	result := map[string]types.EventTypeNID{}
+	for _, eventType := range eventTypes {
+		switch eventType {
+		case "m.room.create":
+			result[eventType] = types.MRoomCreateNID
+		case "m.room.member":
+			result[eventType] = types.MRoomMemberNID
+		}
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	result := map[string]types.EventStateKeyNID{}
+	for _, eventStateKey := range eventStateKeys {
+		switch eventStateKey {
+		case "":
+			result[eventStateKey] = types.EmptyStateKeyNID
+		case "@alice:a":
+			result[eventStateKey] = 2
+		}
+	}
+	return result, nil
+}
+
+func (db *testQueryDatabase) StateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return []types.StateBlockNIDList{{StateSnapshotNID: 1, StateBlockNIDs: []types.StateBlockNID{1}}}, nil
+}
+
+func (db *testQueryDatabase) StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	return []types.StateEntryList{{StateBlockNID: 1, StateEntries: []types.StateEntry{
+		{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1},
+		{types.StateKeyTuple{types.MRoomMemberNID, 2}, 2},
+	}}}, nil
+}
+
+func (db *testQueryDatabase) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, event := range db.events {
+		for _, eventNID := range eventNIDs {
+			if event.EventNID == eventNID {
+				result = append(result, event)
+			}
+		}
+	}
+	return result, nil
+}
+
+// historyPosition returns the position of an event in the history of the room.
+// The events were added to the room in the order of their event NIDs.
+func (db *testQueryDatabase) historyPosition(event types.Event) types.HistoryPosition {
+	return types.HistoryPosition{Depth: event.Depth(), StreamPosition: int64(event.EventNID)}
+}
+
+func (db *testQueryDatabase) EventHistoryPosition(eventID string) (types.RoomNID, types.HistoryPosition, error) {
+	for _, event := range db.events {
+		if event.EventID() == eventID {
+			return 1, db.historyPosition(event), nil
+		}
+	}
+	return 0, types.HistoryPosition{}, nil
+}
+
+func (db *testQueryDatabase) RoomHistory(
+	roomNID types.RoomNID, from types.HistoryPosition, backwards bool, limit int,
+) ([]types.HistoryEvent, error) {
+	// The events are stored in the order of their history positions.
+	var result []types.HistoryEvent
+	for i := range db.events {
+		event := db.events[i]
+		if backwards {
+			event = db.events[len(db.events)-1-i]
+		}
+		position := db.historyPosition(event)
+		if backwards && !positionBefore(position, from) || !backwards && !positionBefore(from, position) {
+			continue
+		}
+		if len(result) < limit {
+			result = append(result, types.HistoryEvent{EventNID: event.EventNID, HistoryPosition: position})
+		}
+	}
+	return result, nil
+}
+
+func positionBefore(a, b types.HistoryPosition) bool {
+	return a.Depth < b.Depth || a.Depth == b.Depth && a.StreamPosition < b.StreamPosition
+}
+
+func TestQueryLatestEventsAndStateHTTP(t *testing.T) {
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: newTestQueryDatabase(t)}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	var response api.QueryLatestEventsAndStateResponse
+	err := client.QueryLatestEventsAndState(&api.QueryLatestEventsAndStateRequest{
+		RoomID: "!room:a",
+		StateToFetch: []api.StateKeyTuple{
+			{EventType: "m.room.member", EventStateKey: "@alice:a"},
+			{EventType: "m.room.member", EventStateKey: "@bob:a"},
+		},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.RoomExists {
+		t.Fatalf("Wanted the room to exist")
+	}
+	if len(response.LatestEvents) != 1 || response.LatestEvents[0].EventID != "$join:a" {
+		t.Fatalf("Wanted latest events [$join:a], got %v", response.LatestEvents)
+	}
+	if len(response.StateEvents) != 1 || response.StateEvents[0].EventID() != "$join:a" {
+		t.Fatalf("Wanted state events [$join:a], got %d events", len(response.StateEvents))
+	}
+
+	response = api.QueryLatestEventsAndStateResponse{}
+	err = client.QueryLatestEventsAndState(&api.QueryLatestEventsAndStateRequest{RoomID: "!missing:a"}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.RoomExists {
+		t.Fatalf("Wanted the room not to exist")
+	}
+}
+
+func TestQueryStateAfterEventsHTTP(t *testing.T) {
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: newTestQueryDatabase(t)}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	var response api.QueryStateAfterEventsResponse
+	err := client.QueryStateAfterEvents(&api.QueryStateAfterEventsRequest{
+		RoomID:       "!room:a",
+		PrevEventIDs: []string{"$join:a"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.RoomExists || !response.PrevEventsExist {
+		t.Fatalf("Wanted the room and the prev events to exist")
+	}
+	if len(response.StateEvents) != 2 {
+		t.Fatalf("Wanted 2 state events, got %d", len(response.StateEvents))
+	}
+
+	response = api.QueryStateAfterEventsResponse{}
+	err = client.QueryStateAfterEvents(&api.QueryStateAfterEventsRequest{
+		RoomID:       "!room:a",
+		PrevEventIDs: []string{"$join:a"},
+		StateToFetch: []api.StateKeyTuple{{EventType: "m.room.create", EventStateKey: ""}},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.StateEvents) != 1 || response.StateEvents[0].EventID() != "$create:a" {
+		t.Fatalf("Wanted state events [$create:a], got %d events", len(response.StateEvents))
+	}
+
+	response = api.QueryStateAfterEventsResponse{}
+	err = client.QueryStateAfterEvents(&api.QueryStateAfterEventsRequest{
+		RoomID:       "!room:a",
+		PrevEventIDs: []string{"$join:a", "$missing:a"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.RoomExists || response.PrevEventsExist {
+		t.Fatalf("Wanted the room to exist but not the prev events")
+	}
+
+	response = api.QueryStateAfterEventsResponse{}
+	err = client.QueryStateAfterEvents(&api.QueryStateAfterEventsRequest{
+		RoomID:       "!room:a",
+		PrevEventIDs: []string{"$join:a", "$join:a"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.PrevEventsExist || len(response.StateEvents) != 2 {
+		t.Fatalf("Wanted duplicate prev events to be ignored, got %d state events", len(response.StateEvents))
+	}
+
+	response = api.QueryStateAfterEventsResponse{}
+	err = client.QueryStateAfterEvents(&api.QueryStateAfterEventsRequest{
+		RoomID:       "!room:a",
+		PrevEventIDs: []string{"$join:a", "$other:b"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.RoomExists || response.PrevEventsExist || len(response.StateEvents) != 0 {
+		t.Fatalf("Wanted prev events in a different room to be treated as missing")
+	}
+}
+
+func TestQueryStateAtEventHTTP(t *testing.T) {
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: newTestQueryDatabase(t)}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	var response api.QueryStateAtEventResponse
+	err := client.QueryStateAtEvent(&api.QueryStateAtEventRequest{
+		EventID:      "$join:a",
+		StateToFetch: []api.StateKeyTuple{{EventType: "m.room.member", EventStateKey: "@alice:a"}},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.EventExists {
+		t.Fatalf("Wanted the event to exist")
+	}
+	if len(response.StateEvents) != 1 || response.StateEvents[0].EventID() != "$join:a" {
+		t.Fatalf("Wanted state events [$join:a], got %d events", len(response.StateEvents))
+	}
+
+	response = api.QueryStateAtEventResponse{}
+	if err = client.QueryStateAtEvent(&api.QueryStateAtEventRequest{EventID: "$missing:a"}, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.EventExists {
+		t.Fatalf("Wanted the event not to exist")
+	}
+}
+
+func TestQueryEventsByIDHTTP(t *testing.T) {
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: newTestQueryDatabase(t)}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	var response api.QueryEventsByIDResponse
+	err := client.QueryEventsByID(&api.QueryEventsByIDRequest{
+		EventIDs: []string{"$join:a", "$missing:a"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 || response.Events[0].EventID() != "$join:a" {
+		t.Fatalf("Wanted events [$join:a], got %d events", len(response.Events))
+	}
+	if len(response.AuthChainEvents) != 0 {
+		t.Fatalf("Wanted no auth chain events, got %d events", len(response.AuthChainEvents))
+	}
+
+	response = api.QueryEventsByIDResponse{}
+	err = client.QueryEventsByID(&api.QueryEventsByIDRequest{
+		EventIDs:  []string{"$join:a"},
+		AuthChain: true,
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.AuthChainEvents) != 1 || response.AuthChainEvents[0].EventID() != "$create:a" {
+		t.Fatalf("Wanted auth chain events [$create:a], got %d events", len(response.AuthChainEvents))
+	}
+}
+
+func TestQueryRejectedEventsHTTP(t *testing.T) {
+	db := newTestQueryDatabase(t)
+	db.rejected = map[types.EventNID]string{2: "not allowed"}
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: db}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	var response api.QueryRejectedEventsResponse
+	err := client.QueryRejectedEvents(&api.QueryRejectedEventsRequest{
+		EventIDs: []string{"$create:a", "$join:a", "$missing:a"},
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.RejectedEvents) != 1 {
+		t.Fatalf("Wanted 1 rejected event, got %d", len(response.RejectedEvents))
+	}
+	rejected := response.RejectedEvents[0]
+	if rejected.Event.EventID() != "$join:a" || rejected.RejectionReason != "not allowed" {
+		t.Fatalf("Wanted $join:a to be rejected as not allowed, got %q rejected as %q",
+			rejected.Event.EventID(), rejected.RejectionReason)
+	}
+}
+
+func TestQueryMessagesHTTP(t *testing.T) {
+	servMux := http.NewServeMux()
+	(&RoomserverQueryAPI{DB: newTestQueryDatabase(t)}).SetupHTTP(servMux)
+	server := httptest.NewServer(servMux)
+	defer server.Close()
+	client := api.NewRoomserverQueryAPIHTTP(server.URL, nil)
+
+	// Page backwards from the end of the room one event at a time.
+	var response api.QueryMessagesResponse
+	err := client.QueryMessages(&api.QueryMessagesRequest{RoomID: "!room:a", Backwards: true, Limit: 1}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 || response.Events[0].EventID() != "$join:a" {
+		t.Fatalf("Wanted events [$join:a], got %d events", len(response.Events))
+	}
+	token := response.NextToken
+
+	response = api.QueryMessagesResponse{}
+	err = client.QueryMessages(&api.QueryMessagesRequest{
+		RoomID: "!room:a", FromToken: token, Backwards: true, Limit: 1,
+	}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 || response.Events[0].EventID() != "$create:a" {
+		t.Fatalf("Wanted events [$create:a], got %d events", len(response.Events))
+	}
+
+	// Page forwards from an event.
+	response = api.QueryMessagesResponse{}
+	err = client.QueryMessages(&api.QueryMessagesRequest{RoomID: "!room:a", FromEventID: "$create:a"}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.FromEventExists || len(response.Events) != 1 || response.Events[0].EventID() != "$join:a" {
+		t.Fatalf("Wanted events [$join:a], got %d events", len(response.Events))
+	}
+
+	// There aren't any more events so the next token is for the same position.
+	token = response.NextToken
+	response = api.QueryMessagesResponse{}
+	if err = client.QueryMessages(&api.QueryMessagesRequest{RoomID: "!room:a", FromToken: token}, &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 0 || response.NextToken != token {
+		t.Fatalf("Wanted no events and the token %q, got %d events and the token %q",
+			token, len(response.Events), response.NextToken)
+	}
+
+	response = api.QueryMessagesResponse{}
+	err = client.QueryMessages(&api.QueryMessagesRequest{RoomID: "!room:a", FromEventID: "$missing:a"}, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.RoomExists || response.FromEventExists {
+		t.Fatalf("Wanted the room to exist but not the event")
+	}
+
+	if err = client.QueryMessages(&api.QueryMessagesRequest{RoomID: "!room:a", FromToken: "bad"}, &response); err == nil {
+		t.Fatalf("Wanted an error for an invalid token")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/purge"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"os"
+	"strconv"
+)
+
+// Deletes the state snapshots and state blocks that nothing in the roomserver
+// database uses. The roomserver can be running while this runs. Each batch of
+// state waits for the events that are storing state to finish before checking
+// whether the state is used. The state is deleted in batches of COLLECT_BATCH_SIZE.
+
+var (
+	database         = os.Getenv("DATABASE")
+	collectBatchSize = os.Getenv("COLLECT_BATCH_SIZE")
+)
+
+func main() {
+	db, err := storage.Open(database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	collector := purge.StateCollector{DB: db}
+
+	if collectBatchSize != "" {
+		if collector.BatchSize, err = strconv.Atoi(collectBatchSize); err != nil {
+			panic(err)
+		}
+	}
+
+	deleted, err := collector.Collect()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf(
+		"Deleted %d state snapshots and %d state blocks, reclaiming %d bytes\n",
+		deleted.StateSnapshots, deleted.StateBlocks, deleted.Bytes,
+	)
+}
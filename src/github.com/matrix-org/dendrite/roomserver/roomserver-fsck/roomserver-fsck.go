@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/fsck"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"os"
+	"strconv"
+)
+
+// Checks the roomserver database for references to rows that don't exist and
+// re-runs the auth checks on a random sample of AUTH_SAMPLE_SIZE stored events.
+// Prints each problem found, reporting at most FSCK_LIMIT problems for each check.
+// If REPAIR is "true" then the problems that can be repaired safely are repaired.
+// The roomserver must be stopped while repairing the database.
+// Exits with status 1 if there are problems that weren't repaired.
+
+var (
+	database       = os.Getenv("DATABASE")
+	repair         = os.Getenv("REPAIR")
+	authSampleSize = os.Getenv("AUTH_SAMPLE_SIZE")
+	fsckLimit      = os.Getenv("FSCK_LIMIT")
+)
+
+func main() {
+	db, err := storage.Open(database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	checker := fsck.Checker{DB: db}
+
+	if repair != "" {
+		if checker.Repair, err = strconv.ParseBool(repair); err != nil {
+			panic(err)
+		}
+	}
+
+	if authSampleSize != "" {
+		if checker.AuthSampleSize, err = strconv.Atoi(authSampleSize); err != nil {
+			panic(err)
+		}
+	}
+
+	if fsckLimit != "" {
+		if checker.Limit, err = strconv.Atoi(fsckLimit); err != nil {
+			panic(err)
+		}
+	}
+
+	problems, err := checker.Check()
+	if err != nil {
+		panic(err)
+	}
+
+	repaired := 0
+	for _, problem := range problems {
+		status := "found"
+		if problem.Repaired {
+			status = "repaired"
+			repaired++
+		}
+		fmt.Printf("%s: %s (%s)\n", problem.Check, problem.Description, status)
+	}
+
+	fmt.Printf("Found %d problems, repaired %d\n", len(problems), repaired)
+
+	if repaired < len(problems) {
+		os.Exit(1)
+	}
+}
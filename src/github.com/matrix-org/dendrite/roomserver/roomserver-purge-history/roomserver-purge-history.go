@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/purge"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Purges the old history of a room from the roomserver database.
+// Either BEFORE_EVENT_ID purges the events in the room of that event that come
+// before it, or ROOM_ID and BEFORE_TS purge the events in ROOM_ID with an
+// origin_server_ts before BEFORE_TS, which is an RFC 3339 timestamp.
+// The events still needed by the room are kept as outliers. The purge is done in
+// batches of PURGE_BATCH_SIZE events and can be run while the roomserver is running.
+
+var (
+	database      = os.Getenv("DATABASE")
+	roomID        = os.Getenv("ROOM_ID")
+	beforeTS      = os.Getenv("BEFORE_TS")
+	beforeEventID = os.Getenv("BEFORE_EVENT_ID")
+	batchSize     = os.Getenv("PURGE_BATCH_SIZE")
+)
+
+func main() {
+	if beforeEventID == "" && (roomID == "" || beforeTS == "") {
+		panic("No BEFORE_EVENT_ID or ROOM_ID and BEFORE_TS environment variables found.")
+	}
+
+	db, err := storage.Open(database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	purger := purge.Purger{DB: db}
+
+	if batchSize != "" {
+		if purger.BatchSize, err = strconv.Atoi(batchSize); err != nil {
+			panic(err)
+		}
+	}
+
+	var result purge.Result
+	if beforeEventID != "" {
+		result, err = purger.PurgeBeforeEvent(beforeEventID)
+	} else {
+		var before time.Time
+		if before, err = time.Parse(time.RFC3339, beforeTS); err != nil {
+			panic(err)
+		}
+		result, err = purger.PurgeBeforeTimestamp(roomID, before)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf(
+		"Purged %d events, kept %d events as outliers, deleted %d state snapshots and %d state blocks\n",
+		result.PurgedEvents, result.RetainedEvents, result.DeletedState.StateSnapshots, result.DeletedState.StateBlocks,
+	)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Regenerates the roomserver output log from the events in the roomserver
+// database and writes it to TOPIC_OUTPUT_ROOM_EVENT. This is intended to be
+// run by hand if the output log is lost or if a new reader needs the full
+// history of the rooms.
+// The output can be limited to the rooms in ROOM_IDS, a comma separated list,
+// and to the events with an origin_server_ts between FROM_TS and TO_TS, which
+// are RFC 3339 timestamps. The events outside the time range are still replayed
+// so that the LastSentEventID and the state deltas of the output are correct.
+// The messages are written to the topic after any messages already in it, so
+// the topic should be a new one unless the readers can cope with repeats.
+
+var (
+	database             = os.Getenv("DATABASE")
+	kafkaURIs            = strings.Split(os.Getenv("KAFKA_URIS"), ",")
+	outputRoomEventTopic = os.Getenv("TOPIC_OUTPUT_ROOM_EVENT")
+	roomIDs              = os.Getenv("ROOM_IDS")
+	fromTS               = os.Getenv("FROM_TS")
+	toTS                 = os.Getenv("TO_TS")
+	legacyOutput         = os.Getenv("LEGACY_OUTPUT")
+)
+
+func main() {
+	if outputRoomEventTopic == "" {
+		panic("No TOPIC_OUTPUT_ROOM_EVENT environment variable found.")
+	}
+
+	db, err := storage.Open(database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	config := sarama.NewConfig()
+	// The sync producer needs to be told when messages are successfully written.
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(kafkaURIs, config)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+
+	regenerator := input.OutputRegenerator{
+		DB:                   db,
+		Producer:             producer,
+		OutputRoomEventTopic: outputRoomEventTopic,
+	}
+
+	if roomIDs != "" {
+		regenerator.RoomIDs = strings.Split(roomIDs, ",")
+	}
+
+	if fromTS != "" {
+		if regenerator.From, err = time.Parse(time.RFC3339, fromTS); err != nil {
+			panic(err)
+		}
+	}
+
+	if toTS != "" {
+		if regenerator.To, err = time.Parse(time.RFC3339, toTS); err != nil {
+			panic(err)
+		}
+	}
+
+	if legacyOutput != "" {
+		if regenerator.LegacyOutput, err = strconv.ParseBool(legacyOutput); err != nil {
+			panic(err)
+		}
+	}
+
+	count, err := regenerator.Regenerate()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Wrote %d output messages\n", count)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	sarama "gopkg.in/Shopify/sarama.v1"
+	"os"
+	"strings"
+)
+
+// Replays the messages in the roomserver dead letter topic back into the
+// roomserver input topic. This is intended to be run by hand once a fix for
+// whatever caused the messages to fail has been deployed.
+// Only the messages that are in the dead letter topic when the command starts
+// are replayed. Messages that fail again are written back to the dead letter
+// topic by the roomserver so running this command in a loop is a bad idea.
+// The offset of the last message replayed from each partition is stored in the
+// roomserver DATABASE so that running the command again only replays the
+// messages that were written to the dead letter topic since it last ran.
+
+var (
+	database            = os.Getenv("DATABASE")
+	kafkaURIs           = strings.Split(os.Getenv("KAFKA_URIS"), ",")
+	deadLetterTopic     = os.Getenv("TOPIC_DEAD_LETTER_ROOM_EVENT")
+	inputRoomEventTopic = os.Getenv("TOPIC_INPUT_ROOM_EVENT")
+)
+
+func main() {
+	if deadLetterTopic == "" {
+		panic("No TOPIC_DEAD_LETTER_ROOM_EVENT environment variable found.")
+	}
+
+	db, err := storage.Open(database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	// Work out where we got to last time.
+	replayedOffsets := map[int32]int64{}
+	storedOffsets, err := db.PartitionOffsets(deadLetterTopic)
+	if err != nil {
+		panic(err)
+	}
+	for _, offset := range storedOffsets {
+		replayedOffsets[offset.Partition] = offset.Offset
+	}
+
+	config := sarama.NewConfig()
+	// The sync producer needs to be told when messages are successfully written.
+	config.Producer.Return.Successes = true
+	client, err := sarama.NewClient(kafkaURIs, config)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		panic(err)
+	}
+	defer consumer.Close()
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		panic(err)
+	}
+	defer producer.Close()
+
+	partitions, err := consumer.Partitions(deadLetterTopic)
+	if err != nil {
+		panic(err)
+	}
+
+	var replayed int
+	for _, partition := range partitions {
+		start := sarama.OffsetOldest
+		if offset, ok := replayedOffsets[partition]; ok {
+			start = offset + 1
+		}
+		count, err := replayPartition(client, consumer, producer, db, partition, start)
+		if err != nil {
+			panic(err)
+		}
+		replayed += count
+	}
+
+	fmt.Printf("Replayed %d dead letters\n", replayed)
+}
+
+// replayPartition replays the messages currently in a single partition of the dead letter topic,
+// starting from the message at the start offset, and stores the offset of each message replayed.
+// Returns the number of messages replayed.
+func replayPartition(
+	client sarama.Client, consumer sarama.Consumer, producer sarama.SyncProducer, db *storage.Database,
+	partition int32, start int64,
+) (int, error) {
+	oldest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	if start > oldest {
+		// Skip the messages we've already replayed.
+		oldest = start
+	}
+	// The newest offset is the offset that will be assigned to the next message.
+	newest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	if oldest >= newest {
+		// The partition is empty.
+		return 0, nil
+	}
+
+	pc, err := consumer.ConsumePartition(deadLetterTopic, partition, oldest)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	var count int
+	for message := range pc.Messages() {
+		if err = replayMessage(producer, message); err != nil {
+			return count, err
+		}
+		if err = db.SetPartitionOffset(deadLetterTopic, partition, message.Offset); err != nil {
+			return count, err
+		}
+		count++
+		if message.Offset+1 >= newest {
+			// We've reached the messages that were in the partition when we started.
+			break
+		}
+	}
+	return count, nil
+}
+
+// replayMessage writes the original message wrapped by a dead letter back to the input topic.
+func replayMessage(producer sarama.SyncProducer, message *sarama.ConsumerMessage) error {
+	var deadLetter api.DeadLetterInputRoomEvent
+	if err := json.Unmarshal(message.Value, &deadLetter); err != nil {
+		return err
+	}
+	topic := inputRoomEventTopic
+	if topic == "" {
+		// Default to replaying the message into the topic it was originally read from.
+		topic = deadLetter.Topic
+	}
+	var m sarama.ProducerMessage
+	m.Topic = topic
+	m.Key = sarama.ByteEncoder(deadLetter.Key)
+	m.Value = sarama.ByteEncoder(deadLetter.Value)
+	_, _, err := producer.SendMessage(&m)
+	return err
+}
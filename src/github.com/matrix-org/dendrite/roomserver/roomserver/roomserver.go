@@ -1,22 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/purge"
+	"github.com/matrix-org/dendrite/roomserver/query"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ed25519"
 	sarama "gopkg.in/Shopify/sarama.v1"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	database             = os.Getenv("DATABASE")
+	bindAddr             = os.Getenv("BIND_ADDRESS")
+	metricsBindAddr      = os.Getenv("METRICS_BIND_ADDRESS")
 	kafkaURIs            = strings.Split(os.Getenv("KAFKA_URIS"), ",")
 	inputRoomEventTopic  = os.Getenv("TOPIC_INPUT_ROOM_EVENT")
 	outputRoomEventTopic = os.Getenv("TOPIC_OUTPUT_ROOM_EVENT")
+	deadLetterTopic      = os.Getenv("TOPIC_DEAD_LETTER_ROOM_EVENT")
+	rejectedEventTopic   = os.Getenv("TOPIC_OUTPUT_REJECTED_EVENT")
+	missingEventsTopic   = os.Getenv("TOPIC_OUTPUT_MISSING_EVENTS")
+	verifySignatures     = os.Getenv("VERIFY_SIGNATURES")
+	legacyOutput         = os.Getenv("LEGACY_OUTPUT")
+	maxStateBlockNIDs    = os.Getenv("MAX_STATE_BLOCK_NIDS")
+	inputWorkers         = os.Getenv("INPUT_WORKERS")
+	maxExtremities       = os.Getenv("MAX_FORWARD_EXTREMITIES")
+	serverName           = os.Getenv("SERVER_NAME")
+	serverKeyID          = os.Getenv("SERVER_KEY_ID")
+	serverPrivateKey     = os.Getenv("SERVER_PRIVATE_KEY")
+	shutdownTimeout      = os.Getenv("SHUTDOWN_TIMEOUT")
+	stateGCInterval      = os.Getenv("STATE_GC_INTERVAL")
 )
 
+// defaultBindAddress is the address the query API is served on if BIND_ADDRESS isn't set.
+const defaultBindAddress = "localhost:7777"
+
+// defaultShutdownTimeout is how long we wait for the roomserver to stop
+// cleanly if SHUTDOWN_TIMEOUT isn't set.
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
+	if bindAddr == "" {
+		bindAddr = defaultBindAddress
+	}
+
 	db, err := storage.Open(database)
 	if err != nil {
 		panic(err)
@@ -33,20 +71,188 @@ func main() {
 	}
 
 	consumer := input.Consumer{
-		Consumer:             kafkaConsumer,
+		Consumer:            kafkaConsumer,
+		DB:                  db,
+		Producer:            kafkaProducer,
+		InputRoomEventTopic: inputRoomEventTopic,
+		DeadLetterTopic:     deadLetterTopic,
+		RejectedEventTopic:  rejectedEventTopic,
+		MissingEventsTopic:  missingEventsTopic,
+	}
+
+	publisher := input.OutputPublisher{
 		DB:                   db,
 		Producer:             kafkaProducer,
-		InputRoomEventTopic:  inputRoomEventTopic,
 		OutputRoomEventTopic: outputRoomEventTopic,
 	}
 
+	if maxStateBlockNIDs != "" {
+		if consumer.MaxStateBlockNIDs, err = strconv.Atoi(maxStateBlockNIDs); err != nil {
+			panic(err)
+		}
+	}
+
+	// Signatures aren't checked unless VERIFY_SIGNATURES is set. Checking them means
+	// fetching the keys of every server that signs an event, including this one, and
+	// nothing serves the keys of this server yet. Turning the checks on by default would
+	// make every event sent by our own users fail processing.
+	if verifySignatures != "" {
+		var verify bool
+		if verify, err = strconv.ParseBool(verifySignatures); err != nil {
+			panic(err)
+		}
+		if verify {
+			consumer.KeyRing = &input.KeyRing{DB: db, Fetcher: input.DirectKeyFetcher{}}
+		}
+	}
+
+	if legacyOutput != "" {
+		if publisher.LegacyOutput, err = strconv.ParseBool(legacyOutput); err != nil {
+			panic(err)
+		}
+	}
+
+	if inputWorkers != "" {
+		if consumer.Workers, err = strconv.Atoi(inputWorkers); err != nil {
+			panic(err)
+		}
+	}
+
+	if maxExtremities != "" {
+		if consumer.MaxForwardExtremities, err = strconv.Atoi(maxExtremities); err != nil {
+			panic(err)
+		}
+	}
+
+	if serverName != "" {
+		if consumer.Signer, err = eventSigner(); err != nil {
+			panic(err)
+		}
+	}
+
+	// The unused state is only deleted in the background if STATE_GC_INTERVAL is set.
+	var collector *purge.StateCollector
+	if stateGCInterval != "" {
+		collector = &purge.StateCollector{DB: db}
+		if collector.Interval, err = time.ParseDuration(stateGCInterval); err != nil {
+			panic(err)
+		}
+	}
+
+	timeout := defaultShutdownTimeout
+	if shutdownTimeout != "" {
+		if timeout, err = time.ParseDuration(shutdownTimeout); err != nil {
+			panic(err)
+		}
+	}
+
+	publisher.Start()
+
+	if collector != nil {
+		collector.Start()
+	}
+
 	if err = consumer.Start(); err != nil {
 		panic(err)
 	}
 
+	queryAPI := query.RoomserverQueryAPI{
+		DB: db,
+	}
+
+	queryAPI.SetupHTTP(http.DefaultServeMux)
+
+	// The metrics are served alongside the query API unless METRICS_BIND_ADDRESS is set.
+	servers := []*http.Server{{Addr: bindAddr}}
+	if metricsBindAddr == "" {
+		http.DefaultServeMux.Handle("/metrics", prometheus.Handler())
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", prometheus.Handler())
+		servers = append(servers, &http.Server{Addr: metricsBindAddr, Handler: metricsMux})
+	}
+
+	for _, server := range servers {
+		go listen(server)
+	}
+
 	fmt.Println("Started roomserver")
 
-	// Wait forever.
-	// TODO: Implement clean shutdown.
-	select {}
+	// Wait until we are told to stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Printf("Received %v, stopping roomserver\n", <-signals)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop(&consumer, &publisher, collector, servers, kafkaConsumer, kafkaProducer, db)
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		fmt.Println("Stopped roomserver")
+	case <-time.After(timeout):
+		// Any room updates that were in progress are rolled back by the
+		// database when we exit, so it is safe to give up here.
+		fmt.Println("Timed out stopping roomserver")
+		os.Exit(1)
+	}
+}
+
+// eventSigner returns the identity used to sign the events the roomserver creates itself.
+// The private key is the unpadded base64 encoding of a 32 byte ed25519 seed.
+func eventSigner() (*input.EventSigner, error) {
+	if serverKeyID == "" || serverPrivateKey == "" {
+		return nil, fmt.Errorf("Must specify SERVER_KEY_ID and SERVER_PRIVATE_KEY with SERVER_NAME")
+	}
+	seed, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(serverPrivateKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != 32 {
+		return nil, fmt.Errorf("SERVER_PRIVATE_KEY must be a 32 byte ed25519 seed")
+	}
+	_, privateKey, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	if err != nil {
+		return nil, err
+	}
+	return &input.EventSigner{ServerName: serverName, KeyID: serverKeyID, PrivateKey: privateKey}, nil
+}
+
+// listen serves HTTP requests until the server is shut down.
+func listen(server *http.Server) {
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+// stop finishes processing the in-flight room events and queries and then
+// closes the connections to kafka and the database.
+// Room events that haven't been written to the output log yet are written
+// when the roomserver next starts.
+func stop(
+	consumer *input.Consumer, publisher *input.OutputPublisher, collector *purge.StateCollector,
+	servers []*http.Server, kafkaConsumer sarama.Consumer, kafkaProducer sarama.SyncProducer,
+	db *storage.Database,
+) {
+	consumer.Stop()
+	publisher.Stop()
+	if collector != nil {
+		collector.Stop()
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(context.Background()); err != nil {
+			fmt.Println("Error stopping HTTP server:", err)
+		}
+	}
+	if err := kafkaConsumer.Close(); err != nil {
+		fmt.Println("Error closing kafka consumer:", err)
+	}
+	if err := kafkaProducer.Close(); err != nil {
+		fmt.Println("Error closing kafka producer:", err)
+	}
+	if err := db.Close(); err != nil {
+		fmt.Println("Error closing database:", err)
+	}
 }
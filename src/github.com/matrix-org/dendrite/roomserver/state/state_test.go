@@ -0,0 +1,427 @@
+package state
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"sort"
+	"testing"
+)
+
+type sortBytes []byte
+
+func (s sortBytes) Len() int           { return len(s) }
+func (s sortBytes) Less(i, j int) bool { return s[i] < s[j] }
+func (s sortBytes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestUnique(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Want  string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"aaabbbccc", "abc"},
+	}
+
+	for _, test := range testCases {
+		input := []byte(test.Input)
+		want := string(test.Want)
+		got := string(input[:unique(sortBytes(input))])
+		if got != want {
+			t.Fatal("Wanted ", want, " got ", got)
+		}
+	}
+}
+
+func TestFindDuplicateStateKeys(t *testing.T) {
+	testCases := []struct {
+		Input []types.StateEntry
+		Want  []types.StateEntry
+	}{{
+		Input: []types.StateEntry{
+			{types.StateKeyTuple{1, 1}, 1},
+			{types.StateKeyTuple{1, 1}, 2},
+			{types.StateKeyTuple{2, 2}, 3},
+		},
+		Want: []types.StateEntry{
+			{types.StateKeyTuple{1, 1}, 1},
+			{types.StateKeyTuple{1, 1}, 2},
+		},
+	}, {
+		Input: []types.StateEntry{
+			{types.StateKeyTuple{1, 1}, 1},
+			{types.StateKeyTuple{1, 2}, 2},
+		},
+		Want: nil,
+	}}
+
+	for _, test := range testCases {
+		got := findDuplicateStateKeys(test.Input)
+		if len(got) != len(test.Want) {
+			t.Fatalf("Wanted %v, got %v", test.Want, got)
+		}
+		for i := range got {
+			if got[i] != test.Want[i] {
+				t.Fatalf("Wanted %v, got %v", test.Want, got)
+			}
+		}
+	}
+}
+
+// testRoomStateDatabase is a RoomStateDatabase that serves events from memory.
+// Only the methods needed by the tests are implemented, calling any other
+// method will panic.
+type testRoomStateDatabase struct {
+	RoomStateDatabase
+	// The events sorted by numeric event ID.
+	events            []types.Event
+	eventStateKeyNIDs map[string]types.EventStateKeyNID
+}
+
+func (db *testRoomStateDatabase) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, event := range db.events {
+		for _, eventNID := range eventNIDs {
+			if event.EventNID == eventNID {
+				result = append(result, event)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (db *testRoomStateDatabase) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	result := map[string]types.EventStateKeyNID{}
+	for _, eventStateKey := range eventStateKeys {
+		if eventStateKeyNID, ok := db.eventStateKeyNIDs[eventStateKey]; ok {
+			result[eventStateKey] = eventStateKeyNID
+		}
+	}
+	return result, nil
+}
+
+const (
+	testAliceNID = 2
+	testBobNID   = 3
+)
+
+// testResolveEvents are the events used by TestResolveConflicts.
+// Events 1 to 4 form the unconflicted state of the room.
+// The remaining events are used to build conflicts.
+var testResolveEvents = []struct {
+	StateEntry types.StateEntry
+	JSON       string
+}{
+	{
+		types.StateEntry{types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID}, 1},
+		`{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":1,"prev_events":[],"content":{"creator":"@alice:a"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, testAliceNID}, 2},
+		`{"type":"m.room.member","state_key":"@alice:a","event_id":"$alice-join:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":2,"prev_events":[],"content":{"membership":"join"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID}, 3},
+		`{"type":"m.room.power_levels","state_key":"","event_id":"$power:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":3,"prev_events":[],"content":{"users":{"@alice:a":100}}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomJoinRulesNID, types.EmptyStateKeyNID}, 4},
+		`{"type":"m.room.join_rules","state_key":"","event_id":"$join-rules:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":4,"prev_events":[],"content":{"join_rule":"public"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, testBobNID}, 5},
+		`{"type":"m.room.member","state_key":"@bob:a","event_id":"$bob-join:a","room_id":"!room:a","sender":"@bob:a",
+		"depth":5,"prev_events":[],"content":{"membership":"join"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, testBobNID}, 6},
+		`{"type":"m.room.member","state_key":"@bob:a","event_id":"$bob-ban:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":6,"prev_events":[],"content":{"membership":"ban"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomMemberNID, testBobNID}, 7},
+		`{"type":"m.room.member","state_key":"@bob:a","event_id":"$bob-rejoin:a","room_id":"!room:a","sender":"@bob:a",
+		"depth":7,"prev_events":[],"content":{"membership":"join"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID}, 8},
+		`{"type":"m.room.power_levels","state_key":"","event_id":"$power-alice:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":8,"prev_events":[],"content":{"users":{"@alice:a":100,"@bob:a":50}}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID}, 9},
+		`{"type":"m.room.power_levels","state_key":"","event_id":"$power-bob:a","room_id":"!room:a","sender":"@bob:a",
+		"depth":9,"prev_events":[],"content":{"users":{"@alice:a":0,"@bob:a":100}}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomJoinRulesNID, types.EmptyStateKeyNID}, 10},
+		`{"type":"m.room.join_rules","state_key":"","event_id":"$join-rules-alice:a","room_id":"!room:a","sender":"@alice:a",
+		"depth":10,"prev_events":[],"content":{"join_rule":"invite"}}`,
+	}, {
+		types.StateEntry{types.StateKeyTuple{types.MRoomJoinRulesNID, types.EmptyStateKeyNID}, 11},
+		`{"type":"m.room.join_rules","state_key":"","event_id":"$join-rules-bob:a","room_id":"!room:a","sender":"@bob:a",
+		"depth":11,"prev_events":[],"content":{"join_rule":"public"}}`,
+	},
+}
+
+func newTestResolveDatabase(t *testing.T) *testRoomStateDatabase {
+	db := &testRoomStateDatabase{
+		eventStateKeyNIDs: map[string]types.EventStateKeyNID{
+			"":         types.EmptyStateKeyNID,
+			"@alice:a": testAliceNID,
+			"@bob:a":   testBobNID,
+		},
+	}
+	for _, testEvent := range testResolveEvents {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(testEvent.JSON), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.events = append(db.events, types.Event{EventNID: testEvent.StateEntry.EventNID, Event: event})
+	}
+	return db
+}
+
+func TestResolveConflicts(t *testing.T) {
+	testCases := []struct {
+		// A description of the conflict.
+		Name string
+		// The numeric IDs of the unconflicted state events.
+		NotConflicted []types.EventNID
+		// The numeric IDs of the conflicting state events.
+		Conflicted []types.EventNID
+		// The numeric ID of the event that should win the conflict.
+		Want types.EventNID
+	}{{
+		Name:          "power levels replaced by a sender with enough power",
+		NotConflicted: []types.EventNID{1, 2, 4, 5},
+		Conflicted:    []types.EventNID{3, 8},
+		Want:          8,
+	}, {
+		Name:          "power levels replaced by a sender without enough power",
+		NotConflicted: []types.EventNID{1, 2, 4, 5},
+		Conflicted:    []types.EventNID{3, 9},
+		Want:          3,
+	}, {
+		Name:          "join rules replaced by a sender with enough power",
+		NotConflicted: []types.EventNID{1, 2, 3, 5},
+		Conflicted:    []types.EventNID{4, 10},
+		Want:          10,
+	}, {
+		Name:          "join rules replaced by a sender without enough power",
+		NotConflicted: []types.EventNID{1, 2, 3, 5},
+		Conflicted:    []types.EventNID{10, 11},
+		Want:          10,
+	}, {
+		Name:          "join replaced by a ban",
+		NotConflicted: []types.EventNID{1, 2, 3, 4},
+		Conflicted:    []types.EventNID{5, 6},
+		Want:          6,
+	}, {
+		Name:          "ban cannot be replaced by a join",
+		NotConflicted: []types.EventNID{1, 2, 3, 4},
+		Conflicted:    []types.EventNID{6, 7},
+		Want:          6,
+	}, {
+		Name:          "three way membership conflict",
+		NotConflicted: []types.EventNID{1, 2, 3, 4},
+		Conflicted:    []types.EventNID{5, 6, 7},
+		Want:          6,
+	}}
+
+	db := newTestResolveDatabase(t)
+	entries := map[types.EventNID]types.StateEntry{}
+	for _, testEvent := range testResolveEvents {
+		entries[testEvent.StateEntry.EventNID] = testEvent.StateEntry
+	}
+
+	for _, test := range testCases {
+		var notConflicted, conflicted []types.StateEntry
+		for _, eventNID := range test.NotConflicted {
+			notConflicted = append(notConflicted, entries[eventNID])
+		}
+		for _, eventNID := range test.Conflicted {
+			conflicted = append(conflicted, entries[eventNID])
+		}
+		sort.Sort(stateEntrySorter(notConflicted))
+		sort.Sort(stateEntrySorter(conflicted))
+
+		got, err := resolveConflicts(db, notConflicted, conflicted)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.Name, err)
+		}
+		if len(got) != len(notConflicted)+1 {
+			t.Fatalf("%s: wanted %d entries, got %v", test.Name, len(notConflicted)+1, got)
+		}
+		gotEventNID, ok := StateEntryMap(got).Lookup(entries[test.Want].StateKeyTuple)
+		if !ok {
+			t.Fatalf("%s: missing entry for %v in %v", test.Name, entries[test.Want].StateKeyTuple, got)
+		}
+		if gotEventNID != test.Want {
+			t.Fatalf("%s: wanted event NID %d, got %d", test.Name, test.Want, gotEventNID)
+		}
+	}
+}
+
+func TestDifferenceBetweenStateEntries(t *testing.T) {
+	testCases := []struct {
+		Old         []types.StateEntry
+		New         []types.StateEntry
+		WantRemoved []types.StateEntry
+		WantAdded   []types.StateEntry
+	}{{
+		Old:         nil,
+		New:         []types.StateEntry{{types.StateKeyTuple{1, 1}, 1}},
+		WantRemoved: nil,
+		WantAdded:   []types.StateEntry{{types.StateKeyTuple{1, 1}, 1}},
+	}, {
+		Old:         []types.StateEntry{{types.StateKeyTuple{1, 1}, 1}},
+		New:         nil,
+		WantRemoved: []types.StateEntry{{types.StateKeyTuple{1, 1}, 1}},
+		WantAdded:   nil,
+	}, {
+		Old: []types.StateEntry{
+			{types.StateKeyTuple{1, 1}, 1},
+			{types.StateKeyTuple{5, 2}, 2},
+			{types.StateKeyTuple{5, 3}, 3},
+		},
+		New: []types.StateEntry{
+			{types.StateKeyTuple{1, 1}, 1},
+			{types.StateKeyTuple{5, 2}, 4},
+			{types.StateKeyTuple{5, 4}, 5},
+		},
+		WantRemoved: []types.StateEntry{
+			{types.StateKeyTuple{5, 2}, 2},
+			{types.StateKeyTuple{5, 3}, 3},
+		},
+		WantAdded: []types.StateEntry{
+			{types.StateKeyTuple{5, 2}, 4},
+			{types.StateKeyTuple{5, 4}, 5},
+		},
+	}}
+
+	for _, test := range testCases {
+		gotRemoved, gotAdded := DifferenceBetweenStateEntries(test.Old, test.New)
+		if len(gotRemoved) != len(test.WantRemoved) || len(gotAdded) != len(test.WantAdded) {
+			t.Fatalf("Wanted removed %v and added %v, got removed %v and added %v",
+				test.WantRemoved, test.WantAdded, gotRemoved, gotAdded)
+		}
+		for i := range gotRemoved {
+			if gotRemoved[i] != test.WantRemoved[i] {
+				t.Fatalf("Wanted removed %v, got %v", test.WantRemoved, gotRemoved)
+			}
+		}
+		for i := range gotAdded {
+			if gotAdded[i] != test.WantAdded[i] {
+				t.Fatalf("Wanted added %v, got %v", test.WantAdded, gotAdded)
+			}
+		}
+	}
+}
+
+func benchmarkStateEntryMapLookup(entries, lookups int64, b *testing.B) {
+	var list []types.StateEntry
+	for i := int64(0); i < entries; i++ {
+		list = append(list, types.StateEntry{types.StateKeyTuple{
+			types.EventTypeNID(i),
+			types.EventStateKeyNID(i),
+		}, types.EventNID(i)})
+	}
+
+	for i := 0; i < b.N; i++ {
+		entryMap := StateEntryMap(list)
+		for j := int64(0); j < lookups; j++ {
+			entryMap.Lookup(types.StateKeyTuple{
+				types.EventTypeNID(j), types.EventStateKeyNID(j),
+			})
+		}
+	}
+}
+
+func BenchmarkStateEntryMap100Lookup10(b *testing.B) {
+	benchmarkStateEntryMapLookup(100, 10, b)
+}
+
+func BenchmarkStateEntryMap1000Lookup100(b *testing.B) {
+	benchmarkStateEntryMapLookup(1000, 100, b)
+}
+
+func BenchmarkStateEntryMap100Lookup100(b *testing.B) {
+	benchmarkStateEntryMapLookup(100, 100, b)
+}
+
+func BenchmarkStateEntryMap1000Lookup10000(b *testing.B) {
+	benchmarkStateEntryMapLookup(1000, 10000, b)
+}
+
+func TestStateEntryMap(t *testing.T) {
+	entryMap := StateEntryMap([]types.StateEntry{
+		{types.StateKeyTuple{1, 1}, 1},
+		{types.StateKeyTuple{1, 3}, 2},
+		{types.StateKeyTuple{2, 1}, 3},
+	})
+
+	testCases := []struct {
+		inputTypeNID  types.EventTypeNID
+		inputStateKey types.EventStateKeyNID
+		wantOK        bool
+		wantEventNID  types.EventNID
+	}{
+		// Check that tuples that in the array are in the map.
+		{1, 1, true, 1},
+		{1, 3, true, 2},
+		{2, 1, true, 3},
+		// Check that tuples that aren't in the array aren't in the map.
+		{0, 0, false, 0},
+		{1, 2, false, 0},
+		{3, 1, false, 0},
+	}
+
+	for _, testCase := range testCases {
+		keyTuple := types.StateKeyTuple{testCase.inputTypeNID, testCase.inputStateKey}
+		gotEventNID, gotOK := entryMap.Lookup(keyTuple)
+		if testCase.wantOK != gotOK {
+			t.Fatalf("stateEntryMap lookup(%v): want ok to be %v, got %v", keyTuple, testCase.wantOK, gotOK)
+		}
+		if testCase.wantEventNID != gotEventNID {
+			t.Fatalf("stateEntryMap lookup(%v): want eventNID to be %v, got %v", keyTuple, testCase.wantEventNID, gotEventNID)
+		}
+	}
+}
+
+func TestEventMap(t *testing.T) {
+	events := EventMap([]types.Event{
+		{EventNID: 1},
+		{EventNID: 2},
+		{EventNID: 3},
+		{EventNID: 5},
+		{EventNID: 8},
+	})
+
+	testCases := []struct {
+		inputEventNID types.EventNID
+		wantOK        bool
+		wantEvent     *types.Event
+	}{
+		// Check that the IDs that are in the array are in the map.
+		{1, true, &events[0]},
+		{2, true, &events[1]},
+		{3, true, &events[2]},
+		{5, true, &events[3]},
+		{8, true, &events[4]},
+		// Check that tuples that aren't in the array aren't in the map.
+		{0, false, nil},
+		{4, false, nil},
+		{6, false, nil},
+		{7, false, nil},
+		{9, false, nil},
+	}
+
+	for _, testCase := range testCases {
+		gotEvent, gotOK := events.Lookup(testCase.inputEventNID)
+		if testCase.wantOK != gotOK {
+			t.Fatalf("eventMap lookup(%v): want ok to be %v, got %v", testCase.inputEventNID, testCase.wantOK, gotOK)
+		}
+
+		if testCase.wantEvent != gotEvent {
+			t.Fatalf("eventMap lookup(%v): want event to be %v, got %v", testCase.inputEventNID, testCase.wantEvent, gotEvent)
+		}
+	}
+
+}
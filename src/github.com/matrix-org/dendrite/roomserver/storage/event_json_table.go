@@ -30,14 +30,54 @@ const insertEventJSONSQL = "" +
 // Bulk event JSON lookup by numeric event ID.
 // Sort by the numeric event ID.
 // This means that we can use binary search to lookup by numeric event ID.
+// Also returns whether each event has been redacted, in which case the JSON
+// stored for the event is the redacted JSON.
 const bulkSelectEventJSONSQL = "" +
-	"SELECT event_nid, event_json FROM event_json" +
+	"SELECT event_nid, event_json, EXISTS(" +
+	" SELECT 1 FROM redactions WHERE redactions.redacts_event_nid = event_json.event_nid" +
+	") FROM event_json" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+const updateEventJSONSQL = "" +
+	"UPDATE event_json SET event_json = $2 WHERE event_nid = $1"
+
+// Select a page of up to $5 events in a room for a purge of its history, starting after
+// event NID $2, along with whether each event is older than the cutoff. An event is older than the cutoff if its depth is
+// less than $3 or its origin_server_ts is less than $4, ignoring the limits that are 0.
+// The depth and timestamp are read from the event JSON since the depth column is 0
+// for events stored before it was added.
+const selectEventsForPurgeSQL = "" +
+	"SELECT events.event_nid, events.state_snapshot_nid," +
+	" ($3 != 0 AND (event_json.event_json::json->>'depth')::bigint < $3)" +
+	" OR ($4 != 0 AND (event_json.event_json::json->>'origin_server_ts')::bigint < $4)" +
+	" FROM events JOIN event_json ON events.event_nid = event_json.event_nid" +
+	" WHERE events.room_nid = $1 AND events.event_nid > $2" +
+	" ORDER BY events.event_nid ASC LIMIT $5"
+
+// Lookup events that don't have any JSON.
+const selectEventsMissingJSONSQL = "" +
+	"SELECT event_nid FROM events" +
+	" WHERE NOT EXISTS (SELECT 1 FROM event_json WHERE event_json.event_nid = events.event_nid)" +
+	" ORDER BY event_nid ASC LIMIT $1"
+
+// Lookup JSON for events that don't exist.
+const selectOrphanedEventJSONSQL = "" +
+	"SELECT event_nid FROM event_json" +
+	" WHERE NOT EXISTS (SELECT 1 FROM events WHERE events.event_nid = event_json.event_nid)" +
+	" ORDER BY event_nid ASC LIMIT $1"
+
+const bulkDeleteEventJSONSQL = "" +
+	"DELETE FROM event_json WHERE event_nid = ANY($1)"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt         *sql.Stmt
+	bulkSelectEventJSONStmt     *sql.Stmt
+	updateEventJSONStmt         *sql.Stmt
+	bulkDeleteEventJSONStmt     *sql.Stmt
+	selectEventsForPurgeStmt    *sql.Stmt
+	selectEventsMissingJSONStmt *sql.Stmt
+	selectOrphanedEventJSONStmt *sql.Stmt
 }
 
 func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
@@ -51,6 +91,21 @@ func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
 	if s.bulkSelectEventJSONStmt, err = db.Prepare(bulkSelectEventJSONSQL); err != nil {
 		return
 	}
+	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
+		return
+	}
+	if s.bulkDeleteEventJSONStmt, err = db.Prepare(bulkDeleteEventJSONSQL); err != nil {
+		return
+	}
+	if s.selectEventsForPurgeStmt, err = db.Prepare(selectEventsForPurgeSQL); err != nil {
+		return
+	}
+	if s.selectEventsMissingJSONStmt, err = db.Prepare(selectEventsMissingJSONSQL); err != nil {
+		return
+	}
+	if s.selectOrphanedEventJSONStmt, err = db.Prepare(selectOrphanedEventJSONSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -59,9 +114,22 @@ func (s *eventJSONStatements) insertEventJSON(eventNID types.EventNID, eventJSON
 	return err
 }
 
+// updateEventJSON replaces the JSON stored for an event.
+// This is used to remove the content of an event that has been redacted.
+func (s *eventJSONStatements) updateEventJSON(txn *sql.Tx, eventNID types.EventNID, eventJSON []byte) error {
+	_, err := txn.Stmt(s.updateEventJSONStmt).Exec(int64(eventNID), eventJSON)
+	return err
+}
+
+func (s *eventJSONStatements) bulkDeleteEventJSON(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := txn.Stmt(s.bulkDeleteEventJSONStmt).Exec(eventNIDsAsArray(eventNIDs))
+	return err
+}
+
 type eventJSONPair struct {
 	EventNID  types.EventNID
 	EventJSON []byte
+	Redacted  bool
 }
 
 func (s *eventJSONStatements) bulkSelectEventJSON(eventNIDs []types.EventNID) ([]eventJSONPair, error) {
@@ -84,10 +152,45 @@ func (s *eventJSONStatements) bulkSelectEventJSON(eventNIDs []types.EventNID) ([
 	for ; rows.Next(); i++ {
 		result := &results[i]
 		var eventNID int64
-		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+		if err := rows.Scan(&eventNID, &result.EventJSON, &result.Redacted); err != nil {
 			return nil, err
 		}
 		result.EventNID = types.EventNID(eventNID)
 	}
 	return results[:i], nil
 }
+
+// selectEventsForPurge returns up to limit events in a room with numeric IDs after afterEventNID,
+// ordered by numeric ID, along with whether each event is older than the cutoff.
+func (s *eventJSONStatements) selectEventsForPurge(
+	roomNID types.RoomNID, cutoff types.PurgeCutoff, afterEventNID types.EventNID, limit int,
+) ([]types.PurgeEvent, error) {
+	rows, err := s.selectEventsForPurgeStmt.Query(
+		int64(roomNID), int64(afterEventNID), cutoff.Depth, cutoff.TimestampMS, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.PurgeEvent
+	for rows.Next() {
+		var eventNID int64
+		var stateSnapshotNID int64
+		var result types.PurgeEvent
+		if err = rows.Scan(&eventNID, &stateSnapshotNID, &result.BeforeCutoff); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		result.BeforeStateSnapshotNID = types.StateSnapshotNID(stateSnapshotNID)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *eventJSONStatements) selectEventsMissingJSON(limit int) ([]types.EventNID, error) {
+	return selectEventNIDList(s.selectEventsMissingJSONStmt, limit)
+}
+
+func (s *eventJSONStatements) selectOrphanedEventJSON(limit int) ([]types.EventNID, error) {
+	return selectEventNIDList(s.selectOrphanedEventJSONStmt, limit)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 const eventsSchema = `
@@ -41,13 +42,54 @@ CREATE TABLE IF NOT EXISTS events (
     -- Needed for setting reference hashes when sending new events.
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
-    auth_event_nids BIGINT[] NOT NULL
+    auth_event_nids BIGINT[] NOT NULL,
+    -- The depth of the event in the event graph, taken from the event JSON.
+    -- Used to page through the history of a room in topological order.
+    depth BIGINT NOT NULL DEFAULT 0,
+    -- The position of the event in the history of the room.
+    -- New events are given increasing positions and backfilled events are
+    -- given decreasing negative positions as they are added to the event graph.
+    -- This is 0 if the event isn't part of the history of the room, e.g. if
+    -- it is an outlier or was rejected.
+    -- Used to order events with the same depth.
+    stream_position BIGINT NOT NULL DEFAULT 0
 );
+CREATE INDEX IF NOT EXISTS events_room_history_idx ON events(room_nid, depth, stream_position)
+    WHERE stream_position != 0;
+CREATE INDEX IF NOT EXISTS events_room_stream_position_idx ON events(room_nid, stream_position)
+    WHERE stream_position != 0;
+-- Used to tell whether a state snapshot is still in use before deleting it.
+CREATE INDEX IF NOT EXISTS events_state_snapshot_nid_idx ON events(state_snapshot_nid)
+    WHERE state_snapshot_nid != 0;
+`
+
+// Whether the events table was created before the depth and stream_position columns existed.
+const selectEventsNeedHistoryColumnsSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name = 'events')" +
+	" AND NOT EXISTS(SELECT 1 FROM information_schema.columns" +
+	" WHERE table_name = 'events' AND column_name = 'stream_position')"
+
+// Add the columns for history paging to databases created before they existed.
+// The depth of each event is copied from its JSON. Each event that is part of the
+// history of its room is given a position in the order the events were stored,
+// which is the order they were added to the event graph before backfilling existed.
+const eventsHistoryColumnsMigration = `
+ALTER TABLE events ADD COLUMN depth BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE events ADD COLUMN stream_position BIGINT NOT NULL DEFAULT 0;
+UPDATE events SET depth = (event_json.event_json::jsonb->>'depth')::numeric::bigint
+    FROM event_json WHERE events.event_nid = event_json.event_nid
+    AND jsonb_typeof(event_json.event_json::jsonb->'depth') = 'number';
+UPDATE events SET stream_position = history.position FROM (
+    SELECT event_nid, ROW_NUMBER() OVER (PARTITION BY room_nid ORDER BY event_nid) AS position
+    FROM events WHERE state_snapshot_nid != 0 AND NOT EXISTS(
+        SELECT 1 FROM rejected_events WHERE rejected_events.event_nid = events.event_nid
+    )
+) AS history WHERE events.event_nid = history.event_nid;
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	"INSERT INTO events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
 	" ON CONFLICT ON CONSTRAINT event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -58,13 +100,24 @@ const selectEventSQL = "" +
 // Bulk lookup of events by string ID.
 // Sort by the numeric IDs for event type and state key.
 // This means we can use binary search to lookup entries by type and state key.
+// Bulk lookup of the state entries for events by string ID.
+// Also returns whether each event was rejected so that rejected events
+// can't be used as the auth events or the state of another event.
 const bulkSelectStateEventByIDSQL = "" +
-	"SELECT event_type_nid, event_state_key_nid, event_nid FROM events" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, EXISTS(" +
+	" SELECT 1 FROM rejected_events WHERE rejected_events.event_nid = events.event_nid" +
+	") FROM events" +
 	" WHERE event_id = ANY($1)" +
 	" ORDER BY event_type_nid, event_state_key_nid ASC"
 
+// Bulk lookup of the state at events by string ID.
+// Also returns whether each event was rejected. The state after a rejected
+// event is the same as the state before it since rejected events are never
+// part of the room state.
 const bulkSelectStateAtEventByIDSQL = "" +
-	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid FROM events" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, EXISTS(" +
+	" SELECT 1 FROM rejected_events WHERE rejected_events.event_nid = events.event_nid" +
+	") FROM events" +
 	" WHERE event_id = ANY($1)"
 
 const updateEventStateSQL = "" +
@@ -79,23 +132,148 @@ const updateEventSentToOutputSQL = "" +
 const selectEventIDSQL = "" +
 	"SELECT event_id FROM events WHERE event_nid = $1"
 
+const bulkSelectEventReferenceSQL = "" +
+	"SELECT event_id, reference_sha256 FROM events WHERE event_nid = ANY($1)"
+
+const bulkSelectEventIDSQL = "" +
+	"SELECT event_nid, event_id FROM events WHERE event_nid = ANY($1)"
+
+const bulkSelectEventRoomNIDSQL = "" +
+	"SELECT event_nid, room_nid FROM events WHERE event_nid = ANY($1)"
+
 const bulkSelectStateAtEventAndReferenceSQL = "" +
 	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, event_id, reference_sha256" +
 	" FROM events WHERE event_nid = ANY($1)"
 
+// Bulk lookup from string event ID to numeric event ID.
+// Event IDs we don't have are left out of the results.
+const bulkSelectEventNIDSQL = "" +
+	"SELECT event_id, event_nid FROM events WHERE event_id = ANY($1)"
+
+// Select the numeric IDs of every event in the auth chains of the given events.
+// The chain is walked inside postgres using a recursive query so that we only
+// make one round trip however deep the chain is. Using UNION rather than
+// UNION ALL discards the events we have already visited which stops the walk
+// once there are no new events to visit.
+const selectAuthChainEventNIDSQL = "" +
+	"WITH RECURSIVE auth_chain(event_nid) AS (" +
+	" SELECT unnest(auth_event_nids) FROM events WHERE event_nid = ANY($1)" +
+	" UNION" +
+	" SELECT unnest(events.auth_event_nids) FROM events" +
+	" JOIN auth_chain ON events.event_nid = auth_chain.event_nid" +
+	") SELECT event_nid FROM auth_chain"
+
+// Bulk lookup of which events we know the state at, by string ID.
+const bulkSelectEventIDWithStateSQL = "" +
+	"SELECT event_id FROM events WHERE event_id = ANY($1) AND state_snapshot_nid != 0"
+
+// Give an event the next position in the history of its room, unless it already has one.
+// The caller must hold the lock on the room so that two events don't get the same position.
+// The subquery only looks at events with a position so that it can use events_room_stream_position_idx.
+// GREATEST ignores the NULL MAX of a room without any positions, so the first position is 1.
+const updateEventStreamPositionSQL = "" +
+	"UPDATE events SET stream_position = (" +
+	" SELECT GREATEST(MAX(e.stream_position), 0) + 1 FROM events AS e" +
+	" WHERE e.room_nid = events.room_nid AND e.stream_position != 0" +
+	") WHERE event_nid = $1 AND stream_position = 0"
+
+// Give a backfilled event a position before the start of the history of its room, unless it already has one.
+// LEAST keeps the position below 0, which means "no position", when the room has no backfilled events yet.
+const updateBackfilledEventStreamPositionSQL = "" +
+	"UPDATE events SET stream_position = (" +
+	" SELECT LEAST(MIN(e.stream_position), 0) - 1 FROM events AS e" +
+	" WHERE e.room_nid = events.room_nid AND e.stream_position != 0" +
+	") WHERE event_nid = $1 AND stream_position = 0"
+
+const selectEventHistoryPositionSQL = "" +
+	"SELECT room_nid, depth, stream_position FROM events WHERE event_id = $1"
+
+// Page backwards through the history of a room from a position, latest first.
+const selectHistoryBeforeSQL = "" +
+	"SELECT event_nid, depth, stream_position FROM events" +
+	" WHERE room_nid = $1 AND stream_position != 0 AND (depth, stream_position) < ($2, $3)" +
+	" ORDER BY depth DESC, stream_position DESC LIMIT $4"
+
+// Page forwards through the history of a room from a position, earliest first.
+const selectHistoryAfterSQL = "" +
+	"SELECT event_nid, depth, stream_position FROM events" +
+	" WHERE room_nid = $1 AND stream_position != 0 AND (depth, stream_position) > ($2, $3)" +
+	" ORDER BY depth ASC, stream_position ASC LIMIT $4"
+
+// Select the events in a room that were written to the output log, in the order they were written.
+// Backfilled events are marked as sent but were never written so they are left out.
+const selectSentEventNIDsSQL = "" +
+	"SELECT event_nid FROM events" +
+	" WHERE room_nid = $1 AND sent_to_output AND stream_position >= 0" +
+	" ORDER BY stream_position ASC, event_nid ASC"
+
+const bulkDeleteEventSQL = "" +
+	"DELETE FROM events WHERE event_nid = ANY($1)"
+
+// Turn events into outliers by forgetting the state at them and removing them from the history of the room.
+const bulkUpdateEventOutlierSQL = "" +
+	"UPDATE events SET state_snapshot_nid = 0, stream_position = 0 WHERE event_nid = ANY($1)"
+
+// Lookup events whose auth_event_nids refer to events that don't exist.
+const selectEventsMissingAuthEventsSQL = "" +
+	"SELECT events.event_nid, auth.event_nid FROM events, unnest(events.auth_event_nids) AS auth(event_nid)" +
+	" WHERE NOT EXISTS (SELECT 1 FROM events AS auth_events WHERE auth_events.event_nid = auth.event_nid)" +
+	" ORDER BY events.event_nid ASC LIMIT $1"
+
+// Lookup rooms whose latest_event_nids refer to events that don't exist or that we don't know the state at.
+const selectRoomsMissingLatestEventsSQL = "" +
+	"SELECT rooms.room_nid, latest.event_nid FROM rooms, unnest(rooms.latest_event_nids) AS latest(event_nid)" +
+	" WHERE NOT EXISTS (SELECT 1 FROM events" +
+	"  WHERE events.event_nid = latest.event_nid AND events.state_snapshot_nid != 0)" +
+	" ORDER BY rooms.room_nid ASC LIMIT $1"
+
+// Lookup rooms whose last_event_sent_nid refers to an event that doesn't exist.
+const selectRoomsMissingLastEventSentSQL = "" +
+	"SELECT room_nid, last_event_sent_nid FROM rooms WHERE last_event_sent_nid != 0" +
+	" AND NOT EXISTS (SELECT 1 FROM events WHERE events.event_nid = rooms.last_event_sent_nid)" +
+	" ORDER BY room_nid ASC LIMIT $1"
+
+const selectEventNIDsWithStateSQL = "" +
+	"SELECT event_nid FROM events WHERE state_snapshot_nid = ANY($1) ORDER BY event_nid ASC"
+
+const selectRandomEventNIDsSQL = "" +
+	"SELECT event_nid FROM events ORDER BY random() LIMIT $1"
+
 type eventStatements struct {
-	insertEventStmt                        *sql.Stmt
-	selectEventStmt                        *sql.Stmt
-	bulkSelectStateEventByIDStmt           *sql.Stmt
-	bulkSelectStateAtEventByIDStmt         *sql.Stmt
-	updateEventStateStmt                   *sql.Stmt
-	selectEventSentToOutputStmt            *sql.Stmt
-	updateEventSentToOutputStmt            *sql.Stmt
-	selectEventIDStmt                      *sql.Stmt
-	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
+	insertEventStmt                         *sql.Stmt
+	selectEventStmt                         *sql.Stmt
+	bulkSelectStateEventByIDStmt            *sql.Stmt
+	bulkSelectStateAtEventByIDStmt          *sql.Stmt
+	updateEventStateStmt                    *sql.Stmt
+	selectEventSentToOutputStmt             *sql.Stmt
+	updateEventSentToOutputStmt             *sql.Stmt
+	selectEventIDStmt                       *sql.Stmt
+	bulkSelectStateAtEventAndReferenceStmt  *sql.Stmt
+	bulkSelectEventReferenceStmt            *sql.Stmt
+	bulkSelectEventIDStmt                   *sql.Stmt
+	bulkSelectEventRoomNIDStmt              *sql.Stmt
+	bulkSelectEventNIDStmt                  *sql.Stmt
+	selectAuthChainEventNIDStmt             *sql.Stmt
+	bulkSelectEventIDWithStateStmt          *sql.Stmt
+	updateEventStreamPositionStmt           *sql.Stmt
+	updateBackfilledEventStreamPositionStmt *sql.Stmt
+	selectEventHistoryPositionStmt          *sql.Stmt
+	selectHistoryBeforeStmt                 *sql.Stmt
+	selectHistoryAfterStmt                  *sql.Stmt
+	selectSentEventNIDsStmt                 *sql.Stmt
+	bulkDeleteEventStmt                     *sql.Stmt
+	bulkUpdateEventOutlierStmt              *sql.Stmt
+	selectEventsMissingAuthEventsStmt       *sql.Stmt
+	selectRoomsMissingLatestEventsStmt      *sql.Stmt
+	selectRoomsMissingLastEventSentStmt     *sql.Stmt
+	selectEventNIDsWithStateStmt            *sql.Stmt
+	selectRandomEventNIDsStmt               *sql.Stmt
 }
 
 func (s *eventStatements) prepare(db *sql.DB) (err error) {
+	if err = migrateEventsHistoryColumns(db); err != nil {
+		return
+	}
 	_, err = db.Exec(eventsSchema)
 	if err != nil {
 		return
@@ -127,14 +305,95 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 	if s.bulkSelectStateAtEventAndReferenceStmt, err = db.Prepare(bulkSelectStateAtEventAndReferenceSQL); err != nil {
 		return
 	}
+	if s.bulkSelectEventReferenceStmt, err = db.Prepare(bulkSelectEventReferenceSQL); err != nil {
+		return
+	}
+	if s.bulkSelectEventIDStmt, err = db.Prepare(bulkSelectEventIDSQL); err != nil {
+		return
+	}
+	if s.bulkSelectEventRoomNIDStmt, err = db.Prepare(bulkSelectEventRoomNIDSQL); err != nil {
+		return
+	}
+	if s.bulkSelectEventNIDStmt, err = db.Prepare(bulkSelectEventNIDSQL); err != nil {
+		return
+	}
+	if s.selectAuthChainEventNIDStmt, err = db.Prepare(selectAuthChainEventNIDSQL); err != nil {
+		return
+	}
+	if s.bulkSelectEventIDWithStateStmt, err = db.Prepare(bulkSelectEventIDWithStateSQL); err != nil {
+		return
+	}
+	if s.updateEventStreamPositionStmt, err = db.Prepare(updateEventStreamPositionSQL); err != nil {
+		return
+	}
+	if s.updateBackfilledEventStreamPositionStmt, err = db.Prepare(updateBackfilledEventStreamPositionSQL); err != nil {
+		return
+	}
+	if s.selectEventHistoryPositionStmt, err = db.Prepare(selectEventHistoryPositionSQL); err != nil {
+		return
+	}
+	if s.selectHistoryBeforeStmt, err = db.Prepare(selectHistoryBeforeSQL); err != nil {
+		return
+	}
+	if s.selectHistoryAfterStmt, err = db.Prepare(selectHistoryAfterSQL); err != nil {
+		return
+	}
+	if s.selectSentEventNIDsStmt, err = db.Prepare(selectSentEventNIDsSQL); err != nil {
+		return
+	}
+	if s.bulkDeleteEventStmt, err = db.Prepare(bulkDeleteEventSQL); err != nil {
+		return
+	}
+	if s.bulkUpdateEventOutlierStmt, err = db.Prepare(bulkUpdateEventOutlierSQL); err != nil {
+		return
+	}
+	if s.selectEventsMissingAuthEventsStmt, err = db.Prepare(selectEventsMissingAuthEventsSQL); err != nil {
+		return
+	}
+	if s.selectRoomsMissingLatestEventsStmt, err = db.Prepare(selectRoomsMissingLatestEventsSQL); err != nil {
+		return
+	}
+	if s.selectRoomsMissingLastEventSentStmt, err = db.Prepare(selectRoomsMissingLastEventSentSQL); err != nil {
+		return
+	}
+	if s.selectEventNIDsWithStateStmt, err = db.Prepare(selectEventNIDsWithStateSQL); err != nil {
+		return
+	}
+	if s.selectRandomEventNIDsStmt, err = db.Prepare(selectRandomEventNIDsSQL); err != nil {
+		return
+	}
 	return
 }
 
+// migrateEventsHistoryColumns adds the depth and stream_position columns to an events table
+// created before they existed. This is done in a single transaction so that a database is
+// never left with the columns but without the values for the existing events.
+func migrateEventsHistoryColumns(db *sql.DB) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var needed bool
+	if err = txn.QueryRow(selectEventsNeedHistoryColumnsSQL).Scan(&needed); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if !needed {
+		return txn.Rollback()
+	}
+	if _, err = txn.Exec(eventsHistoryColumnsMigration); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
 func (s *eventStatements) insertEvent(
 	roomNID types.RoomNID, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID,
 	eventID string,
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
+	depth int64,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	nids := make([]int64, len(authEventNIDs))
 	for i := range authEventNIDs {
@@ -144,7 +403,7 @@ func (s *eventStatements) insertEvent(
 	var stateNID int64
 	err := s.insertEventStmt.QueryRow(
 		int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID), eventID, referenceSHA256,
-		pq.Int64Array(nids),
+		pq.Int64Array(nids), depth,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -170,13 +429,18 @@ func (s *eventStatements) bulkSelectStateEventByID(eventIDs []string) ([]types.S
 	i := 0
 	for ; rows.Next(); i++ {
 		result := &results[i]
+		var rejected bool
 		if err = rows.Scan(
 			&result.EventTypeNID,
 			&result.EventStateKeyNID,
 			&result.EventNID,
+			&rejected,
 		); err != nil {
 			return nil, err
 		}
+		if rejected {
+			return nil, types.RejectedEventError(fmt.Sprintf("storage: state event NID %d was rejected", result.EventNID))
+		}
 	}
 	if i != len(eventIDs) {
 		// If there are fewer rows returned than IDs then we were asked to lookup event IDs we don't have.
@@ -199,20 +463,29 @@ func (s *eventStatements) bulkSelectStateAtEventByID(eventIDs []string) ([]types
 	i := 0
 	for ; rows.Next(); i++ {
 		result := &results[i]
+		var rejected bool
 		if err = rows.Scan(
 			&result.EventTypeNID,
 			&result.EventStateKeyNID,
 			&result.EventNID,
 			&result.BeforeStateSnapshotNID,
+			&rejected,
 		); err != nil {
 			return nil, err
 		}
+		if rejected {
+			// Treat rejected events like non-state events so that they
+			// don't change the state after them.
+			result.EventStateKeyNID = 0
+		}
 		if result.BeforeStateSnapshotNID == 0 {
-			return nil, fmt.Errorf("storage: missing state for event NID %d", result.EventNID)
+			return nil, types.MissingEventError(fmt.Sprintf("storage: missing state for event NID %d", result.EventNID))
 		}
 	}
 	if i != len(eventIDs) {
-		return nil, fmt.Errorf("storage: event IDs missing from the database (%d != %d)", i, len(eventIDs))
+		return nil, types.MissingEventError(
+			fmt.Sprintf("storage: event IDs missing from the database (%d != %d)", i, len(eventIDs)),
+		)
 	}
 	return results, err
 }
@@ -276,3 +549,242 @@ func (s *eventStatements) bulkSelectStateAtEventAndReference(txn *sql.Tx, eventN
 	}
 	return results, nil
 }
+
+func (s *eventStatements) bulkSelectEventReference(eventNIDs []types.EventNID) ([]gomatrixserverlib.EventReference, error) {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	rows, err := s.bulkSelectEventReferenceStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]gomatrixserverlib.EventReference, len(eventNIDs))
+	i := 0
+	for ; rows.Next(); i++ {
+		result := &results[i]
+		if err = rows.Scan(&result.EventID, &result.EventSHA256); err != nil {
+			return nil, err
+		}
+	}
+	if i != len(eventNIDs) {
+		return nil, fmt.Errorf("storage: event NIDs missing from the database (%d != %d)", i, len(eventNIDs))
+	}
+	return results, nil
+}
+
+// bulkSelectEventID returns a map from numeric event ID to string event ID.
+func (s *eventStatements) bulkSelectEventID(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	rows, err := s.bulkSelectEventIDStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[types.EventNID]string, len(eventNIDs))
+	i := 0
+	for ; rows.Next(); i++ {
+		var eventNID int64
+		var eventID string
+		if err = rows.Scan(&eventNID, &eventID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = eventID
+	}
+	if i != len(eventNIDs) {
+		return nil, fmt.Errorf("storage: event NIDs missing from the database (%d != %d)", i, len(eventNIDs))
+	}
+	return results, nil
+}
+
+// bulkSelectEventRoomNID returns the room that each of the events is in.
+// Event NIDs that aren't in the database are left out of the map.
+func (s *eventStatements) bulkSelectEventRoomNID(eventNIDs []types.EventNID) (map[types.EventNID]types.RoomNID, error) {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	rows, err := s.bulkSelectEventRoomNIDStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[types.EventNID]types.RoomNID, len(eventNIDs))
+	for rows.Next() {
+		var eventNID, roomNID int64
+		if err = rows.Scan(&eventNID, &roomNID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = types.RoomNID(roomNID)
+	}
+	return results, rows.Err()
+}
+
+// bulkSelectEventNID returns a map from string event ID to numeric event ID.
+// If an event ID is not in the database then it is omitted from the map.
+func (s *eventStatements) bulkSelectEventNID(eventIDs []string) (map[string]types.EventNID, error) {
+	rows, err := s.bulkSelectEventNIDStmt.Query(pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[string]types.EventNID, len(eventIDs))
+	for rows.Next() {
+		var eventID string
+		var eventNID int64
+		if err = rows.Scan(&eventID, &eventNID); err != nil {
+			return nil, err
+		}
+		results[eventID] = types.EventNID(eventNID)
+	}
+	return results, nil
+}
+
+// selectAuthChainEventNID returns the numeric IDs of the events in the auth chains of the given events.
+func (s *eventStatements) selectAuthChainEventNID(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	rows, err := s.selectAuthChainEventNIDStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.EventNID(eventNID))
+	}
+	return results, nil
+}
+
+// bulkSelectEventIDWithState returns the subset of the event IDs that are stored with state.
+func (s *eventStatements) bulkSelectEventIDWithState(eventIDs []string) (map[string]bool, error) {
+	rows, err := s.bulkSelectEventIDWithStateStmt.Query(pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[string]bool, len(eventIDs))
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		results[eventID] = true
+	}
+	return results, nil
+}
+
+func (s *eventStatements) updateEventStreamPosition(txn *sql.Tx, eventNID types.EventNID, backfilled bool) error {
+	stmt := s.updateEventStreamPositionStmt
+	if backfilled {
+		stmt = s.updateBackfilledEventStreamPositionStmt
+	}
+	_, err := txn.Stmt(stmt).Exec(int64(eventNID))
+	return err
+}
+
+// selectEventHistoryPosition returns the room and the position in the history of the room of an event.
+// Returns sql.ErrNoRows if the event isn't stored.
+func (s *eventStatements) selectEventHistoryPosition(eventID string) (types.RoomNID, types.HistoryPosition, error) {
+	var roomNID int64
+	var position types.HistoryPosition
+	err := s.selectEventHistoryPositionStmt.QueryRow(eventID).Scan(&roomNID, &position.Depth, &position.StreamPosition)
+	return types.RoomNID(roomNID), position, err
+}
+
+// selectHistory returns up to limit events in the history of a room either side of a position.
+// The events are ordered moving away from the position.
+func (s *eventStatements) selectHistory(
+	roomNID types.RoomNID, from types.HistoryPosition, backwards bool, limit int,
+) ([]types.HistoryEvent, error) {
+	stmt := s.selectHistoryAfterStmt
+	if backwards {
+		stmt = s.selectHistoryBeforeStmt
+	}
+	rows, err := stmt.Query(int64(roomNID), from.Depth, from.StreamPosition, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.HistoryEvent
+	for rows.Next() {
+		var eventNID int64
+		var result types.HistoryEvent
+		if err = rows.Scan(&eventNID, &result.Depth, &result.StreamPosition); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *eventStatements) selectSentEventNIDs(roomNID types.RoomNID) ([]types.EventNID, error) {
+	rows, err := s.selectSentEventNIDsStmt.Query(int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.EventNID(eventNID))
+	}
+	return results, nil
+}
+
+func (s *eventStatements) bulkDeleteEvent(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := txn.Stmt(s.bulkDeleteEventStmt).Exec(eventNIDsAsArray(eventNIDs))
+	return err
+}
+
+func (s *eventStatements) bulkUpdateEventOutlier(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := txn.Stmt(s.bulkUpdateEventOutlierStmt).Exec(eventNIDsAsArray(eventNIDs))
+	return err
+}
+
+func (s *eventStatements) selectEventsMissingAuthEvents(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectEventsMissingAuthEventsStmt, limit)
+}
+
+func (s *eventStatements) selectRoomsMissingLatestEvents(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectRoomsMissingLatestEventsStmt, limit)
+}
+
+func (s *eventStatements) selectRoomsMissingLastEventSent(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectRoomsMissingLastEventSentStmt, limit)
+}
+
+func (s *eventStatements) selectEventNIDsWithState(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	nids := make([]int64, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	return selectEventNIDList(s.selectEventNIDsWithStateStmt, pq.Int64Array(nids))
+}
+
+func (s *eventStatements) selectRandomEventNIDs(limit int) ([]types.EventNID, error) {
+	return selectEventNIDList(s.selectRandomEventNIDsStmt, limit)
+}
+
+// eventNIDsAsArray converts a list of numeric event IDs to a postgres array.
+func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	return pq.Int64Array(nids)
+}
@@ -21,10 +21,12 @@ CREATE TABLE IF NOT EXISTS partition_offsets (
 const selectPartitionOffsetsSQL = "" +
 	"SELECT partition, partition_offset FROM partition_offsets WHERE topic = $1"
 
+// The offset only ever moves forwards. Events from a partition are processed
+// concurrently so offsets can be recorded out of order.
 const upsertPartitionOffsetsSQL = "" +
 	"INSERT INTO partition_offsets (topic, partition, partition_offset) VALUES ($1, $2, $3)" +
 	" ON CONFLICT ON CONSTRAINT topic_partition_unique" +
-	" DO UPDATE SET partition_offset = $3"
+	" DO UPDATE SET partition_offset = GREATEST(partition_offsets.partition_offset, $3)"
 
 type partitionOffsetStatements struct {
 	selectPartitionOffsetsStmt *sql.Stmt
@@ -57,11 +59,18 @@ func (s *partitionOffsetStatements) selectPartitionOffsets(topic string) ([]type
 		if err := rows.Scan(&offset.Partition, &offset.Offset); err != nil {
 			return nil, err
 		}
+		results = append(results, offset)
 	}
 	return results, nil
 }
 
-func (s *partitionOffsetStatements) upsertPartitionOffset(topic string, partition int32, offset int64) error {
-	_, err := s.upsertPartitionOffsetStmt.Exec(topic, partition, offset)
+// upsertPartitionOffset records the offset reached in a partition.
+// If txn is not nil then the offset is recorded as part of that transaction.
+func (s *partitionOffsetStatements) upsertPartitionOffset(txn *sql.Tx, topic string, partition int32, offset int64) error {
+	stmt := s.upsertPartitionOffsetStmt
+	if txn != nil {
+		stmt = txn.Stmt(stmt)
+	}
+	_, err := stmt.Exec(topic, partition, offset)
 	return err
 }
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const pendingEventsSchema = `
+-- The pending events table holds new events that can't be processed yet
+-- because we don't have some of their prev_events, or don't know the state
+-- at them. The events are processed once all their prev_events are stored
+-- with state.
+CREATE SEQUENCE IF NOT EXISTS pending_event_nid_seq;
+CREATE TABLE IF NOT EXISTS pending_events (
+    -- Local numeric ID for the pending event.
+    -- Pending events are processed in order of this ID.
+    pending_event_nid BIGINT PRIMARY KEY DEFAULT nextval('pending_event_nid_seq'),
+    -- The string ID of the pending event.
+    event_id TEXT NOT NULL CONSTRAINT pending_event_id_unique UNIQUE,
+    -- The string ID of the room the pending event is in.
+    -- This is a string rather than a numeric ID because we might not have
+    -- any other events for the room yet.
+    room_id TEXT NOT NULL,
+    -- The string IDs of the prev_events we were missing when the event arrived.
+    missing_event_ids TEXT[] NOT NULL,
+    -- The input room event that is waiting to be processed.
+    -- Stored as TEXT because it is JSON.
+    input_json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS pending_events_room_id_idx ON pending_events(room_id);
+`
+
+// If the event is already pending then the missing events are replaced with
+// the events that are missing now.
+const insertPendingEventSQL = "" +
+	"INSERT INTO pending_events (event_id, room_id, missing_event_ids, input_json)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT pending_event_id_unique" +
+	" DO UPDATE SET missing_event_ids = $3"
+
+// Select the pending events in a room that are ready to be processed because
+// all the events they were missing have been stored with state.
+const selectReadyPendingEventsSQL = "" +
+	"SELECT event_id, input_json FROM pending_events WHERE room_id = $1 AND NOT EXISTS (" +
+	" SELECT 1 FROM unnest(missing_event_ids) AS missing_event_id WHERE NOT EXISTS (" +
+	" SELECT 1 FROM events WHERE events.event_id = missing_event_id AND events.state_snapshot_nid != 0" +
+	")) ORDER BY pending_event_nid ASC"
+
+const deletePendingEventSQL = "" +
+	"DELETE FROM pending_events WHERE event_id = $1"
+
+type pendingEventStatements struct {
+	insertPendingEventStmt       *sql.Stmt
+	selectReadyPendingEventsStmt *sql.Stmt
+	deletePendingEventStmt       *sql.Stmt
+}
+
+func (s *pendingEventStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pendingEventsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertPendingEventStmt, err = db.Prepare(insertPendingEventSQL); err != nil {
+		return
+	}
+	if s.selectReadyPendingEventsStmt, err = db.Prepare(selectReadyPendingEventsSQL); err != nil {
+		return
+	}
+	if s.deletePendingEventStmt, err = db.Prepare(deletePendingEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pendingEventStatements) insertPendingEvent(
+	eventID, roomID string, missingEventIDs []string, inputJSON []byte,
+) error {
+	_, err := s.insertPendingEventStmt.Exec(eventID, roomID, pq.StringArray(missingEventIDs), inputJSON)
+	return err
+}
+
+func (s *pendingEventStatements) selectReadyPendingEvents(roomID string) ([]types.PendingEvent, error) {
+	rows, err := s.selectReadyPendingEventsStmt.Query(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.PendingEvent
+	for rows.Next() {
+		var result types.PendingEvent
+		if err = rows.Scan(&result.EventID, &result.InputJSON); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *pendingEventStatements) deletePendingEvent(eventID string) error {
+	_, err := s.deletePendingEventStmt.Exec(eventID)
+	return err
+}
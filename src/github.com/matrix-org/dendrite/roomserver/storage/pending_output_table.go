@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const pendingOutputSchema = `
+-- The pending output table is an outbox for messages to the output log.
+-- Messages are added to this table in the same transaction that updates the
+-- latest events for a room. A separate publisher reads the messages in order,
+-- writes them to the output log and then deletes them from this table.
+-- This means that a message is only written to the output log if the changes
+-- to the room were committed, and that the message will eventually be written
+-- even if the roomserver crashes after committing.
+CREATE SEQUENCE IF NOT EXISTS pending_output_nid_seq;
+CREATE TABLE IF NOT EXISTS pending_output (
+    -- Local numeric ID for the message.
+    -- Messages are written to the output log in order of this ID.
+    -- The messages for a room are stored while holding the lock on the room so
+    -- they commit in this order, but the messages for different rooms may not.
+    pending_output_nid BIGINT PRIMARY KEY DEFAULT nextval('pending_output_nid_seq'),
+    -- The serialised message to write to the output log.
+    -- Stored as TEXT because the messages are JSON.
+    output_json TEXT NOT NULL
+);
+`
+
+const insertPendingOutputSQL = "" +
+	"INSERT INTO pending_output (output_json) VALUES ($1)"
+
+const selectPendingOutputSQL = "" +
+	"SELECT pending_output_nid, output_json FROM pending_output" +
+	" ORDER BY pending_output_nid ASC LIMIT $1"
+
+const deletePendingOutputSQL = "" +
+	"DELETE FROM pending_output WHERE pending_output_nid = $1"
+
+type pendingOutputStatements struct {
+	insertPendingOutputStmt *sql.Stmt
+	selectPendingOutputStmt *sql.Stmt
+	deletePendingOutputStmt *sql.Stmt
+}
+
+func (s *pendingOutputStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pendingOutputSchema)
+	if err != nil {
+		return
+	}
+	if s.insertPendingOutputStmt, err = db.Prepare(insertPendingOutputSQL); err != nil {
+		return
+	}
+	if s.selectPendingOutputStmt, err = db.Prepare(selectPendingOutputSQL); err != nil {
+		return
+	}
+	if s.deletePendingOutputStmt, err = db.Prepare(deletePendingOutputSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pendingOutputStatements) insertPendingOutput(txn *sql.Tx, value []byte) error {
+	_, err := txn.Stmt(s.insertPendingOutputStmt).Exec(value)
+	return err
+}
+
+func (s *pendingOutputStatements) selectPendingOutput(limit int) ([]types.PendingOutput, error) {
+	rows, err := s.selectPendingOutputStmt.Query(limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.PendingOutput
+	for rows.Next() {
+		var result types.PendingOutput
+		if err = rows.Scan(&result.PendingOutputNID, &result.Value); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *pendingOutputStatements) deletePendingOutput(pendingOutputNID types.PendingOutputNID) error {
+	_, err := s.deletePendingOutputStmt.Exec(int64(pendingOutputNID))
+	return err
+}
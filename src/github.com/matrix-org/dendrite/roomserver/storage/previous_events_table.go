@@ -40,9 +40,31 @@ const selectPreviousEventExistsSQL = "" +
 	"SELECT 1 FROM previous_events" +
 	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
 
+// Remove deleted events from the lists of events that reference each previous event.
+// This should only be modified while holding a "FOR UPDATE" lock on the row in the rooms table for this room.
+const bulkRemovePreviousEventReferencesSQL = "" +
+	"UPDATE previous_events SET event_nids = ARRAY(" +
+	" SELECT unnest(event_nids) EXCEPT SELECT unnest($1::bigint[])" +
+	") WHERE event_nids && $1"
+
+// Remove the entries for previous events that are no longer referenced by any event.
+// An entry for a deleted event is kept while an event that references it is still stored
+// so that the deleted event doesn't become one of the latest events if it is received again.
+const deleteUnreferencedPreviousEventsSQL = "" +
+	"DELETE FROM previous_events WHERE event_nids = '{}'"
+
+// Lookup the events listed as referencing a previous event that don't exist.
+const selectPreviousEventsMissingEventsSQL = "" +
+	"SELECT DISTINCT referrer.event_nid FROM previous_events, unnest(previous_events.event_nids) AS referrer(event_nid)" +
+	" WHERE NOT EXISTS (SELECT 1 FROM events WHERE events.event_nid = referrer.event_nid)" +
+	" ORDER BY referrer.event_nid ASC LIMIT $1"
+
 type previousEventStatements struct {
-	insertPreviousEventStmt       *sql.Stmt
-	selectPreviousEventExistsStmt *sql.Stmt
+	insertPreviousEventStmt               *sql.Stmt
+	selectPreviousEventExistsStmt         *sql.Stmt
+	bulkRemovePreviousEventReferencesStmt *sql.Stmt
+	deleteUnreferencedPreviousEventsStmt  *sql.Stmt
+	selectPreviousEventsMissingEventsStmt *sql.Stmt
 }
 
 func (s *previousEventStatements) prepare(db *sql.DB) (err error) {
@@ -56,6 +78,15 @@ func (s *previousEventStatements) prepare(db *sql.DB) (err error) {
 	if s.selectPreviousEventExistsStmt, err = db.Prepare(selectPreviousEventExistsSQL); err != nil {
 		return
 	}
+	if s.bulkRemovePreviousEventReferencesStmt, err = db.Prepare(bulkRemovePreviousEventReferencesSQL); err != nil {
+		return
+	}
+	if s.deleteUnreferencedPreviousEventsStmt, err = db.Prepare(deleteUnreferencedPreviousEventsSQL); err != nil {
+		return
+	}
+	if s.selectPreviousEventsMissingEventsStmt, err = db.Prepare(selectPreviousEventsMissingEventsSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -70,3 +101,16 @@ func (s *previousEventStatements) selectPreviousEventExists(txn *sql.Tx, eventID
 	var ok int64
 	return txn.Stmt(s.selectPreviousEventExistsStmt).QueryRow(eventID, eventReferenceSHA256).Scan(&ok)
 }
+
+// bulkRemovePreviousEventReferences removes the entries for deleted events from the previous events table.
+func (s *previousEventStatements) bulkRemovePreviousEventReferences(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	if _, err := txn.Stmt(s.bulkRemovePreviousEventReferencesStmt).Exec(eventNIDsAsArray(eventNIDs)); err != nil {
+		return err
+	}
+	_, err := txn.Stmt(s.deleteUnreferencedPreviousEventsStmt).Exec()
+	return err
+}
+
+func (s *previousEventStatements) selectPreviousEventsMissingEvents(limit int) ([]types.EventNID, error) {
+	return selectEventNIDList(s.selectPreviousEventsMissingEventsStmt, limit)
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const redactionsSchema = `
+-- The redactions table tracks the m.room.redaction events in each room and
+-- the events they redact.
+-- A redaction can arrive before the event it redacts so the redacted event
+-- is stored by its string ID. Once both events are stored and the redaction
+-- has been applied to the event the numeric ID of the redacted event is set.
+CREATE TABLE IF NOT EXISTS redactions (
+    -- The string ID of the m.room.redaction event.
+    redaction_event_id TEXT NOT NULL PRIMARY KEY,
+    -- The string ID of the event being redacted.
+    redacts_event_id TEXT NOT NULL,
+    -- Local numeric ID for the room the m.room.redaction event is in.
+    -- A redaction is only applied to an event in the same room.
+    room_nid BIGINT NOT NULL,
+    -- Local numeric ID for the redacted event.
+    -- This is 0 if the redaction hasn't been applied yet.
+    redacts_event_nid BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS redactions_redacts_event_id_idx ON redactions(redacts_event_id);
+CREATE INDEX IF NOT EXISTS redactions_redacts_event_nid_idx ON redactions(redacts_event_nid)
+    WHERE redacts_event_nid != 0;
+`
+
+const insertRedactionSQL = "" +
+	"INSERT INTO redactions (redaction_event_id, redacts_event_id, room_nid) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectRedactionsForEventSQL = "" +
+	"SELECT redaction_event_id, room_nid, redacts_event_nid FROM redactions" +
+	" WHERE redacts_event_id = $1"
+
+const updateRedactionAppliedSQL = "" +
+	"UPDATE redactions SET redacts_event_nid = $2 WHERE redaction_event_id = $1"
+
+// Remove the redactions of events that have been deleted.
+// Redactions of events that are still stored are kept so that the events are still marked as redacted.
+const bulkDeleteRedactionsForEventSQL = "" +
+	"DELETE FROM redactions WHERE redacts_event_nid = ANY($1)"
+
+type redactionStatements struct {
+	insertRedactionStmt              *sql.Stmt
+	selectRedactionsForEventStmt     *sql.Stmt
+	updateRedactionAppliedStmt       *sql.Stmt
+	bulkDeleteRedactionsForEventStmt *sql.Stmt
+}
+
+func (s *redactionStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(redactionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRedactionStmt, err = db.Prepare(insertRedactionSQL); err != nil {
+		return
+	}
+	if s.selectRedactionsForEventStmt, err = db.Prepare(selectRedactionsForEventSQL); err != nil {
+		return
+	}
+	if s.updateRedactionAppliedStmt, err = db.Prepare(updateRedactionAppliedSQL); err != nil {
+		return
+	}
+	if s.bulkDeleteRedactionsForEventStmt, err = db.Prepare(bulkDeleteRedactionsForEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *redactionStatements) insertRedaction(
+	redactionEventID, redactsEventID string, roomNID types.RoomNID,
+) error {
+	_, err := s.insertRedactionStmt.Exec(redactionEventID, redactsEventID, int64(roomNID))
+	return err
+}
+
+func (s *redactionStatements) selectRedactionsForEvent(redactsEventID string) ([]types.Redaction, error) {
+	rows, err := s.selectRedactionsForEventStmt.Query(redactsEventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.Redaction
+	for rows.Next() {
+		var result types.Redaction
+		var roomNID int64
+		var redactsEventNID int64
+		if err = rows.Scan(&result.RedactionEventID, &roomNID, &redactsEventNID); err != nil {
+			return nil, err
+		}
+		result.RedactsEventID = redactsEventID
+		result.RoomNID = types.RoomNID(roomNID)
+		result.RedactsEventNID = types.EventNID(redactsEventNID)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *redactionStatements) updateRedactionApplied(
+	txn *sql.Tx, redactionEventID string, redactsEventNID types.EventNID,
+) error {
+	_, err := txn.Stmt(s.updateRedactionAppliedStmt).Exec(redactionEventID, int64(redactsEventNID))
+	return err
+}
+
+func (s *redactionStatements) bulkDeleteRedactionsForEvent(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := txn.Stmt(s.bulkDeleteRedactionsForEventStmt).Exec(eventNIDsAsArray(eventNIDs))
+	return err
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const rejectedEventsSchema = `
+-- The rejected events table holds the events that failed the auth checks.
+-- Rejected events are still stored in the events table so that the events
+-- that reference them in their prev_events can be placed in the event graph.
+-- But they are never part of the state of a room and are never one of the
+-- latest events in a room.
+CREATE TABLE IF NOT EXISTS rejected_events (
+    -- Local numeric ID for the rejected event.
+    event_nid BIGINT PRIMARY KEY,
+    -- Why the event was rejected.
+    -- This is the error returned by the auth checks and is kept for debugging.
+    rejection_reason TEXT NOT NULL
+);
+`
+
+const insertRejectedEventSQL = "" +
+	"INSERT INTO rejected_events (event_nid, rejection_reason) VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const bulkSelectRejectionReasonSQL = "" +
+	"SELECT event_nid, rejection_reason FROM rejected_events WHERE event_nid = ANY($1)"
+
+const bulkDeleteRejectedEventSQL = "" +
+	"DELETE FROM rejected_events WHERE event_nid = ANY($1)"
+
+type rejectedEventStatements struct {
+	insertRejectedEventStmt       *sql.Stmt
+	bulkSelectRejectionReasonStmt *sql.Stmt
+	bulkDeleteRejectedEventStmt   *sql.Stmt
+}
+
+func (s *rejectedEventStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(rejectedEventsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRejectedEventStmt, err = db.Prepare(insertRejectedEventSQL); err != nil {
+		return
+	}
+	if s.bulkSelectRejectionReasonStmt, err = db.Prepare(bulkSelectRejectionReasonSQL); err != nil {
+		return
+	}
+	if s.bulkDeleteRejectedEventStmt, err = db.Prepare(bulkDeleteRejectedEventSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *rejectedEventStatements) insertRejectedEvent(eventNID types.EventNID, rejectionReason string) error {
+	_, err := s.insertRejectedEventStmt.Exec(int64(eventNID), rejectionReason)
+	return err
+}
+
+// bulkSelectRejectionReason returns a map from numeric event ID to the reason the event was rejected.
+// Events that weren't rejected are left out of the map.
+func (s *rejectedEventStatements) bulkSelectRejectionReason(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	rows, err := s.bulkSelectRejectionReasonStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make(map[types.EventNID]string)
+	for rows.Next() {
+		var eventNID int64
+		var rejectionReason string
+		if err = rows.Scan(&eventNID, &rejectionReason); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = rejectionReason
+	}
+	return results, nil
+}
+
+func (s *rejectedEventStatements) bulkDeleteRejectedEvent(txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := txn.Stmt(s.bulkDeleteRejectedEventStmt).Exec(eventNIDsAsArray(eventNIDs))
+	return err
+}
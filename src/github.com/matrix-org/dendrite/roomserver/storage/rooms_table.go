@@ -18,8 +18,14 @@ CREATE TABLE IF NOT EXISTS rooms (
     -- (The server will be in that state while it stores the events for the initial state of the room)
     latest_event_nids BIGINT[] NOT NULL DEFAULT '{}'::BIGINT[],
     -- The last event written to the output log for this room.
-    last_event_sent_nid BIGINT NOT NULL DEFAULT 0
+    last_event_sent_nid BIGINT NOT NULL DEFAULT 0,
+    -- The state of the room after the current set of latest events.
+    -- This will be 0 if there are no latest events in the room.
+    state_snapshot_nid BIGINT NOT NULL DEFAULT 0
 );
+-- Add the current state to databases created before it existed.
+-- The state of an upgraded room is worked out when its next event is processed.
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS state_snapshot_nid BIGINT NOT NULL DEFAULT 0;
 `
 
 // Same as insertEventTypeNIDSQL
@@ -31,17 +37,48 @@ const insertRoomNIDSQL = "" +
 const selectRoomNIDSQL = "" +
 	"SELECT room_nid FROM rooms WHERE room_id = $1"
 
+const selectRoomNIDsSQL = "" +
+	"SELECT room_nid FROM rooms ORDER BY room_nid ASC"
+
 const selectLatestEventNIDsSQL = "" +
-	"SELECT latest_event_nids, last_event_sent_nid FROM rooms WHERE room_nid = $1 FOR UPDATE"
+	"SELECT latest_event_nids, state_snapshot_nid FROM rooms WHERE room_nid = $1"
+
+const selectLatestEventNIDsForUpdateSQL = "" +
+	"SELECT latest_event_nids, last_event_sent_nid, state_snapshot_nid FROM rooms WHERE room_nid = $1 FOR UPDATE"
 
 const updateLatestEventNIDsSQL = "" +
-	"UPDATE rooms SET latest_event_nids = $2, last_event_sent_nid = $3 WHERE room_nid = $1"
+	"UPDATE rooms SET latest_event_nids = $2, last_event_sent_nid = $3, state_snapshot_nid = $4 WHERE room_nid = $1"
+
+// Lookup which of a list of events are the latest events of a room.
+const selectLatestEventNIDsInSQL = "" +
+	"SELECT DISTINCT latest.event_nid FROM rooms, unnest(rooms.latest_event_nids) AS latest(event_nid)" +
+	" WHERE latest.event_nid = ANY($1) ORDER BY latest.event_nid ASC"
+
+// Remove a list of events from the latest events of a room, keeping the others in order.
+const removeLatestEventNIDsSQL = "" +
+	"UPDATE rooms SET latest_event_nids = ARRAY(" +
+	" SELECT latest.event_nid FROM unnest(latest_event_nids) WITH ORDINALITY AS latest(event_nid, i)" +
+	" WHERE latest.event_nid != ALL($2) ORDER BY latest.i" +
+	") WHERE room_nid = $1"
+
+const resetLastEventSentNIDsSQL = "" +
+	"UPDATE rooms SET last_event_sent_nid = 0 WHERE room_nid = ANY($1)"
+
+// A current state of 0 is worked out again when the next event in the room is processed.
+const resetStateSnapshotNIDsSQL = "" +
+	"UPDATE rooms SET state_snapshot_nid = 0 WHERE room_nid = ANY($1)"
 
 type roomStatements struct {
-	insertRoomNIDStmt         *sql.Stmt
-	selectRoomNIDStmt         *sql.Stmt
-	selectLatestEventNIDsStmt *sql.Stmt
-	updateLatestEventNIDsStmt *sql.Stmt
+	insertRoomNIDStmt                  *sql.Stmt
+	selectRoomNIDStmt                  *sql.Stmt
+	selectRoomNIDsStmt                 *sql.Stmt
+	selectLatestEventNIDsStmt          *sql.Stmt
+	selectLatestEventNIDsForUpdateStmt *sql.Stmt
+	updateLatestEventNIDsStmt          *sql.Stmt
+	selectLatestEventNIDsInStmt        *sql.Stmt
+	removeLatestEventNIDsStmt          *sql.Stmt
+	resetLastEventSentNIDsStmt         *sql.Stmt
+	resetStateSnapshotNIDsStmt         *sql.Stmt
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
@@ -55,12 +92,30 @@ func (s *roomStatements) prepare(db *sql.DB) (err error) {
 	if s.selectRoomNIDStmt, err = db.Prepare(selectRoomNIDSQL); err != nil {
 		return
 	}
+	if s.selectRoomNIDsStmt, err = db.Prepare(selectRoomNIDsSQL); err != nil {
+		return
+	}
 	if s.selectLatestEventNIDsStmt, err = db.Prepare(selectLatestEventNIDsSQL); err != nil {
 		return
 	}
+	if s.selectLatestEventNIDsForUpdateStmt, err = db.Prepare(selectLatestEventNIDsForUpdateSQL); err != nil {
+		return
+	}
 	if s.updateLatestEventNIDsStmt, err = db.Prepare(updateLatestEventNIDsSQL); err != nil {
 		return
 	}
+	if s.selectLatestEventNIDsInStmt, err = db.Prepare(selectLatestEventNIDsInSQL); err != nil {
+		return
+	}
+	if s.removeLatestEventNIDsStmt, err = db.Prepare(removeLatestEventNIDsSQL); err != nil {
+		return
+	}
+	if s.resetLastEventSentNIDsStmt, err = db.Prepare(resetLastEventSentNIDsSQL); err != nil {
+		return
+	}
+	if s.resetStateSnapshotNIDsStmt, err = db.Prepare(resetStateSnapshotNIDsSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -76,10 +131,27 @@ func (s *roomStatements) selectRoomNID(roomID string) (types.RoomNID, error) {
 	return types.RoomNID(roomNID), err
 }
 
-func (s *roomStatements) selectLatestEventsNIDsForUpdate(txn *sql.Tx, roomNID types.RoomNID) ([]types.EventNID, types.EventNID, error) {
+func (s *roomStatements) selectRoomNIDs() ([]types.RoomNID, error) {
+	rows, err := s.selectRoomNIDsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.RoomNID
+	for rows.Next() {
+		var roomNID int64
+		if err = rows.Scan(&roomNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.RoomNID(roomNID))
+	}
+	return results, nil
+}
+
+func (s *roomStatements) selectLatestEventNIDs(roomNID types.RoomNID) ([]types.EventNID, types.StateSnapshotNID, error) {
 	var nids pq.Int64Array
-	var lastEventSentNID int64
-	err := txn.Stmt(s.selectLatestEventNIDsStmt).QueryRow(int64(roomNID)).Scan(&nids, &lastEventSentNID)
+	var stateSnapshotNID int64
+	err := s.selectLatestEventNIDsStmt.QueryRow(int64(roomNID)).Scan(&nids, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -87,14 +159,71 @@ func (s *roomStatements) selectLatestEventsNIDsForUpdate(txn *sql.Tx, roomNID ty
 	for i := range nids {
 		eventNIDs[i] = types.EventNID(nids[i])
 	}
-	return eventNIDs, types.EventNID(lastEventSentNID), nil
+	return eventNIDs, types.StateSnapshotNID(stateSnapshotNID), nil
 }
 
-func (s *roomStatements) updateLatestEventNIDs(txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID) error {
+func (s *roomStatements) selectLatestEventsNIDsForUpdate(txn *sql.Tx, roomNID types.RoomNID) (
+	[]types.EventNID, types.EventNID, types.StateSnapshotNID, error,
+) {
+	var nids pq.Int64Array
+	var lastEventSentNID int64
+	var stateSnapshotNID int64
+	err := txn.Stmt(s.selectLatestEventNIDsForUpdateStmt).QueryRow(int64(roomNID)).Scan(&nids, &lastEventSentNID, &stateSnapshotNID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	eventNIDs := make([]types.EventNID, len(nids))
+	for i := range nids {
+		eventNIDs[i] = types.EventNID(nids[i])
+	}
+	return eventNIDs, types.EventNID(lastEventSentNID), types.StateSnapshotNID(stateSnapshotNID), nil
+}
+
+func (s *roomStatements) updateLatestEventNIDs(
+	txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID,
+	stateSnapshotNID types.StateSnapshotNID,
+) error {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	_, err := txn.Stmt(s.updateLatestEventNIDsStmt).Exec(
+		roomNID, pq.Int64Array(nids), int64(lastEventSentNID), int64(stateSnapshotNID),
+	)
+	return err
+}
+
+func (s *roomStatements) selectLatestEventNIDsIn(eventNIDs []types.EventNID) ([]types.EventNID, error) {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
 		nids[i] = int64(eventNIDs[i])
 	}
-	_, err := txn.Stmt(s.updateLatestEventNIDsStmt).Exec(roomNID, pq.Int64Array(nids), int64(lastEventSentNID))
+	return selectEventNIDList(s.selectLatestEventNIDsInStmt, pq.Int64Array(nids))
+}
+
+func (s *roomStatements) removeLatestEventNIDs(roomNID types.RoomNID, eventNIDs []types.EventNID) error {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	_, err := s.removeLatestEventNIDsStmt.Exec(int64(roomNID), pq.Int64Array(nids))
+	return err
+}
+
+func (s *roomStatements) resetLastEventSentNIDs(roomNIDs []types.RoomNID) error {
+	nids := make([]int64, len(roomNIDs))
+	for i := range roomNIDs {
+		nids[i] = int64(roomNIDs[i])
+	}
+	_, err := s.resetLastEventSentNIDsStmt.Exec(pq.Int64Array(nids))
+	return err
+}
+
+func (s *roomStatements) resetStateSnapshotNIDs(roomNIDs []types.RoomNID) error {
+	nids := make([]int64, len(roomNIDs))
+	for i := range roomNIDs {
+		nids[i] = int64(roomNIDs[i])
+	}
+	_, err := s.resetStateSnapshotNIDsStmt.Exec(pq.Int64Array(nids))
 	return err
 }
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const serverKeysSchema = `
+-- The server keys table caches the ed25519 keys that other matrix servers
+-- sign their events with so that we don't need to fetch them again for each
+-- event. Only keys that passed the checks when they were fetched are stored.
+CREATE TABLE IF NOT EXISTS server_keys (
+    -- The name of the matrix server the key belongs to.
+    server_name TEXT NOT NULL,
+    -- The ID of the key, e.g. "ed25519:auto".
+    key_id TEXT NOT NULL,
+    -- The ed25519 public key.
+    public_key BYTEA NOT NULL,
+    -- When the server said we could stop trusting the key, in milliseconds.
+    -- The key is fetched again after this time.
+    valid_until_ts BIGINT NOT NULL,
+    CONSTRAINT server_key_unique UNIQUE (server_name, key_id)
+);
+`
+
+// If we already have the key then it is replaced along with the time it is valid until.
+const upsertServerKeySQL = "" +
+	"INSERT INTO server_keys (server_name, key_id, public_key, valid_until_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT server_key_unique" +
+	" DO UPDATE SET public_key = $3, valid_until_ts = $4"
+
+const selectServerKeysSQL = "" +
+	"SELECT key_id, public_key, valid_until_ts FROM server_keys WHERE server_name = $1"
+
+type serverKeyStatements struct {
+	upsertServerKeyStmt  *sql.Stmt
+	selectServerKeysStmt *sql.Stmt
+}
+
+func (s *serverKeyStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(serverKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertServerKeyStmt, err = db.Prepare(upsertServerKeySQL); err != nil {
+		return
+	}
+	if s.selectServerKeysStmt, err = db.Prepare(selectServerKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *serverKeyStatements) upsertServerKey(key types.ServerKey) error {
+	_, err := s.upsertServerKeyStmt.Exec(key.ServerName, key.KeyID, key.PublicKey, key.ValidUntilTS)
+	return err
+}
+
+func (s *serverKeyStatements) selectServerKeys(serverName string) ([]types.ServerKey, error) {
+	rows, err := s.selectServerKeysStmt.Query(serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.ServerKey
+	for rows.Next() {
+		result := types.ServerKey{ServerName: serverName}
+		if err = rows.Scan(&result.KeyID, &result.PublicKey, &result.ValidUntilTS); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
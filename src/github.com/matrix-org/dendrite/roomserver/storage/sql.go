@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
 type statements struct {
@@ -14,6 +15,12 @@ type statements struct {
 	stateSnapshotStatements
 	stateBlockStatements
 	previousEventStatements
+	pendingOutputStatements
+	redactionStatements
+	rejectedEventStatements
+	pendingEventStatements
+	serverKeyStatements
+	stateLockStatements
 }
 
 func (s *statements) prepare(db *sql.DB) error {
@@ -35,10 +42,20 @@ func (s *statements) prepare(db *sql.DB) error {
 		return err
 	}
 
+	// The event statements use the rejected events table so it must be created first.
+	if err = s.rejectedEventStatements.prepare(db); err != nil {
+		return err
+	}
+
 	if err = s.eventStatements.prepare(db); err != nil {
 		return err
 	}
 
+	// The event JSON statements use the redactions table so it must be created first.
+	if err = s.redactionStatements.prepare(db); err != nil {
+		return err
+	}
+
 	if err = s.eventJSONStatements.prepare(db); err != nil {
 		return err
 	}
@@ -55,5 +72,58 @@ func (s *statements) prepare(db *sql.DB) error {
 		return err
 	}
 
+	if err = s.pendingOutputStatements.prepare(db); err != nil {
+		return err
+	}
+
+	if err = s.pendingEventStatements.prepare(db); err != nil {
+		return err
+	}
+
+	if err = s.serverKeyStatements.prepare(db); err != nil {
+		return err
+	}
+
+	if err = s.stateLockStatements.prepare(db); err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// selectEventNIDList runs a query that returns a single column of numeric event IDs.
+func selectEventNIDList(stmt *sql.Stmt, args ...interface{}) ([]types.EventNID, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.EventNID(eventNID))
+	}
+	return results, nil
+}
+
+// selectBrokenReferences runs a query that returns the numeric ID of a row and a numeric ID
+// that the row refers to that doesn't exist.
+func selectBrokenReferences(stmt *sql.Stmt, limit int) ([]types.BrokenReference, error) {
+	rows, err := stmt.Query(limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.BrokenReference
+	for rows.Next() {
+		var result types.BrokenReference
+		if err = rows.Scan(&result.FromNID, &result.MissingNID); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -46,10 +46,53 @@ const bulkSelectStateDataEntriesSQL = "" +
 	" FROM state_block WHERE state_block_nid = ANY($1)" +
 	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
 
+// Lookup every event referenced by the state blocks of a list of state snapshots.
+// This includes the entries that are replaced by later blocks in the snapshot.
+const bulkSelectStateSnapshotEventNIDsSQL = "" +
+	"SELECT DISTINCT event_nid FROM state_block WHERE state_block_nid IN (" +
+	" SELECT unnest(state_block_nids) FROM state_snapshots WHERE state_snapshot_nid = ANY($1)" +
+	")"
+
+// Delete the state blocks in the list that aren't used by a state snapshot.
+// Returns the number of state blocks deleted and the total size of their rows in bytes.
+const bulkDeleteUnusedStateDataSQL = "" +
+	"WITH deleted AS (" +
+	" DELETE FROM state_block WHERE state_block_nid = ANY($1)" +
+	" AND NOT EXISTS (SELECT 1 FROM state_snapshots" +
+	"  WHERE state_block_nids @> ARRAY[state_block.state_block_nid])" +
+	" RETURNING state_block_nid, pg_column_size(state_block.*) AS size" +
+	") SELECT COUNT(DISTINCT state_block_nid), COALESCE(SUM(size), 0) FROM deleted"
+
+// Lookup the state blocks after a numeric ID that aren't used by a state snapshot.
+const selectUnusedStateBlockNIDsSQL = "" +
+	"SELECT DISTINCT state_block_nid FROM state_block" +
+	" WHERE state_block_nid > $1" +
+	" AND NOT EXISTS (SELECT 1 FROM state_snapshots" +
+	"  WHERE state_block_nids @> ARRAY[state_block.state_block_nid])" +
+	" ORDER BY state_block_nid ASC LIMIT $2"
+
+// Lookup state snapshots that refer to state blocks that don't exist.
+const selectStateMissingBlocksSQL = "" +
+	"SELECT state_snapshots.state_snapshot_nid, block.state_block_nid" +
+	" FROM state_snapshots, unnest(state_snapshots.state_block_nids) AS block(state_block_nid)" +
+	" WHERE NOT EXISTS (SELECT 1 FROM state_block WHERE state_block.state_block_nid = block.state_block_nid)" +
+	" ORDER BY state_snapshots.state_snapshot_nid ASC LIMIT $1"
+
+// Lookup state blocks that refer to events that don't exist.
+const selectStateBlocksMissingEventsSQL = "" +
+	"SELECT DISTINCT state_block_nid, event_nid FROM state_block" +
+	" WHERE NOT EXISTS (SELECT 1 FROM events WHERE events.event_nid = state_block.event_nid)" +
+	" ORDER BY state_block_nid ASC LIMIT $1"
+
 type stateBlockStatements struct {
-	insertStateDataStmt            *sql.Stmt
-	selectNextStateBlockNIDStmt    *sql.Stmt
-	bulkSelectStateDataEntriesStmt *sql.Stmt
+	insertStateDataStmt                  *sql.Stmt
+	selectNextStateBlockNIDStmt          *sql.Stmt
+	bulkSelectStateDataEntriesStmt       *sql.Stmt
+	bulkSelectStateSnapshotEventNIDsStmt *sql.Stmt
+	bulkDeleteUnusedStateDataStmt        *sql.Stmt
+	selectUnusedStateBlockNIDsStmt       *sql.Stmt
+	selectStateMissingBlocksStmt         *sql.Stmt
+	selectStateBlocksMissingEventsStmt   *sql.Stmt
 }
 
 func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
@@ -66,6 +109,21 @@ func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
 	if s.bulkSelectStateDataEntriesStmt, err = db.Prepare(bulkSelectStateDataEntriesSQL); err != nil {
 		return
 	}
+	if s.bulkSelectStateSnapshotEventNIDsStmt, err = db.Prepare(bulkSelectStateSnapshotEventNIDsSQL); err != nil {
+		return
+	}
+	if s.bulkDeleteUnusedStateDataStmt, err = db.Prepare(bulkDeleteUnusedStateDataSQL); err != nil {
+		return
+	}
+	if s.selectUnusedStateBlockNIDsStmt, err = db.Prepare(selectUnusedStateBlockNIDsSQL); err != nil {
+		return
+	}
+	if s.selectStateMissingBlocksStmt, err = db.Prepare(selectStateMissingBlocksSQL); err != nil {
+		return
+	}
+	if s.selectStateBlocksMissingEventsStmt, err = db.Prepare(selectStateBlocksMissingEventsSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -135,3 +193,62 @@ func (s *stateBlockStatements) bulkSelectStateDataEntries(stateBlockNIDs []types
 	}
 	return results, nil
 }
+
+func (s *stateBlockStatements) bulkSelectStateSnapshotEventNIDs(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	nids := make([]int64, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	rows, err := s.bulkSelectStateSnapshotEventNIDsStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.EventNID(eventNID))
+	}
+	return results, nil
+}
+
+func (s *stateBlockStatements) bulkDeleteUnusedStateData(
+	txn *sql.Tx, stateBlockNIDs []types.StateBlockNID,
+) (count, size int64, err error) {
+	nids := make([]int64, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		nids[i] = int64(stateBlockNIDs[i])
+	}
+	err = txn.Stmt(s.bulkDeleteUnusedStateDataStmt).QueryRow(pq.Int64Array(nids)).Scan(&count, &size)
+	return
+}
+
+func (s *stateBlockStatements) selectUnusedStateBlockNIDs(
+	afterStateBlockNID types.StateBlockNID, limit int,
+) ([]types.StateBlockNID, error) {
+	rows, err := s.selectUnusedStateBlockNIDsStmt.Query(int64(afterStateBlockNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.StateBlockNID
+	for rows.Next() {
+		var stateBlockNID int64
+		if err = rows.Scan(&stateBlockNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.StateBlockNID(stateBlockNID))
+	}
+	return results, nil
+}
+
+func (s *stateBlockStatements) selectStateMissingBlocks(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectStateMissingBlocksStmt, limit)
+}
+
+func (s *stateBlockStatements) selectStateBlocksMissingEvents(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectStateBlocksMissingEventsStmt, limit)
+}
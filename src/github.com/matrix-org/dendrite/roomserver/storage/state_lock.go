@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The state of a room is protected by a postgres advisory lock keyed on the numeric ID
+// of the room. The roomserver holds the lock shared while it works out and stores the
+// state for an event, and a purge holds it exclusively while it deletes the state of
+// the room, so that a purge never deletes state that an event is about to use.
+// The state of every room is protected in the same way by the lock keyed on 0, which
+// the StateCollector holds exclusively while it deletes unused state. Room NIDs start
+// at 1 so the keys don't clash.
+// The locks are transaction scoped so they are released if the connection is lost.
+
+// allRoomsStateLockKey is the key of the lock on the state of every room.
+const allRoomsStateLockKey = 0
+
+const lockStateSharedSQL = "" +
+	"SELECT pg_advisory_xact_lock_shared($1)"
+
+const lockStateSQL = "" +
+	"SELECT pg_advisory_xact_lock($1)"
+
+type stateLockStatements struct {
+	lockStateSharedStmt *sql.Stmt
+	lockStateStmt       *sql.Stmt
+}
+
+func (s *stateLockStatements) prepare(db *sql.DB) (err error) {
+	if s.lockStateSharedStmt, err = db.Prepare(lockStateSharedSQL); err != nil {
+		return
+	}
+	if s.lockStateStmt, err = db.Prepare(lockStateSQL); err != nil {
+		return
+	}
+	return
+}
+
+// lockRoomStateShared takes the locks on the state of every room and on the state of a room
+// shared until the transaction ends.
+func (s *stateLockStatements) lockRoomStateShared(txn *sql.Tx, roomNID types.RoomNID) error {
+	// Always take the lock on every room first so that the locks are taken in the same order.
+	if _, err := txn.Stmt(s.lockStateSharedStmt).Exec(int64(allRoomsStateLockKey)); err != nil {
+		return err
+	}
+	_, err := txn.Stmt(s.lockStateSharedStmt).Exec(int64(roomNID))
+	return err
+}
+
+// lockRoomState takes the lock on the state of a room exclusively until the transaction ends.
+func (s *stateLockStatements) lockRoomState(txn *sql.Tx, roomNID types.RoomNID) error {
+	_, err := txn.Stmt(s.lockStateStmt).Exec(int64(roomNID))
+	return err
+}
+
+// lockAllRoomsState takes the lock on the state of every room exclusively until the transaction ends.
+func (s *stateLockStatements) lockAllRoomsState(txn *sql.Tx) error {
+	_, err := txn.Stmt(s.lockStateStmt).Exec(int64(allRoomsStateLockKey))
+	return err
+}
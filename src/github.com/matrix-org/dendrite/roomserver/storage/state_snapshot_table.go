@@ -28,6 +28,8 @@ CREATE TABLE IF NOT EXISTS state_snapshots (
     -- List of state_block_nids, stored sorted by state_block_nid.
     state_block_nids bigint[] NOT NULL
 );
+-- Used to tell whether a state block is still in use before deleting it.
+CREATE INDEX IF NOT EXISTS state_snapshots_state_block_nids_idx ON state_snapshots USING GIN (state_block_nids);
 `
 
 const insertStateSQL = "" +
@@ -42,9 +44,54 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM state_snapshots" +
 	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
 
+// Delete the state snapshots that aren't the state before an event or the current state of a room.
+// Returns the state block NIDs and the size of each deleted snapshot so that the blocks can be
+// deleted if they are no longer used by another snapshot.
+const bulkDeleteUnusedStateSQL = "" +
+	"DELETE FROM state_snapshots WHERE state_snapshot_nid = ANY($1)" +
+	" AND NOT EXISTS (SELECT 1 FROM events" +
+	"  WHERE events.state_snapshot_nid = state_snapshots.state_snapshot_nid)" +
+	" AND NOT EXISTS (SELECT 1 FROM rooms" +
+	"  WHERE rooms.state_snapshot_nid = state_snapshots.state_snapshot_nid)" +
+	" RETURNING state_block_nids, pg_column_size(state_snapshots.*)"
+
+// Lookup the state snapshots after a numeric ID that aren't the state
+// before an event or the current state of a room.
+const selectUnusedStateNIDsSQL = "" +
+	"SELECT state_snapshot_nid FROM state_snapshots" +
+	" WHERE state_snapshot_nid > $1" +
+	" AND NOT EXISTS (SELECT 1 FROM events" +
+	"  WHERE events.state_snapshot_nid = state_snapshots.state_snapshot_nid)" +
+	" AND NOT EXISTS (SELECT 1 FROM rooms" +
+	"  WHERE rooms.state_snapshot_nid = state_snapshots.state_snapshot_nid)" +
+	" ORDER BY state_snapshot_nid ASC LIMIT $2"
+
+// Lookup events whose state_snapshot_nid refers to a state snapshot that doesn't exist.
+const selectEventsMissingStateSQL = "" +
+	"SELECT event_nid, state_snapshot_nid FROM events WHERE state_snapshot_nid != 0" +
+	" AND NOT EXISTS (SELECT 1 FROM state_snapshots" +
+	"  WHERE state_snapshots.state_snapshot_nid = events.state_snapshot_nid)" +
+	" ORDER BY event_nid ASC LIMIT $1"
+
+// Lookup rooms whose state_snapshot_nid refers to a state snapshot that doesn't exist.
+const selectRoomsMissingStateSQL = "" +
+	"SELECT room_nid, state_snapshot_nid FROM rooms WHERE state_snapshot_nid != 0" +
+	" AND NOT EXISTS (SELECT 1 FROM state_snapshots" +
+	"  WHERE state_snapshots.state_snapshot_nid = rooms.state_snapshot_nid)" +
+	" ORDER BY room_nid ASC LIMIT $1"
+
+const selectStateNIDsUsingBlocksSQL = "" +
+	"SELECT state_snapshot_nid FROM state_snapshots WHERE state_block_nids && $1" +
+	" ORDER BY state_snapshot_nid ASC"
+
 type stateSnapshotStatements struct {
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	insertStateStmt                *sql.Stmt
+	bulkSelectStateBlockNIDsStmt   *sql.Stmt
+	bulkDeleteUnusedStateStmt      *sql.Stmt
+	selectUnusedStateNIDsStmt      *sql.Stmt
+	selectEventsMissingStateStmt   *sql.Stmt
+	selectRoomsMissingStateStmt    *sql.Stmt
+	selectStateNIDsUsingBlocksStmt *sql.Stmt
 }
 
 func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
@@ -58,6 +105,21 @@ func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
 	if s.bulkSelectStateBlockNIDsStmt, err = db.Prepare(bulkSelectStateBlockNIDsSQL); err != nil {
 		return
 	}
+	if s.bulkDeleteUnusedStateStmt, err = db.Prepare(bulkDeleteUnusedStateSQL); err != nil {
+		return
+	}
+	if s.selectUnusedStateNIDsStmt, err = db.Prepare(selectUnusedStateNIDsSQL); err != nil {
+		return
+	}
+	if s.selectEventsMissingStateStmt, err = db.Prepare(selectEventsMissingStateSQL); err != nil {
+		return
+	}
+	if s.selectRoomsMissingStateStmt, err = db.Prepare(selectRoomsMissingStateSQL); err != nil {
+		return
+	}
+	if s.selectStateNIDsUsingBlocksStmt, err = db.Prepare(selectStateNIDsUsingBlocksSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -98,3 +160,80 @@ func (s *stateSnapshotStatements) bulkSelectStateBlockNIDs(stateNIDs []types.Sta
 	}
 	return results, nil
 }
+
+// bulkDeleteUnusedState deletes the state snapshots in the list that are no longer used.
+// Returns the number of snapshots deleted, their total size in bytes and the state block NIDs that they used.
+func (s *stateSnapshotStatements) bulkDeleteUnusedState(txn *sql.Tx, stateNIDs []types.StateSnapshotNID) (
+	count, size int64, stateBlockNIDs []types.StateBlockNID, err error,
+) {
+	nids := make([]int64, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	rows, err := txn.Stmt(s.bulkDeleteUnusedStateStmt).Query(pq.Int64Array(nids))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var blockNIDs pq.Int64Array
+		var rowSize int64
+		if err = rows.Scan(&blockNIDs, &rowSize); err != nil {
+			return
+		}
+		count++
+		size += rowSize
+		for _, blockNID := range blockNIDs {
+			stateBlockNIDs = append(stateBlockNIDs, types.StateBlockNID(blockNID))
+		}
+	}
+	return
+}
+
+func (s *stateSnapshotStatements) selectUnusedStateNIDs(
+	afterStateNID types.StateSnapshotNID, limit int,
+) ([]types.StateSnapshotNID, error) {
+	rows, err := s.selectUnusedStateNIDsStmt.Query(int64(afterStateNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.StateSnapshotNID
+	for rows.Next() {
+		var stateNID int64
+		if err = rows.Scan(&stateNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.StateSnapshotNID(stateNID))
+	}
+	return results, nil
+}
+
+func (s *stateSnapshotStatements) selectEventsMissingState(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectEventsMissingStateStmt, limit)
+}
+
+func (s *stateSnapshotStatements) selectRoomsMissingState(limit int) ([]types.BrokenReference, error) {
+	return selectBrokenReferences(s.selectRoomsMissingStateStmt, limit)
+}
+
+func (s *stateSnapshotStatements) selectStateNIDsUsingBlocks(stateBlockNIDs []types.StateBlockNID) ([]types.StateSnapshotNID, error) {
+	nids := make([]int64, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		nids[i] = int64(stateBlockNIDs[i])
+	}
+	rows, err := s.selectStateNIDsUsingBlocksStmt.Query(pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.StateSnapshotNID
+	for rows.Next() {
+		var stateNID int64
+		if err = rows.Scan(&stateNID); err != nil {
+			return nil, err
+		}
+		results = append(results, types.StateSnapshotNID(stateNID))
+	}
+	return results, nil
+}
@@ -27,6 +27,11 @@ func Open(dataSourceName string) (*Database, error) {
 	return &d, nil
 }
 
+// Close closes the database connections.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
 // PartitionOffsets implements input.ConsumerDatabase
 func (d *Database) PartitionOffsets(topic string) ([]types.PartitionOffset, error) {
 	return d.statements.selectPartitionOffsets(topic)
@@ -34,7 +39,17 @@ func (d *Database) PartitionOffsets(topic string) ([]types.PartitionOffset, erro
 
 // SetPartitionOffset implements input.ConsumerDatabase
 func (d *Database) SetPartitionOffset(topic string, partition int32, offset int64) error {
-	return d.statements.upsertPartitionOffset(topic, partition, offset)
+	return d.statements.upsertPartitionOffset(nil, topic, partition, offset)
+}
+
+// PendingOutput implements input.OutputPublisherDatabase
+func (d *Database) PendingOutput(limit int) ([]types.PendingOutput, error) {
+	return d.statements.selectPendingOutput(limit)
+}
+
+// DeletePendingOutput implements input.OutputPublisherDatabase
+func (d *Database) DeletePendingOutput(pendingOutputNID types.PendingOutputNID) error {
+	return d.statements.deletePendingOutput(pendingOutputNID)
 }
 
 // StoreEvent implements input.EventDatabase
@@ -72,6 +87,7 @@ func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []typ
 		event.EventID(),
 		event.EventReference().EventSHA256,
 		authEventNIDs,
+		event.Depth(),
 	); err != nil {
 		if err == sql.ErrNoRows {
 			// We've already inserted the event so select the numeric event ID
@@ -150,6 +166,11 @@ func (d *Database) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.
 	return d.statements.bulkSelectEventStateKeyNID(eventStateKeys)
 }
 
+// EventTypeNIDs implements state.RoomStateDatabase
+func (d *Database) EventTypeNIDs(eventTypes []string) (map[string]types.EventTypeNID, error) {
+	return d.statements.bulkSelectEventTypeNID(eventTypes)
+}
+
 // Events implements input.EventDatabase
 func (d *Database) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
 	eventJSONs, err := d.statements.bulkSelectEventJSON(eventNIDs)
@@ -160,8 +181,9 @@ func (d *Database) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
 	for i, eventJSON := range eventJSONs {
 		result := &results[i]
 		result.EventNID = eventJSON.EventNID
-		// TODO: Use NewEventFromTrustedJSON for efficiency
-		result.Event, err = gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON.EventJSON)
+		// The JSON was checked before it was stored so we can trust it.
+		// If the event has been redacted then the stored JSON is already redacted.
+		result.Event, err = gomatrixserverlib.NewEventFromTrustedJSON(eventJSON.EventJSON, eventJSON.Redacted)
 		if err != nil {
 			return nil, err
 		}
@@ -169,6 +191,108 @@ func (d *Database) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
 	return results, nil
 }
 
+// EventIDs implements input.EventDatabase
+func (d *Database) EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	return d.statements.bulkSelectEventID(eventNIDs)
+}
+
+// EventRoomNIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventRoomNIDs(eventNIDs []types.EventNID) (map[types.EventNID]types.RoomNID, error) {
+	return d.statements.bulkSelectEventRoomNID(eventNIDs)
+}
+
+// EventNIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventNIDs(eventIDs []string) (map[string]types.EventNID, error) {
+	return d.statements.bulkSelectEventNID(eventIDs)
+}
+
+// AuthChainEventNIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) AuthChainEventNIDs(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	return d.statements.selectAuthChainEventNID(eventNIDs)
+}
+
+// StoreRedaction implements input.EventDatabase
+func (d *Database) StoreRedaction(redactionEventID, redactsEventID string, roomNID types.RoomNID) error {
+	return d.statements.insertRedaction(redactionEventID, redactsEventID, roomNID)
+}
+
+// RedactionsForEvent implements input.EventDatabase
+func (d *Database) RedactionsForEvent(redactsEventID string) ([]types.Redaction, error) {
+	return d.statements.selectRedactionsForEvent(redactsEventID)
+}
+
+// RedactEvent implements input.EventDatabase
+func (d *Database) RedactEvent(redactionEventID string, eventNID types.EventNID, redactedJSON []byte) error {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = d.statements.updateEventJSON(txn, eventNID, redactedJSON); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if err = d.statements.updateRedactionApplied(txn, redactionEventID, eventNID); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// MarkEventRejected implements input.EventDatabase
+func (d *Database) MarkEventRejected(eventNID types.EventNID, rejectionReason string) error {
+	return d.statements.insertRejectedEvent(eventNID, rejectionReason)
+}
+
+// RejectionReasons implements query.RoomserverQueryAPIDatabase
+func (d *Database) RejectionReasons(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	return d.statements.bulkSelectRejectionReason(eventNIDs)
+}
+
+// MissingEventIDs implements input.EventDatabase
+func (d *Database) MissingEventIDs(eventIDs []string) ([]string, error) {
+	withState, err := d.statements.bulkSelectEventIDWithState(eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, eventID := range eventIDs {
+		if !withState[eventID] {
+			missing = append(missing, eventID)
+		}
+	}
+	return missing, nil
+}
+
+// StorePendingEvent implements input.EventDatabase
+func (d *Database) StorePendingEvent(eventID, roomID string, missingEventIDs []string, inputJSON []byte) error {
+	return d.statements.insertPendingEvent(eventID, roomID, missingEventIDs, inputJSON)
+}
+
+// ReadyPendingEvents implements input.EventDatabase
+func (d *Database) ReadyPendingEvents(roomID string) ([]types.PendingEvent, error) {
+	return d.statements.selectReadyPendingEvents(roomID)
+}
+
+// DeletePendingEvent implements input.EventDatabase
+func (d *Database) DeletePendingEvent(eventID string) error {
+	return d.statements.deletePendingEvent(eventID)
+}
+
+// ServerKeys implements input.KeyDatabase
+func (d *Database) ServerKeys(serverName string) ([]types.ServerKey, error) {
+	return d.statements.selectServerKeys(serverName)
+}
+
+// StoreServerKeys implements input.KeyDatabase
+func (d *Database) StoreServerKeys(keys []types.ServerKey) error {
+	for _, key := range keys {
+		if err := d.statements.upsertServerKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AddState implements input.EventDatabase
 func (d *Database) AddState(roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error) {
 	if len(state) > 0 {
@@ -205,13 +329,85 @@ func (d *Database) StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.S
 	return d.statements.bulkSelectStateDataEntries(stateBlockNIDs)
 }
 
+// RoomNID implements query.RoomserverQueryAPIDatabase
+func (d *Database) RoomNID(roomID string) (types.RoomNID, error) {
+	roomNID, err := d.statements.selectRoomNID(roomID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return roomNID, err
+}
+
+// RoomNIDs implements input.RegenerateOutputDatabase
+func (d *Database) RoomNIDs() ([]types.RoomNID, error) {
+	return d.statements.selectRoomNIDs()
+}
+
+// SentEventNIDs implements input.RegenerateOutputDatabase
+func (d *Database) SentEventNIDs(roomNID types.RoomNID) ([]types.EventNID, error) {
+	return d.statements.selectSentEventNIDs(roomNID)
+}
+
+// LatestEventIDs implements query.RoomserverQueryAPIDatabase
+func (d *Database) LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, error) {
+	eventNIDs, currentStateSnapshotNID, err := d.statements.selectLatestEventNIDs(roomNID)
+	if err != nil {
+		return nil, 0, err
+	}
+	references, err := d.statements.bulkSelectEventReference(eventNIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return references, currentStateSnapshotNID, nil
+}
+
+// EventHistoryPosition implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventHistoryPosition(eventID string) (types.RoomNID, types.HistoryPosition, error) {
+	roomNID, position, err := d.statements.selectEventHistoryPosition(eventID)
+	if err == sql.ErrNoRows {
+		return 0, types.HistoryPosition{}, nil
+	}
+	return roomNID, position, err
+}
+
+// RoomHistory implements query.RoomserverQueryAPIDatabase
+func (d *Database) RoomHistory(
+	roomNID types.RoomNID, from types.HistoryPosition, backwards bool, limit int,
+) ([]types.HistoryEvent, error) {
+	return d.statements.selectHistory(roomNID, from, backwards, limit)
+}
+
+// LockRoomState implements input.EventDatabase
+func (d *Database) LockRoomState(roomNID types.RoomNID) (types.RoomStateLock, error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.statements.lockRoomStateShared(txn, roomNID); err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	return &roomStateLock{txn}, nil
+}
+
+// roomStateLock holds the lock on the state of a room shared for as long as its transaction is open.
+type roomStateLock struct {
+	txn *sql.Tx
+}
+
+// Unlock implements types.RoomStateLock
+func (l *roomStateLock) Unlock() error {
+	// Nothing is written in the transaction so ending it only releases the lock.
+	return l.txn.Rollback()
+}
+
 // GetLatestEventsForUpdate implements input.EventDatabase
 func (d *Database) GetLatestEventsForUpdate(roomNID types.RoomNID) ([]types.StateAtEventAndReference, string, types.RoomRecentEventsUpdater, error) {
 	txn, err := d.db.Begin()
 	if err != nil {
 		return nil, "", nil, err
 	}
-	eventNIDs, lastEventNIDSent, err := d.statements.selectLatestEventsNIDsForUpdate(txn, roomNID)
+	eventNIDs, lastEventNIDSent, currentStateSnapshotNID, err := d.statements.selectLatestEventsNIDsForUpdate(txn, roomNID)
 	if err != nil {
 		txn.Rollback()
 		return nil, "", nil, err
@@ -229,12 +425,17 @@ func (d *Database) GetLatestEventsForUpdate(roomNID types.RoomNID) ([]types.Stat
 			return nil, "", nil, err
 		}
 	}
-	return stateAndRefs, lastEventIDSent, &roomRecentEventsUpdater{txn, d}, nil
+	return stateAndRefs, lastEventIDSent, &roomRecentEventsUpdater{txn, d, currentStateSnapshotNID}, nil
 }
 
 type roomRecentEventsUpdater struct {
-	txn *sql.Tx
-	d   *Database
+	txn                     *sql.Tx
+	d                       *Database
+	currentStateSnapshotNID types.StateSnapshotNID
+}
+
+func (u *roomRecentEventsUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID {
+	return u.currentStateSnapshotNID
 }
 
 func (u *roomRecentEventsUpdater) StorePreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
@@ -257,12 +458,15 @@ func (u *roomRecentEventsUpdater) IsReferenced(eventReference gomatrixserverlib.
 	return false, err
 }
 
-func (u *roomRecentEventsUpdater) SetLatestEvents(roomNID types.RoomNID, latest []types.StateAtEventAndReference, lastEventNIDSent types.EventNID) error {
+func (u *roomRecentEventsUpdater) SetLatestEvents(
+	roomNID types.RoomNID, latest []types.StateAtEventAndReference, lastEventNIDSent types.EventNID,
+	currentStateSnapshotNID types.StateSnapshotNID,
+) error {
 	eventNIDs := make([]types.EventNID, len(latest))
 	for i := range latest {
 		eventNIDs[i] = latest[i].EventNID
 	}
-	return u.d.statements.updateLatestEventNIDs(u.txn, roomNID, eventNIDs, lastEventNIDSent)
+	return u.d.statements.updateLatestEventNIDs(u.txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID)
 }
 
 func (u *roomRecentEventsUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
@@ -273,6 +477,18 @@ func (u *roomRecentEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error
 	return u.d.statements.updateEventSentToOutput(u.txn, eventNID)
 }
 
+func (u *roomRecentEventsUpdater) SetStreamPosition(eventNID types.EventNID, backfilled bool) error {
+	return u.d.statements.updateEventStreamPosition(u.txn, eventNID, backfilled)
+}
+
+func (u *roomRecentEventsUpdater) StorePendingOutput(value []byte) error {
+	return u.d.statements.insertPendingOutput(u.txn, value)
+}
+
+func (u *roomRecentEventsUpdater) SetPartitionOffset(topic string, partition int32, offset int64) error {
+	return u.d.statements.upsertPartitionOffset(u.txn, topic, partition, offset)
+}
+
 func (u *roomRecentEventsUpdater) Commit() error {
 	return u.txn.Commit()
 }
@@ -280,3 +496,272 @@ func (u *roomRecentEventsUpdater) Commit() error {
 func (u *roomRecentEventsUpdater) Rollback() error {
 	return u.txn.Rollback()
 }
+
+// RoomEventsForPurge implements purge.Database
+func (d *Database) RoomEventsForPurge(
+	roomNID types.RoomNID, cutoff types.PurgeCutoff, afterEventNID types.EventNID, limit int,
+) ([]types.PurgeEvent, error) {
+	return d.statements.selectEventsForPurge(roomNID, cutoff, afterEventNID, limit)
+}
+
+// StateSnapshotEventNIDs implements purge.Database
+func (d *Database) StateSnapshotEventNIDs(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	return d.statements.bulkSelectStateSnapshotEventNIDs(stateNIDs)
+}
+
+// GetRoomForPurge implements purge.Database
+func (d *Database) GetRoomForPurge(roomNID types.RoomNID) (types.RoomPurgeUpdater, error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Wait for the events that are storing state for the room to finish before locking
+	// the room. They lock the room after the state, so taking the locks in the other
+	// order could deadlock.
+	if err = d.statements.lockRoomState(txn, roomNID); err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	eventNIDs, lastEventNIDSent, currentStateSnapshotNID, err := d.statements.selectLatestEventsNIDsForUpdate(txn, roomNID)
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	return &roomPurgeUpdater{txn, d, eventNIDs, lastEventNIDSent, currentStateSnapshotNID}, nil
+}
+
+type roomPurgeUpdater struct {
+	txn                     *sql.Tx
+	d                       *Database
+	latestEventNIDs         []types.EventNID
+	lastEventNIDSent        types.EventNID
+	currentStateSnapshotNID types.StateSnapshotNID
+}
+
+func (u *roomPurgeUpdater) LatestEventNIDs() []types.EventNID {
+	return u.latestEventNIDs
+}
+
+func (u *roomPurgeUpdater) LastEventNIDSent() types.EventNID {
+	return u.lastEventNIDSent
+}
+
+func (u *roomPurgeUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID {
+	return u.currentStateSnapshotNID
+}
+
+func (u *roomPurgeUpdater) DeleteEvents(eventNIDs []types.EventNID) error {
+	if err := u.d.statements.bulkRemovePreviousEventReferences(u.txn, eventNIDs); err != nil {
+		return err
+	}
+	if err := u.d.statements.bulkDeleteRedactionsForEvent(u.txn, eventNIDs); err != nil {
+		return err
+	}
+	if err := u.d.statements.bulkDeleteRejectedEvent(u.txn, eventNIDs); err != nil {
+		return err
+	}
+	if err := u.d.statements.bulkDeleteEventJSON(u.txn, eventNIDs); err != nil {
+		return err
+	}
+	return u.d.statements.bulkDeleteEvent(u.txn, eventNIDs)
+}
+
+func (u *roomPurgeUpdater) MarkEventsAsOutliers(eventNIDs []types.EventNID) error {
+	return u.d.statements.bulkUpdateEventOutlier(u.txn, eventNIDs)
+}
+
+func (u *roomPurgeUpdater) DeleteUnusedStateSnapshots(stateNIDs []types.StateSnapshotNID) (types.DeletedState, error) {
+	return u.d.deleteUnusedState(u.txn, stateNIDs, nil)
+}
+
+func (u *roomPurgeUpdater) Commit() error {
+	return u.txn.Commit()
+}
+
+func (u *roomPurgeUpdater) Rollback() error {
+	return u.txn.Rollback()
+}
+
+// UnusedStateSnapshotNIDs implements purge.StateCollectorDatabase
+func (d *Database) UnusedStateSnapshotNIDs(
+	afterStateNID types.StateSnapshotNID, limit int,
+) ([]types.StateSnapshotNID, error) {
+	return d.statements.selectUnusedStateNIDs(afterStateNID, limit)
+}
+
+// UnusedStateBlockNIDs implements purge.StateCollectorDatabase
+func (d *Database) UnusedStateBlockNIDs(
+	afterStateBlockNID types.StateBlockNID, limit int,
+) ([]types.StateBlockNID, error) {
+	return d.statements.selectUnusedStateBlockNIDs(afterStateBlockNID, limit)
+}
+
+// DeleteUnusedState implements purge.StateCollectorDatabase
+func (d *Database) DeleteUnusedState(
+	stateNIDs []types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID,
+) (types.DeletedState, error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return types.DeletedState{}, err
+	}
+	// Wait for the events that are storing state to finish so that the state
+	// they stored is used by the time we check whether it is unused.
+	if err = d.statements.lockAllRoomsState(txn); err != nil {
+		txn.Rollback()
+		return types.DeletedState{}, err
+	}
+	deleted, err := d.deleteUnusedState(txn, stateNIDs, stateBlockNIDs)
+	if err != nil {
+		txn.Rollback()
+		return types.DeletedState{}, err
+	}
+	return deleted, txn.Commit()
+}
+
+// deleteUnusedState deletes the state snapshots in the list that are no longer used, then
+// deletes the state blocks in the list and the state blocks of the deleted snapshots that
+// are no longer used.
+func (d *Database) deleteUnusedState(
+	txn *sql.Tx, stateNIDs []types.StateSnapshotNID, stateBlockNIDs []types.StateBlockNID,
+) (deleted types.DeletedState, err error) {
+	if len(stateNIDs) > 0 {
+		var snapshotBlockNIDs []types.StateBlockNID
+		deleted.StateSnapshots, deleted.Bytes, snapshotBlockNIDs, err = d.statements.bulkDeleteUnusedState(txn, stateNIDs)
+		if err != nil {
+			return
+		}
+		stateBlockNIDs = append(stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)], snapshotBlockNIDs...)
+	}
+	if len(stateBlockNIDs) > 0 {
+		var size int64
+		if deleted.StateBlocks, size, err = d.statements.bulkDeleteUnusedStateData(txn, stateBlockNIDs); err != nil {
+			return
+		}
+		deleted.Bytes += size
+	}
+	return
+}
+
+// EventsMissingJSON implements fsck.Database
+func (d *Database) EventsMissingJSON(limit int) ([]types.EventNID, error) {
+	return d.statements.selectEventsMissingJSON(limit)
+}
+
+// OrphanedEventJSON implements fsck.Database
+func (d *Database) OrphanedEventJSON(limit int) ([]types.EventNID, error) {
+	return d.statements.selectOrphanedEventJSON(limit)
+}
+
+// EventsMissingState implements fsck.Database
+func (d *Database) EventsMissingState(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectEventsMissingState(limit)
+}
+
+// EventsMissingAuthEvents implements fsck.Database
+func (d *Database) EventsMissingAuthEvents(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectEventsMissingAuthEvents(limit)
+}
+
+// StateMissingBlocks implements fsck.Database
+func (d *Database) StateMissingBlocks(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectStateMissingBlocks(limit)
+}
+
+// StateBlocksMissingEvents implements fsck.Database
+func (d *Database) StateBlocksMissingEvents(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectStateBlocksMissingEvents(limit)
+}
+
+// PreviousEventsMissingEvents implements fsck.Database
+func (d *Database) PreviousEventsMissingEvents(limit int) ([]types.EventNID, error) {
+	return d.statements.selectPreviousEventsMissingEvents(limit)
+}
+
+// RoomsMissingLatestEvents implements fsck.Database
+func (d *Database) RoomsMissingLatestEvents(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectRoomsMissingLatestEvents(limit)
+}
+
+// RoomsMissingLastEventSent implements fsck.Database
+func (d *Database) RoomsMissingLastEventSent(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectRoomsMissingLastEventSent(limit)
+}
+
+// RoomsMissingState implements fsck.Database
+func (d *Database) RoomsMissingState(limit int) ([]types.BrokenReference, error) {
+	return d.statements.selectRoomsMissingState(limit)
+}
+
+// StateNIDsUsingBlocks implements fsck.Database
+func (d *Database) StateNIDsUsingBlocks(stateBlockNIDs []types.StateBlockNID) ([]types.StateSnapshotNID, error) {
+	return d.statements.selectStateNIDsUsingBlocks(stateBlockNIDs)
+}
+
+// EventNIDsWithState implements fsck.Database
+func (d *Database) EventNIDsWithState(stateNIDs []types.StateSnapshotNID) ([]types.EventNID, error) {
+	return d.statements.selectEventNIDsWithState(stateNIDs)
+}
+
+// LatestEventNIDsIn implements fsck.Database
+func (d *Database) LatestEventNIDsIn(eventNIDs []types.EventNID) ([]types.EventNID, error) {
+	return d.statements.selectLatestEventNIDsIn(eventNIDs)
+}
+
+// RemoveLatestEvents implements fsck.Database
+func (d *Database) RemoveLatestEvents(roomNID types.RoomNID, eventNIDs []types.EventNID) error {
+	return d.statements.removeLatestEventNIDs(roomNID, eventNIDs)
+}
+
+// ResetLastEventSent implements fsck.Database
+func (d *Database) ResetLastEventSent(roomNIDs []types.RoomNID) error {
+	return d.statements.resetLastEventSentNIDs(roomNIDs)
+}
+
+// ResetRoomState implements fsck.Database
+func (d *Database) ResetRoomState(roomNIDs []types.RoomNID) error {
+	return d.statements.resetStateSnapshotNIDs(roomNIDs)
+}
+
+// RandomEventNIDs implements fsck.Database
+func (d *Database) RandomEventNIDs(limit int) ([]types.EventNID, error) {
+	return d.statements.selectRandomEventNIDs(limit)
+}
+
+// DeleteEventJSON implements fsck.Database
+func (d *Database) DeleteEventJSON(eventNIDs []types.EventNID) error {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = d.statements.bulkDeleteEventJSON(txn, eventNIDs); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// MarkEventsAsOutliers implements fsck.Database
+func (d *Database) MarkEventsAsOutliers(eventNIDs []types.EventNID) error {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = d.statements.bulkUpdateEventOutlier(txn, eventNIDs); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// RemovePreviousEventReferences implements fsck.Database
+func (d *Database) RemovePreviousEventReferences(eventNIDs []types.EventNID) error {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = d.statements.bulkRemovePreviousEventReferences(txn, eventNIDs); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
@@ -129,6 +129,17 @@ type StateEntryList struct {
 	StateEntries  []StateEntry
 }
 
+// PendingOutputNID is a numeric ID for a message waiting to be written to the output log.
+type PendingOutputNID int64
+
+// A PendingOutput is a message waiting to be written to the output log.
+type PendingOutput struct {
+	// The numeric ID of the message. Messages must be written in order of this ID.
+	PendingOutputNID PendingOutputNID
+	// The serialised message.
+	Value []byte
+}
+
 // A RoomRecentEventsUpdater is used to update the recent events in a room.
 // (On postgresql this wraps a database transaction that holds a "FOR UPDATE"
 //  lock on the row holding the latest events for the room.)
@@ -141,15 +152,167 @@ type RoomRecentEventsUpdater interface {
 	StorePreviousEvents(eventNID EventNID, previousEventReferences []gomatrixserverlib.EventReference) error
 	// Check whether the eventReference is already referenced by another matrix event.
 	IsReferenced(eventReference gomatrixserverlib.EventReference) (bool, error)
+	// The state of the room after the latest events when the updater was created.
+	// This is 0 if the room doesn't have any latest events yet.
+	CurrentStateSnapshotNID() StateSnapshotNID
 	// Set the list of latest events for the room.
 	// This replaces the current list stored in the database with the given list
-	SetLatestEvents(roomNID RoomNID, latest []StateAtEventAndReference, lastEventNIDSent EventNID) error
+	// Also sets the state of the room after those latest events.
+	SetLatestEvents(
+		roomNID RoomNID, latest []StateAtEventAndReference, lastEventNIDSent EventNID,
+		currentStateSnapshotNID StateSnapshotNID,
+	) error
 	// Check if the event has already be written to the output logs.
 	HasEventBeenSent(eventNID EventNID) (bool, error)
 	// Mark the event as having been sent to the output logs.
 	MarkEventAsSent(eventNID EventNID) error
+	// Add the event to the history of the room by giving it a stream position.
+	// New events are added to the end of the history and backfilled events to the start.
+	// This is a no-op if the event already has a stream position.
+	SetStreamPosition(eventNID EventNID, backfilled bool) error
+	// Store a message to write to the output log once the transaction has been committed.
+	// Messages are written to the output log in the order they are stored.
+	StorePendingOutput(value []byte) error
+	// Record where the consumer has reached in a partition of the input log.
+	// The offset is committed along with the rest of the transaction so that
+	// the changes made by an input event and the offset are never out of step.
+	SetPartitionOffset(topic string, partition int32, offset int64) error
+	// Commit the transaction
+	Commit() error
+	// Rollback the transaction.
+	Rollback() error
+}
+
+// A MissingEventError is an error that happened because the roomserver was
+// missing requested events from its database.
+type MissingEventError string
+
+func (e MissingEventError) Error() string { return string(e) }
+
+// A RejectedEventError is an error that happened because an event the roomserver
+// rejected was used as an auth event or as part of the state of another event.
+type RejectedEventError string
+
+func (e RejectedEventError) Error() string { return string(e) }
+
+// A Redaction is an m.room.redaction event and the event it redacts.
+type Redaction struct {
+	// The string ID of the m.room.redaction event.
+	RedactionEventID string
+	// The string ID of the event being redacted.
+	RedactsEventID string
+	// The numeric ID of the room the m.room.redaction event is in.
+	RoomNID RoomNID
+	// The numeric ID of the redacted event, or 0 if the redaction hasn't been applied yet.
+	RedactsEventNID EventNID
+}
+
+// A PendingEvent is an input room event that is waiting for its prev_events to arrive.
+type PendingEvent struct {
+	// The string ID of the event.
+	EventID string
+	// The input room event serialised as JSON.
+	InputJSON []byte
+}
+
+// A ServerKey is an ed25519 key that a matrix server signs its events with.
+type ServerKey struct {
+	// The name of the matrix server.
+	ServerName string
+	// The ID of the key, e.g. "ed25519:auto".
+	KeyID string
+	// The ed25519 public key.
+	PublicKey []byte
+	// When the key should be fetched again, in milliseconds since the epoch.
+	ValidUntilTS int64
+}
+
+// A HistoryPosition is the position of an event in the history of a room.
+// Events are ordered by their depth in the event graph and then by the order
+// they were added to the history of the room.
+type HistoryPosition struct {
+	// The depth of the event.
+	Depth int64
+	// The stream position of the event.
+	// This is 0 if the event isn't part of the history of the room.
+	StreamPosition int64
+}
+
+// A HistoryEvent is the numeric ID of an event in the history of a room along with its position.
+type HistoryEvent struct {
+	EventNID EventNID
+	HistoryPosition
+}
+
+// A PurgeCutoff says which events are old enough to be purged from the history of a room.
+// An event is old enough if its depth is less than Depth or if its origin_server_ts is
+// less than TimestampMS. A limit is ignored if it is 0.
+type PurgeCutoff struct {
+	// The depth that the events must be before.
+	Depth int64
+	// The origin_server_ts that the events must be before, in milliseconds since the epoch.
+	TimestampMS int64
+}
+
+// A PurgeEvent is an event in a room that is being purged.
+type PurgeEvent struct {
+	EventNID EventNID
+	// The numeric ID of the state before the event, or 0 if the event is an outlier.
+	BeforeStateSnapshotNID StateSnapshotNID
+	// Whether the event is older than the PurgeCutoff.
+	BeforeCutoff bool
+}
+
+// A RoomPurgeUpdater is used to delete the history of a room.
+// On postgresql this wraps a database transaction that holds the lock on the
+// state of the room exclusively, so that no state is stored for the room while
+// it is deleted, and a "FOR UPDATE" lock on the row holding the latest events
+// for the room so that the room doesn't change while the events are deleted.
+type RoomPurgeUpdater interface {
+	// The latest events in the room.
+	LatestEventNIDs() []EventNID
+	// The last event in the room written to the output log.
+	LastEventNIDSent() EventNID
+	// The current state of the room.
+	CurrentStateSnapshotNID() StateSnapshotNID
+	// Delete the events and everything stored about them.
+	DeleteEvents(eventNIDs []EventNID) error
+	// Forget the state at the events and remove them from the history of the room.
+	// The events are kept as outliers.
+	MarkEventsAsOutliers(eventNIDs []EventNID) error
+	// Delete the state snapshots in the list that aren't used by an event or as the
+	// current state of the room, along with the state blocks that only they used.
+	DeleteUnusedStateSnapshots(stateNIDs []StateSnapshotNID) (DeletedState, error)
 	// Commit the transaction
 	Commit() error
 	// Rollback the transaction.
 	Rollback() error
 }
+
+// A RoomStateLock is held while the state for an event in a room is worked out and stored,
+// so that the state it uses isn't deleted before the event refers to it.
+// Many events in a room can hold the lock at once, but it can't be held while the room is
+// being purged or while unused state is being deleted.
+// (On postgresql this wraps a database transaction that holds shared advisory locks.)
+type RoomStateLock interface {
+	// Release the lock.
+	Unlock() error
+}
+
+// DeletedState says how much unused state was deleted.
+type DeletedState struct {
+	// The number of state snapshots deleted.
+	StateSnapshots int64
+	// The number of state blocks deleted.
+	StateBlocks int64
+	// The total size of the deleted state snapshot and state block rows in bytes.
+	Bytes int64
+}
+
+// A BrokenReference is a reference from a row in the database to a row that doesn't exist.
+type BrokenReference struct {
+	// The numeric ID of the row with the reference, e.g. an event NID.
+	FromNID int64
+	// The numeric ID that the row refers to but that doesn't exist.
+	MissingNID int64
+}